@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/validate"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+func setupCreateUser(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+	role := fs.String("role", model.RoleUser, "the user's role, user or admin")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return &usageError{msg: "expected the user's name"}
+		}
+
+		err := validate.Struct(&model.UpdateUserRequest{Role: role})
+		if err != nil {
+			return &usageError{msg: "-role must be user or admin"}
+		}
+
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		err = validate.Struct(&model.CreateUserRequest{User: args[0], Password: password})
+		if err != nil {
+			return describe(err)
+		}
+
+		userID, err := lib.InsertUserDB(ctx, args[0], password)
+		if err != nil {
+			return describe(err)
+		}
+
+		if *role != model.RoleUser {
+			_, err = lib.UpdateUserDB(ctx, userID, model.UpdateUserRequest{Role: role})
+			if err != nil {
+				return describe(err)
+			}
+		}
+
+		fmt.Printf("Created %s %s with ID %d\n", *role, args[0], userID)
+		return nil
+	}
+}
+
+func setupResetPassword(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return &usageError{msg: "expected the user's name"}
+		}
+
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		err = validate.Struct(&model.ResetPasswordRequest{Password: password})
+		if err != nil {
+			return describe(err)
+		}
+
+		_, err = lib.SetUserPasswordDB(ctx, args[0], password)
+		if err != nil {
+			return describe(err)
+		}
+
+		fmt.Printf("Reset the password of %s\n", args[0])
+		return nil
+	}
+}
+
+func setupResetTwoFactor(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return &usageError{msg: "expected the user's name"}
+		}
+
+		_, err := lib.ResetTwoFactorDB(ctx, args[0])
+		if err != nil {
+			return describe(err)
+		}
+
+		fmt.Printf("Turned off two-factor authentication for %s\n", args[0])
+		return nil
+	}
+}
+
+func setupExport(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+	output := fs.String("o", "", "file to write the snapshot to instead of stdout")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return &usageError{msg: fmt.Sprintf("unexpected argument %q", args[0])}
+		}
+
+		b, err := app.Context.DB.Export()
+		if err != nil {
+			return err
+		}
+
+		if *output == "" {
+			_, err = os.Stdout.Write(b)
+			return err
+		}
+
+		// The snapshot holds password hashes and signing keys
+		return os.WriteFile(*output, b, 0600)
+	}
+}
+
+func setupImport(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+	replace := fs.Bool("replace", false, "replace everything in the data store instead of requiring it to be empty")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return &usageError{msg: "expected the snapshot file, or - for stdin"}
+		}
+
+		var b []byte
+		var err error
+		if args[0] == "-" {
+			b, err = io.ReadAll(os.Stdin)
+		} else {
+			b, err = os.ReadFile(args[0])
+		}
+		if err != nil {
+			return err
+		}
+
+		err = app.Context.DB.Import(b, *replace)
+		if err != nil {
+			return fmt.Errorf("cannot import %s: %v", args[0], err)
+		}
+
+		// Check the snapshot is consistent, but keep it, since it's what the operator asked for
+		problems, err := lib.VerifyDB(ctx)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", problem)
+		}
+
+		counts, err := app.Context.DB.RowCounts()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %s\n", describeCounts(counts))
+		return nil
+	}
+}
+
+func setupCompact(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return &usageError{msg: fmt.Sprintf("unexpected argument %q", args[0])}
+		}
+
+		removed, err := lib.CompactDB(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed %s\n", describeCounts(removed))
+		return nil
+	}
+}
+
+func setupVerify(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return &usageError{msg: fmt.Sprintf("unexpected argument %q", args[0])}
+		}
+
+		problems, err := lib.VerifyDB(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("found %d problems", len(problems))
+		}
+
+		fmt.Println("No problems found")
+		return nil
+	}
+}
+
+func setupRotateKeys(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+	revoke := fs.Bool("revoke", false, "reject tokens signed with the old keys straight away, logging everyone out")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return &usageError{msg: fmt.Sprintf("unexpected argument %q", args[0])}
+		}
+
+		key, err := lib.RotateSigningKeyDB(ctx, *revoke)
+		if err != nil {
+			return err
+		}
+
+		if *revoke {
+			fmt.Printf("Signing tokens with key %s, tokens signed with older keys are rejected\n", key.KeyID)
+		} else {
+			fmt.Printf("Signing tokens with key %s, tokens signed with older keys remain valid until they expire\n", key.KeyID)
+		}
+		return nil
+	}
+}
+
+// readPassword prompts for a password twice when stdin is a terminal, and otherwise reads it from the first line of stdin
+func readPassword(stdin *os.File) (string, error) {
+	fd := int(stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", fmt.Errorf("cannot read password from stdin: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	var passwords [2]string
+	for i, prompt := range []string{"Password: ", "Repeat password: "} {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		passwords[i] = string(b)
+	}
+
+	if passwords[0] != passwords[1] {
+		return "", errors.New("passwords do not match")
+	}
+	return passwords[0], nil
+}
+
+// describe replaces the error codes used by the API with messages meant for the operator
+func describe(err error) error {
+	if fields := apperr.Fields(err); len(fields) > 0 {
+		messages := make([]string, len(fields))
+		for i, field := range fields {
+			messages[i] = field.Message
+		}
+		return errors.New(strings.Join(messages, ", "))
+	}
+
+	if !apperr.IsClientError(err) {
+		return err
+	}
+	if detail := apperr.Detail(err); detail != "" {
+		return errors.New(detail)
+	}
+	return errors.New(apperr.Lookup(err).Title)
+}
+
+// describeCounts lists the number of rows in each table
+func describeCounts(counts map[string]int) string {
+	tables := make([]string, 0, len(counts))
+	for table := range counts {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	parts := make([]string, len(tables))
+	for i, table := range tables {
+		parts[i] = fmt.Sprintf("%d %s", counts[table], table)
+	}
+	return strings.Join(parts, ", ")
+}
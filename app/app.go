@@ -1,21 +1,141 @@
 package app
 
 import (
+	"context"
+	"github.com/kylegk/notes/config"
 	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/oidc"
+	"github.com/kylegk/notes/ratelimit"
+	"github.com/kylegk/notes/tracing"
+	"log/slog"
+	"os"
+	"sync"
 )
 
 type Configuration struct {
-	DB   db.DB
+	DB     db.DB
+	Config *config.Config
+
+	// Limiter enforces the configured rate limits. It's held in memory by default, and can be replaced by one backed by a
+	// shared store before serving, so several instances enforce the limits together
+	Limiter ratelimit.Limiter
+
+	// OIDC logs users in with the configured identity provider, and is nil unless it's enabled
+	OIDC *oidc.Provider
+
+	hooksMu       sync.Mutex
+	shutdownHooks []func(ctx context.Context) error
 }
 
 var Context *Configuration
 
+// Init initializes the application with the default configuration
 func Init() {
-	c := &Configuration{}
-	dbConn, err := db.InitDB(db.Schema)
+	err := Setup(config.Default())
 	if err != nil {
 		panic(err)
 	}
+}
+
+// Setup initializes the application with the given configuration
+func Setup(cfg *config.Config) error {
+	c := &Configuration{Config: cfg}
+
+	logger, err := NewLogger(os.Stderr, cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	if cfg.Auth.TokenSecret == config.DefaultTokenSecret {
+		slog.Warn("using the default token secret, set NOTES_TOKEN_SECRET before exposing the server")
+	}
+
+	// Tracing shuts down last, so spans recorded while other jobs stop are still exported
+	stopTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		return err
+	}
+	c.OnShutdown(stopTracing)
+
+	var dbConn db.DB
+	switch cfg.Storage.Backend {
+	case config.FileBackend:
+		// The server and the admin commands hold the lock for as long as they run, so only one of them changes the file.
+		// It's released once the last flush is done
+		var unlock func() error
+		unlock, err = db.LockFile(cfg.Storage.Path)
+		if err != nil {
+			return err
+		}
+		c.OnShutdown(func(ctx context.Context) error {
+			return unlock()
+		})
+
+		dbConn, err = db.InitFileDB(db.Schema, cfg.Storage.Path)
+		if err != nil {
+			unlock()
+			return err
+		}
+
+		// Flush whatever the flusher hasn't written yet once everything else has stopped
+		stopFlusher := dbConn.StartFlusher(cfg.Storage.FlushInterval)
+		c.OnShutdown(func(ctx context.Context) error {
+			stopFlusher()
+			return c.DB.Flush()
+		})
+	default:
+		dbConn, err = db.InitDB(db.Schema)
+		if err != nil {
+			return err
+		}
+	}
+
 	c.DB = dbConn
+	if cfg.RateLimit.Enabled {
+		c.Limiter = ratelimit.NewMemory()
+	}
+	if cfg.Auth.OIDC.Enabled {
+		c.OIDC = oidc.New(oidc.Config{
+			Issuer:       cfg.Auth.OIDC.Issuer,
+			ClientID:     cfg.Auth.OIDC.ClientID,
+			ClientSecret: cfg.Auth.OIDC.ClientSecret,
+			RedirectURL:  cfg.Auth.OIDC.RedirectURL,
+			Scopes:       cfg.Auth.OIDC.Scopes,
+		}, nil)
+	}
+	metrics.SetTableRowCounter(c.DB.RowCounts)
 	Context = c
-}
\ No newline at end of file
+
+	return nil
+}
+
+// OnShutdown registers a function to stop a background job when the application shuts down. Hooks run in the reverse
+// order they were registered, so a job can rely on anything registered before it still running
+func (c *Configuration) OnShutdown(fn func(ctx context.Context) error) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.shutdownHooks = append(c.shutdownHooks, fn)
+}
+
+// Shutdown runs every shutdown hook, returning the first error encountered. Hooks should give up when ctx is done
+func (c *Configuration) Shutdown(ctx context.Context) error {
+	c.hooksMu.Lock()
+	hooks := c.shutdownHooks
+	c.shutdownHooks = nil
+	c.hooksMu.Unlock()
+
+	var firstErr error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		err := hooks[i](ctx)
+		if err != nil {
+			slog.Error("shutdown hook failed", "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"github.com/kylegk/notes/config"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShutdownHooks(t *testing.T) {
+	Init()
+
+	// Hooks run in reverse order and every hook runs even if one fails
+	var order []int
+	Context.OnShutdown(func(ctx context.Context) error {
+		order = append(order, 1)
+		return nil
+	})
+	Context.OnShutdown(func(ctx context.Context) error {
+		order = append(order, 2)
+		return errors.New("failed")
+	})
+
+	err := Context.Shutdown(context.Background())
+	if err == nil {
+		t.Errorf("shutdown should report the failed hook")
+	}
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Errorf("hooks ran in the wrong order, have: %v", order)
+	}
+
+	// Hooks only run once
+	order = nil
+	_ = Context.Shutdown(context.Background())
+	if len(order) != 0 {
+		t.Errorf("hooks should not run twice")
+	}
+}
+
+func TestShutdownFlushesFileStorage(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "app")
+	defer os.RemoveAll(dir)
+
+	cfg := config.Default()
+	cfg.Storage.Backend = config.FileBackend
+	cfg.Storage.Path = filepath.Join(dir, "notes.json")
+	cfg.Storage.FlushInterval = time.Hour
+
+	err := Setup(cfg)
+	if err != nil {
+		t.Fatalf("failed to set up: %s", err.Error())
+	}
+
+	err = Context.DB.Upsert(context.Background(), db.UsersTable, model.UserAccount{UserID: 1, User: "test.account"})
+	if err != nil || !Context.DB.Dirty() {
+		t.Errorf("upsert should have left pending changes")
+	}
+
+	err = Context.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("shutdown failed: %s", err.Error())
+	}
+	if Context.DB.Dirty() {
+		t.Errorf("pending changes should have been flushed")
+	}
+}
@@ -1,8 +0,0 @@
-package app
-
-const (
-	UserExistsError     = "USER_EXISTS"
-	InvalidUserError    = "INVALID_USER"
-	InvalidRequestError = "INVALID_REQUEST"
-	InvalidTokenError   = "INVALID_TOKEN"
-)
\ No newline at end of file
@@ -0,0 +1,41 @@
+package app
+
+import "context"
+
+type requestIDKey struct{}
+
+// WithRequestID attaches the request ID to the request context
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the ID assigned to the request, or an empty string if there isn't one
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type requestInfoKey struct{}
+
+// RequestInfo collects details learned while a request is handled, such as the matched route and the authenticated
+// user, so middleware wrapping the router can report them once the request has finished
+type RequestInfo struct {
+	Route  string
+	UserID int
+}
+
+// WithRequestInfo attaches an empty RequestInfo to the request context
+func WithRequestInfo(ctx context.Context) (context.Context, *RequestInfo) {
+	info := &RequestInfo{}
+	return context.WithValue(ctx, requestInfoKey{}, info), info
+}
+
+// CurrentRequest returns the RequestInfo attached to the context. Outside a request it returns a detached RequestInfo,
+// so callers never need to check
+func CurrentRequest(ctx context.Context) *RequestInfo {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	if !ok {
+		return &RequestInfo{}
+	}
+	return info
+}
@@ -0,0 +1,180 @@
+package apperr
+
+import (
+	"errors"
+	"github.com/kylegk/notes/model"
+	"net/http"
+	"time"
+)
+
+// Error is a sentinel error with a stable, machine-readable code and the HTTP status it's reported with
+type Error struct {
+	Code   string
+	Status int
+	Title  string
+}
+
+func (e *Error) Error() string {
+	return e.Code
+}
+
+var (
+	ErrInvalidRequest       = &Error{Code: "INVALID_REQUEST", Status: http.StatusBadRequest, Title: "Invalid request"}
+	ErrValidation           = &Error{Code: "VALIDATION_FAILED", Status: http.StatusBadRequest, Title: "Request failed validation"}
+	ErrInvalidSyncToken     = &Error{Code: "INVALID_SYNC_TOKEN", Status: http.StatusBadRequest, Title: "Sync token is invalid or has expired"}
+	ErrInvalidToken         = &Error{Code: "INVALID_TOKEN", Status: http.StatusUnauthorized, Title: "Authentication token is missing or invalid"}
+	ErrInvalidCredentials   = &Error{Code: "INVALID_CREDENTIALS", Status: http.StatusUnauthorized, Title: "User name or password is incorrect"}
+	ErrOIDCLoginFailed      = &Error{Code: "OIDC_LOGIN_FAILED", Status: http.StatusUnauthorized, Title: "Login with the identity provider failed"}
+	ErrTwoFactorRequired    = &Error{Code: "TWO_FACTOR_REQUIRED", Status: http.StatusUnauthorized, Title: "A second factor is needed to log in"}
+	ErrInvalidTwoFactorCode = &Error{Code: "INVALID_TWO_FACTOR_CODE", Status: http.StatusUnauthorized, Title: "Two-factor code is incorrect or has already been used"}
+	ErrAccountDisabled      = &Error{Code: "ACCOUNT_DISABLED", Status: http.StatusForbidden, Title: "Account has been disabled"}
+	ErrForbidden            = &Error{Code: "FORBIDDEN", Status: http.StatusForbidden, Title: "You are not allowed to access this resource"}
+	ErrInvalidCSRFToken     = &Error{Code: "INVALID_CSRF_TOKEN", Status: http.StatusForbidden, Title: "CSRF token is missing or invalid"}
+	ErrNotFound             = &Error{Code: "NOT_FOUND", Status: http.StatusNotFound, Title: "Resource not found"}
+	ErrNoteNotFound         = &Error{Code: "NOTE_NOT_FOUND", Status: http.StatusNotFound, Title: "Note not found"}
+	ErrUserNotFound         = &Error{Code: "USER_NOT_FOUND", Status: http.StatusNotFound, Title: "User not found"}
+	ErrAccessTokenNotFound  = &Error{Code: "ACCESS_TOKEN_NOT_FOUND", Status: http.StatusNotFound, Title: "Access token not found"}
+	ErrMethodNotAllowed     = &Error{Code: "METHOD_NOT_ALLOWED", Status: http.StatusMethodNotAllowed, Title: "Method not allowed"}
+	ErrUserExists           = &Error{Code: "USER_EXISTS", Status: http.StatusConflict, Title: "User already exists"}
+	ErrLastAdmin            = &Error{Code: "LAST_ADMIN", Status: http.StatusConflict, Title: "The last administrator cannot be removed"}
+	ErrIdentityLinked       = &Error{Code: "IDENTITY_LINKED", Status: http.StatusConflict, Title: "Identity is already linked to another user"}
+	ErrTwoFactorEnabled     = &Error{Code: "TWO_FACTOR_ENABLED", Status: http.StatusConflict, Title: "Two-factor authentication is already enabled"}
+	ErrRequestTooLarge      = &Error{Code: "REQUEST_TOO_LARGE", Status: http.StatusRequestEntityTooLarge, Title: "Request body is too large"}
+	ErrNoteTooLarge         = &Error{Code: "NOTE_TOO_LARGE", Status: http.StatusRequestEntityTooLarge, Title: "Note is larger than the maximum note size"}
+	ErrIdempotencyKeyReused = &Error{Code: "IDEMPOTENCY_KEY_REUSED", Status: http.StatusUnprocessableEntity, Title: "Idempotency key was already used for a different request"}
+	ErrRateLimited          = &Error{Code: "RATE_LIMITED", Status: http.StatusTooManyRequests, Title: "Too many requests"}
+	ErrTwoFactorLocked      = &Error{Code: "TWO_FACTOR_LOCKED", Status: http.StatusTooManyRequests, Title: "Too many wrong two-factor codes"}
+	ErrQuotaExceeded        = &Error{Code: "QUOTA_EXCEEDED", Status: http.StatusInsufficientStorage, Title: "Storage quota exceeded"}
+	ErrInternal             = &Error{Code: "INTERNAL_ERROR", Status: http.StatusInternalServerError, Title: "An error has occurred"}
+)
+
+// detailError adds a description of this particular occurrence to a sentinel error
+type detailError struct {
+	err    *Error
+	detail string
+}
+
+func (e *detailError) Error() string {
+	return e.err.Code + ": " + e.detail
+}
+
+func (e *detailError) Unwrap() error {
+	return e.err
+}
+
+// New wraps the sentinel error with a human-readable detail
+func New(err *Error, detail string) error {
+	return &detailError{err: err, detail: detail}
+}
+
+// ValidationError reports every field that failed validation
+type ValidationError struct {
+	Fields []model.FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msg := ErrValidation.Code
+	for _, f := range e.Fields {
+		msg += "; " + f.Field + ": " + f.Message
+	}
+	return msg
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+// Validation creates a validation error for the given fields
+func Validation(fields ...model.FieldError) error {
+	return &ValidationError{Fields: fields}
+}
+
+// challengeError asks for the second factor of a login whose password was correct
+type challengeError struct {
+	challenge string
+}
+
+func (e *challengeError) Error() string {
+	return ErrTwoFactorRequired.Code
+}
+
+func (e *challengeError) Unwrap() error {
+	return ErrTwoFactorRequired
+}
+
+// TwoFactorRequired creates the error returned when a login needs a second factor, naming the challenge to finish it
+// with
+func TwoFactorRequired(challenge string) error {
+	return &challengeError{challenge: challenge}
+}
+
+// retryError tells the client how long to wait before trying again
+type retryError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryError) Unwrap() error {
+	return e.err
+}
+
+// WithRetryAfter adds how long the client should wait before trying again to err
+func WithRetryAfter(err error, after time.Duration) error {
+	return &retryError{err: err, after: after}
+}
+
+// Lookup finds the sentinel error wrapped by err. Errors that don't wrap a sentinel are internal errors
+func Lookup(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return ErrInternal
+}
+
+// Detail returns the human-readable detail attached to err, if any
+func Detail(err error) string {
+	var d *detailError
+	if errors.As(err, &d) {
+		return d.detail
+	}
+	return ""
+}
+
+// Fields returns the field-level validation failures attached to err, if any
+func Fields(err error) []model.FieldError {
+	var v *ValidationError
+	if errors.As(err, &v) {
+		return v.Fields
+	}
+	return nil
+}
+
+// Challenge returns the challenge attached to err by TwoFactorRequired, if any
+func Challenge(err error) string {
+	var c *challengeError
+	if errors.As(err, &c) {
+		return c.challenge
+	}
+	return ""
+}
+
+// RetryAfter returns how long WithRetryAfter said the client should wait before trying again, if it did
+func RetryAfter(err error) time.Duration {
+	var r *retryError
+	if errors.As(err, &r) {
+		return r.after
+	}
+	return 0
+}
+
+// IsClientError reports whether err was caused by the request rather than by the server. Exceeding a quota is reported
+// with a 507, but it's still down to the caller
+func IsClientError(err error) bool {
+	e := Lookup(err)
+	return e.Status < http.StatusInternalServerError || e == ErrQuotaExceeded
+}
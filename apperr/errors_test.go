@@ -0,0 +1,69 @@
+package apperr
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kylegk/notes/model"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLookup(t *testing.T) {
+	// Sentinels are found through any amount of wrapping
+	err := fmt.Errorf("while updating: %w", New(ErrNoteNotFound, "note 5 does not exist"))
+	if Lookup(err) != ErrNoteNotFound {
+		t.Errorf("unexpected sentinel, have: %v, want: %v", Lookup(err).Code, ErrNoteNotFound.Code)
+	}
+	if !errors.Is(err, ErrNoteNotFound) {
+		t.Errorf("wrapped error should match its sentinel")
+	}
+	if Detail(err) != "note 5 does not exist" {
+		t.Errorf("unexpected detail, have: %v", Detail(err))
+	}
+
+	// Anything else is an internal error
+	if Lookup(errors.New("boom")) != ErrInternal {
+		t.Errorf("unknown errors should be internal")
+	}
+	if IsClientError(errors.New("boom")) {
+		t.Errorf("unknown errors are not client errors")
+	}
+	if !IsClientError(ErrInvalidToken) {
+		t.Errorf("invalid token is a client error")
+	}
+}
+
+func TestValidation(t *testing.T) {
+	err := Validation(
+		model.FieldError{Field: "user", Code: "required", Message: "user is required"},
+		model.FieldError{Field: "content", Code: "too_long", Message: "content is too long"},
+	)
+
+	if Lookup(err).Status != http.StatusBadRequest {
+		t.Errorf("validation errors should be bad requests")
+	}
+	if len(Fields(err)) != 2 {
+		t.Errorf("unexpected number of field errors, have: %v, want: %v", len(Fields(err)), 2)
+	}
+}
+
+func TestTwoFactorRequired(t *testing.T) {
+	err := fmt.Errorf("while logging in: %w", TwoFactorRequired("abc"))
+	if Lookup(err) != ErrTwoFactorRequired || Challenge(err) != "abc" {
+		t.Errorf("unexpected error, have: %v, %v", Lookup(err).Code, Challenge(err))
+	}
+	if Challenge(ErrInvalidCredentials) != "" {
+		t.Errorf("other errors should have no challenge")
+	}
+}
+
+func TestWithRetryAfter(t *testing.T) {
+	err := WithRetryAfter(New(ErrTwoFactorLocked, "try again later"), time.Minute)
+	if Lookup(err) != ErrTwoFactorLocked || Detail(err) != "try again later" || RetryAfter(err) != time.Minute {
+		t.Errorf("unexpected error, have: %v, %v, %v", Lookup(err).Code, Detail(err), RetryAfter(err))
+	}
+	if RetryAfter(ErrRateLimited) != 0 {
+		t.Errorf("other errors should have no retry delay")
+	}
+}
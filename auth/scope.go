@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/model"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type scopesKey struct{}
+
+// WithScopes returns the request marked as one a personal access token may make if it holds every one of the scopes.
+// Personal access tokens are refused on routes that aren't marked, so new routes are only open to them when they say so
+func WithScopes(r *http.Request, scopes ...string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), scopesKey{}, scopes))
+}
+
+// IsAccessToken reports whether the token is a personal access token rather than a JWT
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, model.AccessTokenPrefix)
+}
+
+// parseAccessToken checks the personal access token was issued, hasn't expired, and holds the scopes the request needs
+func parseAccessToken(ctx context.Context, tokenString string) (model.AccessToken, error) {
+	token, ok, err := lib.LookupAccessTokenDB(ctx, tokenString)
+	if err != nil {
+		return model.AccessToken{}, err
+	}
+	if !ok {
+		return model.AccessToken{}, authFailure("unknown_access_token", "access token is not valid")
+	}
+	if token.Expires != 0 && token.Expires <= time.Now().Unix() {
+		return model.AccessToken{}, authFailure("expired", "access token has expired")
+	}
+
+	required, _ := ctx.Value(scopesKey{}).([]string)
+	if len(required) == 0 {
+		metrics.AuthFailures.WithLabelValues("missing_scope").Inc()
+		return model.AccessToken{}, apperr.New(apperr.ErrForbidden, "personal access tokens can't be used here, log in instead")
+	}
+	for _, scope := range required {
+		if !slices.Contains(token.Scopes, scope) {
+			metrics.AuthFailures.WithLabelValues("missing_scope").Inc()
+			return model.AccessToken{}, apperr.New(apperr.ErrForbidden, "access token needs the "+scope+" scope")
+		}
+	}
+
+	return token, nil
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/golang-jwt/jwt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/config"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/model"
+	"net/http"
+	"time"
+)
+
+const (
+	// SessionCookie holds the token of a browser session. It's HttpOnly, so scripts can't read it
+	SessionCookie = "notes_session"
+
+	// CSRFCookie holds the session's CSRF token, which scripts must copy into the CSRFHeader of state-changing requests
+	CSRFCookie = "notes_csrf"
+	CSRFHeader = "X-CSRF-Token"
+
+	// OIDCStateCookie holds the state of the login the browser started at the identity provider, so the callback only
+	// finishes logins started by the same browser
+	OIDCStateCookie = "notes_oidc_state"
+)
+
+// GenerateSessionToken generates the JWT held in a session's cookie. It names the session, so it stops being valid as
+// soon as the session ends
+func GenerateSessionToken(ctx context.Context, session model.Session) (string, error) {
+	return signToken(ctx, session.UserID, jwt.MapClaims{
+		"expires": session.Expires,
+		"sid":     session.SessionID,
+	})
+}
+
+// SessionID returns the session named by the request's token, or an empty string when it wasn't made with a session
+// cookie
+func SessionID(r *http.Request) string {
+	claims, reason, _ := parseToken(r.Context(), ExtractToken(r))
+	if reason != "" {
+		return ""
+	}
+	return claims.SessionID
+}
+
+// CSRFToken returns the session's CSRF token. It's derived from the session with the token secret, so another site
+// can neither guess it nor plant a cookie of its own that would be accepted
+func CSRFToken(sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(app.Context.Config.Auth.TokenSecret))
+	mac.Write([]byte("csrf:" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SetSessionCookies hands the session's token and CSRF token to the browser
+func SetSessionCookies(w http.ResponseWriter, token string, session model.Session) {
+	expires := time.Unix(session.Expires, 0)
+	http.SetCookie(w, sessionCookie(SessionCookie, token, expires, true))
+	http.SetCookie(w, sessionCookie(CSRFCookie, CSRFToken(session.SessionID), expires, false))
+}
+
+// ClearSessionCookies tells the browser to forget the session
+func ClearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, sessionCookie(SessionCookie, "", time.Unix(0, 0), true))
+	http.SetCookie(w, sessionCookie(CSRFCookie, "", time.Unix(0, 0), false))
+}
+
+// SetOIDCStateCookie remembers the state of the login the browser is starting at the identity provider. It's always
+// SameSite=Lax, since the provider sends the browser back with a navigation from its own site
+func SetOIDCStateCookie(w http.ResponseWriter, state string, expires time.Time) {
+	cookie := sessionCookie(OIDCStateCookie, state, expires, true)
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+}
+
+// ClearOIDCStateCookie tells the browser to forget the login it started at the identity provider
+func ClearOIDCStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, sessionCookie(OIDCStateCookie, "", time.Unix(0, 0), true))
+}
+
+// OIDCState returns the state of the login the browser started at the identity provider, if any
+func OIDCState(r *http.Request) string {
+	cookie, err := r.Cookie(OIDCStateCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func sessionCookie(name string, value string, expires time.Time, httpOnly bool) *http.Cookie {
+	cfg := app.Context.Config.Auth.Sessions
+
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   cfg.Domain,
+		Expires:  expires,
+		Secure:   cfg.Secure,
+		HttpOnly: httpOnly,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+
+	switch cfg.SameSite {
+	case config.SameSiteStrict:
+		cookie.SameSite = http.SameSiteStrictMode
+	case config.SameSiteNone:
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+
+	return cookie
+}
+
+// CheckCSRF guards against other sites making requests with the browser's session cookie. State-changing requests that
+// rely on the cookie must send the session's CSRF token in both the CSRF cookie and header, which only scripts allowed
+// to read the token can do. Requests with an Authorization header, or without a valid session cookie, aren't checked,
+// since browsers never attach those credentials by themselves
+func CheckCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+
+	if !app.Context.Config.Auth.Sessions.Enabled || r.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	claims, reason, _ := parseToken(r.Context(), cookie.Value)
+	if reason != "" || claims.SessionID == "" {
+		return nil
+	}
+
+	header := r.Header.Get(CSRFHeader)
+	csrfCookie, err := r.Cookie(CSRFCookie)
+	if header == "" || err != nil {
+		metrics.AuthFailures.WithLabelValues("csrf_missing").Inc()
+		return apperr.New(apperr.ErrInvalidCSRFToken, "missing "+CSRFHeader+" header or "+CSRFCookie+" cookie")
+	}
+
+	want := CSRFToken(claims.SessionID)
+	if !hmac.Equal([]byte(header), []byte(csrfCookie.Value)) || !hmac.Equal([]byte(header), []byte(want)) {
+		metrics.AuthFailures.WithLabelValues("csrf_invalid").Inc()
+		return apperr.New(apperr.ErrInvalidCSRFToken, "CSRF token does not match the session")
+	}
+
+	return nil
+}
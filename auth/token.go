@@ -1,27 +1,54 @@
 package auth
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang-jwt/jwt"
 	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
 	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// TokenSecret is the string used to sign and validate the JWT for the application
-// NOTE: If this were production code, the secret would be set in the environment or through an .env file
-const TokenSecret = "THIS_IS_MY_SECRET"
-
 // GenerateUserToken generates a JWT
-func GenerateUserToken(userID int) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"expires": time.Now().Add(time.Minute * 15).Unix(),
-		"userid": userID,
+func GenerateUserToken(ctx context.Context, userID int) (string, error) {
+	return signToken(ctx, userID, jwt.MapClaims{
+		"expires": time.Now().Add(app.Context.Config.Auth.TokenLifetime).Unix(),
 	})
+}
+
+// signToken adds the claims every token carries, naming the user, their role and their token version, and signs the token
+// with the current signing key, or the configured token secret before any key has been rotated in
+func signToken(ctx context.Context, userID int, claims jwt.MapClaims) (string, error) {
+	account, err := lib.GetUserDB(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	claims["userid"] = userID
+	claims["role"] = account.Role
+	claims["version"] = account.TokenVersion
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	secret := app.Context.Config.Auth.TokenSecret
+	key, ok, err := lib.CurrentSigningKeyDB(ctx)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		token.Header["kid"] = key.KeyID
+		secret = key.Secret
+	}
 
-	tokenString, err := token.SignedString([]byte(TokenSecret))
+	tokenString, err := token.SignedString([]byte(secret))
 	if err != nil {
 		return "", err
 	}
@@ -30,48 +57,197 @@ func GenerateUserToken(userID int) (string, error) {
 }
 
 // ValidateUserToken validates a JWT
-func ValidateUserToken(r *http.Request) (int, error) {
+func ValidateUserToken(r *http.Request) (_ int, err error) {
+	ctx, span := tracing.Start(r.Context(), "auth.ValidateUserToken")
+	defer tracing.End(span, &err)
+
+	account, _, err := authenticate(ctx, r)
+	return account.UserID, err
+}
+
+// RequireRole validates a JWT for a route only users with the role may use. The token must carry the role and the user
+// must still hold it, so a user who has been given the role has to log in again before they can use it, and one who has
+// lost it can't use it any longer
+func RequireRole(r *http.Request, role string) (_ int, err error) {
+	ctx, span := tracing.Start(r.Context(), "auth.RequireRole", attribute.String("enduser.role", role))
+	defer tracing.End(span, &err)
+
+	account, claims, err := authenticate(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+
+	if claims.Role != role || account.Role != role {
+		metrics.AuthFailures.WithLabelValues("missing_role").Inc()
+		return 0, apperr.New(apperr.ErrForbidden, "only users with the "+role+" role may do this")
+	}
+
+	return account.UserID, nil
+}
+
+// authenticate checks the request's token is valid, and that the user it was issued to can still use it
+func authenticate(ctx context.Context, r *http.Request) (model.UserAccount, tokenClaims, error) {
 	tokenString := ExtractToken(r)
 
+	// Personal access tokens are revoked by deleting them, rather than by the user's token version
+	var claims tokenClaims
+	var accessToken model.AccessToken
+	if IsAccessToken(tokenString) {
+		var err error
+		accessToken, err = parseAccessToken(ctx, tokenString)
+		if err != nil {
+			return model.UserAccount{}, claims, err
+		}
+		claims.UserID = accessToken.UserID
+	} else {
+		var reason, detail string
+		claims, reason, detail = parseToken(ctx, tokenString)
+		if reason != "" {
+			return model.UserAccount{}, claims, authFailure(reason, detail)
+		}
+	}
+	userID := claims.UserID
+
+	// Session tokens are only valid until the session ends
+	if claims.SessionID != "" {
+		res, err := app.Context.DB.Query(ctx, db.SessionsTable, db.IDIdx, claims.SessionID)
+		if err != nil {
+			return model.UserAccount{}, claims, err
+		}
+
+		if len(res) == 0 || res[0].(model.Session).UserID != userID || res[0].(model.Session).Expires <= time.Now().Unix() {
+			return model.UserAccount{}, claims, authFailure("session_ended", "session has ended")
+		}
+	}
+
+	// Verify the user exists in the data store, and hasn't been disabled or logged out since the token was issued
+	res, err := app.Context.DB.Query(ctx, db.UsersTable, db.IDIdx, userID)
+	if err != nil {
+		return model.UserAccount{}, claims, err
+	}
+
+	if len(res) == 0 {
+		return model.UserAccount{}, claims, authFailure("unknown_user", "user no longer exists")
+	}
+
+	account := res[0].(model.UserAccount)
+	if account.Disabled {
+		return model.UserAccount{}, claims, authFailure("account_disabled", "account has been disabled")
+	}
+	if accessToken.TokenID == "" && claims.Version != account.TokenVersion {
+		return model.UserAccount{}, claims, authFailure("revoked", "token has been revoked")
+	}
+	if accessToken.TokenID != "" {
+		err = lib.TouchAccessTokenDB(ctx, accessToken)
+		if err != nil {
+			return model.UserAccount{}, claims, err
+		}
+	}
+
+	app.CurrentRequest(ctx).UserID = userID
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("enduser.id", userID))
+
+	return account, claims, nil
+}
+
+// TokenUserID returns the user the request's token was issued to, if it carries a token with a valid signature that
+// hasn't expired, or a personal access token that was issued. Unlike ValidateUserToken it doesn't check the user still
+// exists, or that the token may be used for the request, so it's only suitable for telling callers apart, never for
+// granting access
+func TokenUserID(r *http.Request) (int, bool) {
+	tokenString := ExtractToken(r)
+	if IsAccessToken(tokenString) {
+		token, ok, err := lib.LookupAccessTokenDB(r.Context(), tokenString)
+		return token.UserID, ok && err == nil
+	}
+
+	claims, reason, _ := parseToken(r.Context(), tokenString)
+	return claims.UserID, reason == ""
+}
+
+// tokenClaims are the claims carried by a valid token. Only tokens held in a session cookie name a session
+type tokenClaims struct {
+	UserID    int
+	Role      string
+	Version   int
+	SessionID string
+}
+
+// parseToken verifies the token's signature and expiry, returning the claims it carries. If the token isn't valid, it
+// returns the reason reported by the auth failure metric, and a detail for the client
+func parseToken(ctx context.Context, tokenString string) (_ tokenClaims, reason string, detail string) {
 	if tokenString == "" {
-		return 0, fmt.Errorf(app.InvalidTokenError)
+		return tokenClaims{}, "missing", "missing bearer token"
 	}
 
+	// Tokens signed with the configured token secret don't name a key
+	unknownKey := false
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return []byte(TokenSecret), nil
+		keyID := lib.ConfiguredKeyID
+		if kid, ok := token.Header["kid"].(string); ok {
+			keyID = kid
+		}
+
+		key, ok, err := lib.GetSigningKeyDB(ctx, keyID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			unknownKey = true
+			return nil, fmt.Errorf("unknown signing key %q", keyID)
+		}
+
+		return []byte(key.Secret), nil
 	})
+	if unknownKey {
+		return tokenClaims{}, "unknown_key", "token was signed with a key that has been revoked"
+	}
 	if err != nil {
-		return 0, fmt.Errorf(app.InvalidTokenError)
+		return tokenClaims{}, "malformed", "token could not be parsed"
 	}
 
-	var userID int
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// TODO: Validate that the 'expires' claim is now or in the future and return an error if it has expired
-		tmp := claims["userid"].(float64)
-		userID = int(tmp)
-	} else {
-		return 0, fmt.Errorf(app.InvalidTokenError)
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return tokenClaims{}, "invalid_claims", "token is not valid"
 	}
 
-	// Verify the user exists in the data store
-	res, err := app.Context.DB.Query(db.UsersTable, db.IDIdx, userID)
-	if err != nil {
-		return 0, err
+	expires, ok := claims["expires"].(float64)
+	if !ok || time.Now().Unix() > int64(expires) {
+		return tokenClaims{}, "expired", "token has expired"
 	}
 
-	if len(res) == 0 {
-		return 0, fmt.Errorf(app.InvalidTokenError)
+	tmp, ok := claims["userid"].(float64)
+	if !ok {
+		return tokenClaims{}, "invalid_claims", "token is not valid"
 	}
 
-	return userID, nil
+	sessionID, _ := claims["sid"].(string)
+	role, _ := claims["role"].(string)
+	version, _ := claims["version"].(float64)
+
+	return tokenClaims{UserID: int(tmp), Role: role, Version: int(version), SessionID: sessionID}, "", ""
+}
+
+// authFailure counts the failed authentication by reason and returns the error reported to the client
+func authFailure(reason string, detail string) error {
+	metrics.AuthFailures.WithLabelValues(reason).Inc()
+	return apperr.New(apperr.ErrInvalidToken, detail)
 }
 
+// ExtractToken returns the bearer token from the Authorization header or, when browser sessions are enabled and the
+// header isn't given, the token held in the session cookie
 func ExtractToken(r *http.Request) string {
 	bearToken := r.Header.Get("Authorization")
+	if bearToken == "" && app.Context.Config.Auth.Sessions.Enabled {
+		if cookie, err := r.Cookie(SessionCookie); err == nil {
+			return cookie.Value
+		}
+	}
+
 	strArr := strings.Split(bearToken, " ")
 
 	if len(strArr) == 2 {
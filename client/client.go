@@ -0,0 +1,356 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kylegk/notes/model"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshMargin is how long before a token expires it's replaced, so requests aren't sent with a token about to expire
+const refreshMargin = 30 * time.Second
+
+// Client calls the notes API. Once it has logged in, or created a user with a password, expired tokens are replaced
+// automatically. Requests that fail with a 429, a 5xx or a network error are retried with exponential backoff, and
+// requests that create data carry an Idempotency-Key so retrying them is safe. A Client is safe for concurrent use
+type Client struct {
+	// HTTPClient sends the requests, http.DefaultClient is used when it's nil
+	HTTPClient *http.Client
+
+	// MaxRetries is how many times a failed request is retried
+	MaxRetries int
+
+	// MinBackoff and MaxBackoff bound the wait between retries. A longer Retry-After than MaxBackoff isn't waited for,
+	// the error is returned instead
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	baseURL string
+
+	mu       sync.Mutex
+	token    string
+	user     string
+	password string
+
+	// refreshMu makes concurrent requests with an expired token share a single login
+	refreshMu sync.Mutex
+}
+
+// New creates a client for the server at baseURL, e.g. "https://notes.example.com"
+func New(baseURL string) *Client {
+	return &Client{
+		MaxRetries: 3,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Token returns the token the client is using, so it can be saved and passed to SetToken later
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// SetToken makes the client use a token obtained earlier. It can only be replaced when it expires if the client has also
+// logged in
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// Error is a problem reported by the API
+type Error struct {
+	model.Problem
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("notes: %d %s", e.Status, e.Code)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	} else if e.Title != "" {
+		msg += ": " + e.Title
+	}
+	return msg
+}
+
+// ErrorCode returns the code of the problem reported by the API, e.g. NOTE_NOT_FOUND, or an empty string if err isn't
+// one
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// Challenge returns the challenge of a login that needs a second factor, to pass to FinishLogin, or an empty string if
+// err isn't a TWO_FACTOR_REQUIRED error
+func Challenge(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Problem.Challenge
+	}
+	return ""
+}
+
+// do sends the request, retrying it when that's worthwhile, and decodes a successful response into out
+func (c *Client) do(ctx context.Context, method string, path string, in interface{}, out interface{}, authenticated bool) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	var idempotencyKey string
+	if method == http.MethodPost {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		var token string
+		if authenticated {
+			var err error
+			token, err = c.validToken(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		resp, err := c.send(ctx, method, path, body, token, idempotencyKey)
+		if err != nil {
+			if ctx.Err() != nil || attempt >= c.MaxRetries {
+				return err
+			}
+			err = sleep(ctx, c.backoff(attempt))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// A token that's been revoked or has expired early is replaced once
+		if resp.StatusCode == http.StatusUnauthorized && authenticated && !refreshed && c.canRefresh() {
+			drain(resp)
+			refreshed = true
+			err = c.refresh(ctx, token)
+			if err != nil {
+				return err
+			}
+			attempt--
+			continue
+		}
+
+		if retryable(resp.StatusCode) && attempt < c.MaxRetries {
+			wait, ok := c.retryDelay(resp, attempt)
+			if ok {
+				drain(resp)
+				err = sleep(ctx, wait)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		return decodeResponse(resp, out)
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, body []byte, token string, idempotencyKey string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+func decodeResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		e := &Error{}
+		if json.Unmarshal(b, &e.Problem) != nil || e.Code == "" {
+			e.Problem = model.Problem{Status: resp.StatusCode, Title: http.StatusText(resp.StatusCode)}
+		}
+		return e
+	}
+
+	if out == nil {
+		return nil
+	}
+	err = json.Unmarshal(b, out)
+	if err != nil {
+		return fmt.Errorf("notes: cannot decode response: %v", err)
+	}
+	return nil
+}
+
+// retryable reports whether a request that failed with the status is worth retrying. Exceeding a quota is reported as
+// a 507, but it won't succeed on a retry
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before retrying, preferring the server's Retry-After. It reports false when the
+// server asked for a longer wait than MaxBackoff
+func (c *Client) retryDelay(resp *http.Response, attempt int) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		wait := time.Duration(seconds) * time.Second
+		return wait, wait <= c.MaxBackoff
+	}
+	return c.backoff(attempt), true
+}
+
+// backoff doubles the wait with every attempt, up to MaxBackoff, choosing a random wait up to that to spread out retries
+// from many clients
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.MinBackoff
+	for i := 0; i < attempt && wait < c.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > c.MaxBackoff {
+		wait = c.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return time.Duration(mathrand.Int63n(int64(wait))) + 1
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// drain discards the rest of the response so the connection can be reused
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// validToken returns the token to send, logging in again first if it's about to expire
+func (c *Client) validToken(ctx context.Context) (string, error) {
+	token := c.Token()
+	if !c.canRefresh() {
+		return token, nil
+	}
+
+	if expires, ok := tokenExpiry(token); !ok || time.Until(expires) < refreshMargin {
+		err := c.refresh(ctx, token)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return c.Token(), nil
+}
+
+func (c *Client) canRefresh() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user != "" && c.password != ""
+}
+
+// refresh logs in again to replace the stale token, unless another request already has
+func (c *Client) refresh(ctx context.Context, stale string) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	if c.Token() != stale {
+		return nil
+	}
+
+	c.mu.Lock()
+	user, password := c.user, c.password
+	c.mu.Unlock()
+
+	_, err := c.Login(ctx, user, password)
+	return err
+}
+
+// tokenExpiry reads when the token expires. The token isn't verified, that's up to the server
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Expires int64 `json:"expires"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Expires == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(claims.Expires, 0), true
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,264 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/config"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/router"
+	"github.com/kylegk/notes/totp"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer runs the notes server in-process, passing every request through wrap first
+func startServer(t *testing.T, wrap func(h http.Handler) http.Handler) *httptest.Server {
+	cfg := config.Default()
+	cfg.RateLimit.Enabled = false
+	_ = app.Setup(cfg)
+
+	h := router.NewHandler()
+	if wrap != nil {
+		h = wrap(h)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	srv := startServer(t, nil)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	_, err := c.CreateUser(ctx, "test.account", "correct horse")
+	if err != nil {
+		t.Fatalf("failed to create user: %s", err.Error())
+	}
+
+	var noteIDs []int
+	for i := 0; i < 5; i++ {
+		noteID, err := c.CreateNote(ctx, fmt.Sprintf("Note %d", i))
+		if err != nil {
+			t.Fatalf("failed to create note: %s", err.Error())
+		}
+		noteIDs = append(noteIDs, noteID)
+	}
+
+	// Iterate over every note, two at a time
+	var listed []int
+	it := c.ListNotes(ctx, 2)
+	for it.Next() {
+		listed = append(listed, it.NoteID())
+	}
+	if it.Err() != nil || fmt.Sprint(listed) != fmt.Sprint(noteIDs) {
+		t.Errorf("iterator should have listed every note, have: %v, %v, want: %v", listed, it.Err(), noteIDs)
+	}
+
+	err = c.UpdateNote(ctx, noteIDs[0], "Updated")
+	if err != nil {
+		t.Errorf("failed to update note: %s", err.Error())
+	}
+	note, err := c.GetNote(ctx, noteIDs[0])
+	if err != nil || note.Content != "Updated" {
+		t.Errorf("note should have been updated, have: %+v, %v", note, err)
+	}
+
+	// Errors reported by the API keep their problem details
+	err = c.DeleteNote(ctx, noteIDs[0])
+	if err != nil {
+		t.Errorf("failed to delete note: %s", err.Error())
+	}
+	_, err = c.GetNote(ctx, noteIDs[0])
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != 404 || ErrorCode(err) != "NOTE_NOT_FOUND" || apiErr.RequestID == "" {
+		t.Errorf("deleted note should not have been found, have: %v", err)
+	}
+
+	// Logging in replaces the token
+	other := New(srv.URL)
+	_, err = other.Login(ctx, "test.account", "wrong horse")
+	if ErrorCode(err) != "INVALID_CREDENTIALS" {
+		t.Errorf("login with the wrong password should have failed, have: %v", err)
+	}
+	_, err = other.Login(ctx, "test.account", "correct horse")
+	if err != nil || other.Token() == "" {
+		t.Errorf("login should have succeeded, have: %v", err)
+	}
+}
+
+func TestClientRefreshesToken(t *testing.T) {
+	var mu sync.Mutex
+	logins := 0
+	srv := startServer(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/login" {
+				mu.Lock()
+				logins++
+				mu.Unlock()
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	_, err := c.Login(ctx, "missing.account", "correct horse")
+	if ErrorCode(err) != "INVALID_CREDENTIALS" {
+		t.Errorf("login as an unknown user should have failed, have: %v", err)
+	}
+	_, err = c.CreateUser(ctx, "test.account", "correct horse")
+	if err != nil {
+		t.Fatalf("failed to create user: %s", err.Error())
+	}
+
+	// A token the server refuses is replaced by logging in again, and the request is retried
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"expires":%d,"userid":1}`, time.Now().Add(time.Hour).Unix())))
+	c.SetToken("eyJhbGciOiJIUzI1NiJ9." + payload + ".forged")
+	_, err = c.CreateNote(ctx, "Written with a refreshed token")
+	if err != nil {
+		t.Errorf("request should have succeeded after refreshing the token, have: %v", err)
+	}
+
+	// A token about to expire is replaced before it's used
+	payload = base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"expires":%d,"userid":1}`, time.Now().Add(time.Second).Unix())))
+	c.SetToken("eyJhbGciOiJIUzI1NiJ9." + payload + ".forged")
+	it := c.ListNotes(ctx, 0)
+	for it.Next() {
+	}
+	if it.Err() != nil {
+		t.Errorf("request should have succeeded after refreshing the token, have: %v", it.Err())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if logins != 3 {
+		t.Errorf("client should have logged in again for each stale token, have: %v logins", logins)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	keys := map[string]bool{}
+	srv := startServer(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.Path != "/notes" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			mu.Lock()
+			keys[r.Header.Get("Idempotency-Key")] = true
+			attempts++
+			attempt := attempts
+			mu.Unlock()
+
+			switch attempt {
+			case 1:
+				// The note is created, but the response is lost
+				h.ServeHTTP(httptest.NewRecorder(), r)
+				w.WriteHeader(http.StatusBadGateway)
+			case 2:
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+			default:
+				h.ServeHTTP(w, r)
+			}
+		})
+	})
+	c := New(srv.URL)
+	c.MinBackoff = time.Millisecond
+	ctx := context.Background()
+
+	_, err := c.CreateUser(ctx, "test.account", "")
+	if err != nil {
+		t.Fatalf("failed to create user: %s", err.Error())
+	}
+
+	noteID, err := c.CreateNote(ctx, "Retried")
+	if err != nil {
+		t.Fatalf("request should have succeeded once retried, have: %v", err)
+	}
+
+	// Every attempt used the same idempotency key, so the note was only created once
+	mu.Lock()
+	if len(keys) != 1 || attempts != 3 {
+		t.Errorf("retries should have reused the idempotency key, have: %v keys, %v attempts", len(keys), attempts)
+	}
+	mu.Unlock()
+	var listed []int
+	it := c.ListNotes(ctx, 0)
+	for it.Next() {
+		listed = append(listed, it.NoteID())
+	}
+	if len(listed) != 1 || listed[0] != noteID {
+		t.Errorf("note should only have been created once, have: %v", listed)
+	}
+}
+
+func TestClientGivesUp(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	// Retries stop after MaxRetries
+	c := New(srv.URL)
+	c.MinBackoff = time.Millisecond
+	_, err := c.CreateUser(context.Background(), "test.account", "")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != 503 || attempts != c.MaxRetries+1 {
+		t.Errorf("client should have given up after %d retries, have: %v after %d attempts", c.MaxRetries, err, attempts)
+	}
+
+	// Waiting between retries stops when the context is done
+	c.MinBackoff = time.Hour
+	c.MaxBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.CreateUser(ctx, "test.account", "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("client should have stopped waiting when the context expired, have: %v", err)
+	}
+}
+
+func TestClientTwoFactorLogin(t *testing.T) {
+	srv := startServer(t, nil)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	userID, err := c.CreateUser(ctx, "test.account", "correct horse")
+	if err != nil {
+		t.Fatalf("failed to create user: %s", err.Error())
+	}
+	enrolment, _ := lib.StartTwoFactorDB(ctx, userID)
+	code, _ := totp.Code(enrolment.Secret, totp.Step(time.Now()))
+	_, err = lib.ConfirmTwoFactorDB(ctx, userID, code)
+	if err != nil {
+		t.Fatalf("failed to enable two-factor authentication: %s", err.Error())
+	}
+
+	// The password alone isn't enough, and the login is finished with the challenge and a code
+	other := New(srv.URL)
+	_, err = other.Login(ctx, "test.account", "correct horse")
+	if ErrorCode(err) != "TWO_FACTOR_REQUIRED" || Challenge(err) == "" {
+		t.Fatalf("login should need a second factor, have: %v", err)
+	}
+	code, _ = totp.Code(enrolment.Secret, totp.Step(time.Now())+1)
+	have, err := other.FinishLogin(ctx, Challenge(err), code)
+	if err != nil || have != userID || other.Token() == "" {
+		t.Errorf("login should have been finished, have: %v, %v", have, err)
+	}
+	if _, err = other.GetNote(ctx, 1); ErrorCode(err) != "NOTE_NOT_FOUND" {
+		t.Errorf("client should use the new token, have: %v", err)
+	}
+}
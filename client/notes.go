@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/kylegk/notes/model"
+)
+
+// CreateNote creates a note, returning its ID
+func (c *Client) CreateNote(ctx context.Context, content string) (int, error) {
+	var resp model.CreateNoteResponse
+	err := c.do(ctx, "POST", "/notes", model.CreateNoteRequest{Content: content}, &resp, true)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.NoteID, nil
+}
+
+// GetNote retrieves a note
+func (c *Client) GetNote(ctx context.Context, noteID int) (model.Note, error) {
+	var note model.Note
+	err := c.do(ctx, "GET", fmt.Sprintf("/notes/%d", noteID), nil, &note, true)
+	return note, err
+}
+
+// UpdateNote replaces the content of a note
+func (c *Client) UpdateNote(ctx context.Context, noteID int, content string) error {
+	return c.do(ctx, "PUT", fmt.Sprintf("/notes/%d", noteID), model.UpdateNoteRequest{Content: content}, nil, true)
+}
+
+// DeleteNote deletes a note
+func (c *Client) DeleteNote(ctx context.Context, noteID int) error {
+	return c.do(ctx, "DELETE", fmt.Sprintf("/notes/%d", noteID), nil, nil, true)
+}
+
+const defaultPageSize = 100
+
+// ListNotes returns an iterator over the IDs of the user's notes in ascending order, fetching pageSize IDs at a time, or
+// defaultPageSize when it's 0
+//
+//	it := c.ListNotes(ctx, 100)
+//	for it.Next() {
+//		fmt.Println(it.NoteID())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (c *Client) ListNotes(ctx context.Context, pageSize int) *NoteIterator {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	return &NoteIterator{c: c, ctx: ctx, pageSize: pageSize}
+}
+
+// NoteIterator pages through the IDs of the user's notes
+type NoteIterator struct {
+	c        *Client
+	ctx      context.Context
+	pageSize int
+
+	page   []int
+	after  int
+	last   bool
+	noteID int
+	err    error
+}
+
+// Next advances to the next note, fetching another page when needed. It returns false once every note has been seen or
+// a request has failed, which Err reports
+func (it *NoteIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || it.last {
+			return false
+		}
+		it.fetch()
+	}
+
+	it.noteID, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+func (it *NoteIterator) fetch() {
+	var resp model.GetAllNotesForUserResponse
+	it.err = it.c.do(it.ctx, "GET", fmt.Sprintf("/notes?limit=%d&after=%d", it.pageSize, it.after), nil, &resp, true)
+	if it.err != nil {
+		return
+	}
+
+	it.page = resp.Notes
+	it.after = resp.Next
+	it.last = resp.Next == 0
+}
+
+// NoteID returns the ID of the current note
+func (it *NoteIterator) NoteID() int {
+	return it.noteID
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *NoteIterator) Err() error {
+	return it.err
+}
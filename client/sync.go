@@ -0,0 +1,20 @@
+package client
+
+import (
+	"context"
+	"github.com/kylegk/notes/model"
+	"net/url"
+)
+
+// Changes returns the notes that changed since the sync token, including deletions, along with the token for the next
+// sync. An empty token returns every note
+func (c *Client) Changes(ctx context.Context, since string) (model.GetSyncChangesResponse, error) {
+	path := "/sync"
+	if since != "" {
+		path += "?since=" + url.QueryEscape(since)
+	}
+
+	var resp model.GetSyncChangesResponse
+	err := c.do(ctx, "GET", path, nil, &resp, true)
+	return resp, err
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"github.com/kylegk/notes/model"
+)
+
+// CreateUser creates a user and starts using their token. When a password is given, the client logs in again with it
+// whenever the token expires
+func (c *Client) CreateUser(ctx context.Context, user string, password string) (int, error) {
+	var resp model.CreateUserResponse
+	err := c.do(ctx, "POST", "/users", model.CreateUserRequest{User: user, Password: password}, &resp, false)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.token, c.user, c.password = resp.Token, user, password
+	c.mu.Unlock()
+
+	return resp.UserID, nil
+}
+
+// Login logs in with the user's password and starts using their token. The client logs in again whenever the token
+// expires. When the user has two-factor authentication enabled, the error's code is TWO_FACTOR_REQUIRED and the login
+// is finished with FinishLogin
+func (c *Client) Login(ctx context.Context, user string, password string) (int, error) {
+	var resp model.LoginResponse
+	err := c.do(ctx, "POST", "/login", model.LoginRequest{User: user, Password: password}, &resp, false)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.token, c.user, c.password = resp.Token, user, password
+	c.mu.Unlock()
+
+	return resp.UserID, nil
+}
+
+// FinishLogin finishes a login that needs a second factor, with the challenge from the TWO_FACTOR_REQUIRED error and a
+// code from the user's authenticator app or one of their recovery codes. Codes can only be used once, so the client
+// can't log in again by itself when the token expires
+func (c *Client) FinishLogin(ctx context.Context, challenge string, code string) (int, error) {
+	var resp model.LoginResponse
+	err := c.do(ctx, "POST", "/login/2fa", model.TwoFactorLoginRequest{Challenge: challenge, Code: code}, &resp, false)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.token, c.user, c.password = resp.Token, "", ""
+	c.mu.Unlock()
+
+	return resp.UserID, nil
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/client"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cli holds what every command needs: the client, and the saved credentials it was set up with
+type cli struct {
+	env             *env
+	client          *client.Client
+	creds           credentials
+	credentialsPath string
+	json            bool
+
+	// usage is the usage of the command being run
+	usage string
+}
+
+func newCLI(e *env, credentialsPath string, server string, jsonOutput bool) (*cli, error) {
+	var err error
+	if credentialsPath == "" {
+		credentialsPath, err = credentialsFile(e.getenv)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	creds, err := loadCredentials(credentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read credentials: %v", err)
+	}
+
+	// A token is only sent to the server it was issued by
+	if server != "" && server != creds.Server {
+		creds = credentials{Server: server}
+	}
+	if creds.Server == "" {
+		creds.Server = defaultServer
+	}
+
+	c := client.New(creds.Server)
+	c.SetToken(creds.Token)
+
+	return &cli{env: e, client: c, creds: creds, credentialsPath: credentialsPath, json: jsonOutput}, nil
+}
+
+// note is how notes are printed with -json and exported
+type note struct {
+	NoteID   int    `json:"noteid"`
+	Content  string `json:"content"`
+	Modified string `json:"modified"`
+}
+
+func (cli *cli) printJSON(v any) error {
+	enc := json.NewEncoder(cli.env.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// authenticated reports a request rejected for its token as a reminder to log in
+func (cli *cli) authenticated(err error) error {
+	if client.ErrorCode(err) == apperr.ErrInvalidToken.Code {
+		return errNotLoggedIn
+	}
+	return err
+}
+
+func runLogin(ctx context.Context, cli *cli, args []string) error {
+	fs := commandFlags(cli, "login")
+	user := fs.String("user", "", "user to log in as, prompted for when omitted")
+	err := parseFlags(fs, args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	in := bufio.NewReader(cli.env.stdin)
+	if *user == "" {
+		if cli.env.interactive {
+			fmt.Fprint(cli.env.stderr, "User: ")
+		}
+		*user, err = readLine(in)
+		if err != nil {
+			return fmt.Errorf("cannot read user: %v", err)
+		}
+	}
+
+	var password string
+	if cli.env.interactive {
+		fmt.Fprint(cli.env.stderr, "Password: ")
+		password, err = cli.env.readPassword()
+	} else {
+		password, err = readLine(in)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read password: %v", err)
+	}
+
+	userID, err := cli.client.Login(ctx, *user, password)
+	// Users with two-factor authentication enabled are asked for a code from their authenticator app as well
+	if challenge := client.Challenge(err); challenge != "" {
+		if cli.env.interactive {
+			fmt.Fprint(cli.env.stderr, "Code: ")
+		}
+		var code string
+		code, err = readLine(in)
+		if err != nil {
+			return fmt.Errorf("cannot read code: %v", err)
+		}
+		userID, err = cli.client.FinishLogin(ctx, challenge, code)
+	}
+	if err != nil {
+		return err
+	}
+
+	cli.creds.User = *user
+	cli.creds.Token = cli.client.Token()
+	err = saveCredentials(cli.credentialsPath, cli.creds)
+	if err != nil {
+		return fmt.Errorf("cannot save credentials: %v", err)
+	}
+
+	if cli.json {
+		return cli.printJSON(map[string]any{"userid": userID, "user": *user, "server": cli.creds.Server})
+	}
+	fmt.Fprintf(cli.env.stdout, "Logged in to %s as %s\n", cli.creds.Server, *user)
+	return nil
+}
+
+func runLogout(ctx context.Context, cli *cli, args []string) error {
+	err := parseFlags(commandFlags(cli, "logout"), args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	cli.creds.Token = ""
+	err = saveCredentials(cli.credentialsPath, cli.creds)
+	if err != nil {
+		return fmt.Errorf("cannot save credentials: %v", err)
+	}
+
+	if !cli.json {
+		fmt.Fprintln(cli.env.stdout, "Logged out")
+	}
+	return nil
+}
+
+func runList(ctx context.Context, cli *cli, args []string) error {
+	err := parseFlags(commandFlags(cli, "list"), args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	notes, err := cli.allNotes(ctx)
+	if err != nil {
+		return err
+	}
+
+	return cli.printNotes(notes)
+}
+
+func runSearch(ctx context.Context, cli *cli, args []string) error {
+	fs := commandFlags(cli, "search")
+	err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	notes, err := cli.allNotes(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := strings.ToLower(fs.Arg(0))
+	matches := make([]note, 0)
+	for _, n := range notes {
+		if strings.Contains(strings.ToLower(n.Content), query) {
+			matches = append(matches, n)
+		}
+	}
+
+	return cli.printNotes(matches)
+}
+
+func runShow(ctx context.Context, cli *cli, args []string) error {
+	fs := commandFlags(cli, "show")
+	err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	noteID, err := parseNoteID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	n, err := cli.client.GetNote(ctx, noteID)
+	if err != nil {
+		return cli.authenticated(err)
+	}
+
+	if cli.json {
+		return cli.printJSON(note{NoteID: n.NoteID, Content: n.Content, Modified: n.Modified})
+	}
+	fmt.Fprint(cli.env.stdout, n.Content)
+	if !strings.HasSuffix(n.Content, "\n") {
+		fmt.Fprintln(cli.env.stdout)
+	}
+	return nil
+}
+
+func runCreate(ctx context.Context, cli *cli, args []string) error {
+	fs := commandFlags(cli, "create")
+	message := fs.String("m", "", "content of the note, read from stdin or written in $EDITOR when omitted")
+	err := parseFlags(fs, args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	content, err := cli.content(*message, "")
+	if err != nil {
+		return err
+	}
+
+	noteID, err := cli.client.CreateNote(ctx, content)
+	if err != nil {
+		return cli.authenticated(err)
+	}
+
+	if cli.json {
+		return cli.printJSON(map[string]int{"noteid": noteID})
+	}
+	fmt.Fprintf(cli.env.stdout, "Created note %d\n", noteID)
+	return nil
+}
+
+func runEdit(ctx context.Context, cli *cli, args []string) error {
+	fs := commandFlags(cli, "edit")
+	message := fs.String("m", "", "new content of the note, read from stdin or edited in $EDITOR when omitted")
+	err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	noteID, err := parseNoteID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	n, err := cli.client.GetNote(ctx, noteID)
+	if err != nil {
+		return cli.authenticated(err)
+	}
+
+	content, err := cli.content(*message, n.Content)
+	if err != nil {
+		return err
+	}
+
+	if content != n.Content {
+		err = cli.client.UpdateNote(ctx, noteID, content)
+		if err != nil {
+			return cli.authenticated(err)
+		}
+	}
+
+	if cli.json {
+		return cli.printJSON(map[string]any{"noteid": noteID, "updated": content != n.Content})
+	}
+	if content == n.Content {
+		fmt.Fprintf(cli.env.stdout, "Note %d is unchanged\n", noteID)
+		return nil
+	}
+	fmt.Fprintf(cli.env.stdout, "Updated note %d\n", noteID)
+	return nil
+}
+
+func runDelete(ctx context.Context, cli *cli, args []string) error {
+	fs := commandFlags(cli, "delete")
+	err := parseFlags(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	noteIDs := make([]int, fs.NArg())
+	for i, arg := range fs.Args() {
+		noteIDs[i], err = parseNoteID(arg)
+		if err != nil {
+			return err
+		}
+	}
+
+	deleted := make([]int, 0, len(noteIDs))
+	for _, noteID := range noteIDs {
+		err = cli.client.DeleteNote(ctx, noteID)
+		if err != nil {
+			err = fmt.Errorf("cannot delete note %d: %w", noteID, cli.authenticated(err))
+			break
+		}
+		deleted = append(deleted, noteID)
+		if !cli.json {
+			fmt.Fprintf(cli.env.stdout, "Deleted note %d\n", noteID)
+		}
+	}
+
+	if cli.json {
+		if jsonErr := cli.printJSON(map[string][]int{"deleted": deleted}); err == nil {
+			err = jsonErr
+		}
+	}
+	return err
+}
+
+func runExport(ctx context.Context, cli *cli, args []string) error {
+	fs := commandFlags(cli, "export")
+	output := fs.String("o", "", "file to write the notes to instead of stdout")
+	err := parseFlags(fs, args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	notes, err := cli.allNotes(ctx)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(notes, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if *output == "" {
+		_, err = cli.env.stdout.Write(b)
+		return err
+	}
+
+	err = os.WriteFile(*output, b, 0600)
+	if err != nil {
+		return err
+	}
+	if !cli.json {
+		fmt.Fprintf(cli.env.stdout, "Exported %d notes to %s\n", len(notes), *output)
+	}
+	return nil
+}
+
+// allNotes fetches every note with a full sync, which returns their content in a single request rather than one per note
+func (cli *cli) allNotes(ctx context.Context) ([]note, error) {
+	resp, err := cli.client.Changes(ctx, "")
+	if err != nil {
+		return nil, cli.authenticated(err)
+	}
+
+	notes := make([]note, 0, len(resp.Changes))
+	for _, change := range resp.Changes {
+		if change.Deleted {
+			continue
+		}
+		notes = append(notes, note{NoteID: change.NoteID, Content: change.Content, Modified: change.Modified})
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].NoteID < notes[j].NoteID })
+
+	return notes, nil
+}
+
+// printNotes prints a line per note with its ID, when it was modified and the start of its first line
+func (cli *cli) printNotes(notes []note) error {
+	if cli.json {
+		return cli.printJSON(notes)
+	}
+
+	for _, n := range notes {
+		fmt.Fprintf(cli.env.stdout, "%d\t%s\t%s\n", n.NoteID, formatModified(n.Modified), summary(n.Content))
+	}
+	return nil
+}
+
+// content returns the content of a note from -m when it was given, from stdin when it isn't a terminal, and otherwise
+// from the user's editor, starting from the note's current content
+func (cli *cli) content(message string, current string) (string, error) {
+	var content string
+	var err error
+	switch {
+	case message != "":
+		content = message
+	case !cli.env.interactive:
+		var b []byte
+		b, err = io.ReadAll(cli.env.stdin)
+		content = string(b)
+	default:
+		content, err = cli.edit(current)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(content) == "" {
+		return "", errors.New("note is empty")
+	}
+	return content, nil
+}
+
+// edit opens $VISUAL or $EDITOR, falling back to vi, on a temporary file holding the content and returns what was saved
+func (cli *cli) edit(content string) (string, error) {
+	editor := cli.env.getenv("VISUAL")
+	if editor == "" {
+		editor = cli.env.getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	f, err := os.CreateTemp("", "note-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = cli.env.stdin, cli.env.stdout, cli.env.stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("editor %s failed: %v", args[0], err)
+	}
+
+	b, err := os.ReadFile(f.Name())
+	return string(b), err
+}
+
+func parseNoteID(s string) (int, error) {
+	noteID, err := strconv.Atoi(s)
+	if err != nil || noteID <= 0 {
+		return 0, &usageError{msg: fmt.Sprintf("invalid note ID %q", s)}
+	}
+	return noteID, nil
+}
+
+// readLine reads a line without its line ending. The last line of the input doesn't need one
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// modifiedLayout is how the server formats when a note was modified, as time.Time's String method does
+const modifiedLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// formatModified shortens when a note was modified to the minute in local time, leaving it as it is if it can't be parsed
+func formatModified(modified string) string {
+	// Drop the monotonic clock reading
+	s, _, _ := strings.Cut(modified, " m=")
+
+	t, err := time.Parse(modifiedLayout, s)
+	if err != nil {
+		return modified
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+const summaryLength = 60
+
+// summary returns the start of the first non-blank line of the content
+func summary(content string) string {
+	var line string
+	for _, l := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(l); line != "" {
+			break
+		}
+	}
+
+	runes := []rune(line)
+	if len(runes) > summaryLength {
+		return string(runes[:summaryLength-1]) + "…"
+	}
+	return line
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// credentials is what's saved between runs. The password is never saved, so the token can't be refreshed once it
+// expires and the user has to log in again
+type credentials struct {
+	Server string `json:"server"`
+	User   string `json:"user,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
+
+// credentialsFile returns where the credentials are saved: $NOTES_CREDENTIALS, or notes/credentials.json in the user's
+// config directory
+func credentialsFile(getenv func(string) string) (string, error) {
+	if path := getenv("NOTES_CREDENTIALS"); path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "notes", "credentials.json"), nil
+}
+
+// loadCredentials reads the saved credentials, which are empty when nothing has been saved yet
+func loadCredentials(path string) (credentials, error) {
+	var creds credentials
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return creds, nil
+	}
+	if err != nil {
+		return creds, err
+	}
+
+	err = json.Unmarshal(b, &creds)
+	return creds, err
+}
+
+// saveCredentials writes the credentials readable only by the user. They're written to a temporary file that's renamed
+// over the old one, so a failed write can't leave a truncated file behind
+func saveCredentials(path string, creds credentials) error {
+	b, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".credentials-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(append(b, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
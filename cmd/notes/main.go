@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+)
+
+// defaultServer is used until the user logs in to a different server
+const defaultServer = "http://localhost:8080"
+
+// env is everything the commands use from the outside world, so the tests can substitute their own
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	getenv func(string) string
+
+	// interactive reports whether stdin is a terminal the user can be prompted on, and where an editor can be opened
+	interactive  bool
+	readPassword func() (string, error)
+}
+
+// command is a subcommand of the CLI
+type command struct {
+	usage   string
+	summary string
+	run     func(ctx context.Context, cli *cli, args []string) error
+
+	// anonymous commands can be run without logging in first
+	anonymous bool
+}
+
+var commands = map[string]command{
+	"login":  {"login [-user NAME]", "log in and save the token", runLogin, true},
+	"logout": {"logout", "forget the saved token", runLogout, true},
+	"list":   {"list", "list every note", runList, false},
+	"show":   {"show ID", "print a note", runShow, false},
+	"create": {"create [-m CONTENT]", "create a note from -m, stdin or $EDITOR", runCreate, false},
+	"edit":   {"edit [-m CONTENT] ID", "replace a note from -m, stdin or $EDITOR", runEdit, false},
+	"delete": {"delete ID...", "delete notes", runDelete, false},
+	"search": {"search TEXT", "list the notes containing the text, ignoring case", runSearch, false},
+	"export": {"export [-o FILE]", "write every note as JSON to stdout or a file", runExport, false},
+}
+
+var errNotLoggedIn = errors.New("not logged in, run notes login")
+
+// errUsage is returned once the flag package has already reported a bad flag along with the usage
+var errUsage = errors.New("usage")
+
+// usageError is reported with the usage of the command, and exits with status 2
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	stdin := int(os.Stdin.Fd())
+	os.Exit(run(ctx, os.Args[1:], &env{
+		stdin:       os.Stdin,
+		stdout:      os.Stdout,
+		stderr:      os.Stderr,
+		getenv:      os.Getenv,
+		interactive: term.IsTerminal(stdin),
+		readPassword: func() (string, error) {
+			b, err := term.ReadPassword(stdin)
+			fmt.Fprintln(os.Stderr)
+			return string(b), err
+		},
+	}))
+}
+
+// run runs the command named by the arguments, returning the exit status
+func run(ctx context.Context, args []string, e *env) int {
+	fs := flag.NewFlagSet("notes", flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	server := fs.String("server", "", "URL of the notes server, defaults to the one last logged in to")
+	jsonOutput := fs.Bool("json", false, "print results as JSON")
+	credentialsPath := fs.String("credentials", "", "file the token is saved in, defaults to $NOTES_CREDENTIALS or the user config directory")
+	fs.Usage = func() { printUsage(e.stderr, fs) }
+
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		printUsage(e.stderr, fs)
+		return 2
+	}
+
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(e.stderr, "notes: unknown command %q\n", name)
+		printUsage(e.stderr, fs)
+		return 2
+	}
+
+	cli, err := newCLI(e, *credentialsPath, *server, *jsonOutput)
+	if err == nil && !cmd.anonymous && cli.creds.Token == "" {
+		err = errNotLoggedIn
+	}
+	if err == nil {
+		cli.usage = cmd.usage
+		err = cmd.run(ctx, cli, fs.Args()[1:])
+	}
+
+	var usageErr *usageError
+	switch {
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(e.stderr, "notes: %s\nusage: notes %s\n", usageErr.msg, cmd.usage)
+		return 2
+	case errors.Is(err, errUsage):
+		return 2
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case err != nil:
+		fmt.Fprintf(e.stderr, "notes: %s\n", err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+func printUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "usage: notes [flags] <command> [arguments]\n\ncommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-24s %s\n", commands[name].usage, commands[name].summary)
+	}
+
+	fmt.Fprintf(w, "\nflags:\n")
+	fs.PrintDefaults()
+}
+
+// commandFlags returns the flag set for a subcommand, which prints its usage when given a bad flag
+func commandFlags(cli *cli, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(cli.env.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(cli.env.stderr, "usage: notes %s\n", cli.usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses a subcommand's flags, checking it was given the expected number of arguments
+func parseFlags(fs *flag.FlagSet, args []string, min int, max int) error {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	if err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() < min {
+		return &usageError{msg: "missing arguments"}
+	}
+	if max >= 0 && fs.NArg() > max {
+		return &usageError{msg: "unexpected arguments: " + strings.Join(fs.Args()[max:], " ")}
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/client"
+	"github.com/kylegk/notes/config"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/router"
+	"github.com/kylegk/notes/totp"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// harness runs the CLI against an in-process server with its own credentials file
+type harness struct {
+	t           *testing.T
+	server      string
+	credentials string
+	vars        map[string]string
+}
+
+func newHarness(t *testing.T) *harness {
+	cfg := config.Default()
+	cfg.RateLimit.Enabled = false
+	_ = app.Setup(cfg)
+
+	srv := httptest.NewServer(router.NewHandler())
+	t.Cleanup(srv.Close)
+
+	_, err := client.New(srv.URL).CreateUser(context.Background(), "test.account", "correct horse")
+	if err != nil {
+		t.Fatalf("failed to create user: %s", err.Error())
+	}
+
+	return &harness{
+		t:           t,
+		server:      srv.URL,
+		credentials: filepath.Join(t.TempDir(), "notes", "credentials.json"),
+		vars:        map[string]string{},
+	}
+}
+
+// run runs the CLI with stdin as its input, returning the exit status and output
+func (h *harness) run(stdin string, interactive bool, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	e := &env{
+		stdin:        strings.NewReader(stdin),
+		stdout:       &stdout,
+		stderr:       &stderr,
+		getenv:       func(name string) string { return h.vars[name] },
+		interactive:  interactive,
+		readPassword: func() (string, error) { return "correct horse", nil },
+	}
+
+	status := run(context.Background(), append([]string{"-credentials", h.credentials}, args...), e)
+	return status, stdout.String(), stderr.String()
+}
+
+// mustRun runs the CLI non-interactively, failing the test if it doesn't succeed
+func (h *harness) mustRun(stdin string, args ...string) string {
+	status, stdout, stderr := h.run(stdin, false, args...)
+	if status != 0 {
+		h.t.Fatalf("notes %s failed with status %d: %s", strings.Join(args, " "), status, stderr)
+	}
+	return stdout
+}
+
+func TestCLI(t *testing.T) {
+	h := newHarness(t)
+
+	status, _, stderr := h.run("", false, "list")
+	if status != 1 || !strings.Contains(stderr, "notes login") {
+		t.Errorf("list before logging in should ask to log in, have: %d %q", status, stderr)
+	}
+
+	h.mustRun("test.account\ncorrect horse\n", "-server", h.server, "login")
+
+	info, err := os.Stat(h.credentials)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("credentials should be saved readable only by the user, have: %v", err)
+	}
+	b, _ := os.ReadFile(h.credentials)
+	if strings.Contains(string(b), "correct horse") {
+		t.Errorf("password should not be saved")
+	}
+
+	// Later commands use the saved server and token
+	out := h.mustRun("", "create", "-m", "Shopping list\nmilk")
+	if out != "Created note 1\n" {
+		t.Errorf("unexpected output from create, have: %q", out)
+	}
+	h.mustRun("Meeting notes\n", "create")
+
+	out = h.mustRun("", "show", "1")
+	if out != "Shopping list\nmilk\n" {
+		t.Errorf("show should print the note, have: %q", out)
+	}
+
+	out = h.mustRun("", "list")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "1\t") || !strings.HasSuffix(lines[0], "\tShopping list") ||
+		!strings.HasSuffix(lines[1], "\tMeeting notes") {
+		t.Errorf("list should print a line per note, have: %q", out)
+	}
+
+	var notes []note
+	out = h.mustRun("", "-json", "search", "MEETING")
+	err = json.Unmarshal([]byte(out), &notes)
+	if err != nil || len(notes) != 1 || notes[0].NoteID != 2 || notes[0].Content != "Meeting notes\n" {
+		t.Errorf("search should find notes ignoring case, have: %q, %v", out, err)
+	}
+
+	h.mustRun("Meeting notes\nagenda\n", "edit", "2")
+	out = h.mustRun("", "-json", "show", "2")
+	var n note
+	_ = json.Unmarshal([]byte(out), &n)
+	if n.Content != "Meeting notes\nagenda\n" {
+		t.Errorf("edit should replace the note, have: %q", out)
+	}
+
+	export := filepath.Join(t.TempDir(), "export.json")
+	h.mustRun("", "export", "-o", export)
+	b, _ = os.ReadFile(export)
+	notes = nil
+	err = json.Unmarshal(b, &notes)
+	if err != nil || len(notes) != 2 {
+		t.Errorf("export should write every note, have: %q, %v", b, err)
+	}
+
+	h.mustRun("", "delete", "1", "2")
+	out = h.mustRun("", "-json", "list")
+	if strings.TrimSpace(out) != "[]" {
+		t.Errorf("deleted notes should not be listed, have: %q", out)
+	}
+
+	h.mustRun("", "logout")
+	status, _, _ = h.run("", false, "list")
+	if status != 1 {
+		t.Errorf("list after logging out should fail, have: %d", status)
+	}
+}
+
+func TestCLIEditor(t *testing.T) {
+	h := newHarness(t)
+	h.mustRun("correct horse\n", "-server", h.server, "login", "-user", "test.account")
+
+	// The editor appends a line to whatever file it's given
+	editor := filepath.Join(t.TempDir(), "editor.sh")
+	err := os.WriteFile(editor, []byte("#!/bin/sh\necho 'written in the editor' >> \"$1\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.vars["EDITOR"] = editor
+
+	status, _, stderr := h.run("", true, "create")
+	if status != 0 {
+		t.Fatalf("create with an editor failed: %s", stderr)
+	}
+	status, _, stderr = h.run("", true, "edit", "1")
+	if status != 0 {
+		t.Fatalf("edit with an editor failed: %s", stderr)
+	}
+
+	out := h.mustRun("", "show", "1")
+	if out != "written in the editor\nwritten in the editor\n" {
+		t.Errorf("editor should start from the note's content, have: %q", out)
+	}
+
+	// Saving an empty file cancels creating the note
+	h.vars["EDITOR"] = "true"
+	status, _, stderr = h.run("", true, "create")
+	if status != 1 || !strings.Contains(stderr, "empty") {
+		t.Errorf("empty note should not be created, have: %d %q", status, stderr)
+	}
+}
+
+func TestCLITwoFactorLogin(t *testing.T) {
+	h := newHarness(t)
+	ctx := context.Background()
+	userID, _ := lib.AuthenticateUserDB(ctx, "test.account", "correct horse")
+	enrolment, _ := lib.StartTwoFactorDB(ctx, userID)
+	code, _ := totp.Code(enrolment.Secret, totp.Step(time.Now()))
+	recovery, err := lib.ConfirmTwoFactorDB(ctx, userID, code)
+	if err != nil {
+		t.Fatalf("failed to enable two-factor authentication: %s", err.Error())
+	}
+
+	// The code is read after the password
+	status, _, stderr := h.run("test.account\ncorrect horse\nnot-a-code\n", false, "-server", h.server, "login")
+	if status != 1 || !strings.Contains(stderr, "INVALID_TWO_FACTOR_CODE") {
+		t.Errorf("login with the wrong code should fail, have: %d %q", status, stderr)
+	}
+	h.mustRun("test.account\ncorrect horse\n"+recovery.RecoveryCodes[0]+"\n", "-server", h.server, "login")
+	h.mustRun("", "create", "-m", "Logged in with a recovery code")
+
+	// Interactive logins prompt for it
+	status, _, stderr = h.run(recovery.RecoveryCodes[1]+"\n", true, "login", "-user", "test.account")
+	if status != 0 || !strings.Contains(stderr, "Code: ") {
+		t.Errorf("interactive login should prompt for the code, have: %d %q", status, stderr)
+	}
+}
+
+func TestCLIUsage(t *testing.T) {
+	h := newHarness(t)
+	h.mustRun("test.account\ncorrect horse\n", "-server", h.server, "login")
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{nil, 2},
+		{[]string{"frobnicate"}, 2},
+		{[]string{"show"}, 2},
+		{[]string{"show", "abc"}, 2},
+		{[]string{"show", "1", "2"}, 2},
+		{[]string{"create", "-x"}, 2},
+		{[]string{"-h"}, 0},
+	}
+
+	for _, test := range tests {
+		status, _, _ := h.run("", false, test.args...)
+		if status != test.want {
+			t.Errorf("unexpected status for notes %v, have: %d, want: %d", test.args, status, test.want)
+		}
+	}
+}
+
+func TestFormatModified(t *testing.T) {
+	have := formatModified("2024-06-01 09:30:15.123456789 +0000 UTC m=+12.345")
+	if !strings.HasPrefix(have, "2024-06-0") || len(have) != len("2024-06-01 09:30") {
+		t.Errorf("unexpected format, have: %q", have)
+	}
+
+	if have := formatModified("yesterday"); have != "yesterday" {
+		t.Errorf("unparsable times should be left alone, have: %q", have)
+	}
+}
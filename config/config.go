@@ -0,0 +1,617 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	MemoryBackend = "memory"
+	FileBackend   = "file"
+)
+
+// DefaultTokenSecret is only suitable for local development, a warning is logged when it's used
+const DefaultTokenSecret = "THIS_IS_MY_SECRET"
+
+// EnvPrefix prefixes the environment variable for every setting, e.g. NOTES_LISTEN_ADDR for -listen-addr
+const EnvPrefix = "NOTES_"
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// Config holds every setting that can be changed without rebuilding the server
+type Config struct {
+	ListenAddr string          `yaml:"listen_addr"`
+	LogLevel   string          `yaml:"log_level"`
+	Server     ServerConfig    `yaml:"server"`
+	TLS        TLSConfig       `yaml:"tls"`
+	Auth       AuthConfig      `yaml:"auth"`
+	CORS       CORSConfig      `yaml:"cors"`
+	Storage    StorageConfig   `yaml:"storage"`
+	Limits     LimitsConfig    `yaml:"limits"`
+	Quotas     QuotaConfig     `yaml:"quotas"`
+	Metrics    MetricsConfig   `yaml:"metrics"`
+	Tracing    TracingConfig   `yaml:"tracing"`
+	RateLimit  RateLimitConfig `yaml:"rate_limit"`
+}
+
+type ServerConfig struct {
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+}
+
+// TLSConfig enables HTTPS when both a certificate and key are given
+type TLSConfig struct {
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	RedirectAddr   string        `yaml:"redirect_addr"`
+	ClientCAFile   string        `yaml:"client_ca_file"`
+	ClientAuth     string        `yaml:"client_auth"`
+}
+
+// Enabled reports whether the server should serve HTTPS
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+const (
+	ClientAuthRequire       = "require"
+	ClientAuthVerifyIfGiven = "verify_if_given"
+)
+
+type AuthConfig struct {
+	TokenSecret   string          `yaml:"token_secret"`
+	TokenLifetime time.Duration   `yaml:"token_lifetime"`
+	Sessions      SessionConfig   `yaml:"sessions"`
+	OIDC          OIDCConfig      `yaml:"oidc"`
+	TwoFactor     TwoFactorConfig `yaml:"two_factor"`
+}
+
+const (
+	SameSiteLax    = "lax"
+	SameSiteStrict = "strict"
+	SameSiteNone   = "none"
+)
+
+// SessionConfig enables browser sessions, where the token is kept in an HttpOnly cookie instead of being sent in the
+// Authorization header, and state-changing requests must carry a CSRF token
+type SessionConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Lifetime time.Duration `yaml:"lifetime"`
+	Secure   bool          `yaml:"secure"`
+	SameSite string        `yaml:"same_site"`
+	Domain   string        `yaml:"domain"`
+}
+
+// OIDCConfig lets users log in with an OpenID Connect identity provider. Users are matched by the issuer and subject of
+// their ID token, and new accounts are named by the username claim when they may be provisioned
+type OIDCConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	Issuer        string   `yaml:"issuer"`
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	RedirectURL   string   `yaml:"redirect_url"`
+	Scopes        []string `yaml:"scopes"`
+	UsernameClaim string   `yaml:"username_claim"`
+	AutoProvision bool     `yaml:"auto_provision"`
+}
+
+// TwoFactorConfig sets up two-factor authentication with authenticator apps. The issuer names the service in the user's
+// app, next to their user name
+type TwoFactorConfig struct {
+	Issuer string `yaml:"issuer"`
+}
+
+// CORSConfig lets browser front ends served from other origins call the API. Origins are given as scheme://host[:port],
+// or "*" for any origin, and CORS is disabled when none are allowed
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+type StorageConfig struct {
+	Backend       string        `yaml:"backend"`
+	Path          string        `yaml:"path"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+type LimitsConfig struct {
+	MaxBodySize       int64         `yaml:"max_body_size"`
+	MaxBulkBodySize   int64         `yaml:"max_bulk_body_size"`
+	MaxBatchSize      int           `yaml:"max_batch_size"`
+	IdempotencyWindow time.Duration `yaml:"idempotency_window"`
+}
+
+// QuotaConfig limits what each user may store, where 0 means unlimited
+type QuotaConfig struct {
+	MaxNotes      int   `yaml:"max_notes"`
+	MaxTotalBytes int64 `yaml:"max_total_bytes"`
+	MaxNoteBytes  int64 `yaml:"max_note_bytes"`
+}
+
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+const (
+	TracingNone   = "none"
+	TracingStdout = "stdout"
+	TracingOTLP   = "otlp"
+)
+
+// TracingConfig selects where OpenTelemetry spans are exported to
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter"`
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+	ServiceName string  `yaml:"service_name"`
+}
+
+// RateLimitConfig limits how often each user, or each client IP for requests without a token, may call the API. Routes
+// are named by method and path template, e.g. "POST /notes", and use the default rule unless they have their own.
+// TrustedProxies is how many proxies in front of the server add to X-Forwarded-For; the header is ignored when it's 0
+type RateLimitConfig struct {
+	Enabled        bool                     `yaml:"enabled"`
+	TrustedProxies int                      `yaml:"trusted_proxies"`
+	Default        RateLimitRule            `yaml:"default"`
+	Routes         map[string]RateLimitRule `yaml:"routes"`
+}
+
+// RateLimitRule allows bursts of up to Burst requests, refilling at Requests per Period. Burst defaults to Requests, and a
+// rule with no requests lifts the limit
+type RateLimitRule struct {
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst"`
+}
+
+// Default returns the configuration used when nothing else is specified
+func Default() *Config {
+	return &Config{
+		ListenAddr: ":8080",
+		LogLevel:   "info",
+		Server: ServerConfig{
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		TLS: TLSConfig{
+			ReloadInterval: 30 * time.Second,
+			ClientAuth:     ClientAuthRequire,
+		},
+		Auth: AuthConfig{
+			TokenSecret:   DefaultTokenSecret,
+			TokenLifetime: 15 * time.Minute,
+			Sessions: SessionConfig{
+				Lifetime: 12 * time.Hour,
+				Secure:   true,
+				SameSite: SameSiteLax,
+			},
+			OIDC: OIDCConfig{
+				Scopes:        []string{"openid", "profile", "email"},
+				UsernameClaim: "preferred_username",
+				AutoProvision: true,
+			},
+			TwoFactor: TwoFactorConfig{
+				Issuer: "Notes",
+			},
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "Idempotency-Key", "X-CSRF-Token", "X-Request-ID"},
+			ExposedHeaders: []string{"X-Request-ID", "Idempotent-Replayed", "Retry-After", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
+			MaxAge:         10 * time.Minute,
+		},
+		Storage: StorageConfig{
+			Backend:       MemoryBackend,
+			Path:          "notes.json",
+			FlushInterval: time.Second,
+		},
+		Limits: LimitsConfig{
+			MaxBodySize:       1 << 20,
+			MaxBulkBodySize:   16 << 20,
+			MaxBatchSize:      500,
+			IdempotencyWindow: 24 * time.Hour,
+		},
+		Quotas: QuotaConfig{
+			MaxNotes:      10000,
+			MaxTotalBytes: 100 << 20,
+			MaxNoteBytes:  256 << 10,
+		},
+		Metrics: MetricsConfig{
+			Enabled: true,
+		},
+		Tracing: TracingConfig{
+			Exporter:    TracingNone,
+			Endpoint:    "localhost:4318",
+			SampleRatio: 1,
+			ServiceName: "notes",
+		},
+		RateLimit: RateLimitConfig{
+			Enabled: true,
+			Default: RateLimitRule{Requests: 600, Period: time.Minute},
+			Routes: map[string]RateLimitRule{
+				"POST /users":          {Requests: 20, Period: time.Hour, Burst: 5},
+				"POST /notes":          {Requests: 120, Period: time.Minute},
+				"POST /login":          {Requests: 10, Period: time.Minute},
+				"POST /session":        {Requests: 10, Period: time.Minute},
+				"POST /login/2fa":      {Requests: 5, Period: time.Minute},
+				"POST /session/2fa":    {Requests: 5, Period: time.Minute},
+				"GET /users/me/export": {Requests: 10, Period: time.Hour},
+				"GET /oidc/login":      {Requests: 30, Period: time.Minute},
+				"POST /oidc/login":     {Requests: 30, Period: time.Minute},
+			},
+		},
+	}
+}
+
+// bind registers a flag for every setting, writing into the configuration
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen-addr", c.ListenAddr, "address to listen for HTTP requests on")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level to log: "+strings.Join(logLevels, ", "))
+	fs.DurationVar(&c.Server.ReadTimeout, "read-timeout", c.Server.ReadTimeout, "maximum time to read a request, including the body")
+	fs.DurationVar(&c.Server.ReadHeaderTimeout, "read-header-timeout", c.Server.ReadHeaderTimeout, "maximum time to read the request headers")
+	fs.DurationVar(&c.Server.WriteTimeout, "write-timeout", c.Server.WriteTimeout, "maximum time to write a response")
+	fs.DurationVar(&c.Server.IdleTimeout, "idle-timeout", c.Server.IdleTimeout, "how long idle keep-alive connections are kept open")
+	fs.DurationVar(&c.Server.ShutdownTimeout, "shutdown-timeout", c.Server.ShutdownTimeout, "how long to wait for in-flight requests and background jobs when shutting down")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert-file", c.TLS.CertFile, "PEM certificate chain, serves HTTPS when set with -tls-key-file")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key-file", c.TLS.KeyFile, "PEM private key for the certificate")
+	fs.DurationVar(&c.TLS.ReloadInterval, "tls-reload-interval", c.TLS.ReloadInterval, "how often the certificate and key files are checked for changes")
+	fs.StringVar(&c.TLS.RedirectAddr, "tls-redirect-addr", c.TLS.RedirectAddr, "address of an optional plain HTTP listener that redirects to HTTPS")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca-file", c.TLS.ClientCAFile, "PEM CA bundle used to verify client certificates, enables mutual TLS when set")
+	fs.StringVar(&c.TLS.ClientAuth, "tls-client-auth", c.TLS.ClientAuth, "whether client certificates are required with mutual TLS: require or verify_if_given")
+	fs.StringVar(&c.Auth.TokenSecret, "token-secret", c.Auth.TokenSecret, "secret used to sign and validate tokens")
+	fs.DurationVar(&c.Auth.TokenLifetime, "token-lifetime", c.Auth.TokenLifetime, "how long issued tokens remain valid")
+	fs.BoolVar(&c.Auth.Sessions.Enabled, "sessions-enabled", c.Auth.Sessions.Enabled, "allow browsers to log in with a session cookie instead of a bearer token")
+	fs.DurationVar(&c.Auth.Sessions.Lifetime, "session-lifetime", c.Auth.Sessions.Lifetime, "how long browser sessions last")
+	fs.BoolVar(&c.Auth.Sessions.Secure, "session-cookie-secure", c.Auth.Sessions.Secure, "only send session cookies over HTTPS")
+	fs.StringVar(&c.Auth.Sessions.SameSite, "session-cookie-same-site", c.Auth.Sessions.SameSite, "SameSite attribute of session cookies: lax, strict or none")
+	fs.StringVar(&c.Auth.Sessions.Domain, "session-cookie-domain", c.Auth.Sessions.Domain, "domain session cookies are sent to, defaults to the server's host")
+	fs.BoolVar(&c.Auth.OIDC.Enabled, "oidc-enabled", c.Auth.OIDC.Enabled, "allow users to log in with an OpenID Connect identity provider")
+	fs.StringVar(&c.Auth.OIDC.Issuer, "oidc-issuer", c.Auth.OIDC.Issuer, "issuer URL of the OpenID Connect identity provider")
+	fs.StringVar(&c.Auth.OIDC.ClientID, "oidc-client-id", c.Auth.OIDC.ClientID, "client ID the server is registered with at the identity provider")
+	fs.StringVar(&c.Auth.OIDC.ClientSecret, "oidc-client-secret", c.Auth.OIDC.ClientSecret, "client secret, if the identity provider issued one")
+	fs.StringVar(&c.Auth.OIDC.RedirectURL, "oidc-redirect-url", c.Auth.OIDC.RedirectURL, "URL of the server's /oidc/callback route, as registered with the identity provider")
+	fs.Var((*stringList)(&c.Auth.OIDC.Scopes), "oidc-scopes", "comma-separated scopes requested from the identity provider, including openid")
+	fs.StringVar(&c.Auth.OIDC.UsernameClaim, "oidc-username-claim", c.Auth.OIDC.UsernameClaim, "ID token claim new accounts are named by")
+	fs.BoolVar(&c.Auth.OIDC.AutoProvision, "oidc-auto-provision", c.Auth.OIDC.AutoProvision, "create accounts for identity provider users who don't have one yet")
+	fs.StringVar(&c.Auth.TwoFactor.Issuer, "two-factor-issuer", c.Auth.TwoFactor.Issuer, "name of the service shown in users' authenticator apps")
+	fs.Var((*stringList)(&c.CORS.AllowedOrigins), "cors-allowed-origins", "comma-separated origins allowed to call the API from a browser, or * for any")
+	fs.BoolVar(&c.CORS.AllowCredentials, "cors-allow-credentials", c.CORS.AllowCredentials, "allow cross-origin requests to send cookies, needed by browser sessions")
+	fs.DurationVar(&c.CORS.MaxAge, "cors-max-age", c.CORS.MaxAge, "how long browsers may cache the response to a preflight request")
+	fs.StringVar(&c.Storage.Backend, "storage-backend", c.Storage.Backend, "where data is stored: memory or file")
+	fs.StringVar(&c.Storage.Path, "storage-path", c.Storage.Path, "file used by the file storage backend")
+	fs.DurationVar(&c.Storage.FlushInterval, "storage-flush-interval", c.Storage.FlushInterval, "how often changes are written by the file storage backend")
+	fs.Int64Var(&c.Limits.MaxBodySize, "max-body-size", c.Limits.MaxBodySize, "maximum size of a request body in bytes")
+	fs.Int64Var(&c.Limits.MaxBulkBodySize, "max-bulk-body-size", c.Limits.MaxBulkBodySize, "maximum size of a batch or sync request body in bytes")
+	fs.IntVar(&c.Limits.MaxBatchSize, "max-batch-size", c.Limits.MaxBatchSize, "maximum number of operations in a batch or sync request")
+	fs.DurationVar(&c.Limits.IdempotencyWindow, "idempotency-window", c.Limits.IdempotencyWindow, "how long responses are kept for idempotent replay")
+	fs.IntVar(&c.Quotas.MaxNotes, "quota-max-notes", c.Quotas.MaxNotes, "maximum number of notes per user, 0 for no limit")
+	fs.Int64Var(&c.Quotas.MaxTotalBytes, "quota-max-total-bytes", c.Quotas.MaxTotalBytes, "maximum total size of a user's notes in bytes, 0 for no limit")
+	fs.Int64Var(&c.Quotas.MaxNoteBytes, "quota-max-note-bytes", c.Quotas.MaxNoteBytes, "maximum size of a single note in bytes, 0 for no limit")
+	fs.BoolVar(&c.Metrics.Enabled, "metrics-enabled", c.Metrics.Enabled, "serve Prometheus metrics at /metrics")
+	fs.StringVar(&c.Tracing.Exporter, "tracing-exporter", c.Tracing.Exporter, "where traces are sent: none, stdout or otlp")
+	fs.StringVar(&c.Tracing.Endpoint, "tracing-endpoint", c.Tracing.Endpoint, "host:port of the OTLP/HTTP collector")
+	fs.BoolVar(&c.Tracing.Insecure, "tracing-insecure", c.Tracing.Insecure, "send traces to the collector over plain HTTP")
+	fs.Float64Var(&c.Tracing.SampleRatio, "tracing-sample-ratio", c.Tracing.SampleRatio, "fraction of new traces to sample, between 0 and 1")
+	fs.StringVar(&c.Tracing.ServiceName, "tracing-service-name", c.Tracing.ServiceName, "service name reported with every span")
+	fs.BoolVar(&c.RateLimit.Enabled, "rate-limit-enabled", c.RateLimit.Enabled, "limit how often each user or client IP may call the API")
+	fs.IntVar(&c.RateLimit.TrustedProxies, "rate-limit-trusted-proxies", c.RateLimit.TrustedProxies, "number of proxies in front of the server that add to X-Forwarded-For, which is ignored when 0")
+	fs.IntVar(&c.RateLimit.Default.Requests, "rate-limit-requests", c.RateLimit.Default.Requests, "requests allowed per period on routes without their own limit, 0 for no limit")
+	fs.DurationVar(&c.RateLimit.Default.Period, "rate-limit-period", c.RateLimit.Default.Period, "period over which the default number of requests is allowed")
+	fs.IntVar(&c.RateLimit.Default.Burst, "rate-limit-burst", c.RateLimit.Default.Burst, "requests allowed at once on routes without their own limit, defaults to the number of requests")
+}
+
+// Load builds the configuration from, in increasing order of precedence, the defaults, a YAML file named by -config or
+// NOTES_CONFIG, environment variables and command-line flags. The result is validated before it's returned
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("notes", flag.ContinueOnError)
+	c, err := Parse(fs, args, getenv)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	return c, nil
+}
+
+// Parse is Load for commands with flags and arguments of their own. Flags registered on fs beforehand are parsed along
+// with the settings, and the arguments that follow the flags are left in fs.Args()
+func Parse(fs *flag.FlagSet, args []string, getenv func(string) string) (*Config, error) {
+	c := Default()
+
+	// The command's own flags aren't settings, so they aren't read from the environment
+	own := map[string]bool{}
+	fs.VisitAll(func(f *flag.Flag) {
+		own[f.Name] = true
+	})
+
+	configPath := fs.String("config", getenv(EnvPrefix+"CONFIG"), "path to a YAML configuration file")
+	c.bind(fs)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remember the flags that were given, then rebuild the configuration in order of precedence
+	given := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+	*c = *Default()
+
+	if *configPath != "" {
+		err = c.loadFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		env := EnvName(f.Name)
+		value := getenv(env)
+		if err != nil || f.Name == "config" || own[f.Name] || value == "" {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, env, setErr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range given {
+		if name == "config" || own[name] {
+			continue
+		}
+		err = fs.Lookup(name).Value.Set(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// EnvName returns the environment variable used for the flag
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %v", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("cannot parse config file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		invalid("listen_addr %q must be in the form host:port", c.ListenAddr)
+	}
+	if !contains(logLevels, c.LogLevel) {
+		invalid("log_level %q must be one of: %s", c.LogLevel, strings.Join(logLevels, ", "))
+	}
+	if c.Server.ReadTimeout <= 0 || c.Server.ReadHeaderTimeout <= 0 || c.Server.WriteTimeout <= 0 || c.Server.IdleTimeout <= 0 {
+		invalid("server timeouts must be positive")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		invalid("server.shutdown_timeout must be positive")
+	}
+	if c.TLS.Enabled() {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			invalid("tls.cert_file and tls.key_file must be set together")
+		}
+		if c.TLS.ReloadInterval <= 0 {
+			invalid("tls.reload_interval must be positive")
+		}
+		if c.TLS.RedirectAddr != "" {
+			if _, _, err := net.SplitHostPort(c.TLS.RedirectAddr); err != nil {
+				invalid("tls.redirect_addr %q must be in the form host:port", c.TLS.RedirectAddr)
+			}
+		}
+		if c.TLS.ClientAuth != ClientAuthRequire && c.TLS.ClientAuth != ClientAuthVerifyIfGiven {
+			invalid("tls.client_auth %q must be %s or %s", c.TLS.ClientAuth, ClientAuthRequire, ClientAuthVerifyIfGiven)
+		}
+	} else if c.TLS.RedirectAddr != "" || c.TLS.ClientCAFile != "" {
+		invalid("tls.redirect_addr and tls.client_ca_file require tls.cert_file and tls.key_file")
+	}
+	if c.Auth.TokenSecret == "" {
+		invalid("auth.token_secret must not be empty")
+	}
+	if c.Auth.TokenLifetime <= 0 {
+		invalid("auth.token_lifetime must be positive")
+	}
+	if c.Auth.Sessions.Enabled {
+		if c.Auth.Sessions.Lifetime <= 0 {
+			invalid("auth.sessions.lifetime must be positive")
+		}
+		switch c.Auth.Sessions.SameSite {
+		case SameSiteLax, SameSiteStrict:
+		case SameSiteNone:
+			if !c.Auth.Sessions.Secure {
+				invalid("auth.sessions.same_site %s requires auth.sessions.secure", SameSiteNone)
+			}
+		default:
+			invalid("auth.sessions.same_site %q must be %s, %s or %s", c.Auth.Sessions.SameSite, SameSiteLax, SameSiteStrict, SameSiteNone)
+		}
+	}
+	if c.Auth.OIDC.Enabled {
+		oidc := c.Auth.OIDC
+		if u, err := url.Parse(oidc.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			invalid("auth.oidc.issuer %q must be an http or https URL", oidc.Issuer)
+		}
+		if oidc.ClientID == "" {
+			invalid("auth.oidc.client_id must not be empty")
+		}
+		if u, err := url.Parse(oidc.RedirectURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			invalid("auth.oidc.redirect_url %q must be an http or https URL", oidc.RedirectURL)
+		}
+		if !contains(oidc.Scopes, "openid") {
+			invalid("auth.oidc.scopes must include openid")
+		}
+		if oidc.UsernameClaim == "" {
+			invalid("auth.oidc.username_claim must not be empty")
+		}
+	}
+	if c.Auth.TwoFactor.Issuer == "" || strings.Contains(c.Auth.TwoFactor.Issuer, ":") {
+		invalid("auth.two_factor.issuer %q must not be empty or contain a colon", c.Auth.TwoFactor.Issuer)
+	}
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			if c.CORS.AllowCredentials {
+				invalid("cors.allowed_origins must list origins explicitly when cors.allow_credentials is set")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			invalid("cors.allowed_origins entry %q must be in the form scheme://host[:port]", origin)
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		invalid("cors.max_age must not be negative")
+	}
+	switch c.Storage.Backend {
+	case MemoryBackend:
+	case FileBackend:
+		if c.Storage.Path == "" {
+			invalid("storage.path is required by the file backend")
+		}
+		if c.Storage.FlushInterval <= 0 {
+			invalid("storage.flush_interval must be positive")
+		}
+	default:
+		invalid("storage.backend %q must be %s or %s", c.Storage.Backend, MemoryBackend, FileBackend)
+	}
+	if c.Limits.MaxBodySize <= 0 {
+		invalid("limits.max_body_size must be positive")
+	}
+	if c.Limits.MaxBulkBodySize < c.Limits.MaxBodySize {
+		invalid("limits.max_bulk_body_size must be at least limits.max_body_size")
+	}
+	if c.Limits.MaxBatchSize <= 0 {
+		invalid("limits.max_batch_size must be positive")
+	}
+	if c.Limits.IdempotencyWindow <= 0 {
+		invalid("limits.idempotency_window must be positive")
+	}
+	if c.Quotas.MaxNotes < 0 || c.Quotas.MaxTotalBytes < 0 || c.Quotas.MaxNoteBytes < 0 {
+		invalid("quotas must not be negative")
+	}
+	switch c.Tracing.Exporter {
+	case TracingNone, TracingStdout:
+	case TracingOTLP:
+		if c.Tracing.Endpoint == "" {
+			invalid("tracing.endpoint is required by the otlp exporter")
+		}
+	default:
+		invalid("tracing.exporter %q must be %s, %s or %s", c.Tracing.Exporter, TracingNone, TracingStdout, TracingOTLP)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		invalid("tracing.sample_ratio must be between 0 and 1")
+	}
+	if c.Tracing.Exporter != TracingNone && c.Tracing.ServiceName == "" {
+		invalid("tracing.service_name must not be empty")
+	}
+	if c.RateLimit.Enabled {
+		if c.RateLimit.TrustedProxies < 0 {
+			invalid("rate_limit.trusted_proxies must not be negative")
+		}
+		validateRateLimitRule("rate_limit.default", c.RateLimit.Default, invalid)
+		for route, rule := range c.RateLimit.Routes {
+			method, path, ok := strings.Cut(route, " ")
+			if !ok || method == "" || method != strings.ToUpper(method) || !strings.HasPrefix(path, "/") {
+				invalid("rate_limit.routes key %q must be a method and path template, e.g. \"POST /notes\"", route)
+			}
+			validateRateLimitRule(fmt.Sprintf("rate_limit.routes[%q]", route), rule, invalid)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+func validateRateLimitRule(name string, rule RateLimitRule, invalid func(format string, args ...interface{})) {
+	if rule.Requests < 0 || rule.Burst < 0 {
+		invalid("%s.requests and %s.burst must not be negative", name, name)
+	}
+	if rule.Requests > 0 && rule.Period <= 0 {
+		invalid("%s.period must be positive", name)
+	}
+}
+
+// stringList is a flag holding a comma-separated list
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatalf("failed to load defaults: %s", err.Error())
+	}
+	if c.ListenAddr != ":8080" || c.Storage.Backend != MemoryBackend {
+		t.Errorf("unexpected defaults: %+v", c)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "config")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notes.yaml")
+	file := `
+listen_addr: ":9000"
+log_level: debug
+auth:
+  token_lifetime: 1h
+storage:
+  backend: file
+  path: /var/lib/notes.json
+`
+	_ = os.WriteFile(path, []byte(file), 0600)
+
+	// The file overrides the defaults, the environment overrides the file and flags override everything
+	c, err := Load(
+		[]string{"-config", path, "-listen-addr", ":9002"},
+		env(map[string]string{"NOTES_LISTEN_ADDR": ":9001", "NOTES_LOG_LEVEL": "warn"}),
+	)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err.Error())
+	}
+
+	if c.ListenAddr != ":9002" {
+		t.Errorf("flag should take precedence, have: %v", c.ListenAddr)
+	}
+	if c.LogLevel != "warn" {
+		t.Errorf("environment should take precedence over the file, have: %v", c.LogLevel)
+	}
+	if c.Auth.TokenLifetime != time.Hour || c.Storage.Backend != FileBackend {
+		t.Errorf("file values should have been loaded, have: %+v", c)
+	}
+	if c.Limits.MaxBatchSize != Default().Limits.MaxBatchSize {
+		t.Errorf("unset values should keep their default, have: %v", c.Limits.MaxBatchSize)
+	}
+
+	// Lists are given as comma-separated values
+	c, err = Load(nil, env(map[string]string{"NOTES_CORS_ALLOWED_ORIGINS": "https://app.example.com, http://localhost:3000"}))
+	if err != nil || len(c.CORS.AllowedOrigins) != 2 || c.CORS.AllowedOrigins[1] != "http://localhost:3000" {
+		t.Errorf("allowed origins should have been split, have: %v, %v", c.CORS.AllowedOrigins, err)
+	}
+
+	// The config file can also be named in the environment
+	c, err = Load(nil, env(map[string]string{"NOTES_CONFIG": path}))
+	if err != nil || c.ListenAddr != ":9000" {
+		t.Errorf("config file from the environment should have been loaded")
+	}
+}
+
+func TestParseCommandFlags(t *testing.T) {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	replace := fs.Bool("replace", false, "")
+
+	// The command's own flags are parsed with the settings, but aren't read from the environment
+	c, err := Parse(fs, []string{"-replace", "-storage-backend", "file", "snapshot.json"}, env(map[string]string{
+		"NOTES_REPLACE":      "false",
+		"NOTES_STORAGE_PATH": "/var/lib/notes.json",
+	}))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err.Error())
+	}
+	if !*replace || c.Storage.Backend != FileBackend || c.Storage.Path != "/var/lib/notes.json" {
+		t.Errorf("unexpected flags, have: %v %+v", *replace, c.Storage)
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "snapshot.json" {
+		t.Errorf("arguments should be left for the command, have: %v", fs.Args())
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "config")
+	defer os.RemoveAll(dir)
+
+	// Unknown keys in the file are reported
+	path := filepath.Join(dir, "notes.yaml")
+	_ = os.WriteFile(path, []byte("listen_address: \":9000\"\n"), 0600)
+	_, err := Load([]string{"-config", path}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "listen_address") {
+		t.Errorf("unknown key should have been reported, have: %v", err)
+	}
+
+	// Malformed environment variables name the variable
+	_, err = Load(nil, env(map[string]string{"NOTES_TOKEN_LIFETIME": "forever"}))
+	if err == nil || !strings.Contains(err.Error(), "NOTES_TOKEN_LIFETIME") {
+		t.Errorf("invalid environment variable should have been reported, have: %v", err)
+	}
+
+	// TLS options that depend on a certificate are rejected without one
+	_, err = Load([]string{"-tls-redirect-addr", ":80"}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "tls.redirect_addr") {
+		t.Errorf("redirect without a certificate should have been rejected, have: %v", err)
+	}
+	_, err = Load([]string{"-tls-cert-file", "server.crt"}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "tls.key_file") {
+		t.Errorf("certificate without a key should have been rejected, have: %v", err)
+	}
+
+	// Tracing settings are checked
+	_, err = Load([]string{"-tracing-exporter", "jaeger", "-tracing-sample-ratio", "2"}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "tracing.exporter") || !strings.Contains(err.Error(), "tracing.sample_ratio") {
+		t.Errorf("invalid tracing settings should have been rejected, have: %v", err)
+	}
+
+	// Rate limited routes must name a method and path
+	path = filepath.Join(dir, "ratelimit.yaml")
+	_ = os.WriteFile(path, []byte("rate_limit:\n  routes:\n    /notes: {requests: 10, period: 1m}\n    GET /sync: {requests: 10}\n"), 0600)
+	_, err = Load([]string{"-config", path}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), `key "/notes"`) || !strings.Contains(err.Error(), `rate_limit.routes["GET /sync"].period`) {
+		t.Errorf("invalid rate limit rules should have been rejected, have: %v", err)
+	}
+
+	// Session cookies and CORS must be configured consistently
+	_, err = Load([]string{"-sessions-enabled", "-session-cookie-same-site", "none", "-session-cookie-secure=false", "-cors-allowed-origins", "*,example.com", "-cors-allow-credentials"}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "auth.sessions.same_site none") || !strings.Contains(err.Error(), "explicitly") || !strings.Contains(err.Error(), `"example.com"`) {
+		t.Errorf("inconsistent session and CORS settings should have been rejected, have: %v", err)
+	}
+
+	// The identity provider must be named, and the server registered with it
+	_, err = Load([]string{"-oidc-enabled", "-oidc-issuer", "idp.example.com", "-oidc-scopes", "profile,email"}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "auth.oidc.issuer") || !strings.Contains(err.Error(), "auth.oidc.client_id") || !strings.Contains(err.Error(), "auth.oidc.redirect_url") || !strings.Contains(err.Error(), "openid") {
+		t.Errorf("incomplete identity provider settings should have been rejected, have: %v", err)
+	}
+
+	// Colons separate the issuer from the user name in authenticator apps
+	_, err = Load([]string{"-two-factor-issuer", "Notes: Work"}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "auth.two_factor.issuer") {
+		t.Errorf("issuer with a colon should have been rejected, have: %v", err)
+	}
+
+	// Every invalid setting is reported at once
+	_, err = Load([]string{"-log-level", "loud", "-storage-backend", "s3", "-max-batch-size", "0"}, env(nil))
+	if err == nil {
+		t.Fatalf("invalid configuration should have been rejected")
+	}
+	for _, want := range []string{"log_level", "storage.backend", "limits.max_batch_size"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %s, have: %v", want, err)
+		}
+	}
+}
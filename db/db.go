@@ -1,11 +1,18 @@
 package db
 
 import (
+	"context"
 	"github.com/hashicorp/go-memdb"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
 )
 
 type DB struct {
 	Conn *memdb.MemDB
+	file *fileStore
 }
 
 // InitDB initializes the database connect
@@ -19,14 +26,20 @@ func InitDB(schema *memdb.DBSchema) (DB, error) {
 		panic(err)
 	}
 
-	return DB{conn}, nil
+	// A new database starts its id sequences from scratch
+	resetIncrementers()
+
+	return DB{Conn: conn}, nil
 }
 
 // Query queries the data store
-func (d *DB) Query(table string, idx string, args ...interface{}) ([]interface{}, error) {
+func (d *DB) Query(ctx context.Context, table string, idx string, args ...interface{}) (_ []interface{}, err error) {
 	if d.Conn == nil {
 		panic("database is not initialized")
 	}
+	_, span := startSpan(ctx, "query", table)
+	defer tracing.End(span, &err)
+	defer observe("query", table, time.Now())
 
 	txn := d.Conn.Txn(false)
 
@@ -44,29 +57,36 @@ func (d *DB) Query(table string, idx string, args ...interface{}) ([]interface{}
 }
 
 // Upsert inserts or replaces existing data in the data store
-func (d *DB) Upsert(table string, record interface{}) error {
+func (d *DB) Upsert(ctx context.Context, table string, record interface{}) (err error) {
 	if d.Conn == nil {
 		panic("database is not initialized")
 	}
+	_, span := startSpan(ctx, "upsert", table)
+	defer tracing.End(span, &err)
+	defer observe("upsert", table, time.Now())
 
 	txn := d.Conn.Txn(true)
 	defer txn.Abort()
 
-	err := txn.Insert(table, record)
+	err = txn.Insert(table, record)
 	if err != nil {
 		return err
 	}
 
 	txn.Commit()
+	d.markDirty()
 
 	return nil
 }
 
 // Delete deletes rows in the data store
-func (d *DB) Delete(table string, idx string, args ...interface{}) (int, error) {
+func (d *DB) Delete(ctx context.Context, table string, idx string, args ...interface{}) (_ int, err error) {
 	if d.Conn == nil {
 		panic("database is not initialized")
 	}
+	_, span := startSpan(ctx, "delete", table)
+	defer tracing.End(span, &err)
+	defer observe("delete", table, time.Now())
 
 	txn := d.Conn.Txn(true)
 	defer txn.Abort()
@@ -77,6 +97,133 @@ func (d *DB) Delete(table string, idx string, args ...interface{}) (int, error)
 	}
 
 	txn.Commit()
+	d.markDirty()
 
 	return count, nil
-}
\ No newline at end of file
+}
+
+// Store is the set of operations shared by DB and Txn, allowing data access code to run inside or outside a transaction
+type Store interface {
+	Query(ctx context.Context, table string, idx string, args ...interface{}) ([]interface{}, error)
+	Upsert(ctx context.Context, table string, record interface{}) error
+	Delete(ctx context.Context, table string, idx string, args ...interface{}) (int, error)
+}
+
+// Txn wraps a go-memdb transaction so several operations can be applied atomically
+type Txn struct {
+	txn *memdb.Txn
+}
+
+// View runs fn inside a read-only transaction, giving it a consistent snapshot of the data store. The context passed to fn
+// carries the transaction's span
+func (d *DB) View(ctx context.Context, fn func(ctx context.Context, txn *Txn) error) (err error) {
+	if d.Conn == nil {
+		panic("database is not initialized")
+	}
+	ctx, span := startSpan(ctx, "view", "")
+	defer tracing.End(span, &err)
+	defer observe("view", "", time.Now())
+
+	txn := d.Conn.Txn(false)
+	defer txn.Abort()
+
+	return fn(ctx, &Txn{txn})
+}
+
+// Update runs fn inside a write transaction, committing only if fn returns without error. The context passed to fn carries
+// the transaction's span
+func (d *DB) Update(ctx context.Context, fn func(ctx context.Context, txn *Txn) error) (err error) {
+	if d.Conn == nil {
+		panic("database is not initialized")
+	}
+	ctx, span := startSpan(ctx, "update", "")
+	defer tracing.End(span, &err)
+	defer observe("update", "", time.Now())
+
+	txn := d.Conn.Txn(true)
+	defer txn.Abort()
+
+	err = fn(ctx, &Txn{txn})
+	if err != nil {
+		return err
+	}
+
+	txn.Commit()
+	d.markDirty()
+
+	return nil
+}
+
+// Query queries the data store within the transaction
+func (t *Txn) Query(ctx context.Context, table string, idx string, args ...interface{}) (_ []interface{}, err error) {
+	_, span := startSpan(ctx, "query", table)
+	defer tracing.End(span, &err)
+
+	it, err := t.txn.Get(table, idx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]interface{}, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// Upsert inserts or replaces existing data within the transaction
+func (t *Txn) Upsert(ctx context.Context, table string, record interface{}) (err error) {
+	_, span := startSpan(ctx, "upsert", table)
+	defer tracing.End(span, &err)
+
+	return t.txn.Insert(table, record)
+}
+
+// Delete deletes rows within the transaction
+func (t *Txn) Delete(ctx context.Context, table string, idx string, args ...interface{}) (_ int, err error) {
+	_, span := startSpan(ctx, "delete", table)
+	defer tracing.End(span, &err)
+
+	return t.txn.DeleteAll(table, idx, args...)
+}
+
+// RowCounts counts the rows in every table
+func (d *DB) RowCounts() (map[string]int, error) {
+	txn := d.Conn.Txn(false)
+	defer txn.Abort()
+
+	counts := make(map[string]int, len(Schema.Tables))
+	for table := range Schema.Tables {
+		it, err := txn.Get(table, IDIdx)
+		if err != nil {
+			return nil, err
+		}
+
+		count := 0
+		for obj := it.Next(); obj != nil; obj = it.Next() {
+			count++
+		}
+		counts[table] = count
+	}
+
+	return counts, nil
+}
+
+// observe records how long a data store operation took. Transactions span several tables, so they're recorded without one
+func observe(operation string, table string, start time.Time) {
+	metrics.DBOperationDuration.WithLabelValues(operation, table).Observe(time.Since(start).Seconds())
+}
+
+// startSpan starts a span for a data store operation. Transactions span several tables, so they're traced without one
+func startSpan(ctx context.Context, operation string, table string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "memdb"),
+		attribute.String("db.operation.name", operation),
+	}
+	if table != "" {
+		attrs = append(attrs, attribute.String("db.collection.name", table))
+	}
+
+	return tracing.Start(ctx, "db."+operation, attrs...)
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"github.com/hashicorp/go-memdb"
 	"github.com/kylegk/notes/model"
@@ -27,19 +28,19 @@ func TestDB_Query(t *testing.T) {
 	}
 
 	// Test invalid table name
-	_, err = db.Query("invalid_table", "id_idx")
+	_, err = db.Query(context.Background(), "invalid_table", "id_idx")
 	if err == nil {
 		t.Errorf("invalid table query should have failed")
 	}
 
 	// Test valid table, invalid index
-	_, err = db.Query(NotesTable, "invalid_index")
+	_, err = db.Query(context.Background(), NotesTable, "invalid_index")
 	if err == nil {
 		t.Errorf("invalid index query should have failed")
 	}
 
 	// Test valid table, valid index
-	_, err = db.Query(NotesTable, IDIdx)
+	_, err = db.Query(context.Background(), NotesTable, IDIdx)
 	if err != nil {
 		t.Errorf("valid table and index")
 	}
@@ -54,19 +55,19 @@ func TestDB_Upsert(t *testing.T) {
 	note := model.Note{NoteID: 1, Content: "test note"}
 
 	// Test invalid table name
-	err = db.Upsert("invalid_table", note)
+	err = db.Upsert(context.Background(), "invalid_table", note)
 	if err == nil {
 		t.Errorf("upsert should have failed with an invalid table name")
 	}
 
 	// Test invalid insert interface type
-	err = db.Upsert(UserNotesTable, note)
+	err = db.Upsert(context.Background(), UserNotesTable, note)
 	if err == nil {
 		t.Errorf("upsert should have failed with an invalid interface type")
 	}
 
 	// Insert valid data
-	err = db.Upsert(NotesTable, note)
+	err = db.Upsert(context.Background(), NotesTable, note)
 	if err != nil {
 		t.Errorf("upsert should have succeeded")
 	}
@@ -82,20 +83,20 @@ func TestDB_Delete(t *testing.T) {
 	notes := []int{1,2,3,4,5}
 	for _, noteID := range notes {
 		note := model.Note{NoteID: noteID, Content: "test note"}
-		err = db.Upsert(NotesTable, note)
+		err = db.Upsert(context.Background(), NotesTable, note)
 		if err != nil {
 			t.Errorf("failed to insert data")
 		}
 	}
 
 	// Try to delete invalid table name
-	_, err = db.Delete("invalid_table", "invalid_idx")
+	_, err = db.Delete(context.Background(), "invalid_table", "invalid_idx")
 	if err == nil {
 		t.Errorf("delete should have failed on invalid table")
 	}
 
 	// Delete record
-	have, err := db.Delete(NotesTable, IDIdx, 1)
+	have, err := db.Delete(context.Background(), NotesTable, IDIdx, 1)
 	if err != nil {
 		t.Errorf("failed to delete note: %s", err.Error())
 	}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// CheckWritable verifies the data store is initialized and that a write transaction can be started before ctx is done
+func (d *DB) CheckWritable(ctx context.Context) error {
+	if d.Conn == nil {
+		return errors.New("data store is not initialized")
+	}
+
+	// go-memdb only allows one writer at a time, so this blocks for as long as another write is in progress
+	acquired := make(chan struct{})
+	go func() {
+		txn := d.Conn.Txn(true)
+		txn.Abort()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out waiting to write to the data store")
+	}
+}
+
+// CheckFlushed verifies the most recent flush succeeded and that no change has waited longer than maxLag to be written.
+// It always succeeds for an in-memory database
+func (d *DB) CheckFlushed(maxLag time.Duration) error {
+	if d.file == nil {
+		return nil
+	}
+
+	d.file.mu.Lock()
+	err := d.file.flushErr
+	d.file.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("last flush failed: %v", err)
+	}
+
+	since := atomic.LoadInt64(&d.file.dirtySince)
+	if since != 0 {
+		lag := time.Since(time.Unix(0, since))
+		if lag > maxLag {
+			return fmt.Errorf("changes have been waiting %s to be flushed", lag.Round(time.Millisecond))
+		}
+	}
+
+	return nil
+}
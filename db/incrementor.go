@@ -1,22 +1,60 @@
 package db
 
+import "sync"
+
+var incrementerMu sync.Mutex
 var noteIDIncrementer int
 var userIDIncrementer int
+var changeSeqIncrementer int
+
+func resetIncrementers() {
+	setIncrementers(0, 0, 0)
+}
+
+func setIncrementers(noteID int, userID int, changeSeq int) {
+	incrementerMu.Lock()
+	defer incrementerMu.Unlock()
+	noteIDIncrementer = noteID
+	userIDIncrementer = userID
+	changeSeqIncrementer = changeSeq
+}
 
 func GetCurrentNoteID() int {
+	incrementerMu.Lock()
+	defer incrementerMu.Unlock()
 	return noteIDIncrementer
 }
 
 func IncrementNoteID() int {
+	incrementerMu.Lock()
+	defer incrementerMu.Unlock()
 	noteIDIncrementer++
 	return noteIDIncrementer
 }
 
 func GetCurrentUserID() int {
+	incrementerMu.Lock()
+	defer incrementerMu.Unlock()
 	return userIDIncrementer
 }
 
 func IncrementUserID() int {
+	incrementerMu.Lock()
+	defer incrementerMu.Unlock()
 	userIDIncrementer++
 	return userIDIncrementer
-}
\ No newline at end of file
+}
+
+func GetCurrentChangeSeq() int {
+	incrementerMu.Lock()
+	defer incrementerMu.Unlock()
+	return changeSeqIncrementer
+}
+
+// IncrementChangeSeq must only be called inside a write transaction, which keeps changes committed in sequence order
+func IncrementChangeSeq() int {
+	incrementerMu.Lock()
+	defer incrementerMu.Unlock()
+	changeSeqIncrementer++
+	return changeSeqIncrementer
+}
@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package db
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile reports that files can't be locked on this platform, so the file backend isn't used without a lock
+func lockFile(f *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package db
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// lockFile takes an exclusive lock on the open file without waiting, returning ErrLocked if another process holds it
+func lockFile(f *os.File) error {
+	var overlapped windows.Overlapped
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return ErrLocked
+	}
+	return err
+}
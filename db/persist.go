@@ -0,0 +1,282 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-memdb"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fileStore keeps a copy of the data store in a file. Every committed write marks the store as dirty, and the whole
+// store is written out as a single JSON snapshot the next time it's flushed
+type fileStore struct {
+	path string
+	mu   sync.Mutex
+
+	// dirtySince holds the time, in Unix nanoseconds, of the oldest change that hasn't been flushed, or 0 if there isn't one
+	dirtySince int64
+
+	// flushErr is the result of the most recent flush, guarded by mu
+	flushErr error
+}
+
+// snapshot is the on-disk representation of the data store
+type snapshot struct {
+	NoteID    int                        `json:"noteid"`
+	UserID    int                        `json:"userid"`
+	ChangeSeq int                        `json:"changeseq"`
+	Tables    map[string]json.RawMessage `json:"tables"`
+}
+
+// ErrLocked is returned by LockFile when another process holds the lock on the data store's file
+var ErrLocked = errors.New("it's in use by another process, such as the running server")
+
+// LockFile takes an exclusive lock on the data store's file at path, so the server and the admin commands never change
+// it at the same time. The lock is kept in a file beside it, and is held until the returned function is called or the
+// process exits. If another process holds it, ErrLocked is returned straight away
+func LockFile(path string) (func() error, error) {
+	lockPath := path + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock %s: %v", path, err)
+	}
+
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("cannot lock %s: %w", path, ErrLocked)
+		}
+		return nil, fmt.Errorf("cannot lock %s: %v", path, err)
+	}
+
+	// Closing the file releases the lock. The file itself is left behind, since removing it would let another process
+	// lock a new file while this one still holds the old
+	return f.Close, nil
+}
+
+// InitFileDB initializes a database backed by the file at path, loading any data previously flushed to it
+func InitFileDB(schema *memdb.DBSchema, path string) (DB, error) {
+	d, err := InitDB(schema)
+	if err != nil {
+		return d, err
+	}
+	d.file = &fileStore{path: path}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return d, err
+	}
+
+	err = d.restore(b)
+	if err != nil {
+		return d, fmt.Errorf("cannot load %s: %v", path, err)
+	}
+
+	return d, nil
+}
+
+func (d *DB) markDirty() {
+	if d.file != nil {
+		atomic.CompareAndSwapInt64(&d.file.dirtySince, 0, time.Now().UnixNano())
+	}
+}
+
+// Dirty reports whether there are changes that haven't been flushed yet. It's always false for an in-memory database
+func (d *DB) Dirty() bool {
+	return d.file != nil && atomic.LoadInt64(&d.file.dirtySince) != 0
+}
+
+// Flush writes the data store to its file if anything has changed since the last flush
+func (d *DB) Flush() error {
+	if d.file == nil {
+		return nil
+	}
+
+	d.file.mu.Lock()
+	defer d.file.mu.Unlock()
+
+	since := atomic.SwapInt64(&d.file.dirtySince, 0)
+	if since == 0 {
+		return nil
+	}
+
+	b, err := d.dump()
+	if err == nil {
+		err = writeFileAtomic(d.file.path, b)
+	}
+	d.file.flushErr = err
+	if err != nil {
+		// The changes are still waiting to be written, and have been since before the failed attempt
+		atomic.StoreInt64(&d.file.dirtySince, since)
+		return err
+	}
+
+	return nil
+}
+
+// StartFlusher flushes the data store every interval until the returned function is called
+func (d *DB) StartFlusher(interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := d.Flush(); err != nil {
+					slog.Error("failed to flush data store", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// dump serialises every table from a single read transaction, so the snapshot is consistent
+func (d *DB) dump() ([]byte, error) {
+	txn := d.Conn.Txn(false)
+	defer txn.Abort()
+
+	snap := snapshot{Tables: map[string]json.RawMessage{}}
+	for table := range RowTypes {
+		it, err := txn.Get(table, IDIdx)
+		if err != nil {
+			return nil, err
+		}
+
+		rows := make([]interface{}, 0)
+		for obj := it.Next(); obj != nil; obj = it.Next() {
+			rows = append(rows, obj)
+		}
+
+		snap.Tables[table], err = json.Marshal(rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Read the sequences after the data, so they're never behind the ids in the snapshot
+	snap.NoteID = GetCurrentNoteID()
+	snap.UserID = GetCurrentUserID()
+	snap.ChangeSeq = GetCurrentChangeSeq()
+
+	return json.Marshal(snap)
+}
+
+// Export returns a consistent snapshot of the whole data store, in the format it's kept in by the file backend
+func (d *DB) Export() ([]byte, error) {
+	return d.dump()
+}
+
+// Import loads a snapshot made by Export. The data store must be empty unless replace is set, in which case everything
+// in it is removed first. Either the whole snapshot is loaded or nothing changes
+func (d *DB) Import(b []byte, replace bool) error {
+	err := d.load(b, replace)
+	if err != nil {
+		return err
+	}
+
+	d.markDirty()
+	return nil
+}
+
+func (d *DB) restore(b []byte) error {
+	return d.load(b, false)
+}
+
+func (d *DB) load(b []byte, replace bool) error {
+	var snap snapshot
+	err := json.Unmarshal(b, &snap)
+	if err != nil {
+		return err
+	}
+
+	txn := d.Conn.Txn(true)
+	defer txn.Abort()
+
+	for table := range RowTypes {
+		if replace {
+			_, err = txn.DeleteAll(table, IDIdx)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		row, err := txn.First(table, IDIdx)
+		if err != nil {
+			return err
+		}
+		if row != nil {
+			return fmt.Errorf("data store is not empty, table %s has rows", table)
+		}
+	}
+
+	for table, raw := range snap.Tables {
+		rowType, ok := RowTypes[table]
+		if !ok {
+			return fmt.Errorf("unknown table %s", table)
+		}
+
+		rows := reflect.New(reflect.SliceOf(reflect.TypeOf(rowType)))
+		err = json.Unmarshal(raw, rows.Interface())
+		if err != nil {
+			return fmt.Errorf("table %s: %v", table, err)
+		}
+
+		for i := 0; i < rows.Elem().Len(); i++ {
+			err = txn.Insert(table, rows.Elem().Index(i).Interface())
+			if err != nil {
+				return fmt.Errorf("table %s: %v", table, err)
+			}
+		}
+	}
+
+	txn.Commit()
+	setIncrementers(snap.NoteID, snap.UserID, snap.ChangeSeq)
+
+	return nil
+}
+
+// writeFileAtomic replaces the file in a single step, so a crash mid-write never leaves a truncated snapshot behind
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
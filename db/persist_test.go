@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/kylegk/notes/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileDB(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "db")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notes.json")
+
+	db, err := InitFileDB(Schema, path)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %s", err.Error())
+	}
+
+	// Nothing is written until there's something to flush
+	if db.Dirty() {
+		t.Errorf("new database should not be dirty")
+	}
+	noteID := IncrementNoteID()
+	err = db.Upsert(context.Background(), NotesTable, model.Note{NoteID: noteID, Content: "test note"})
+	if err != nil {
+		t.Errorf("upsert should have succeeded")
+	}
+	if !db.Dirty() {
+		t.Errorf("database should be dirty after a write")
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Errorf("failed to flush: %s", err.Error())
+	}
+	if db.Dirty() {
+		t.Errorf("database should be clean after a flush")
+	}
+
+	// Reopening the file restores the data and the id sequences
+	db, err = InitFileDB(Schema, path)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %s", err.Error())
+	}
+	res, err := db.Query(context.Background(), NotesTable, IDIdx, noteID)
+	if err != nil || len(res) != 1 {
+		t.Errorf("note was not restored")
+	}
+	if GetCurrentNoteID() != noteID {
+		t.Errorf("note id sequence was not restored, have: %v, want: %v", GetCurrentNoteID(), noteID)
+	}
+
+	// A corrupt file is reported rather than silently discarded
+	_ = os.WriteFile(path, []byte("{"), 0600)
+	_, err = InitFileDB(Schema, path)
+	if err == nil {
+		t.Errorf("corrupt file should have been rejected")
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "db")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notes.json")
+
+	unlock, err := LockFile(path)
+	if err != nil {
+		t.Fatalf("failed to lock: %s", err.Error())
+	}
+
+	// Only one holder at a time, until it lets go
+	if _, err = LockFile(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("second lock should have been refused, have: %v", err)
+	}
+	err = unlock()
+	if err != nil {
+		t.Errorf("failed to unlock: %s", err.Error())
+	}
+	unlock, err = LockFile(path)
+	if err != nil {
+		t.Fatalf("lock should have been free again: %s", err.Error())
+	}
+	_ = unlock()
+}
+
+func TestExportImport(t *testing.T) {
+	source, _ := InitDB(Schema)
+	noteID := IncrementNoteID()
+	_ = source.Upsert(context.Background(), NotesTable, model.Note{NoteID: noteID, Content: "test note"})
+	_ = source.Upsert(context.Background(), UsersTable, model.UserAccount{UserID: IncrementUserID(), User: "test.account"})
+
+	b, err := source.Export()
+	if err != nil {
+		t.Fatalf("failed to export: %s", err.Error())
+	}
+
+	target, _ := InitDB(Schema)
+	err = target.Import(b, false)
+	if err != nil {
+		t.Fatalf("failed to import: %s", err.Error())
+	}
+	res, _ := target.Query(context.Background(), NotesTable, IDIdx, noteID)
+	if len(res) != 1 || GetCurrentNoteID() != noteID {
+		t.Errorf("note and id sequence should have been imported")
+	}
+
+	// Importing into a data store with data only happens when replacing it
+	_ = target.Upsert(context.Background(), NotesTable, model.Note{NoteID: IncrementNoteID(), Content: "another note"})
+	err = target.Import(b, false)
+	if err == nil {
+		t.Errorf("import into a data store with data should have been rejected")
+	}
+	err = target.Import(b, true)
+	if err != nil {
+		t.Fatalf("failed to replace data store: %s", err.Error())
+	}
+	counts, _ := target.RowCounts()
+	if counts[NotesTable] != 1 || counts[UsersTable] != 1 {
+		t.Errorf("data store should hold only the snapshot, have: %v", counts)
+	}
+
+	// A snapshot that can't be loaded leaves the data store as it was
+	err = target.Import([]byte(`{"tables":{"notes":"not rows"}}`), true)
+	if err == nil {
+		t.Errorf("invalid snapshot should have been rejected")
+	}
+	counts, _ = target.RowCounts()
+	if counts[NotesTable] != 1 {
+		t.Errorf("failed import should not have changed the data store, have: %v", counts)
+	}
+}
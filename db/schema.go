@@ -1,22 +1,43 @@
 package db
 
-import "github.com/hashicorp/go-memdb"
+import (
+	"github.com/hashicorp/go-memdb"
+	"github.com/kylegk/notes/model"
+)
 
 const (
 	NotesTable = "notes"
 	UsersTable = "users"
 	UserNotesTable = "user_notes"
+	NoteChangesTable = "note_changes"
+	IdempotencyKeysTable = "idempotency_keys"
+	UserUsageTable = "user_usage"
+	SessionsTable = "sessions"
+	SigningKeysTable = "signing_keys"
+	AccessTokensTable = "access_tokens"
+	IdentitiesTable = "identities"
+	OIDCLoginsTable = "oidc_logins"
+	LoginChallengesTable = "login_challenges"
 
 	IDIdx = "id"
 	ContentIdx = "content_idx"
 	ModifiedIdx = "modified_idx"
 	UserIdx = "user_idx"
+	SeqIdx = "seq_idx"
 
 	NoteIDFld = "NoteID"
 	ContentFld = "Content"
 	ModifiedFld = "Modified"
 	UserIDFld = "UserID"
 	UserFld = "User"
+	SeqFld = "Seq"
+	KeyFld = "Key"
+	SessionIDFld = "SessionID"
+	KeyIDFld = "KeyID"
+	TokenIDFld = "TokenID"
+	IdentityIDFld = "IdentityID"
+	StateFld = "State"
+	ChallengeIDFld = "ChallengeID"
 )
 
 // Schema defines the schema used for the go-memdb database
@@ -74,5 +95,146 @@ var Schema = &memdb.DBSchema{
 
 			},
 		},
+		NoteChangesTable: {
+			Name: NoteChangesTable,
+			Indexes: map[string]*memdb.IndexSchema{
+				IDIdx: {
+					Name:    IDIdx,
+					Unique:  true,
+					Indexer: &memdb.IntFieldIndex{Field: NoteIDFld},
+				},
+				UserIdx: {
+					Name:    UserIdx,
+					Unique:  false,
+					Indexer: &memdb.IntFieldIndex{Field: UserIDFld},
+				},
+				SeqIdx: {
+					Name:    SeqIdx,
+					Unique:  true,
+					Indexer: &memdb.IntFieldIndex{Field: SeqFld},
+				},
+			},
+		},
+		IdempotencyKeysTable: {
+			Name: IdempotencyKeysTable,
+			Indexes: map[string]*memdb.IndexSchema{
+				IDIdx: {
+					Name:    IDIdx,
+					Unique:  true,
+					Indexer: &memdb.StringFieldIndex{Field: KeyFld},
+				},
+				UserIdx: {
+					Name:    UserIdx,
+					Unique:  false,
+					Indexer: &memdb.IntFieldIndex{Field: UserIDFld},
+				},
+			},
+		},
+		UserUsageTable: {
+			Name: UserUsageTable,
+			Indexes: map[string]*memdb.IndexSchema{
+				IDIdx: {
+					Name:    IDIdx,
+					Unique:  true,
+					Indexer: &memdb.IntFieldIndex{Field: UserIDFld},
+				},
+			},
+		},
+		SessionsTable: {
+			Name: SessionsTable,
+			Indexes: map[string]*memdb.IndexSchema{
+				IDIdx: {
+					Name:    IDIdx,
+					Unique:  true,
+					Indexer: &memdb.StringFieldIndex{Field: SessionIDFld},
+				},
+				UserIdx: {
+					Name:    UserIdx,
+					Unique:  false,
+					Indexer: &memdb.IntFieldIndex{Field: UserIDFld},
+				},
+			},
+		},
+		AccessTokensTable: {
+			Name: AccessTokensTable,
+			Indexes: map[string]*memdb.IndexSchema{
+				IDIdx: {
+					Name:    IDIdx,
+					Unique:  true,
+					Indexer: &memdb.StringFieldIndex{Field: TokenIDFld},
+				},
+				UserIdx: {
+					Name:    UserIdx,
+					Unique:  false,
+					Indexer: &memdb.IntFieldIndex{Field: UserIDFld},
+				},
+			},
+		},
+		IdentitiesTable: {
+			Name: IdentitiesTable,
+			Indexes: map[string]*memdb.IndexSchema{
+				IDIdx: {
+					Name:    IDIdx,
+					Unique:  true,
+					Indexer: &memdb.StringFieldIndex{Field: IdentityIDFld},
+				},
+				UserIdx: {
+					Name:    UserIdx,
+					Unique:  false,
+					Indexer: &memdb.IntFieldIndex{Field: UserIDFld},
+				},
+			},
+		},
+		OIDCLoginsTable: {
+			Name: OIDCLoginsTable,
+			Indexes: map[string]*memdb.IndexSchema{
+				IDIdx: {
+					Name:    IDIdx,
+					Unique:  true,
+					Indexer: &memdb.StringFieldIndex{Field: StateFld},
+				},
+			},
+		},
+		LoginChallengesTable: {
+			Name: LoginChallengesTable,
+			Indexes: map[string]*memdb.IndexSchema{
+				IDIdx: {
+					Name:    IDIdx,
+					Unique:  true,
+					Indexer: &memdb.StringFieldIndex{Field: ChallengeIDFld},
+				},
+				UserIdx: {
+					Name:    UserIdx,
+					Unique:  false,
+					Indexer: &memdb.IntFieldIndex{Field: UserIDFld},
+				},
+			},
+		},
+		SigningKeysTable: {
+			Name: SigningKeysTable,
+			Indexes: map[string]*memdb.IndexSchema{
+				IDIdx: {
+					Name:    IDIdx,
+					Unique:  true,
+					Indexer: &memdb.StringFieldIndex{Field: KeyIDFld},
+				},
+			},
+		},
 	},
-}
\ No newline at end of file
+}
+
+// RowTypes maps each table to the type of the rows stored in it, which is needed to load a table back from a file
+var RowTypes = map[string]interface{}{
+	NotesTable:           model.Note{},
+	UsersTable:           model.UserAccount{},
+	UserNotesTable:       model.UserNote{},
+	NoteChangesTable:     model.NoteChange{},
+	IdempotencyKeysTable: model.IdempotencyRecord{},
+	UserUsageTable:       model.UserUsage{},
+	SessionsTable:        model.Session{},
+	SigningKeysTable:     model.SigningKey{},
+	AccessTokensTable:    model.AccessToken{},
+	IdentitiesTable:      model.Identity{},
+	OIDCLoginsTable:      model.OIDCLogin{},
+	LoginChallengesTable: model.LoginChallenge{},
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// ListUsers lists the users whose name contains the q query parameter. Like every administrative handler, it relies on
+// the router to only let administrators through
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	after, limit, err := pageParams(r)
+	if err != nil {
+		return
+	}
+
+	users, next, err := lib.ListUsersDB(r.Context(), r.URL.Query().Get("q"), after, limit)
+	if err != nil {
+		return
+	}
+
+	sendResponse(model.ListUsersResponse{Users: users, Next: next}, http.StatusOK, w)
+}
+
+// GetUser describes a user to administrators
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := userIDParam(r)
+	if err != nil {
+		return
+	}
+
+	summary, err := lib.GetUserSummaryDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	sendResponse(summary, http.StatusOK, w)
+}
+
+// UpdateUser changes a user's role, or disables or re-enables them
+func UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := userIDParam(r)
+	if err != nil {
+		return
+	}
+
+	body := model.UpdateUserRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	summary, err := lib.UpdateUserDB(r.Context(), userID, body)
+	if err != nil {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "user updated by administrator", "admin_id", app.CurrentRequest(r.Context()).UserID, "target_user_id", userID, "role", summary.Role, "disabled", summary.Disabled)
+	sendResponse(summary, http.StatusOK, w)
+}
+
+// DeleteUser removes a user along with everything they own
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := userIDParam(r)
+	if err != nil {
+		return
+	}
+
+	err = lib.DeleteUserDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "user deleted by administrator", "admin_id", app.CurrentRequest(r.Context()).UserID, "target_user_id", userID)
+	sendResponse(model.GenericResponse{Message: "User deleted"}, http.StatusOK, w)
+}
+
+// LogoutUser ends a user's sessions and revokes every token issued to them, so they must log in again
+func LogoutUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := userIDParam(r)
+	if err != nil {
+		return
+	}
+
+	err = lib.LogoutUserDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "user logged out by administrator", "admin_id", app.CurrentRequest(r.Context()).UserID, "target_user_id", userID)
+	sendResponse(model.GenericResponse{Message: "User logged out"}, http.StatusOK, w)
+}
+
+// GetStats summarises what the server holds, for administrators
+func GetStats(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	stats, err := lib.GetStatsDB(r.Context())
+	if err != nil {
+		return
+	}
+
+	sendResponse(stats, http.StatusOK, w)
+}
+
+func userIDParam(r *http.Request) (int, error) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, apperr.New(apperr.ErrInvalidRequest, "user id must be a number")
+	}
+	return userID, nil
+}
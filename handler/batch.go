@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/auth"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"net/http"
+)
+
+// BatchNotes handles the request to create, update and delete many notes in a single transaction
+func BatchNotes(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	body := model.BatchRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBulkBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	results, committed, err := lib.ApplyNoteBatchDB(r.Context(), userID, body.Mode, body.Operations)
+	if err != nil {
+		return
+	}
+
+	mode := body.Mode
+	if mode == "" {
+		mode = lib.BatchAtomic
+	}
+
+	// An atomic batch that was rolled back still reports which operation caused it
+	status := http.StatusOK
+	if !committed {
+		status = http.StatusUnprocessableEntity
+	}
+
+	sendResponse(model.BatchResponse{Mode: mode, Committed: committed, Results: results}, status, w)
+}
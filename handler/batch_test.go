@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func initBatchTest() *mux.Router {
+	router := initNotesTest()
+	router.HandleFunc("/notes/batch", BatchNotes).Methods("POST")
+	return router
+}
+
+func sendBatch(router *mux.Router, token string, batch model.BatchRequest) (model.BatchResponse, int) {
+	var r model.BatchResponse
+	j, _ := json.Marshal(batch)
+	request, _ := http.NewRequest("POST", "/notes/batch", bytes.NewBuffer(j))
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	request.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	_ = json.NewDecoder(response.Body).Decode(&r)
+	return r, response.Code
+}
+
+func TestBatchNotes(t *testing.T) {
+	router := initBatchTest()
+	user, err := createTestUser(router, "test.account")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// Create several notes in one request
+	batch := model.BatchRequest{Operations: []model.BatchOperation{
+		{Op: lib.BatchCreate, Content: "one"},
+		{Op: lib.BatchCreate, Content: "two"},
+		{Op: lib.BatchCreate, Content: "three"},
+	}}
+	r, code := sendBatch(router, user.Token, batch)
+	if code != 200 || !r.Committed || r.Mode != lib.BatchAtomic {
+		t.Errorf("batch should have been committed, have: %v", code)
+	}
+	if len(r.Results) != len(batch.Operations) {
+		t.Errorf("expected a result per operation, have: %v", len(r.Results))
+	}
+
+	// A failing atomic batch is reported with its results
+	batch = model.BatchRequest{Operations: []model.BatchOperation{
+		{Op: lib.BatchDelete, NoteID: r.Results[0].NoteID},
+		{Op: lib.BatchDelete, NoteID: 99999},
+	}}
+	r, code = sendBatch(router, user.Token, batch)
+	if code != http.StatusUnprocessableEntity || r.Committed {
+		t.Errorf("batch should have been rolled back, have: %v", code)
+	}
+
+	// Unknown operations fail validation before anything is attempted
+	batch = model.BatchRequest{Operations: []model.BatchOperation{{Op: "rename"}}}
+	_, code = sendBatch(router, user.Token, batch)
+	if code != http.StatusBadRequest {
+		t.Errorf("batch with an unknown operation should have been rejected, have: %v", code)
+	}
+
+	// Notes can't be created or updated without content, as with single notes
+	for _, op := range []model.BatchOperation{{Op: lib.BatchCreate}, {Op: lib.BatchUpdate, NoteID: r.Results[1].NoteID}} {
+		_, code = sendBatch(router, user.Token, model.BatchRequest{Operations: []model.BatchOperation{op}})
+		if code != http.StatusBadRequest {
+			t.Errorf("%s without content should have been rejected, have: %v", op.Op, code)
+		}
+	}
+
+	// Batches require a valid token
+	_, code = sendBatch(router, "", batch)
+	if code == 200 {
+		t.Errorf("batch without a token should have failed")
+	}
+}
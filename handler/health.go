@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/version"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds how long a readiness probe waits to write to the data store
+const readinessTimeout = 2 * time.Second
+
+// maxFlushLagIntervals is how many flush intervals a change may wait to be written before the server is reported as not ready
+const maxFlushLagIntervals = 3
+
+// Healthz reports that the process is alive and able to serve requests
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	sendResponse(model.HealthResponse{Status: "ok"}, http.StatusOK, w)
+}
+
+// Readyz reports whether the server can handle traffic: the data store must accept writes and, with the file backend,
+// changes must be reaching the disk. Every check is reported, with a 503 if any of them failed
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]error{
+		"store":       app.Context.DB.CheckWritable(ctx),
+		"persistence": app.Context.DB.CheckFlushed(maxFlushLagIntervals * app.Context.Config.Storage.FlushInterval),
+	}
+
+	response := model.ReadinessResponse{Status: "ready", Checks: map[string]string{}}
+	status := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			response.Checks[name] = err.Error()
+			response.Status = "not ready"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		response.Checks[name] = "ok"
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	sendResponse(response, status, w)
+}
+
+// Version returns the version, commit and Go version the server was built with
+func Version(w http.ResponseWriter, r *http.Request) {
+	info := version.Get()
+
+	sendResponse(model.VersionResponse{
+		Version:   info.Version,
+		Commit:    info.Commit,
+		BuildDate: info.BuildDate,
+		GoVersion: info.GoVersion,
+	}, http.StatusOK, w)
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/config"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	app.Init()
+	request, _ := http.NewRequest("GET", "/healthz", nil)
+	response := httptest.NewRecorder()
+	Healthz(response, request)
+
+	have := response.Code
+	want := 200
+	if have != want {
+		t.Errorf("health check should have succeeded, have: %v, want: %v", have, want)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	app.Init()
+
+	ready := func() (model.ReadinessResponse, int) {
+		var body model.ReadinessResponse
+		request, _ := http.NewRequest("GET", "/readyz", nil)
+		response := httptest.NewRecorder()
+		Readyz(response, request)
+		_ = json.NewDecoder(response.Body).Decode(&body)
+		return body, response.Code
+	}
+
+	body, code := ready()
+	if code != 200 || body.Checks["store"] != "ok" || body.Checks["persistence"] != "ok" {
+		t.Errorf("in-memory store should be ready, have: %v %v", code, body)
+	}
+
+	// Changes that can't be written to disk make the server unready
+	dir, _ := os.MkdirTemp("", "handler")
+	defer os.RemoveAll(dir)
+	cfg := config.Default()
+	cfg.Storage.Backend = config.FileBackend
+	cfg.Storage.Path = filepath.Join(dir, "missing", "notes.json")
+	cfg.Storage.FlushInterval = time.Hour
+	_ = os.Mkdir(filepath.Join(dir, "missing"), 0700)
+	err := app.Setup(cfg)
+	if err != nil {
+		t.Fatalf("failed to set up: %s", err.Error())
+	}
+	defer app.Context.Shutdown(context.Background())
+	_ = os.RemoveAll(filepath.Join(dir, "missing"))
+
+	_ = app.Context.DB.Upsert(context.Background(), db.UsersTable, model.UserAccount{UserID: 1, User: "test.account"})
+	if app.Context.DB.Flush() == nil {
+		t.Fatalf("flush should have failed")
+	}
+
+	body, code = ready()
+	if code != 503 || body.Status != "not ready" || body.Checks["persistence"] == "ok" {
+		t.Errorf("failed flush should make the server unready, have: %v %v", code, body)
+	}
+	if body.Checks["store"] != "ok" {
+		t.Errorf("store should still accept writes, have: %v", body.Checks["store"])
+	}
+}
+
+func TestVersion(t *testing.T) {
+	app.Init()
+	request, _ := http.NewRequest("GET", "/version", nil)
+	response := httptest.NewRecorder()
+	Version(response, request)
+
+	var body model.VersionResponse
+	_ = json.NewDecoder(response.Body).Decode(&body)
+	if response.Code != 200 || body.Version == "" || body.GoVersion != runtime.Version() {
+		t.Errorf("version should describe the build, have: %v %v", response.Code, body)
+	}
+}
@@ -1,12 +1,11 @@
 package handler
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
 	"github.com/kylegk/notes/auth"
-	"github.com/kylegk/notes/db"
 	"github.com/kylegk/notes/lib"
 	"github.com/kylegk/notes/model"
 	"net/http"
@@ -18,7 +17,7 @@ func CreateNote(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer func() {
 		if err != nil {
-			sendErrorResponse(w, r, err)
+			SendErrorResponse(w, r, err)
 			return
 		}
 	}()
@@ -29,19 +28,12 @@ func CreateNote(w http.ResponseWriter, r *http.Request) {
 	}
 
 	body := model.CreateNoteRequest{}
-	err = json.NewDecoder(r.Body).Decode(&body)
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
 	if err != nil {
-		err = fmt.Errorf(app.InvalidRequestError)
 		return
 	}
 
-	noteID := db.IncrementNoteID()
-	err = lib.InsertNoteDB(noteID, body.Content)
-	if err != nil {
-		return
-	}
-
-	err = lib.InsertUserNoteDB(userID, noteID)
+	noteID, err := lib.CreateNoteForUserDB(r.Context(), userID, body.Content)
 	if err != nil {
 		return
 	}
@@ -54,7 +46,7 @@ func UpdateNote(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer func() {
 		if err != nil {
-			sendErrorResponse(w, r, err)
+			SendErrorResponse(w, r, err)
 			return
 		}
 	}()
@@ -67,23 +59,17 @@ func UpdateNote(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	noteID, err := strconv.Atoi(id)
 	if err != nil {
-		err = fmt.Errorf(app.InvalidRequestError)
+		err = apperr.New(apperr.ErrInvalidRequest, "note id must be a number")
 		return
 	}
 
 	body := model.UpdateNoteRequest{}
-	err = json.NewDecoder(r.Body).Decode(&body)
-	if err != nil {
-		err = fmt.Errorf(app.InvalidRequestError)
-		return
-	}
-
-	err = lib.ValidateNoteOwnershipDB(userID, noteID)
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
 	if err != nil {
 		return
 	}
 
-	err = lib.UpdateNoteDB(noteID, body.Content)
+	err = lib.UpdateNoteForUserDB(r.Context(), userID, noteID, body.Content)
 	if err != nil {
 		return
 	}
@@ -96,7 +82,7 @@ func GetNote(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer func() {
 		if err != nil {
-			sendErrorResponse(w, r, err)
+			SendErrorResponse(w, r, err)
 			return
 		}
 	}()
@@ -109,16 +95,16 @@ func GetNote(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	noteID, err := strconv.Atoi(id)
 	if err != nil {
-		err = fmt.Errorf(app.InvalidRequestError)
+		err = apperr.New(apperr.ErrInvalidRequest, "note id must be a number")
 		return
 	}
 
-	err = lib.ValidateNoteOwnershipDB(userID, noteID)
+	err = lib.ValidateNoteOwnershipDB(r.Context(), userID, noteID)
 	if err != nil {
 		return
 	}
 
-	note, err := lib.GetNoteDB(noteID)
+	note, err := lib.GetNoteDB(r.Context(), noteID)
 	if err != nil {
 		return
 	}
@@ -126,12 +112,12 @@ func GetNote(w http.ResponseWriter, r *http.Request) {
 	sendResponse(note, http.StatusOK, w)
 }
 
-// GetAllNotesForUser gets all the notes associated with a user
+// GetAllNotesForUser gets the notes associated with a user, a page at a time when a limit is given
 func GetAllNotesForUser(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer func() {
 		if err != nil {
-			sendErrorResponse(w, r, err)
+			SendErrorResponse(w, r, err)
 			return
 		}
 	}()
@@ -141,12 +127,47 @@ func GetAllNotesForUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	noteIDs, err := lib.GetAllNotesForUserDB(userID)
+	after, limit, err := pageParams(r)
 	if err != nil {
 		return
 	}
 
-	sendResponse(model.GetAllNotesForUserResponse{Notes: noteIDs}, http.StatusOK, w)
+	noteIDs, next, err := lib.ListNotesForUserDB(r.Context(), userID, after, limit)
+	if err != nil {
+		return
+	}
+
+	sendResponse(model.GetAllNotesForUserResponse{Notes: noteIDs, Next: next}, http.StatusOK, w)
+}
+
+// maxPageSize limits how many notes can be listed in a single page
+const maxPageSize = 1000
+
+// pageParams reads the optional after and limit query parameters used to paginate lists. Without a limit, every item
+// after the cursor is returned
+func pageParams(r *http.Request) (after int, limit int, err error) {
+	var fields []model.FieldError
+	query := r.URL.Query()
+
+	if v := query.Get("after"); v != "" {
+		after, err = strconv.Atoi(v)
+		if err != nil || after < 0 {
+			fields = append(fields, model.FieldError{Field: "after", Code: "invalid", Message: "after must be an id"})
+		}
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			fields = append(fields, model.FieldError{Field: "limit", Code: "invalid", Message: fmt.Sprintf("limit must be between 1 and %d", maxPageSize)})
+		}
+	}
+
+	if len(fields) > 0 {
+		return 0, 0, apperr.Validation(fields...)
+	}
+
+	return after, limit, nil
 }
 
 // DeleteNote handles the request to delete a note and the user's relationship to that note
@@ -154,7 +175,7 @@ func DeleteNote(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer func() {
 		if err != nil {
-			sendErrorResponse(w, r, err)
+			SendErrorResponse(w, r, err)
 			return
 		}
 	}()
@@ -162,7 +183,7 @@ func DeleteNote(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	noteID, err := strconv.Atoi(id)
 	if err != nil {
-		err = fmt.Errorf(app.InvalidRequestError)
+		err = apperr.New(apperr.ErrInvalidRequest, "note id must be a number")
 		return
 	}
 
@@ -171,17 +192,7 @@ func DeleteNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = lib.ValidateNoteOwnershipDB(userID, noteID)
-	if err != nil {
-		return
-	}
-
-	_, err = lib.DeleteNoteDB(noteID)
-	if err != nil {
-		return
-	}
-
-	_, err = lib.DeleteUserNoteDB(noteID)
+	err = lib.DeleteNoteForUserDB(r.Context(), userID, noteID)
 	if err != nil {
 		return
 	}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -87,7 +88,7 @@ func TestCreateNote(t *testing.T) {
 	response := httptest.NewRecorder()
 	router.ServeHTTP(response, request)
 	have := response.Code
-	want := 405
+	want := 401
 	if have != want {
 		t.Errorf("create should have failed with an error code, have: %v, want: %v", have, want)
 	}
@@ -124,7 +125,7 @@ func TestUpdateNote(t *testing.T) {
 	response := httptest.NewRecorder()
 	router.ServeHTTP(response, request)
 	have := response.Code
-	want := 405
+	want := 401
 	if have != want {
 		t.Errorf("update should have failed with an error code, have: %v, want: %v", have, want)
 	}
@@ -152,13 +153,13 @@ func TestUpdateNote(t *testing.T) {
 	response = httptest.NewRecorder()
 	router.ServeHTTP(response, request)
 	have = response.Code
-	want = 405
+	want = 404
 	if have != want {
 		t.Errorf("update should have failed with an error code, have: %v, want: %v", have, want)
 	}
 
 	// Insert a user note that doesn't belong to our user
-	_ = lib.InsertUserNoteDB(12345, 777)
+	_ = lib.InsertUserNoteDB(context.Background(), 12345, 777)
 
 	// Try to update the note that doesn't belong to our user
 	updateNote.Content = "This is an updated note"
@@ -169,7 +170,7 @@ func TestUpdateNote(t *testing.T) {
 	response = httptest.NewRecorder()
 	router.ServeHTTP(response, request)
 	have = response.Code
-	want = 405
+	want = 403
 	if have != want {
 		t.Errorf("update should have failed with an error code, have: %v, want: %v", have, want)
 	}
@@ -212,14 +213,14 @@ func TestGetNote(t *testing.T) {
 	response = httptest.NewRecorder()
 	router.ServeHTTP(response, request)
 	have = response.Code
-	want = 405
+	want = 404
 	if have != want {
 		t.Errorf("get note should have failed with an error code, have: %v, want: %v", have, want)
 	}
 
 	// Insert a user note that doesn't belong to our user
-	_ = lib.InsertNoteDB(999, "this is a note")
-	_ = lib.InsertUserNoteDB(111, 999)
+	_ = lib.InsertNoteDB(context.Background(), 999, "this is a note")
+	_ = lib.InsertUserNoteDB(context.Background(), 111, 999)
 
 	// Try to get the note that doesn't belong to our user
 	request, _ = http.NewRequest("GET", "/notes/999", nil)
@@ -228,7 +229,7 @@ func TestGetNote(t *testing.T) {
 	response = httptest.NewRecorder()
 	router.ServeHTTP(response, request)
 	have = response.Code
-	want = 405
+	want = 403
 	if have != want {
 		t.Errorf("get note should have failed with an error code, have: %v, want: %v", have, want)
 	}
@@ -247,7 +248,7 @@ func TestGetAllNotesForUser(t *testing.T) {
 	noteIDs := []int{1,2,3,4}
 	for _, noteID := range noteIDs {
 		userNote := model.UserNote{UserID: user.UserID, NoteID: noteID}
-		err := lib.InsertUserNoteDB(userNote.UserID, userNote.NoteID)
+		err := lib.InsertUserNoteDB(context.Background(), userNote.UserID, userNote.NoteID)
 		if err != nil {
 			t.Errorf("insertion of user note failed: %s", err.Error())
 		}
@@ -277,6 +278,38 @@ func TestGetAllNotesForUser(t *testing.T) {
 	if have != want {
 		t.Errorf("number of notes returned is mismatched, have: %v, want: %v", have, want)
 	}
+
+	// Page through the notes, following the cursor until the last page
+	var paged []int
+	next := 0
+	for page := 0; page < len(noteIDs); page++ {
+		request, _ = http.NewRequest("GET", fmt.Sprintf("/notes?limit=3&after=%d", next), nil)
+		request.Header.Set("Authorization", "Bearer " + user.Token)
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		r = model.GetAllNotesForUserResponse{}
+		_ = json.NewDecoder(response.Body).Decode(&r)
+		paged = append(paged, r.Notes...)
+		next = r.Next
+		if next == 0 {
+			break
+		}
+	}
+	if fmt.Sprint(paged) != fmt.Sprint(noteIDs) {
+		t.Errorf("paged notes are mismatched, have: %v, want: %v", paged, noteIDs)
+	}
+
+	// Page sizes are limited
+	request, _ = http.NewRequest("GET", "/notes?limit=0", nil)
+	request.Header.Set("Authorization", "Bearer " + user.Token)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	have = response.Code
+	want = 400
+	if have != want {
+		t.Errorf("invalid page size should have been rejected, have: %v, want: %v", have, want)
+	}
 }
 
 func TestDeleteNote(t *testing.T) {
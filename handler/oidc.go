@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/auth"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/model"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// OIDCLogin sends the user to the identity provider to log in. When the request carries a bearer token, the identity
+// they log in with is linked to the token's user instead, so they can log in with either afterwards. Browsers send the
+// session cookie with navigations other sites start too, so it doesn't link identities here; OIDCLink does that
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	var userID int
+	if r.Header.Get("Authorization") != "" {
+		userID, err = auth.ValidateUserToken(r)
+		if err != nil {
+			return
+		}
+	}
+
+	url, err := startOIDCLogin(w, r, userID)
+	if err != nil {
+		return
+	}
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// OIDCLink starts linking an identity to the user's account, returning the URL to send the browser to. Unlike OIDCLogin
+// it accepts the session cookie, since POSTs made with it have to pass the CSRF check
+func OIDCLink(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	url, err := startOIDCLogin(w, r, userID)
+	if err != nil {
+		return
+	}
+
+	sendResponse(model.OIDCLinkResponse{URL: url}, http.StatusOK, w)
+}
+
+// startOIDCLogin records a login for userID, or a plain login when it's 0, and ties it to the browser with the state
+// cookie. It returns the identity provider's URL to send the browser to
+func startOIDCLogin(w http.ResponseWriter, r *http.Request, userID int) (string, error) {
+	login, err := lib.StartOIDCLoginDB(r.Context(), userID)
+	if err != nil {
+		return "", err
+	}
+
+	url, err := app.Context.OIDC.AuthCodeURL(r.Context(), login.State, login.Nonce, login.Verifier)
+	if err != nil {
+		return "", err
+	}
+
+	auth.SetOIDCStateCookie(w, login.State, time.Unix(login.Expires, 0))
+	w.Header().Set("Cache-Control", "no-store")
+	return url, nil
+}
+
+// OIDCCallback finishes a login when the identity provider sends the user back. The code is exchanged for an ID token,
+// and the user it names is logged in, linked, or provisioned. A browser session is started too when sessions are enabled.
+// Users with two-factor authentication enabled get a TWO_FACTOR_REQUIRED error instead, finished like a password login
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	// The state has to match the browser's cookie too, otherwise a callback URL from someone else's login could log
+	// this browser in to their account
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie := auth.OIDCState(r)
+	auth.ClearOIDCStateCookie(w)
+	if state == "" || !hmac.Equal([]byte(state), []byte(cookie)) {
+		err = oidcFailure("state_mismatch", "the login was not started in this browser, log in again")
+		return
+	}
+
+	login, ok, err := lib.FinishOIDCLoginDB(r.Context(), state)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = oidcFailure("unknown_state", "the login was not started here or has expired, log in again")
+		return
+	}
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		err = oidcFailure("provider_error", "the identity provider refused the login: "+providerErr)
+		return
+	}
+
+	idToken, err := app.Context.OIDC.Exchange(r.Context(), query.Get("code"), login.Verifier, login.Nonce)
+	if err != nil {
+		slog.WarnContext(r.Context(), "identity provider login failed", "error", err)
+		err = oidcFailure("oidc_invalid", "the identity provider's response could not be verified")
+		return
+	}
+
+	cfg := app.Context.Config.Auth.OIDC
+	username, _ := idToken.Claims[cfg.UsernameClaim].(string)
+	displayName, _ := idToken.Claims["name"].(string)
+	userID, provisioned, err := lib.LoginWithIdentityDB(r.Context(), login.UserID, model.IdentityClaims{
+		Issuer:      cfg.Issuer,
+		Subject:     idToken.Subject,
+		Username:    username,
+		DisplayName: displayName,
+	})
+	if err != nil {
+		return
+	}
+
+	response := model.OIDCLoginResponse{UserID: userID, Provisioned: provisioned, Linked: login.UserID != 0}
+	response.Token, err = auth.GenerateUserToken(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	if app.Context.Config.Auth.Sessions.Enabled {
+		var session model.Session
+		session, err = lib.CreateSessionDB(r.Context(), userID)
+		if err != nil {
+			return
+		}
+
+		var token string
+		token, err = auth.GenerateSessionToken(r.Context(), session)
+		if err != nil {
+			return
+		}
+
+		auth.SetSessionCookies(w, token, session)
+		response.CSRFToken = auth.CSRFToken(session.SessionID)
+	}
+
+	slog.InfoContext(r.Context(), "user logged in with identity provider", "user_id", userID, "provisioned", response.Provisioned, "linked", response.Linked)
+	w.Header().Set("Cache-Control", "no-store")
+	sendResponse(response, http.StatusOK, w)
+}
+
+// oidcFailure counts the failed login by reason and returns the error reported to the client
+func oidcFailure(reason string, detail string) error {
+	metrics.AuthFailures.WithLabelValues(reason).Inc()
+	return apperr.New(apperr.ErrOIDCLoginFailed, detail)
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/validate"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decodeRequest reads a JSON body of at most limit bytes into body, rejecting unknown fields, and validates the result.
+// Unknown fields and rule violations are reported together in a single validation error
+func decodeRequest(w http.ResponseWriter, r *http.Request, limit int64, body interface{}) error {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		return apperr.New(apperr.ErrRequestTooLarge, fmt.Sprintf("request body must not exceed %d bytes", limit))
+	}
+
+	var fields []model.FieldError
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(body)
+	if err != nil {
+		fe, ok := decodeFieldError(err)
+		if !ok {
+			return apperr.New(apperr.ErrInvalidRequest, "request body is not valid JSON")
+		}
+		fields = append(fields, fe)
+
+		// Decode again without the strict checks so the rest of the body can still be validated
+		err = json.Unmarshal(b, body)
+		if err != nil && fe.Code == "unknown_field" {
+			return apperr.New(apperr.ErrInvalidRequest, "request body is not valid JSON")
+		}
+	} else if dec.More() {
+		return apperr.New(apperr.ErrInvalidRequest, "request body must contain a single JSON object")
+	}
+
+	err = validate.Struct(body)
+	fields = append(fields, apperr.Fields(err)...)
+	if len(fields) > 0 {
+		return apperr.Validation(fields...)
+	}
+
+	return nil
+}
+
+// decodeFieldError converts the decoding errors that can be blamed on a single field into a field error
+func decodeFieldError(err error) (model.FieldError, bool) {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return model.FieldError{Field: typeErr.Field, Code: "invalid_type", Message: typeErr.Field + " must be a " + typeErr.Type.String()}, true
+	}
+
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		name := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return model.FieldError{Field: name, Code: "unknown_field", Message: name + " is not a recognised field"}, true
+	}
+
+	return model.FieldError{}, false
+}
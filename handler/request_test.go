@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	router := initUsersTests()
+
+	send := func(body string) (int, model.Problem) {
+		var problem model.Problem
+		request, _ := http.NewRequest("POST", "/users", bytes.NewBufferString(body))
+		request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		_ = json.NewDecoder(response.Body).Decode(&problem)
+		return response.Code, problem
+	}
+
+	// Unknown fields are reported alongside the rule violations
+	code, problem := send(`{"user": "a!", "admin": true}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("unexpected status, have: %v, want: %v", code, http.StatusBadRequest)
+	}
+	have := map[string]bool{}
+	for _, f := range problem.Errors {
+		have[f.Field+":"+f.Code] = true
+	}
+	for _, want := range []string{"admin:unknown_field", "user:too_short", "user:invalid_characters"} {
+		if !have[want] {
+			t.Errorf("missing violation %v, have: %+v", want, problem.Errors)
+		}
+	}
+
+	// Fields of the wrong type are reported against the field
+	_, problem = send(`{"user": 5}`)
+	if len(problem.Errors) == 0 || problem.Errors[0].Code != "invalid_type" {
+		t.Errorf("expected a type violation, have: %+v", problem.Errors)
+	}
+
+	// Malformed JSON and trailing data are rejected
+	code, _ = send(`{"user": `)
+	if code != http.StatusBadRequest {
+		t.Errorf("unexpected status, have: %v, want: %v", code, http.StatusBadRequest)
+	}
+	code, _ = send(`{"user": "test.account"} {}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("unexpected status, have: %v, want: %v", code, http.StatusBadRequest)
+	}
+
+	// Oversized bodies are rejected
+	code, _ = send(`{"user": "` + strings.Repeat("a", int(app.Context.Config.Limits.MaxBodySize)) + `"}`)
+	if code != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status, have: %v, want: %v", code, http.StatusRequestEntityTooLarge)
+	}
+}
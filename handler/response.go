@@ -3,59 +3,73 @@ package handler
 import (
 	"encoding/json"
 	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
 	"github.com/kylegk/notes/model"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+// problemTypePrefix prefixes the error code to form the problem type URI
+const problemTypePrefix = "urn:notes:problem:"
+
 // SendGenericNotFoundResponse returns a generic 404 error
 func SendGenericNotFoundResponse(w http.ResponseWriter, r *http.Request) {
-	sendResponse(&model.GenericResponse{Error: "Not Found", Code: http.StatusNotFound, Message: "Resource not found"}, http.StatusNotFound, w)
+	SendErrorResponse(w, r, apperr.ErrNotFound)
 }
 
 // SendGenericNotAllowedResponse returns a generic 405 error
 func SendGenericNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	sendResponse(&model.GenericResponse{Error: "Not Allowed", Code: http.StatusMethodNotAllowed, Message: "You are not authorized to access this resource"}, http.StatusMethodNotAllowed, w)
-}
-
-// SendGenericInternalServerError returns a generic 500 error
-func SendGenericInternalServerError(w http.ResponseWriter, r *http.Request) {
-	sendResponse(&model.GenericResponse{Error: "Internal Server Error", Code: http.StatusInternalServerError, Message: "An error has occurred"}, http.StatusInternalServerError, w)
-}
-
-// SendGenericBadRequestResponse returns a generic 400 error
-func SendGenericBadRequestResponse(w http.ResponseWriter, r *http.Request) {
-	sendResponse(&model.GenericResponse{Error: "Bad Request", Code: http.StatusBadRequest, Message: "Invalid Request"}, http.StatusMethodNotAllowed, w)
+	SendErrorResponse(w, r, apperr.ErrMethodNotAllowed)
 }
 
-// SendGenericNotAuthorizedResponse returns a generic 401 error
-func SendGenericNotAuthorizedResponse(w http.ResponseWriter, r *http.Request) {
-	sendResponse(&model.GenericResponse{Error: "Not Authorized", Code: http.StatusUnauthorized, Message: "User is not authorized"}, http.StatusMethodNotAllowed, w)
+func sendResponse(payload interface{}, status int, w http.ResponseWriter) {
+	writeJSON(payload, "application/json; charset=UTF-8", status, w)
 }
 
-func sendResponse(payload interface{}, status int, w http.ResponseWriter) {
-	w.WriteHeader(status)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	enc := json.NewEncoder(w)
-	err := enc.Encode(payload)
+func writeJSON(payload interface{}, contentType string, status int, w http.ResponseWriter) {
+	b, err := json.Marshal(payload)
 	if err != nil {
-		log.Println(err)
+		slog.Error("cannot encode response", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
 		return
 	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
 }
 
-func sendErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
-	log.Println(err)
+// SendErrorResponse reports the error to the client as an RFC 7807 problem, using the status and code of the sentinel
+// error it wraps
+func SendErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	e := apperr.Lookup(err)
+	if e.Status >= http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), "request failed", "code", e.Code, "error", err)
+	} else {
+		slog.DebugContext(r.Context(), "request rejected", "code", e.Code, "error", err)
+	}
 
-	switch err.Error() {
-	case app.InvalidTokenError:
-		SendGenericNotAuthorizedResponse(w, r)
-	case app.UserExistsError, app.InvalidUserError, app.InvalidRequestError:
-		SendGenericBadRequestResponse(w, r)
-	default:
-		SendGenericInternalServerError(w, r)
+	problem := model.Problem{
+		Type:      problemTypePrefix + strings.ToLower(strings.ReplaceAll(e.Code, "_", "-")),
+		Title:     e.Title,
+		Status:    e.Status,
+		Detail:    apperr.Detail(err),
+		Instance:  r.URL.Path,
+		Code:      e.Code,
+		RequestID: app.RequestID(r.Context()),
+		Errors:    apperr.Fields(err),
+		Challenge: apperr.Challenge(err),
 	}
 
-}
\ No newline at end of file
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	if after := apperr.RetryAfter(err); after > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(after.Seconds()))))
+	}
+
+	writeJSON(problem, "application/problem+json", e.Status, w)
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendErrorResponse(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/users", nil)
+	request = request.WithContext(app.WithRequestID(request.Context(), "abc123"))
+	response := httptest.NewRecorder()
+
+	err := apperr.Validation(model.FieldError{Field: "user", Code: "required", Message: "user is required"})
+	SendErrorResponse(response, request, err)
+
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status, have: %v, want: %v", response.Code, http.StatusBadRequest)
+	}
+	if response.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("unexpected content type, have: %v", response.Header().Get("Content-Type"))
+	}
+
+	problem := model.Problem{}
+	_ = json.NewDecoder(response.Body).Decode(&problem)
+	if problem.Code != apperr.ErrValidation.Code || problem.Status != http.StatusBadRequest {
+		t.Errorf("unexpected problem, have: %+v", problem)
+	}
+	if problem.RequestID != "abc123" || problem.Instance != "/users" {
+		t.Errorf("problem should identify the request, have: %+v", problem)
+	}
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "user" {
+		t.Errorf("problem should include field errors, have: %+v", problem.Errors)
+	}
+
+	// Unauthorized responses tell the client how to authenticate
+	response = httptest.NewRecorder()
+	SendErrorResponse(response, request, apperr.ErrInvalidToken)
+	if response.Code != http.StatusUnauthorized || response.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("unexpected unauthorized response, have: %v", response.Code)
+	}
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/auth"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"net/http"
+)
+
+// Login checks the user's password and returns a token. Users with two-factor authentication enabled get a
+// TWO_FACTOR_REQUIRED problem with a challenge instead, which they finish the login with at /login/2fa
+func Login(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	body := model.LoginRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	userID, err := lib.AuthenticateUserDB(r.Context(), body.User, body.Password)
+	if err != nil {
+		return
+	}
+
+	token, err := auth.GenerateUserToken(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	sendResponse(model.LoginResponse{UserID: userID, Token: token}, http.StatusOK, w)
+}
+
+// FinishTwoFactorLogin checks the code for a login whose password was accepted, and returns a token
+func FinishTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	body := model.TwoFactorLoginRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	userID, err := lib.FinishTwoFactorLoginDB(r.Context(), body)
+	if err != nil {
+		return
+	}
+
+	token, err := auth.GenerateUserToken(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	sendResponse(model.LoginResponse{UserID: userID, Token: token}, http.StatusOK, w)
+}
+
+// CreateSession checks the user's password and starts a browser session. The token is only handed to the browser in an
+// HttpOnly cookie, while the CSRF token is returned so front ends on other origins can send it. Like Login, users with
+// two-factor authentication enabled are given a challenge to finish at /session/2fa
+func CreateSession(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	body := model.LoginRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	userID, err := lib.AuthenticateUserDB(r.Context(), body.User, body.Password)
+	if err != nil {
+		return
+	}
+
+	err = startSession(w, r, userID)
+}
+
+// FinishTwoFactorSession checks the code for a login whose password was accepted, and starts a browser session
+func FinishTwoFactorSession(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	body := model.TwoFactorLoginRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	userID, err := lib.FinishTwoFactorLoginDB(r.Context(), body)
+	if err != nil {
+		return
+	}
+
+	err = startSession(w, r, userID)
+}
+
+// startSession starts a browser session for the user, setting its cookies and sending its CSRF token
+func startSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	session, err := lib.CreateSessionDB(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	token, err := auth.GenerateSessionToken(r.Context(), session)
+	if err != nil {
+		return err
+	}
+
+	auth.SetSessionCookies(w, token, session)
+	sendResponse(model.CreateSessionResponse{
+		UserID:    userID,
+		CSRFToken: auth.CSRFToken(session.SessionID),
+		Expires:   session.Expires,
+	}, http.StatusOK, w)
+	return nil
+}
+
+// DeleteSession ends the browser session and clears its cookies
+func DeleteSession(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	_, err = auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	if sessionID := auth.SessionID(r); sessionID != "" {
+		err = lib.DeleteSessionDB(r.Context(), sessionID)
+		if err != nil {
+			return
+		}
+	}
+
+	auth.ClearSessionCookies(w)
+	sendResponse(model.GenericResponse{Message: "Logged out"}, http.StatusOK, w)
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/auth"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"log/slog"
+	"net/http"
+)
+
+// GetSyncChanges handles the request to retrieve every note created, updated or deleted since the client's last sync
+func GetSyncChanges(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	since, err := lib.DecodeSyncToken(r.URL.Query().Get("since"))
+	if err != nil {
+		return
+	}
+
+	changes, latest, err := lib.GetSyncChangesDB(r.Context(), userID, since)
+	if err != nil {
+		return
+	}
+
+	sendResponse(model.GetSyncChangesResponse{Changes: changes, Token: lib.EncodeSyncToken(latest)}, http.StatusOK, w)
+}
+
+// UploadSyncChanges handles the request to apply a batch of changes made while the client was offline
+func UploadSyncChanges(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	body := model.SyncUploadRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBulkBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	maxChanges := app.Context.Config.Limits.MaxBatchSize
+	if len(body.Changes) > maxChanges {
+		err = apperr.Validation(model.FieldError{Field: "changes", Code: "too_long", Message: fmt.Sprintf("changes must have at most %d items", maxChanges)})
+		return
+	}
+
+	// Each change is applied on its own, so a conflict on one note doesn't prevent the rest from syncing
+	results := make([]model.SyncUploadResult, 0, len(body.Changes))
+	for _, item := range body.Changes {
+		result, applyErr := lib.ApplySyncChangeDB(r.Context(), userID, item)
+		if applyErr != nil {
+			slog.ErrorContext(r.Context(), "cannot apply sync change", "note_id", item.NoteID, "error", applyErr)
+			result = model.SyncUploadResult{ClientID: item.ClientID, NoteID: item.NoteID, Status: lib.SyncRejected, Error: apperr.ErrInternal.Code}
+		}
+		results = append(results, result)
+	}
+
+	sendResponse(model.SyncUploadResponse{Results: results}, http.StatusOK, w)
+}
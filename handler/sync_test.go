@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func initSyncTest() *mux.Router {
+	router := initNotesTest()
+	router.HandleFunc("/sync", GetSyncChanges).Methods("GET")
+	router.HandleFunc("/sync", UploadSyncChanges).Methods("POST")
+	return router
+}
+
+func getSyncChanges(router *mux.Router, token string, since string) (model.GetSyncChangesResponse, int) {
+	var changes model.GetSyncChangesResponse
+	request, _ := http.NewRequest("GET", "/sync?since="+since, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	_ = json.NewDecoder(response.Body).Decode(&changes)
+	return changes, response.Code
+}
+
+func TestGetSyncChanges(t *testing.T) {
+	router := initSyncTest()
+	user, err := createTestUser(router, "test.account")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// Notes created through the regular API show up in a full sync
+	noteID, err := createValidTestNote(router, model.CreateNoteRequest{Content: "This is a test note"}, user.Token)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	full, code := getSyncChanges(router, user.Token, "")
+	if code != 200 {
+		t.Errorf("sync should have succeeded, have: %v, want: %v", code, 200)
+	}
+	if len(full.Changes) != 1 || full.Changes[0].NoteID != noteID {
+		t.Errorf("unexpected changes in full sync: %+v", full.Changes)
+	}
+
+	// Deleting the note produces a tombstone since the last token
+	request, _ := http.NewRequest("DELETE", "/notes/"+fmt.Sprint(noteID), nil)
+	request.Header.Set("Authorization", "Bearer "+user.Token)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != 200 {
+		t.Errorf("delete should have succeeded, have: %v", response.Code)
+	}
+	delta, code := getSyncChanges(router, user.Token, full.Token)
+	if code != 200 {
+		t.Errorf("sync should have succeeded, have: %v, want: %v", code, 200)
+	}
+	if len(delta.Changes) != 1 || !delta.Changes[0].Deleted {
+		t.Errorf("expected a tombstone, have: %+v", delta.Changes)
+	}
+
+	// Garbage tokens are rejected
+	_, code = getSyncChanges(router, user.Token, "garbage")
+	if code == 200 {
+		t.Errorf("sync with an invalid token should have failed")
+	}
+
+	// Sync requires a valid token
+	_, code = getSyncChanges(router, "", "")
+	if code == 200 {
+		t.Errorf("sync without a token should have failed")
+	}
+}
+
+func TestUploadSyncChanges(t *testing.T) {
+	router := initSyncTest()
+	user, err := createTestUser(router, "test.account")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	upload := model.SyncUploadRequest{Changes: []model.SyncUploadItem{
+		{ClientID: "new", Content: "written offline"},
+		{ClientID: "missing", NoteID: 424242, Content: "not mine"},
+	}}
+	j, _ := json.Marshal(upload)
+	request, _ := http.NewRequest("POST", "/sync", bytes.NewBuffer(j))
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	request.Header.Set("Authorization", "Bearer "+user.Token)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != 200 {
+		t.Errorf("upload should have succeeded, have: %v, want: %v", response.Code, 200)
+	}
+
+	r := model.SyncUploadResponse{}
+	err = json.NewDecoder(response.Body).Decode(&r)
+	if err != nil {
+		t.Errorf("unable to parse response")
+	}
+	if len(r.Results) != 2 {
+		t.Fatalf("expected a result per change, have: %v", len(r.Results))
+	}
+	if r.Results[0].Status != lib.SyncApplied || r.Results[0].NoteID == 0 {
+		t.Errorf("create should have been applied, have: %+v", r.Results[0])
+	}
+	if r.Results[1].Status != lib.SyncRejected {
+		t.Errorf("change to unknown note should have been rejected, have: %+v", r.Results[1])
+	}
+
+	// Deletions don't need content, but other changes do
+	for _, tc := range []struct {
+		item model.SyncUploadItem
+		want int
+	}{
+		{model.SyncUploadItem{ClientID: "delete", NoteID: r.Results[0].NoteID, BaseRevision: r.Results[0].Revision, Deleted: true}, 200},
+		{model.SyncUploadItem{ClientID: "empty"}, http.StatusBadRequest},
+	} {
+		j, _ = json.Marshal(model.SyncUploadRequest{Changes: []model.SyncUploadItem{tc.item}})
+		request, _ = http.NewRequest("POST", "/sync", bytes.NewBuffer(j))
+		request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		request.Header.Set("Authorization", "Bearer "+user.Token)
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != tc.want {
+			t.Errorf("unexpected status for change %q, have: %v, want: %v", tc.item.ClientID, response.Code, tc.want)
+		}
+	}
+}
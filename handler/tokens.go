@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/auth"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"net/http"
+)
+
+// CreateAccessToken issues the user a personal access token, which is only returned this once
+func CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	body := model.CreateAccessTokenRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	token, err := lib.CreateAccessTokenDB(r.Context(), userID, body)
+	if err != nil {
+		return
+	}
+
+	sendResponse(token, http.StatusOK, w)
+}
+
+// ListAccessTokens lists the user's personal access tokens, without their secrets
+func ListAccessTokens(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	tokens, err := lib.ListAccessTokensDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	sendResponse(model.ListAccessTokensResponse{Tokens: tokens}, http.StatusOK, w)
+}
+
+// DeleteAccessToken revokes one of the user's personal access tokens
+func DeleteAccessToken(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	err = lib.DeleteAccessTokenDB(r.Context(), userID, mux.Vars(r)["id"])
+	if err != nil {
+		return
+	}
+
+	sendResponse(model.GenericResponse{Message: "Access token revoked"}, http.StatusOK, w)
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/auth"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"net/http"
+)
+
+// GetTwoFactorStatus tells the user whether two-factor authentication is enabled for their account
+func GetTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	status, err := lib.GetTwoFactorStatusDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	sendResponse(status, http.StatusOK, w)
+}
+
+// StartTwoFactor returns a new secret for the user's authenticator app, along with the otpauth:// URI front ends show
+// as a QR code. It isn't used until it's confirmed
+func StartTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	enrolment, err := lib.StartTwoFactorDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	sendResponse(enrolment, http.StatusOK, w)
+}
+
+// ConfirmTwoFactor enables two-factor authentication with a code from the user's authenticator app, and returns their
+// recovery codes, which are only returned this once
+func ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	body := model.TwoFactorCodeRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	codes, err := lib.ConfirmTwoFactorDB(r.Context(), userID, body.Code)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	sendResponse(codes, http.StatusOK, w)
+}
+
+// DisableTwoFactor turns two-factor authentication off, once the user has entered their password and a code again
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	body := model.DisableTwoFactorRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	err = lib.DisableTwoFactorDB(r.Context(), userID, body)
+	if err != nil {
+		return
+	}
+
+	sendResponse(model.GenericResponse{Message: "Two-factor authentication disabled"}, http.StatusOK, w)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes with new ones, which are only returned this once
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	body := model.TwoFactorCodeRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	codes, err := lib.RegenerateRecoveryCodesDB(r.Context(), userID, body.Code)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	sendResponse(codes, http.StatusOK, w)
+}
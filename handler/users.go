@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/kylegk/notes/app"
@@ -15,7 +17,7 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer func() {
 		if err != nil {
-			sendErrorResponse(w, r, err)
+			SendErrorResponse(w, r, err)
 			return
 		}
 	}()
@@ -24,21 +26,208 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	// If this were a production ready application, this is where we'd verify account creation access
 
 	body := model.CreateUserRequest{}
-	err = json.NewDecoder(r.Body).Decode(&body)
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
 	if err != nil {
-		err = fmt.Errorf(app.InvalidRequestError)
 		return
 	}
 
-	userID, err := lib.InsertUserDB(body.User)
+	userID, err := lib.InsertUserDB(r.Context(), body.User, body.Password)
 	if err != nil {
 		return
 	}
+	app.CurrentRequest(r.Context()).UserID = userID
 
-	token, err := auth.GenerateUserToken(userID)
+	token, err := auth.GenerateUserToken(r.Context(), userID)
 	if err != nil {
 		return
 	}
 
 	sendResponse(model.CreateUserResponse{UserID: userID, Token: token}, http.StatusOK, w)
-}
\ No newline at end of file
+}
+
+// GetUsage returns how much the user has stored, along with their quotas
+func GetUsage(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	usage, err := lib.GetUsageDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	quotas := app.Context.Config.Quotas
+	sendResponse(model.GetUsageResponse{
+		Notes: usage.Notes,
+		Bytes: usage.Bytes,
+		Limits: model.UsageLimits{
+			MaxNotes:     quotas.MaxNotes,
+			MaxBytes:     quotas.MaxTotalBytes,
+			MaxNoteBytes: quotas.MaxNoteBytes,
+		},
+	}, http.StatusOK, w)
+}
+
+// GetCurrentUser returns the profile of the user the token was issued to
+func GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	profile, err := lib.GetProfileDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	sendResponse(profile, http.StatusOK, w)
+}
+
+// UpdateCurrentUser renames the user the token was issued to, or changes their display name or settings
+func UpdateCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	body := model.UpdateProfileRequest{}
+	err = decodeRequest(w, r, app.Context.Config.Limits.MaxBodySize, &body)
+	if err != nil {
+		return
+	}
+
+	profile, err := lib.UpdateProfileDB(r.Context(), userID, body)
+	if err != nil {
+		return
+	}
+
+	sendResponse(profile, http.StatusOK, w)
+}
+
+// DeleteCurrentUser deletes the user the token was issued to, along with their notes, sync history and sessions
+func DeleteCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	err = lib.DeleteUserDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	if app.Context.Config.Auth.Sessions.Enabled {
+		auth.ClearSessionCookies(w)
+	}
+	sendResponse(model.GenericResponse{Message: "User deleted"}, http.StatusOK, w)
+}
+
+// ExportCurrentUser returns a zip archive of everything held about the user the token was issued to
+func ExportCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}()
+
+	userID, err := auth.ValidateUserToken(r)
+	if err != nil {
+		return
+	}
+
+	export, err := lib.ExportUserDB(r.Context(), userID)
+	if err != nil {
+		return
+	}
+
+	archive, err := exportArchive(export)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="notes-%s.zip"`, export.Account.User))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive)
+}
+
+// exportArchive lays the export out as account.json, describing the user, and notes.json, holding every note, along with
+// the content of each note in notes/ID.txt so it can be read without any tools
+func exportArchive(export model.UserExport) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	add := func(name string, b []byte) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(b)
+		return err
+	}
+	addJSON := func(name string, v interface{}) error {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, append(b, '\n'))
+	}
+
+	err := addJSON("account.json", export.Account)
+	if err != nil {
+		return nil, err
+	}
+	err = addJSON("notes.json", export.Notes)
+	if err != nil {
+		return nil, err
+	}
+	for _, note := range export.Notes {
+		err = add(fmt.Sprintf("notes/%d.txt", note.NoteID), []byte(note.Content))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
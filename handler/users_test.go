@@ -1,11 +1,16 @@
 package handler
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/lib"
 	"github.com/kylegk/notes/model"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -43,10 +48,209 @@ func TestCreateUser(t *testing.T) {
 	response = httptest.NewRecorder()
 	router.ServeHTTP(response, request)
 
-	// Verify status code is 405
+	// Verify status code is 409
 	have = response.Code
-	want = 405
+	want = 409
 	if have != want {
 		t.Errorf("failed to create user, status code: %v", response.Code)
 	}
-}
\ No newline at end of file
+}
+
+func TestGetUsage(t *testing.T) {
+	router := initNotesTest()
+	router.HandleFunc("/users/me/usage", GetUsage).Methods("GET")
+	app.Context.Config.Quotas.MaxNotes = 1
+
+	user, err := createTestUser(router, "test.account")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	_, err = createValidTestNote(router, model.CreateNoteRequest{Content: "This is a test note"}, user.Token)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// Notes over the quota are refused
+	j, _ := json.Marshal(model.CreateNoteRequest{Content: "One too many"})
+	request, _ := http.NewRequest("POST", "/notes", bytes.NewBuffer(j))
+	request.Header.Set("Authorization", "Bearer "+user.Token)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	have := response.Code
+	want := 507
+	if have != want {
+		t.Errorf("create should have exceeded the quota, have: %v, want: %v", have, want)
+	}
+
+	request, _ = http.NewRequest("GET", "/users/me/usage", nil)
+	request.Header.Set("Authorization", "Bearer "+user.Token)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var usage model.GetUsageResponse
+	_ = json.NewDecoder(response.Body).Decode(&usage)
+	if response.Code != 200 || usage.Notes != 1 || usage.Bytes != int64(len("This is a test note")) || usage.Limits.MaxNotes != 1 {
+		t.Errorf("usage should reflect the stored note, have: %v %+v", response.Code, usage)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	router := initUsersTests()
+	router.HandleFunc("/login", Login).Methods("POST")
+
+	post := func(path string, payload interface{}) *httptest.ResponseRecorder {
+		j, _ := json.Marshal(payload)
+		request, _ := http.NewRequest("POST", path, bytes.NewBuffer(j))
+		request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	// Passwords that are too short are rejected
+	response := post("/users", model.CreateUserRequest{User: "test.account", Password: "short"})
+	have := response.Code
+	want := 400
+	if have != want {
+		t.Errorf("short password should have been rejected, have: %v, want: %v", have, want)
+	}
+
+	response = post("/users", model.CreateUserRequest{User: "test.account", Password: "correct horse"})
+	if response.Code != 200 {
+		t.Fatalf("failed to create user, status code: %v", response.Code)
+	}
+
+	// The right password returns a token
+	response = post("/login", model.LoginRequest{User: "test.account", Password: "correct horse"})
+	var login model.LoginResponse
+	_ = json.NewDecoder(response.Body).Decode(&login)
+	if response.Code != 200 || login.UserID == 0 || login.Token == "" {
+		t.Errorf("login should have succeeded, have: %v %+v", response.Code, login)
+	}
+
+	// The wrong one doesn't
+	response = post("/login", model.LoginRequest{User: "test.account", Password: "wrong horse"})
+	have = response.Code
+	want = 401
+	if have != want {
+		t.Errorf("login with the wrong password should have failed, have: %v, want: %v", have, want)
+	}
+}
+
+func TestExportAndDeleteCurrentUser(t *testing.T) {
+	router := initNotesTest()
+	router.HandleFunc("/users/me", DeleteCurrentUser).Methods("DELETE")
+	router.HandleFunc("/users/me/export", ExportCurrentUser).Methods("GET")
+
+	do := func(method string, path string, token string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, path, nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	user, _ := createTestUser(router, "test.account")
+	other, _ := createTestUser(router, "other.account")
+	noteID, _ := createValidTestNote(router, model.CreateNoteRequest{Content: "This is a test note"}, user.Token)
+	otherNoteID, _ := createValidTestNote(router, model.CreateNoteRequest{Content: "Another user's note"}, other.Token)
+
+	// The archive holds the account, and each note both in notes.json and on its own
+	response := do("GET", "/users/me/export", user.Token)
+	if response.Code != 200 || response.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("failed to export user, have: %v %s", response.Code, response.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(response.Body.Bytes()), int64(response.Body.Len()))
+	if err != nil {
+		t.Fatalf("export should be a zip archive: %s", err.Error())
+	}
+	files := map[string]string{}
+	for _, f := range archive.File {
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+	var account model.ExportedAccount
+	_ = json.Unmarshal([]byte(files["account.json"]), &account)
+	var notes []model.Note
+	_ = json.Unmarshal([]byte(files["notes.json"]), &notes)
+	if account.UserID != user.UserID || account.User != "test.account" || account.Notes != 1 {
+		t.Errorf("archive should describe the account, have: %+v", account)
+	}
+	if len(notes) != 1 || notes[0].NoteID != noteID || files[fmt.Sprintf("notes/%d.txt", noteID)] != "This is a test note" {
+		t.Errorf("archive should only hold the user's note, have: %v", files)
+	}
+
+	// Deleting the account removes the user's notes and revokes their token, leaving other users alone
+	response = do("DELETE", "/users/me", user.Token)
+	if response.Code != 200 {
+		t.Fatalf("failed to delete user, have: %v %s", response.Code, response.Body.String())
+	}
+	if code := do("GET", "/notes", user.Token).Code; code != 401 {
+		t.Errorf("deleted user's token should have been refused, have: %v", code)
+	}
+	if note, _ := lib.GetNoteDB(context.Background(), noteID); note.NoteID != 0 {
+		t.Errorf("deleted user's note should have been removed")
+	}
+	if code := do("GET", fmt.Sprintf("/notes/%d", otherNoteID), other.Token).Code; code != 200 {
+		t.Errorf("other user's note should have been kept, have: %v", code)
+	}
+}
+
+func TestUpdateCurrentUser(t *testing.T) {
+	router := initNotesTest()
+	router.HandleFunc("/users/me", GetCurrentUser).Methods("GET")
+	router.HandleFunc("/users/me", UpdateCurrentUser).Methods("PATCH")
+
+	do := func(method string, path string, token string, body string) (int, model.UserProfile) {
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		var profile model.UserProfile
+		_ = json.NewDecoder(response.Body).Decode(&profile)
+		return response.Code, profile
+	}
+
+	user, _ := createTestUser(router, "test.account")
+	_, _ = createTestUser(router, "other.account")
+
+	// Settings take their defaults until they're changed
+	code, profile := do("GET", "/users/me", user.Token, "")
+	want := model.UserSettings{NoteFormat: model.NoteFormatPlain, Timezone: "UTC"}
+	if code != 200 || profile.User != "test.account" || profile.Settings != want {
+		t.Errorf("profile should have the default settings, have: %v %+v", code, profile)
+	}
+
+	// Only the fields given are changed
+	code, profile = do("PATCH", "/users/me", user.Token, `{"displayname": "Test Account", "settings": {"timezone": "Europe/London"}}`)
+	want.Timezone = "Europe/London"
+	if code != 200 || profile.DisplayName != "Test Account" || profile.Settings != want {
+		t.Errorf("display name and time zone should have been changed, have: %v %+v", code, profile)
+	}
+	code, profile = do("PATCH", "/users/me", user.Token, `{"settings": {"noteformat": "markdown", "defaultnotebook": "Work"}}`)
+	want.NoteFormat, want.DefaultNotebook = model.NoteFormatMarkdown, "Work"
+	if code != 200 || profile.DisplayName != "Test Account" || profile.Settings != want {
+		t.Errorf("other settings should have been kept, have: %v %+v", code, profile)
+	}
+
+	// Names must still be unique, and renamed users keep their token but log in with the new name
+	if code, _ = do("PATCH", "/users/me", user.Token, `{"user": "other.account"}`); code != 409 {
+		t.Errorf("name that's taken should have been refused, have: %v", code)
+	}
+	if code, _ = do("PATCH", "/users/me", user.Token, `{"user": "x"}`); code != 400 {
+		t.Errorf("invalid name should have been refused, have: %v", code)
+	}
+	code, profile = do("PATCH", "/users/me", user.Token, `{"user": "renamed.account"}`)
+	if code != 200 || profile.User != "renamed.account" {
+		t.Errorf("user should have been renamed, have: %v %+v", code, profile)
+	}
+	if code, _ = do("GET", "/users/me", user.Token, ""); code != 200 {
+		t.Errorf("token should still be valid after renaming, have: %v", code)
+	}
+	if _, err := createTestUser(router, "test.account"); err != nil {
+		t.Errorf("old name should be free once the user has been renamed, have: %v", err)
+	}
+}
@@ -0,0 +1,436 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ListUsersDB lists the users whose name contains the query, ignoring case, in ascending order of ID. It returns up to
+// limit users after the cursor, every one when limit is 0, along with the cursor for the next page, which is 0 on the
+// last page
+func ListUsersDB(ctx context.Context, query string, after int, limit int) (_ []model.UserSummary, next int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.ListUsersDB")
+	defer tracing.End(span, &err)
+
+	query = strings.ToLower(query)
+	users := make([]model.UserSummary, 0)
+	err = app.Context.DB.View(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.UsersTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+
+		// The index doesn't keep integer IDs in numeric order, so the users are sorted before the cursor is applied
+		accounts := make([]model.UserAccount, 0, len(res))
+		for _, row := range res {
+			accounts = append(accounts, row.(model.UserAccount))
+		}
+		sort.Slice(accounts, func(i, j int) bool { return accounts[i].UserID < accounts[j].UserID })
+
+		for _, account := range accounts {
+			if account.UserID <= after || !strings.Contains(strings.ToLower(account.User), query) {
+				continue
+			}
+
+			if limit > 0 && len(users) == limit {
+				next = users[len(users)-1].UserID
+				return nil
+			}
+
+			summary, err := summarise(ctx, txn, account)
+			if err != nil {
+				return err
+			}
+			users = append(users, summary)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return users, next, nil
+}
+
+// GetUserSummaryDB describes a user to administrators
+func GetUserSummaryDB(ctx context.Context, userID int) (_ model.UserSummary, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetUserSummaryDB")
+	defer tracing.End(span, &err)
+
+	account, err := getUser(ctx, &app.Context.DB, userID)
+	if err != nil {
+		return model.UserSummary{}, err
+	}
+
+	return summarise(ctx, &app.Context.DB, account)
+}
+
+// UpdateUserDB changes a user's role or disables them. Disabling a user, or demoting them, revokes their tokens, and the
+// last administrator can't be disabled or demoted
+func UpdateUserDB(ctx context.Context, userID int, update model.UpdateUserRequest) (_ model.UserSummary, err error) {
+	ctx, span := tracing.Start(ctx, "lib.UpdateUserDB")
+	defer tracing.End(span, &err)
+
+	var summary model.UserSummary
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		account, err := getUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+
+		changed := account
+		if update.Role != nil {
+			changed.Role = *update.Role
+		}
+		if update.Disabled != nil {
+			changed.Disabled = *update.Disabled
+		}
+
+		demoted := account.Role == model.RoleAdmin && changed.Role != model.RoleAdmin
+		disabled := !account.Disabled && changed.Disabled
+		if demoted || disabled {
+			err = ensureAnotherAdmin(ctx, txn, account)
+			if err == nil {
+				err = revokeTokens(ctx, txn, changed)
+			}
+		} else {
+			err = txn.Upsert(ctx, db.UsersTable, changed)
+		}
+		if err != nil {
+			return err
+		}
+
+		summary, err = summarise(ctx, txn, changed)
+		return err
+	})
+	if err != nil {
+		return model.UserSummary{}, err
+	}
+
+	return summary, nil
+}
+
+// GetStatsDB counts the users, notes and sessions held by the server
+func GetStatsDB(ctx context.Context) (_ model.SystemStats, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetStatsDB")
+	defer tracing.End(span, &err)
+
+	var stats model.SystemStats
+	err = app.Context.DB.View(ctx, func(ctx context.Context, txn *db.Txn) error {
+		users, err := txn.Query(ctx, db.UsersTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range users {
+			account := row.(model.UserAccount)
+			stats.Users++
+			if account.Disabled {
+				stats.DisabledUsers++
+			} else if account.Role == model.RoleAdmin {
+				stats.Admins++
+			}
+		}
+
+		notes, err := txn.Query(ctx, db.NotesTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range notes {
+			stats.Notes++
+			stats.Bytes += int64(len(row.(model.Note).Content))
+		}
+
+		sessions, err := txn.Query(ctx, db.SessionsTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		for _, row := range sessions {
+			if row.(model.Session).Expires > now {
+				stats.ActiveSessions++
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return model.SystemStats{}, err
+	}
+
+	return stats, nil
+}
+
+func summarise(ctx context.Context, s db.Store, account model.UserAccount) (model.UserSummary, error) {
+	usage, err := getUsage(ctx, s, account.UserID)
+	if err != nil {
+		return model.UserSummary{}, err
+	}
+
+	return model.UserSummary{
+		UserID:   account.UserID,
+		User:     account.User,
+		Role:     roleOf(account),
+		Disabled: account.Disabled,
+		Notes:    usage.Notes,
+		Bytes:    usage.Bytes,
+	}, nil
+}
+
+// CompactDB removes what's no longer needed from the data store: expired sessions, idempotency records, access tokens,
+// identity provider logins and two-factor login challenges, and signing keys that can't have signed a token that's
+// still valid. It returns how many rows were removed from each table
+func CompactDB(ctx context.Context) (_ map[string]int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.CompactDB")
+	defer tracing.End(span, &err)
+
+	now := time.Now()
+	removed := map[string]int{db.SessionsTable: 0, db.IdempotencyKeysTable: 0, db.AccessTokensTable: 0, db.OIDCLoginsTable: 0, db.LoginChallengesTable: 0, db.SigningKeysTable: 0}
+
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		sessions, err := txn.Query(ctx, db.SessionsTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range sessions {
+			if session := row.(model.Session); session.Expires <= now.Unix() {
+				_, err = txn.Delete(ctx, db.SessionsTable, db.IDIdx, session.SessionID)
+				if err != nil {
+					return err
+				}
+				removed[db.SessionsTable]++
+			}
+		}
+
+		records, err := txn.Query(ctx, db.IdempotencyKeysTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range records {
+			if record := row.(model.IdempotencyRecord); record.Expires <= now.Unix() {
+				_, err = txn.Delete(ctx, db.IdempotencyKeysTable, db.IDIdx, record.Key)
+				if err != nil {
+					return err
+				}
+				removed[db.IdempotencyKeysTable]++
+			}
+		}
+
+		tokens, err := txn.Query(ctx, db.AccessTokensTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range tokens {
+			if token := row.(model.AccessToken); token.Expires != 0 && token.Expires <= now.Unix() {
+				_, err = txn.Delete(ctx, db.AccessTokensTable, db.IDIdx, token.TokenID)
+				if err != nil {
+					return err
+				}
+				removed[db.AccessTokensTable]++
+			}
+		}
+
+		logins, err := txn.Query(ctx, db.OIDCLoginsTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range logins {
+			if login := row.(model.OIDCLogin); login.Expires <= now.Unix() {
+				_, err = txn.Delete(ctx, db.OIDCLoginsTable, db.IDIdx, login.State)
+				if err != nil {
+					return err
+				}
+				removed[db.OIDCLoginsTable]++
+			}
+		}
+
+		challenges, err := txn.Query(ctx, db.LoginChallengesTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range challenges {
+			if challenge := row.(model.LoginChallenge); challenge.Expires <= now.Unix() {
+				_, err = txn.Delete(ctx, db.LoginChallengesTable, db.IDIdx, challenge.ChallengeID)
+				if err != nil {
+					return err
+				}
+				removed[db.LoginChallengesTable]++
+			}
+		}
+
+		removed[db.SigningKeysTable], err = pruneSigningKeys(ctx, txn, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// VerifyDB checks the data store is consistent: every note has exactly one owner who exists, the change log agrees with
+// the notes, usage totals match the notes each user owns, and the id sequences are ahead of every id in use. It returns
+// a description of each problem found
+func VerifyDB(ctx context.Context) (_ []string, err error) {
+	ctx, span := tracing.Start(ctx, "lib.VerifyDB")
+	defer tracing.End(span, &err)
+
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	err = app.Context.DB.View(ctx, func(ctx context.Context, txn *db.Txn) error {
+		users := map[int]bool{}
+		maxUserID := 0
+		res, err := txn.Query(ctx, db.UsersTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			account := row.(model.UserAccount)
+			users[account.UserID] = true
+			maxUserID = max(maxUserID, account.UserID)
+		}
+
+		notes := map[int]model.Note{}
+		maxNoteID := 0
+		res, err = txn.Query(ctx, db.NotesTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			note := row.(model.Note)
+			notes[note.NoteID] = note
+			maxNoteID = max(maxNoteID, note.NoteID)
+		}
+
+		owners := map[int]int{}
+		usage := map[int]*model.UserUsage{}
+		res, err = txn.Query(ctx, db.UserNotesTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			userNote := row.(model.UserNote)
+			owners[userNote.NoteID] = userNote.UserID
+			maxNoteID = max(maxNoteID, userNote.NoteID)
+
+			if !users[userNote.UserID] {
+				problem("%s: note %d is owned by user %d, who does not exist", db.UserNotesTable, userNote.NoteID, userNote.UserID)
+			}
+			note, ok := notes[userNote.NoteID]
+			if !ok {
+				problem("%s: user %d owns note %d, which does not exist", db.UserNotesTable, userNote.UserID, userNote.NoteID)
+				continue
+			}
+
+			u, ok := usage[userNote.UserID]
+			if !ok {
+				u = &model.UserUsage{UserID: userNote.UserID}
+				usage[userNote.UserID] = u
+			}
+			u.Notes++
+			u.Bytes += int64(len(note.Content))
+		}
+		for noteID := range notes {
+			if _, ok := owners[noteID]; !ok {
+				problem("%s: note %d has no owner", db.NotesTable, noteID)
+			}
+		}
+
+		maxSeq := 0
+		res, err = txn.Query(ctx, db.NoteChangesTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			change := row.(model.NoteChange)
+			maxSeq = max(maxSeq, change.Seq)
+			maxNoteID = max(maxNoteID, change.NoteID)
+
+			_, exists := notes[change.NoteID]
+			switch {
+			case change.Deleted && exists:
+				problem("%s: note %d is recorded as deleted but still exists", db.NoteChangesTable, change.NoteID)
+			case !change.Deleted && !exists:
+				problem("%s: note %d is recorded as changed but does not exist", db.NoteChangesTable, change.NoteID)
+			case !change.Deleted && owners[change.NoteID] != change.UserID:
+				problem("%s: note %d is recorded as changed by user %d but is owned by user %d", db.NoteChangesTable, change.NoteID, change.UserID, owners[change.NoteID])
+			}
+		}
+
+		res, err = txn.Query(ctx, db.UserUsageTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			stored := row.(model.UserUsage)
+			if _, ok := usage[stored.UserID]; !ok {
+				usage[stored.UserID] = &model.UserUsage{UserID: stored.UserID}
+			}
+			if want := *usage[stored.UserID]; stored != want {
+				problem("%s: user %d is recorded as storing %d notes and %d bytes, but stores %d notes and %d bytes", db.UserUsageTable, stored.UserID, stored.Notes, stored.Bytes, want.Notes, want.Bytes)
+			}
+			delete(usage, stored.UserID)
+		}
+		for _, u := range usage {
+			problem("%s: user %d stores %d notes and %d bytes, but has no usage recorded", db.UserUsageTable, u.UserID, u.Notes, u.Bytes)
+		}
+
+		res, err = txn.Query(ctx, db.SessionsTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			if session := row.(model.Session); !users[session.UserID] {
+				problem("%s: a session belongs to user %d, who does not exist", db.SessionsTable, session.UserID)
+			}
+		}
+
+		res, err = txn.Query(ctx, db.AccessTokensTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			if token := row.(model.AccessToken); !users[token.UserID] {
+				problem("%s: token %s belongs to user %d, who does not exist", db.AccessTokensTable, token.TokenID, token.UserID)
+			}
+		}
+
+		res, err = txn.Query(ctx, db.IdentitiesTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			if identity := row.(model.Identity); !users[identity.UserID] {
+				problem("%s: identity %s at %s is linked to user %d, who does not exist", db.IdentitiesTable, identity.Subject, identity.Issuer, identity.UserID)
+			}
+		}
+
+		// Sequences behind the data would hand out ids that are already in use
+		if current := db.GetCurrentNoteID(); current < maxNoteID {
+			problem("note id sequence is at %d, but note %d exists", current, maxNoteID)
+		}
+		if current := db.GetCurrentUserID(); current < maxUserID {
+			problem("user id sequence is at %d, but user %d exists", current, maxUserID)
+		}
+		if current := db.GetCurrentChangeSeq(); current < maxSeq {
+			problem("change sequence is at %d, but change %d exists", current, maxSeq)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	userID, _ := InsertUserDB(ctx, "test.account", "")
+	session, _ := CreateSessionDB(ctx, userID)
+	expired := time.Now().Add(-time.Minute).Unix()
+	_ = app.Context.DB.Upsert(ctx, db.SessionsTable, model.Session{SessionID: "expired", UserID: userID, Expires: expired})
+	_ = app.Context.DB.Upsert(ctx, db.IdempotencyKeysTable, model.IdempotencyRecord{Key: "expired", Expires: expired})
+	_ = SaveIdempotencyRecordDB(ctx, model.IdempotencyRecord{Key: "current"})
+
+	removed, err := CompactDB(ctx)
+	if err != nil {
+		t.Fatalf("failed to compact: %s", err.Error())
+	}
+	if removed[db.SessionsTable] != 1 || removed[db.IdempotencyKeysTable] != 1 {
+		t.Errorf("expired rows should have been removed, have: %v", removed)
+	}
+
+	res, _ := app.Context.DB.Query(ctx, db.SessionsTable, db.IDIdx, session.SessionID)
+	if len(res) != 1 {
+		t.Errorf("current session should have been kept")
+	}
+	if _, ok, _ := GetIdempotencyRecordDB(ctx, "current"); !ok {
+		t.Errorf("current idempotency record should have been kept")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	userID, _ := InsertUserDB(ctx, "test.account", "")
+	noteID, _ := CreateNoteForUserDB(ctx, userID, "first note")
+	_, _ = CreateNoteForUserDB(ctx, userID, "second note")
+	deletedID, _ := CreateNoteForUserDB(ctx, userID, "deleted note")
+	_ = DeleteNoteForUserDB(ctx, userID, deletedID)
+
+	problems, err := VerifyDB(ctx)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("consistent data store should pass, have: %v, %v", problems, err)
+	}
+
+	// Break the data store in a few ways
+	_, _ = app.Context.DB.Delete(ctx, db.NotesTable, db.IDIdx, noteID)
+	_ = app.Context.DB.Upsert(ctx, db.NotesTable, model.Note{NoteID: 99, Content: "orphan"})
+	_ = app.Context.DB.Upsert(ctx, db.UserNotesTable, model.UserNote{UserID: 42, NoteID: deletedID + 100})
+
+	problems, err = VerifyDB(ctx)
+	if err != nil {
+		t.Fatalf("failed to verify: %s", err.Error())
+	}
+
+	want := []string{
+		"user 1 owns note 1, which does not exist",
+		"note 99 has no owner",
+		"owned by user 42, who does not exist",
+		"note 1 is recorded as changed but does not exist",
+		"user 1 is recorded as storing 2 notes",
+		"note id sequence is at 3, but note 103 exists",
+	}
+	report := strings.Join(problems, "\n")
+	for _, w := range want {
+		if !strings.Contains(report, w) {
+			t.Errorf("problem %q should have been reported, have:\n%s", w, report)
+		}
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	for _, user := range []string{"alice.account", "bob.account", "Alice.Other"} {
+		_, _ = InsertUserDB(ctx, user, "")
+	}
+
+	users, next, err := ListUsersDB(ctx, "ALICE", 0, 1)
+	if err != nil || len(users) != 1 || users[0].User != "alice.account" || next != users[0].UserID {
+		t.Fatalf("first page should only hold the first match, have: %+v, %v, %v", users, next, err)
+	}
+	users, next, err = ListUsersDB(ctx, "ALICE", next, 1)
+	if err != nil || len(users) != 1 || users[0].User != "Alice.Other" || next != 0 {
+		t.Errorf("last page should hold the second match, have: %+v, %v, %v", users, next, err)
+	}
+	if users[0].Role != model.RoleUser {
+		t.Errorf("new users should have the user role, have: %v", users[0].Role)
+	}
+}
+
+func TestListUsersPages(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	// Enough users for IDs past the ones that sort out of order in the index
+	for i := 0; i < 150; i++ {
+		_, _ = InsertUserDB(ctx, fmt.Sprintf("user.%d", i), "")
+	}
+
+	seen := map[int]int{}
+	last, after := 0, 0
+	for {
+		users, next, err := ListUsersDB(ctx, "", after, 20)
+		if err != nil {
+			t.Fatalf("failed to list users: %s", err.Error())
+		}
+		for _, user := range users {
+			if user.UserID <= last {
+				t.Errorf("users should be listed in ascending order of ID, have: %d after %d", user.UserID, last)
+			}
+			last = user.UserID
+			seen[user.UserID]++
+		}
+		if next == 0 {
+			break
+		}
+		after = next
+	}
+
+	if len(seen) != 150 {
+		t.Errorf("every user should have been listed, have: %d", len(seen))
+	}
+	for userID, count := range seen {
+		if count != 1 {
+			t.Errorf("user %d should have been listed once, have: %d", userID, count)
+		}
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+	admin, user := model.RoleAdmin, model.RoleUser
+	disabled := true
+
+	adminID, _ := InsertUserDB(ctx, "admin.account", "")
+	userID, _ := InsertUserDB(ctx, "test.account", "correct horse")
+	_, _ = CreateSessionDB(ctx, userID)
+
+	summary, err := UpdateUserDB(ctx, adminID, model.UpdateUserRequest{Role: &admin})
+	if err != nil || summary.Role != model.RoleAdmin {
+		t.Fatalf("user should have been made an administrator, have: %+v, %v", summary, err)
+	}
+
+	// Disabling a user revokes their tokens and ends their sessions
+	summary, err = UpdateUserDB(ctx, userID, model.UpdateUserRequest{Disabled: &disabled})
+	if err != nil || !summary.Disabled {
+		t.Fatalf("user should have been disabled, have: %+v, %v", summary, err)
+	}
+	account, _ := GetUserDB(ctx, userID)
+	res, _ := app.Context.DB.Query(ctx, db.SessionsTable, db.UserIdx, userID)
+	if account.TokenVersion != 1 || len(res) != 0 {
+		t.Errorf("disabled user's tokens should have been revoked, have: version %v, %v sessions", account.TokenVersion, len(res))
+	}
+	if _, err = AuthenticateUserDB(ctx, "test.account", "correct horse"); !errors.Is(err, apperr.ErrAccountDisabled) {
+		t.Errorf("disabled user should not have been able to log in, have: %v", err)
+	}
+
+	// The last administrator can't be demoted, disabled or deleted
+	for what, update := range map[string]model.UpdateUserRequest{"demoted": {Role: &user}, "disabled": {Disabled: &disabled}} {
+		_, err = UpdateUserDB(ctx, adminID, update)
+		if !errors.Is(err, apperr.ErrLastAdmin) {
+			t.Errorf("last administrator should not have been %s, have: %v", what, err)
+		}
+	}
+	if err = DeleteUserDB(ctx, adminID); !errors.Is(err, apperr.ErrLastAdmin) {
+		t.Errorf("last administrator should not have been deleted, have: %v", err)
+	}
+
+	_, err = UpdateUserDB(ctx, 9999, model.UpdateUserRequest{Role: &admin})
+	if !errors.Is(err, apperr.ErrUserNotFound) {
+		t.Errorf("unknown user should have been reported, have: %v", err)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	userID, _ := InsertUserDB(ctx, "test.account", "")
+	otherID, _ := InsertUserDB(ctx, "other.account", "")
+	_, _ = CreateNoteForUserDB(ctx, userID, "first note")
+	_, _ = CreateNoteForUserDB(ctx, userID, "second note")
+	otherNoteID, _ := CreateNoteForUserDB(ctx, otherID, "other note")
+	_, _ = CreateSessionDB(ctx, userID)
+	_ = SaveIdempotencyRecordDB(ctx, model.IdempotencyRecord{Key: "user", UserID: userID})
+	_ = SaveIdempotencyRecordDB(ctx, model.IdempotencyRecord{Key: "other", UserID: otherID})
+
+	err := DeleteUserDB(ctx, userID)
+	if err != nil {
+		t.Fatalf("failed to delete user: %s", err.Error())
+	}
+
+	// Everything the user owned is gone, and what's left is consistent
+	for _, table := range []string{db.UserNotesTable, db.NoteChangesTable, db.SessionsTable, db.IdempotencyKeysTable} {
+		res, _ := app.Context.DB.Query(ctx, table, db.UserIdx, userID)
+		if len(res) != 0 {
+			t.Errorf("user's %s should have been deleted, have: %v", table, res)
+		}
+	}
+	stats, _ := GetStatsDB(ctx)
+	if stats.Users != 1 || stats.Notes != 1 {
+		t.Errorf("only the other user and their note should remain, have: %+v", stats)
+	}
+	if note, _ := GetNoteDB(ctx, otherNoteID); note.NoteID != otherNoteID {
+		t.Errorf("other user's note should have been kept, have: %+v", note)
+	}
+	if _, ok, _ := GetIdempotencyRecordDB(ctx, "other"); !ok {
+		t.Errorf("other user's idempotency record should have been kept")
+	}
+	if problems, _ := VerifyDB(ctx); len(problems) != 0 {
+		t.Errorf("data store should be consistent, have: %v", problems)
+	}
+
+	if err = DeleteUserDB(ctx, userID); !errors.Is(err, apperr.ErrUserNotFound) {
+		t.Errorf("deleted user should not have been found, have: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+)
+
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+
+	// BatchAtomic applies every operation or none of them, BatchBestEffort applies whichever operations succeed
+	BatchAtomic     = "atomic"
+	BatchBestEffort = "best_effort"
+
+	BatchApplied    = "applied"
+	BatchFailed     = "failed"
+	BatchRolledBack = "rolled_back"
+	BatchSkipped    = "skipped"
+)
+
+var errBatchRolledBack = errors.New("batch rolled back")
+
+// ApplyNoteBatchDB applies a list of note operations for the user inside a single transaction, returning a result for
+// every operation and whether the transaction was committed. Operations are validated before anything is written, so a
+// failed operation never leaves partial changes behind, even in best effort mode
+func ApplyNoteBatchDB(ctx context.Context, userID int, mode string, ops []model.BatchOperation) (_ []model.BatchResult, _ bool, err error) {
+	ctx, span := tracing.Start(ctx, "lib.ApplyNoteBatchDB")
+	defer tracing.End(span, &err)
+
+	if mode == "" {
+		mode = BatchAtomic
+	}
+	if mode != BatchAtomic && mode != BatchBestEffort {
+		return nil, false, apperr.Validation(model.FieldError{Field: "mode", Code: "invalid", Message: "mode must be atomic or best_effort"})
+	}
+	maxOps := app.Context.Config.Limits.MaxBatchSize
+	if len(ops) == 0 || len(ops) > maxOps {
+		return nil, false, apperr.Validation(model.FieldError{Field: "operations", Code: "too_long", Message: fmt.Sprintf("operations must contain between 1 and %d items", maxOps)})
+	}
+
+	results := make([]model.BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = model.BatchResult{Index: i, Op: op.Op, NoteID: op.NoteID, Status: BatchSkipped}
+	}
+
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		for i, op := range ops {
+			noteID, err := applyBatchOperation(ctx, txn, userID, op)
+			if err != nil && !apperr.IsClientError(err) {
+				return err
+			}
+
+			if err != nil {
+				results[i].Status = BatchFailed
+				results[i].Error = apperr.Lookup(err).Code
+
+				if mode == BatchAtomic {
+					for j := 0; j < i; j++ {
+						results[j].Status = BatchRolledBack
+					}
+					return errBatchRolledBack
+				}
+				continue
+			}
+
+			results[i].NoteID = noteID
+			results[i].Status = BatchApplied
+		}
+
+		return nil
+	})
+	if errors.Is(err, errBatchRolledBack) {
+		return results, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return results, true, nil
+}
+
+func applyBatchOperation(ctx context.Context, txn *db.Txn, userID int, op model.BatchOperation) (int, error) {
+	switch op.Op {
+	case BatchCreate:
+		noteID, _, err := createUserNote(ctx, txn, userID, op.Content)
+		return noteID, err
+	case BatchUpdate:
+		err := validateNoteOwnership(ctx, txn, userID, op.NoteID)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = updateUserNote(ctx, txn, userID, op.NoteID, op.Content)
+		return op.NoteID, err
+	case BatchDelete:
+		err := validateNoteOwnership(ctx, txn, userID, op.NoteID)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = removeUserNote(ctx, txn, userID, op.NoteID)
+		return op.NoteID, err
+	default:
+		return 0, apperr.New(apperr.ErrInvalidRequest, "unknown operation "+op.Op)
+	}
+}
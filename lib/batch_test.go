@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"context"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/model"
+	"testing"
+)
+
+func TestApplyNoteBatchDB(t *testing.T) {
+	app.Init()
+
+	userID := 1
+	ops := []model.BatchOperation{
+		{Op: BatchCreate, Content: "first"},
+		{Op: BatchCreate, Content: "second"},
+	}
+	results, committed, err := ApplyNoteBatchDB(context.Background(), userID, BatchAtomic, ops)
+	if err != nil || !committed {
+		t.Errorf("batch should have been committed")
+	}
+	for _, result := range results {
+		if result.Status != BatchApplied {
+			t.Errorf("operation should have been applied, have: %+v", result)
+		}
+	}
+	first, second := results[0].NoteID, results[1].NoteID
+
+	// An atomic batch with a bad operation changes nothing
+	ops = []model.BatchOperation{
+		{Op: BatchUpdate, NoteID: first, Content: "updated"},
+		{Op: BatchDelete, NoteID: 99999},
+		{Op: BatchDelete, NoteID: second},
+	}
+	results, committed, err = ApplyNoteBatchDB(context.Background(), userID, BatchAtomic, ops)
+	if err != nil || committed {
+		t.Errorf("batch should have been rolled back")
+	}
+	want := []string{BatchRolledBack, BatchFailed, BatchSkipped}
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("unexpected status for operation %v, have: %v, want: %v", i, result.Status, want[i])
+		}
+	}
+	note, _ := GetNoteDB(context.Background(), first)
+	if note.Content != "first" {
+		t.Errorf("rolled back update was written")
+	}
+
+	// The same batch in best effort mode applies the valid operations
+	results, committed, err = ApplyNoteBatchDB(context.Background(), userID, BatchBestEffort, ops)
+	if err != nil || !committed {
+		t.Errorf("batch should have been committed")
+	}
+	want = []string{BatchApplied, BatchFailed, BatchApplied}
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("unexpected status for operation %v, have: %v, want: %v", i, result.Status, want[i])
+		}
+	}
+	note, _ = GetNoteDB(context.Background(), first)
+	if note.Content != "updated" {
+		t.Errorf("update was not written")
+	}
+	noteIDs, _ := GetAllNotesForUserDB(context.Background(), userID)
+	if len(noteIDs) != 1 {
+		t.Errorf("unexpected number of notes, have: %v, want: %v", len(noteIDs), 1)
+	}
+
+	// Invalid modes and empty batches are rejected outright
+	_, _, err = ApplyNoteBatchDB(context.Background(), userID, "sometimes", ops)
+	if err == nil {
+		t.Errorf("invalid mode should have been rejected")
+	}
+	_, _, err = ApplyNoteBatchDB(context.Background(), userID, BatchAtomic, nil)
+	if err == nil {
+		t.Errorf("empty batch should have been rejected")
+	}
+}
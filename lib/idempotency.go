@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// idempotencySweepInterval is how often the server removes responses whose window has passed. Keys that are never
+// retried would otherwise be kept until the data store is compacted
+const idempotencySweepInterval = 10 * time.Minute
+
+type idempotencyLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+var idempotencyLocksMu sync.Mutex
+var idempotencyLocks = map[string]*idempotencyLock{}
+
+// LockIdempotencyKey serialises requests sharing the same idempotency key, so a concurrent retry waits for the original
+// request to finish and then replays its response. The returned function releases the lock
+func LockIdempotencyKey(key string) func() {
+	idempotencyLocksMu.Lock()
+	lock, ok := idempotencyLocks[key]
+	if !ok {
+		lock = &idempotencyLock{}
+		idempotencyLocks[key] = lock
+	}
+	lock.users++
+	idempotencyLocksMu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		idempotencyLocksMu.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(idempotencyLocks, key)
+		}
+		idempotencyLocksMu.Unlock()
+	}
+}
+
+// GetIdempotencyRecordDB retrieves the stored response for an idempotency key, removing it if the window has passed
+func GetIdempotencyRecordDB(ctx context.Context, key string) (_ model.IdempotencyRecord, _ bool, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetIdempotencyRecordDB")
+	defer tracing.End(span, &err)
+
+	var record model.IdempotencyRecord
+
+	res, err := app.Context.DB.Query(ctx, db.IdempotencyKeysTable, db.IDIdx, key)
+	if err != nil {
+		return record, false, err
+	}
+
+	if len(res) == 0 {
+		return record, false, nil
+	}
+	record = res[0].(model.IdempotencyRecord)
+
+	if time.Now().Unix() >= record.Expires {
+		_, err = app.Context.DB.Delete(ctx, db.IdempotencyKeysTable, db.IDIdx, key)
+		return model.IdempotencyRecord{}, false, err
+	}
+
+	return record, true, nil
+}
+
+// SaveIdempotencyRecordDB stores the response for an idempotency key until the window has passed
+func SaveIdempotencyRecordDB(ctx context.Context, record model.IdempotencyRecord) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.SaveIdempotencyRecordDB")
+	defer tracing.End(span, &err)
+
+	record.Expires = time.Now().Add(app.Context.Config.Limits.IdempotencyWindow).Unix()
+
+	return app.Context.DB.Upsert(ctx, db.IdempotencyKeysTable, record)
+}
+
+// SweepIdempotencyRecordsDB removes every stored response whose window has passed, returning how many were removed
+func SweepIdempotencyRecordsDB(ctx context.Context) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.SweepIdempotencyRecordsDB")
+	defer tracing.End(span, &err)
+
+	removed := 0
+	now := time.Now().Unix()
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		records, err := txn.Query(ctx, db.IdempotencyKeysTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+		for _, row := range records {
+			if record := row.(model.IdempotencyRecord); record.Expires <= now {
+				_, err = txn.Delete(ctx, db.IdempotencyKeysTable, db.IDIdx, record.Key)
+				if err != nil {
+					return err
+				}
+				removed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return removed, nil
+}
+
+// StartIdempotencySweeper sweeps expired responses in the background until the returned function is called
+func StartIdempotencySweeper() func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(idempotencySweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				removed, err := SweepIdempotencyRecordsDB(context.Background())
+				if err != nil {
+					slog.Error("failed to sweep expired idempotency keys", "error", err)
+				} else if removed > 0 {
+					slog.Debug("swept expired idempotency keys", "removed", removed)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,30 @@
+package lib
+
+import (
+	"context"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"testing"
+	"time"
+)
+
+func TestSweepIdempotencyRecords(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	expired := time.Now().Add(-time.Minute).Unix()
+	_ = app.Context.DB.Upsert(ctx, db.IdempotencyKeysTable, model.IdempotencyRecord{Key: "expired", Expires: expired})
+	_ = SaveIdempotencyRecordDB(ctx, model.IdempotencyRecord{Key: "current"})
+
+	removed, err := SweepIdempotencyRecordsDB(ctx)
+	if err != nil || removed != 1 {
+		t.Errorf("expired response should have been swept, have: %v, %v", removed, err)
+	}
+	if res, _ := app.Context.DB.Query(ctx, db.IdempotencyKeysTable, db.IDIdx, "expired"); len(res) != 0 {
+		t.Errorf("expired response should have been removed")
+	}
+	if _, ok, _ := GetIdempotencyRecordDB(ctx, "current"); !ok {
+		t.Errorf("current response should have been kept")
+	}
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+	"time"
+)
+
+// ConfiguredKeyID names the configured token secret, which signs tokens until the first key is rotated in. Tokens it
+// signed don't carry a kid header
+const ConfiguredKeyID = "config"
+
+// CurrentSigningKeyDB retrieves the key new tokens are signed with. It returns false while the configured token secret
+// is still used
+func CurrentSigningKeyDB(ctx context.Context) (_ model.SigningKey, _ bool, err error) {
+	ctx, span := tracing.Start(ctx, "lib.CurrentSigningKeyDB")
+	defer tracing.End(span, &err)
+
+	res, err := app.Context.DB.Query(ctx, db.SigningKeysTable, db.IDIdx)
+	if err != nil {
+		return model.SigningKey{}, false, err
+	}
+
+	for _, row := range res {
+		if key := row.(model.SigningKey); key.Retired == 0 {
+			return key, true, nil
+		}
+	}
+
+	return model.SigningKey{}, false, nil
+}
+
+// GetSigningKeyDB retrieves the key a token names, returning false if it's unknown or has been revoked. The configured
+// token secret is returned as a key until it's revoked
+func GetSigningKeyDB(ctx context.Context, keyID string) (_ model.SigningKey, _ bool, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetSigningKeyDB")
+	defer tracing.End(span, &err)
+
+	res, err := app.Context.DB.Query(ctx, db.SigningKeysTable, db.IDIdx, keyID)
+	if err != nil {
+		return model.SigningKey{}, false, err
+	}
+
+	var key model.SigningKey
+	switch {
+	case len(res) > 0:
+		key = res[0].(model.SigningKey)
+	case keyID == ConfiguredKeyID:
+		key = model.SigningKey{KeyID: ConfiguredKeyID}
+	default:
+		return model.SigningKey{}, false, nil
+	}
+
+	if key.Revoked {
+		return model.SigningKey{}, false, nil
+	}
+	if key.KeyID == ConfiguredKeyID {
+		key.Secret = app.Context.Config.Auth.TokenSecret
+	}
+
+	return key, true, nil
+}
+
+// RotateSigningKeyDB creates a key to sign new tokens with and retires the current one, which keeps verifying the tokens
+// it signed until they expire. When revoke is set, every existing key is revoked instead, so tokens they signed are
+// rejected straight away
+func RotateSigningKeyDB(ctx context.Context, revoke bool) (_ model.SigningKey, err error) {
+	ctx, span := tracing.Start(ctx, "lib.RotateSigningKeyDB")
+	defer tracing.End(span, &err)
+
+	now := time.Now().Unix()
+	key := model.SigningKey{
+		KeyID:   randomString(8, hex.EncodeToString),
+		Secret:  randomString(32, base64.RawURLEncoding.EncodeToString),
+		Created: now,
+	}
+
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.SigningKeysTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+
+		// The configured secret is recorded the first time, so it can be retired like any other key
+		existing := make([]model.SigningKey, 0, len(res)+1)
+		if len(res) == 0 {
+			existing = append(existing, model.SigningKey{KeyID: ConfiguredKeyID})
+		}
+		for _, row := range res {
+			existing = append(existing, row.(model.SigningKey))
+		}
+
+		for _, old := range existing {
+			if old.Retired == 0 {
+				old.Retired = now
+			}
+			old.Revoked = old.Revoked || revoke
+
+			err = txn.Upsert(ctx, db.SigningKeysTable, old)
+			if err != nil {
+				return err
+			}
+		}
+
+		return txn.Upsert(ctx, db.SigningKeysTable, key)
+	})
+	if err != nil {
+		return model.SigningKey{}, err
+	}
+
+	return key, nil
+}
+
+// pruneSigningKeys removes the keys that can no longer have signed a token that's still valid, returning how many were
+// removed. The configured secret is revoked rather than removed, so tokens without a kid stay rejected
+func pruneSigningKeys(ctx context.Context, txn *db.Txn, now time.Time) (int, error) {
+	auth := app.Context.Config.Auth
+	cutoff := now.Add(-max(auth.TokenLifetime, auth.Sessions.Lifetime)).Unix()
+
+	res, err := txn.Query(ctx, db.SigningKeysTable, db.IDIdx)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, row := range res {
+		key := row.(model.SigningKey)
+		if key.Retired == 0 || (key.Retired > cutoff && !key.Revoked) {
+			continue
+		}
+
+		if key.KeyID == ConfiguredKeyID {
+			if !key.Revoked {
+				key.Revoked = true
+				err = txn.Upsert(ctx, db.SigningKeysTable, key)
+			}
+		} else {
+			_, err = txn.Delete(ctx, db.SigningKeysTable, db.IDIdx, key.KeyID)
+			pruned++
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return pruned, nil
+}
+
+// randomString encodes n random bytes
+func randomString(n int, encode func([]byte) string) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return encode(b)
+}
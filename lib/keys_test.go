@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"context"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"testing"
+	"time"
+)
+
+func TestRotateSigningKey(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	// Until a key is rotated in, tokens are signed with the configured secret
+	_, ok, _ := CurrentSigningKeyDB(ctx)
+	if ok {
+		t.Errorf("new data store should not have a signing key")
+	}
+	configured, ok, _ := GetSigningKeyDB(ctx, ConfiguredKeyID)
+	if !ok || configured.Secret != app.Context.Config.Auth.TokenSecret {
+		t.Errorf("configured secret should verify tokens without a kid")
+	}
+
+	first, err := RotateSigningKeyDB(ctx, false)
+	if err != nil {
+		t.Fatalf("failed to rotate key: %s", err.Error())
+	}
+	current, ok, _ := CurrentSigningKeyDB(ctx)
+	if !ok || current.KeyID != first.KeyID || current.Secret == "" {
+		t.Errorf("new key should be current, have: %+v", current)
+	}
+	if _, ok, _ = GetSigningKeyDB(ctx, ConfiguredKeyID); !ok {
+		t.Errorf("retired configured secret should still verify tokens")
+	}
+
+	second, _ := RotateSigningKeyDB(ctx, false)
+	if retired, ok, _ := GetSigningKeyDB(ctx, first.KeyID); !ok || retired.Retired == 0 {
+		t.Errorf("previous key should be retired but still verify tokens, have: %+v", retired)
+	}
+
+	// Revoking rejects every key but the new one
+	third, _ := RotateSigningKeyDB(ctx, true)
+	for _, keyID := range []string{ConfiguredKeyID, first.KeyID, second.KeyID} {
+		if _, ok, _ = GetSigningKeyDB(ctx, keyID); ok {
+			t.Errorf("key %s should have been revoked", keyID)
+		}
+	}
+	if _, ok, _ = GetSigningKeyDB(ctx, third.KeyID); !ok {
+		t.Errorf("new key should verify tokens")
+	}
+	if _, ok, _ = GetSigningKeyDB(ctx, "unknown"); ok {
+		t.Errorf("unknown key should not verify tokens")
+	}
+}
+
+func TestPruneSigningKeys(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	first, _ := RotateSigningKeyDB(ctx, false)
+	_, _ = RotateSigningKeyDB(ctx, false)
+
+	// Nothing is pruned while tokens the retired keys signed may still be valid
+	var pruned int
+	_ = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		var err error
+		pruned, err = pruneSigningKeys(ctx, txn, time.Now())
+		return err
+	})
+	if pruned != 0 {
+		t.Errorf("recently retired keys should be kept, have: %v pruned", pruned)
+	}
+
+	// Once those tokens have expired, retired keys are removed and the configured secret is revoked
+	later := time.Now().Add(app.Context.Config.Auth.Sessions.Lifetime + time.Minute)
+	_ = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		var err error
+		pruned, err = pruneSigningKeys(ctx, txn, later)
+		return err
+	})
+	if pruned != 1 {
+		t.Errorf("unexpected number of keys pruned, have: %v, want: 1", pruned)
+	}
+	if _, ok, _ := GetSigningKeyDB(ctx, first.KeyID); ok {
+		t.Errorf("retired key should have been removed")
+	}
+	res, _ := app.Context.DB.Query(ctx, db.SigningKeysTable, db.IDIdx, ConfiguredKeyID)
+	if len(res) != 1 || !res[0].(model.SigningKey).Revoked {
+		t.Errorf("configured secret should be kept as revoked")
+	}
+	if _, ok, _ := CurrentSigningKeyDB(ctx); !ok {
+		t.Errorf("current key should never be pruned")
+	}
+}
@@ -1,22 +1,33 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
 	"github.com/kylegk/notes/db"
 	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+	"sort"
 	"time"
 )
 
 // InsertNoteDB inserts the note into the data store
-func InsertNoteDB(noteID int, body string) error {
+func InsertNoteDB(ctx context.Context, noteID int, body string) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.InsertNoteDB")
+	defer tracing.End(span, &err)
+
+	return insertNote(ctx, &app.Context.DB, noteID, body)
+}
+
+func insertNote(ctx context.Context, s db.Store, noteID int, body string) error {
 	note := model.Note{
 		NoteID:   noteID,
 		Content:  body,
 		Modified: time.Now().String(),
 	}
 
-	exists, err := GetNoteDB(noteID)
+	exists, err := getNote(ctx, s, noteID)
 	if err != nil {
 		return err
 	}
@@ -25,7 +36,7 @@ func InsertNoteDB(noteID int, body string) error {
 		return fmt.Errorf("cannot insert note; note already exists")
 	}
 
-	err = app.Context.DB.Upsert(db.NotesTable, note)
+	err = s.Upsert(ctx, db.NotesTable, note)
 	if err != nil {
 		return err
 	}
@@ -34,7 +45,14 @@ func InsertNoteDB(noteID int, body string) error {
 }
 
 // UpdateNoteDB updates a note
-func UpdateNoteDB(noteID int, body string) error {
+func UpdateNoteDB(ctx context.Context, noteID int, body string) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.UpdateNoteDB")
+	defer tracing.End(span, &err)
+
+	return updateNote(ctx, &app.Context.DB, noteID, body)
+}
+
+func updateNote(ctx context.Context, s db.Store, noteID int, body string) error {
 	note := model.Note{
 		NoteID:   noteID,
 		Content:  body,
@@ -42,12 +60,15 @@ func UpdateNoteDB(noteID int, body string) error {
 	}
 
 	// Verify the row exists before attempting to modify
-	n, err := app.Context.DB.Query(db.NotesTable, db.IDIdx, noteID)
+	n, err := s.Query(ctx, db.NotesTable, db.IDIdx, noteID)
+	if err != nil {
+		return err
+	}
 	if len(n) == 0 {
-		return fmt.Errorf("cannot update; row doesn't exist")
+		return apperr.ErrNoteNotFound
 	}
 
-	err = app.Context.DB.Upsert(db.NotesTable, note)
+	err = s.Upsert(ctx, db.NotesTable, note)
 	if err != nil {
 		return err
 	}
@@ -56,8 +77,15 @@ func UpdateNoteDB(noteID int, body string) error {
 }
 
 // DeleteNoteDB deletes a note
-func DeleteNoteDB(noteID int) (int, error) {
-	count, err := app.Context.DB.Delete(db.NotesTable, db.IDIdx, noteID)
+func DeleteNoteDB(ctx context.Context, noteID int) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.DeleteNoteDB")
+	defer tracing.End(span, &err)
+
+	return deleteNote(ctx, &app.Context.DB, noteID)
+}
+
+func deleteNote(ctx context.Context, s db.Store, noteID int) (int, error) {
+	count, err := s.Delete(ctx, db.NotesTable, db.IDIdx, noteID)
 	if err != nil {
 		return 0, err
 	}
@@ -66,10 +94,17 @@ func DeleteNoteDB(noteID int) (int, error) {
 }
 
 // GetNoteDB retrieves a single note
-func GetNoteDB(noteID int) (model.Note, error) {
+func GetNoteDB(ctx context.Context, noteID int) (_ model.Note, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetNoteDB")
+	defer tracing.End(span, &err)
+
+	return getNote(ctx, &app.Context.DB, noteID)
+}
+
+func getNote(ctx context.Context, s db.Store, noteID int) (model.Note, error) {
 	var note model.Note
 
-	res, err := app.Context.DB.Query(db.NotesTable, db.IDIdx, noteID)
+	res, err := s.Query(ctx, db.NotesTable, db.IDIdx, noteID)
 	if err != nil {
 		return note, err
 	}
@@ -87,14 +122,21 @@ func GetNoteDB(noteID int) (model.Note, error) {
 }
 
 // InsertUserNoteDB creates the relationship between the user and a note
-func InsertUserNoteDB(userID int, noteID int) error {
+func InsertUserNoteDB(ctx context.Context, userID int, noteID int) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.InsertUserNoteDB")
+	defer tracing.End(span, &err)
+
+	return insertUserNote(ctx, &app.Context.DB, userID, noteID)
+}
+
+func insertUserNote(ctx context.Context, s db.Store, userID int, noteID int) error {
 	userNote := model.UserNote{
 		UserID: userID,
 		NoteID: noteID,
 	}
 
 	// Verify that the note doesn't exist before attempting to insert
-	res, err := app.Context.DB.Query(db.UserNotesTable, db.IDIdx, noteID)
+	res, err := s.Query(ctx, db.UserNotesTable, db.IDIdx, noteID)
 	if err != nil {
 		return err
 	}
@@ -102,7 +144,7 @@ func InsertUserNoteDB(userID int, noteID int) error {
 		return fmt.Errorf("cannot insert user note, note already exists")
 	}
 
-	err = app.Context.DB.Upsert(db.UserNotesTable, userNote)
+	err = s.Upsert(ctx, db.UserNotesTable, userNote)
 	if err != nil {
 		return err
 	}
@@ -111,8 +153,15 @@ func InsertUserNoteDB(userID int, noteID int) error {
 }
 
 // DeleteUserNoteDB deletes the relationship between the user and the note
-func DeleteUserNoteDB(userID int) (int, error) {
-	count, err := app.Context.DB.Delete(db.UserNotesTable, db.IDIdx, userID)
+func DeleteUserNoteDB(ctx context.Context, userID int) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.DeleteUserNoteDB")
+	defer tracing.End(span, &err)
+
+	return deleteUserNote(ctx, &app.Context.DB, userID)
+}
+
+func deleteUserNote(ctx context.Context, s db.Store, noteID int) (int, error) {
+	count, err := s.Delete(ctx, db.UserNotesTable, db.IDIdx, noteID)
 	if err != nil {
 		return 0, err
 	}
@@ -121,10 +170,13 @@ func DeleteUserNoteDB(userID int) (int, error) {
 }
 
 // GetAllNotesForUserDB retrieves all the note ids associated with the specified user
-func GetAllNotesForUserDB(userID int) ([]int, error) {
-	var noteIDs []int
+func GetAllNotesForUserDB(ctx context.Context, userID int) (_ []int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetAllNotesForUserDB")
+	defer tracing.End(span, &err)
 
-	notes, err := app.Context.DB.Query(db.UserNotesTable, db.UserIdx, userID)
+	noteIDs := make([]int, 0)
+
+	notes, err := app.Context.DB.Query(ctx, db.UserNotesTable, db.UserIdx, userID)
 	if err != nil {
 		return noteIDs, err
 	}
@@ -136,20 +188,172 @@ func GetAllNotesForUserDB(userID int) ([]int, error) {
 	return noteIDs, nil
 }
 
+// ListNotesForUserDB returns a page of the IDs of the user's notes in ascending order, starting after the given note ID.
+// A limit of 0 returns every remaining note. next is the value of after for the following page, or 0 on the last page
+func ListNotesForUserDB(ctx context.Context, userID int, after int, limit int) (_ []int, next int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.ListNotesForUserDB")
+	defer tracing.End(span, &err)
+
+	noteIDs, err := GetAllNotesForUserDB(ctx, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Ints(noteIDs)
+
+	start := sort.SearchInts(noteIDs, after+1)
+	page := noteIDs[start:]
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+		next = page[len(page)-1]
+	}
+
+	return page, next, nil
+}
+
 // ValidateNoteOwnershipDB verifies the user attempting an action owns the note they're trying to act on
-func ValidateNoteOwnershipDB(userID int, noteID int) error {
-	res, err := app.Context.DB.Query(db.UserNotesTable, db.IDIdx, noteID)
+func ValidateNoteOwnershipDB(ctx context.Context, userID int, noteID int) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.ValidateNoteOwnershipDB")
+	defer tracing.End(span, &err)
+
+	return validateNoteOwnership(ctx, &app.Context.DB, userID, noteID)
+}
+
+func validateNoteOwnership(ctx context.Context, s db.Store, userID int, noteID int) error {
+	res, err := s.Query(ctx, db.UserNotesTable, db.IDIdx, noteID)
 	if err != nil {
 		return err
 	}
 
 	if len(res) == 0  {
-		return fmt.Errorf(app.InvalidRequestError)
+		return apperr.ErrNoteNotFound
 	}
 
 	if res[0].(model.UserNote).UserID != userID {
-		return fmt.Errorf(app.InvalidTokenError)
+		return apperr.ErrForbidden
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// CreateNoteForUserDB creates a note owned by the user, provided it fits within the user's quotas, and records the change
+// for sync
+func CreateNoteForUserDB(ctx context.Context, userID int, content string) (noteID int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.CreateNoteForUserDB")
+	defer tracing.End(span, &err)
+
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		var err error
+		noteID, _, err = createUserNote(ctx, txn, userID, content)
+		return err
+	})
+
+	return noteID, err
+}
+
+// UpdateNoteForUserDB replaces the content of a note the user owns, provided it fits within the user's quotas, and
+// records the change for sync
+func UpdateNoteForUserDB(ctx context.Context, userID int, noteID int, content string) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.UpdateNoteForUserDB")
+	defer tracing.End(span, &err)
+
+	return app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		err := validateNoteOwnership(ctx, txn, userID, noteID)
+		if err != nil {
+			return err
+		}
+
+		_, err = updateUserNote(ctx, txn, userID, noteID, content)
+		return err
+	})
+}
+
+// DeleteNoteForUserDB deletes a note the user owns, releasing its share of the user's quotas, and records the deletion
+// for sync
+func DeleteNoteForUserDB(ctx context.Context, userID int, noteID int) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.DeleteNoteForUserDB")
+	defer tracing.End(span, &err)
+
+	return app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		err := validateNoteOwnership(ctx, txn, userID, noteID)
+		if err != nil {
+			return err
+		}
+
+		_, err = removeUserNote(ctx, txn, userID, noteID)
+		return err
+	})
+}
+
+// createUserNote creates a note owned by the user and records the change, returning the note's ID and the change
+// sequence. The quotas are checked before anything is written
+func createUserNote(ctx context.Context, txn *db.Txn, userID int, content string) (int, int, error) {
+	size := int64(len(content))
+	err := chargeUsage(ctx, txn, userID, 1, size, size)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	noteID := db.IncrementNoteID()
+	err = insertNote(ctx, txn, noteID, content)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = insertUserNote(ctx, txn, userID, noteID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	seq, err := recordNoteChange(ctx, txn, userID, noteID, false)
+	return noteID, seq, err
+}
+
+// updateUserNote replaces the content of a note the caller has already checked the user owns, and records the change.
+// The quotas are checked before anything is written
+func updateUserNote(ctx context.Context, txn *db.Txn, userID int, noteID int, content string) (int, error) {
+	note, err := getNote(ctx, txn, noteID)
+	if err != nil {
+		return 0, err
+	}
+	if note.NoteID != noteID {
+		return 0, apperr.ErrNoteNotFound
+	}
+
+	size := int64(len(content))
+	err = chargeUsage(ctx, txn, userID, 0, size-int64(len(note.Content)), size)
+	if err != nil {
+		return 0, err
+	}
+
+	err = updateNote(ctx, txn, noteID, content)
+	if err != nil {
+		return 0, err
+	}
+
+	return recordNoteChange(ctx, txn, userID, noteID, false)
+}
+
+// removeUserNote deletes a note the caller has already checked the user owns, and records the deletion
+func removeUserNote(ctx context.Context, txn *db.Txn, userID int, noteID int) (int, error) {
+	note, err := getNote(ctx, txn, noteID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = deleteNote(ctx, txn, noteID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = deleteUserNote(ctx, txn, noteID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = chargeUsage(ctx, txn, userID, -1, -int64(len(note.Content)), 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return recordNoteChange(ctx, txn, userID, noteID, true)
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"github.com/kylegk/notes/app"
 	"github.com/kylegk/notes/model"
 	"testing"
@@ -15,13 +16,13 @@ func TestInsertNoteDB(t *testing.T) {
 	}
 
 	// Insert a valid note
-	err := InsertNoteDB(note.NoteID, note.Content)
+	err := InsertNoteDB(context.Background(), note.NoteID, note.Content)
 	if err != nil {
 		t.Errorf("failed to insert note: %s", err.Error())
 	}
 
 	// Attempt to insert a duplicate record
-	err = InsertNoteDB(note.NoteID, note.Content)
+	err = InsertNoteDB(context.Background(), note.NoteID, note.Content)
 	if err == nil {
 		t.Errorf("insert should have failed")
 	}
@@ -36,20 +37,20 @@ func TestUpdateNoteDB(t *testing.T) {
 	}
 
 	// Insert a valid note
-	err := InsertNoteDB(note.NoteID, note.Content)
+	err := InsertNoteDB(context.Background(), note.NoteID, note.Content)
 	if err != nil {
 		t.Errorf("failed to insert note: %s", err.Error())
 	}
 
 	// Update the content of the note
 	note.Content = "this is an updated note"
-	err = UpdateNoteDB(note.NoteID, note.Content)
+	err = UpdateNoteDB(context.Background(), note.NoteID, note.Content)
 	if err != nil {
 		t.Errorf("update note failed: %s", err.Error())
 	}
 
 	// Verify the content matches
-	updatedNote, err := GetNoteDB(note.NoteID)
+	updatedNote, err := GetNoteDB(context.Background(), note.NoteID)
 	if updatedNote.Content != note.Content {
 		t.Errorf("update failed, strings don't match")
 	}
@@ -59,7 +60,7 @@ func TestUpdateNoteDB(t *testing.T) {
 		NoteID: 2,
 		Content: "This should fail",
 	}
-	err = UpdateNoteDB(newNote.NoteID, newNote.Content)
+	err = UpdateNoteDB(context.Background(), newNote.NoteID, newNote.Content)
 	if err == nil {
 		t.Errorf("updated note that doesn't exist")
 	}
@@ -74,14 +75,14 @@ func TestDeleteNoteDB(t *testing.T) {
 	}
 
 	// Insert a valid note
-	err := InsertNoteDB(note.NoteID, note.Content)
+	err := InsertNoteDB(context.Background(), note.NoteID, note.Content)
 	if err != nil {
 		t.Errorf("failed to insert note: %s", err.Error())
 	}
 
 	// Verify that delete succeeds with the correct number of records (1)
 	want := 1
-	have, err := DeleteNoteDB(note.NoteID)
+	have, err := DeleteNoteDB(context.Background(), note.NoteID)
 	if err != nil {
 		t.Errorf("failed to delete")
 	}
@@ -90,7 +91,7 @@ func TestDeleteNoteDB(t *testing.T) {
 	}
 
 	// Attempt to delete a note that doesn't exist
-	have, err = DeleteNoteDB(99999)
+	have, err = DeleteNoteDB(context.Background(), 99999)
 	want = 0
 	if have != want {
 		t.Errorf("attempt to delete an invalid record succeeded")
@@ -106,13 +107,13 @@ func TestInsertUserNoteDB(t *testing.T) {
 	}
 
 	// Insert a user note
-	err := InsertUserNoteDB(userNote.UserID, userNote.NoteID)
+	err := InsertUserNoteDB(context.Background(), userNote.UserID, userNote.NoteID)
 	if err != nil {
 		t.Errorf("insertion of user note failed: %s", err.Error())
 	}
 
 	// Attempt to insert a duplicate user note
-	err = InsertUserNoteDB(userNote.UserID, userNote.NoteID)
+	err = InsertUserNoteDB(context.Background(), userNote.UserID, userNote.NoteID)
 	if err == nil {
 		t.Errorf("inserted user note, when it should have failed")
 	}
@@ -127,14 +128,14 @@ func TestDeleteUserNoteDB(t *testing.T) {
 	}
 
 	// Insert a user note
-	err := InsertUserNoteDB(userNote.UserID, userNote.NoteID)
+	err := InsertUserNoteDB(context.Background(), userNote.UserID, userNote.NoteID)
 	if err != nil {
 		t.Errorf("insertion of user note failed: %s", err.Error())
 	}
 
 	// Delete a valid user note
 	want := 1
-	have, err := DeleteUserNoteDB(userNote.UserID)
+	have, err := DeleteUserNoteDB(context.Background(), userNote.UserID)
 	if err != nil {
 		t.Errorf("failed to delete user note")
 	}
@@ -145,7 +146,7 @@ func TestDeleteUserNoteDB(t *testing.T) {
 	// Attempt to delete a user note that doesn't exist
 	userNote.NoteID = 9999
 	want = 0
-	have, err = DeleteUserNoteDB(userNote.NoteID)
+	have, err = DeleteUserNoteDB(context.Background(), userNote.NoteID)
 	if err != nil {
 		t.Errorf("error %s", err.Error())
 	}
@@ -162,13 +163,13 @@ func TestGetAllNotesForUserDB(t *testing.T) {
 	noteIDs := []int{1,2,3,4}
 	for _, noteID := range noteIDs {
 		userNote := model.UserNote{UserID: userID, NoteID: noteID}
-		err := InsertUserNoteDB(userNote.UserID, userNote.NoteID)
+		err := InsertUserNoteDB(context.Background(), userNote.UserID, userNote.NoteID)
 		if err != nil {
 			t.Errorf("insertion of user note failed: %s", err.Error())
 		}
 	}
 
-	ownedIDs, err := GetAllNotesForUserDB(userID)
+	ownedIDs, err := GetAllNotesForUserDB(context.Background(), userID)
 	if err != nil {
 		t.Errorf("failed to retrieve ownership: %s", err.Error())
 	}
@@ -188,20 +189,20 @@ func TestValidateNoteOwnershipDB(t *testing.T) {
 	}
 
 	// Insert a user note
-	err := InsertUserNoteDB(userNote.UserID, userNote.NoteID)
+	err := InsertUserNoteDB(context.Background(), userNote.UserID, userNote.NoteID)
 	if err != nil {
 		t.Errorf("insertion of user note failed: %s", err.Error())
 	}
 
 	// Verify a valid note owner
-	err = ValidateNoteOwnershipDB(userNote.UserID, userNote.NoteID)
+	err = ValidateNoteOwnershipDB(context.Background(), userNote.UserID, userNote.NoteID)
 	if err != nil {
 		t.Errorf("failed to find valid ownership")
 	}
 
 	// Verify an invalid note owner
 	userNote.UserID = 5
-	err = ValidateNoteOwnershipDB(userNote.UserID, userNote.NoteID)
+	err = ValidateNoteOwnershipDB(context.Background(), userNote.UserID, userNote.NoteID)
 	if err == nil {
 		t.Errorf("failed to reject ownership")
 	}
@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"context"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/oidc"
+	"github.com/kylegk/notes/tracing"
+	"github.com/kylegk/notes/validate"
+	"time"
+	"unicode/utf8"
+)
+
+// oidcLoginLifetime limits how long the user may take to log in at the identity provider
+const oidcLoginLifetime = 10 * time.Minute
+
+// StartOIDCLoginDB records a login that's about to be sent to the identity provider. When userID is given, the identity
+// the user logs in with is linked to that user instead
+func StartOIDCLoginDB(ctx context.Context, userID int) (_ model.OIDCLogin, err error) {
+	ctx, span := tracing.Start(ctx, "lib.StartOIDCLoginDB")
+	defer tracing.End(span, &err)
+
+	login := model.OIDCLogin{
+		State:    oidc.NewState(),
+		Verifier: oidc.NewVerifier(),
+		Nonce:    oidc.NewState(),
+		UserID:   userID,
+		Expires:  time.Now().Add(oidcLoginLifetime).Unix(),
+	}
+
+	err = app.Context.DB.Upsert(ctx, db.OIDCLoginsTable, login)
+	if err != nil {
+		return model.OIDCLogin{}, err
+	}
+
+	return login, nil
+}
+
+// FinishOIDCLoginDB removes the login with the state, so it can only be finished once, returning false if it wasn't
+// started or has expired
+func FinishOIDCLoginDB(ctx context.Context, state string) (_ model.OIDCLogin, _ bool, err error) {
+	ctx, span := tracing.Start(ctx, "lib.FinishOIDCLoginDB")
+	defer tracing.End(span, &err)
+
+	var login model.OIDCLogin
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.OIDCLoginsTable, db.IDIdx, state)
+		if err != nil || len(res) == 0 {
+			return err
+		}
+
+		login = res[0].(model.OIDCLogin)
+		_, err = txn.Delete(ctx, db.OIDCLoginsTable, db.IDIdx, state)
+		return err
+	})
+	if err != nil {
+		return model.OIDCLogin{}, false, err
+	}
+
+	if login.State == "" || login.Expires <= time.Now().Unix() {
+		return model.OIDCLogin{}, false, nil
+	}
+
+	return login, true, nil
+}
+
+// LoginWithIdentityDB returns the user linked to the identity. When linkUserID is given, the identity is linked to that
+// user first. Otherwise, if no user is linked yet and provisioning is enabled, an account is created for the identity,
+// named by its username claim, and provisioned is true. Users with two-factor authentication enabled still need a code,
+// so a login challenge is started for them and returned in an ErrTwoFactorRequired error, as with passwords
+func LoginWithIdentityDB(ctx context.Context, linkUserID int, claims model.IdentityClaims) (_ int, provisioned bool, err error) {
+	ctx, span := tracing.Start(ctx, "lib.LoginWithIdentityDB")
+	defer tracing.End(span, &err)
+
+	identity := model.Identity{
+		IdentityID: identityID(claims.Issuer, claims.Subject),
+		Issuer:     claims.Issuer,
+		Subject:    claims.Subject,
+		Created:    time.Now().Unix(),
+	}
+
+	var account model.UserAccount
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.IdentitiesTable, db.IDIdx, identity.IdentityID)
+		if err != nil {
+			return err
+		}
+
+		var linked model.Identity
+		if len(res) > 0 {
+			linked = res[0].(model.Identity)
+		}
+
+		switch {
+		case linkUserID != 0:
+			if linked.UserID != 0 && linked.UserID != linkUserID {
+				return apperr.ErrIdentityLinked
+			}
+			account, err = getUser(ctx, txn, linkUserID)
+			if err != nil || linked.UserID != 0 {
+				return err
+			}
+		case linked.UserID != 0:
+			account, err = getUser(ctx, txn, linked.UserID)
+			return err
+		case !app.Context.Config.Auth.OIDC.AutoProvision:
+			return apperr.New(apperr.ErrForbidden, "no account is linked to the identity, log in and link it first")
+		default:
+			account, err = provisionUser(ctx, txn, claims)
+			if err != nil {
+				return err
+			}
+			provisioned = true
+		}
+
+		identity.UserID = account.UserID
+		return txn.Upsert(ctx, db.IdentitiesTable, identity)
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	if account.Disabled {
+		metrics.AuthFailures.WithLabelValues("account_disabled").Inc()
+		return 0, false, apperr.ErrAccountDisabled
+	}
+
+	// Linking needs the user to be logged in already, so only logins ask for the second factor
+	if linkUserID == 0 && account.TOTPSecret != "" {
+		challenge, err := startLoginChallenge(ctx, account.UserID)
+		if err != nil {
+			return 0, false, err
+		}
+		return 0, false, apperr.TwoFactorRequired(challenge)
+	}
+
+	return account.UserID, provisioned, nil
+}
+
+// provisionUser creates an account for the identity. It has no password, so the user can only log in with the identity
+// provider
+func provisionUser(ctx context.Context, txn *db.Txn, claims model.IdentityClaims) (model.UserAccount, error) {
+	claim := app.Context.Config.Auth.OIDC.UsernameClaim
+	err := validate.Struct(&model.CreateUserRequest{User: claims.Username})
+	if err != nil {
+		return model.UserAccount{}, apperr.New(apperr.ErrInvalidRequest, "the identity provider's "+claim+" claim is not a valid user name")
+	}
+
+	res, err := txn.Query(ctx, db.UsersTable, db.UserIdx, claims.Username)
+	if err != nil {
+		return model.UserAccount{}, err
+	}
+	if len(res) > 0 {
+		return model.UserAccount{}, apperr.New(apperr.ErrUserExists, "user "+claims.Username+" already exists, log in and link the identity to it")
+	}
+
+	// Display names from the provider are trimmed to fit, rather than refusing the login
+	displayName := claims.DisplayName
+	for utf8.RuneCountInString(displayName) > 100 {
+		_, size := utf8.DecodeLastRuneInString(displayName)
+		displayName = displayName[:len(displayName)-size]
+	}
+
+	account := model.UserAccount{
+		UserID:      db.IncrementUserID(),
+		User:        claims.Username,
+		Role:        model.RoleUser,
+		DisplayName: displayName,
+	}
+
+	return account, txn.Upsert(ctx, db.UsersTable, account)
+}
+
+// identityID joins the issuer and subject, which can't contain a space in the issuer's case, into one key
+func identityID(issuer string, subject string) string {
+	return issuer + " " + subject
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"testing"
+	"time"
+)
+
+func TestLoginWithIdentity(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+	identity := model.IdentityClaims{Issuer: "https://idp.test", Subject: "user-1", Username: "test.account", DisplayName: "Test Account"}
+
+	// The first login provisions an account, and later ones log in to it
+	userID, provisioned, err := LoginWithIdentityDB(ctx, 0, identity)
+	if err != nil || !provisioned {
+		t.Fatalf("identity should have been provisioned, have: %v, %v", provisioned, err)
+	}
+	account, _ := GetUserDB(ctx, userID)
+	if account.User != "test.account" || account.DisplayName != "Test Account" || account.PasswordHash != "" {
+		t.Errorf("unexpected provisioned account, have: %v", account)
+	}
+
+	identity.Username = "renamed.account"
+	again, provisioned, err := LoginWithIdentityDB(ctx, 0, identity)
+	if err != nil || provisioned || again != userID {
+		t.Errorf("identity should have logged in to the same account, have: %v, %v, %v", again, provisioned, err)
+	}
+
+	// Names that are taken or invalid aren't provisioned
+	taken := model.IdentityClaims{Issuer: "https://idp.test", Subject: "user-2", Username: "test.account"}
+	if _, _, err = LoginWithIdentityDB(ctx, 0, taken); !errors.Is(err, apperr.ErrUserExists) {
+		t.Errorf("taken name should have been refused, have: %v", err)
+	}
+	invalid := model.IdentityClaims{Issuer: "https://idp.test", Subject: "user-3", Username: "not a name"}
+	if _, _, err = LoginWithIdentityDB(ctx, 0, invalid); !errors.Is(err, apperr.ErrInvalidRequest) {
+		t.Errorf("invalid name should have been refused, have: %v", err)
+	}
+
+	// Identities are linked to the user who started the login, unless they're linked to someone else
+	otherID, _ := InsertUserDB(ctx, "other.account", "correct horse")
+	linked, _, err := LoginWithIdentityDB(ctx, otherID, taken)
+	if err != nil || linked != otherID {
+		t.Errorf("identity should have been linked, have: %v, %v", linked, err)
+	}
+	if _, _, err = LoginWithIdentityDB(ctx, otherID, identity); !errors.Is(err, apperr.ErrIdentityLinked) {
+		t.Errorf("identity linked to another user should have been refused, have: %v", err)
+	}
+
+	// Disabled users can't log in with their identity either
+	disabled := true
+	_, _ = UpdateUserDB(ctx, userID, model.UpdateUserRequest{Disabled: &disabled})
+	if _, _, err = LoginWithIdentityDB(ctx, 0, identity); !errors.Is(err, apperr.ErrAccountDisabled) {
+		t.Errorf("disabled user should have been refused, have: %v", err)
+	}
+
+	// Deleting the user unlinks their identities
+	_ = DeleteUserDB(ctx, otherID)
+	res, _ := app.Context.DB.Query(ctx, db.IdentitiesTable, db.UserIdx, otherID)
+	if len(res) != 0 {
+		t.Errorf("deleted user's identities should have been removed")
+	}
+}
+
+func TestLoginWithIdentityWithoutProvisioning(t *testing.T) {
+	app.Init()
+	app.Context.Config.Auth.OIDC.AutoProvision = false
+	ctx := context.Background()
+
+	_, _, err := LoginWithIdentityDB(ctx, 0, model.IdentityClaims{Issuer: "https://idp.test", Subject: "user-1", Username: "test.account"})
+	if !errors.Is(err, apperr.ErrForbidden) {
+		t.Errorf("unlinked identity should have been refused, have: %v", err)
+	}
+}
+
+func TestFinishOIDCLogin(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	login, err := StartOIDCLoginDB(ctx, 0)
+	if err != nil {
+		t.Fatalf("failed to start login: %s", err.Error())
+	}
+	if login.State == "" || login.Verifier == "" || login.Nonce == "" {
+		t.Errorf("login should have a state, verifier and nonce, have: %v", login)
+	}
+
+	// Logins can only be finished once
+	if finished, ok, _ := FinishOIDCLoginDB(ctx, login.State); !ok || finished.Verifier != login.Verifier {
+		t.Errorf("login should have been finished, have: %v, %v", finished, ok)
+	}
+	if _, ok, _ := FinishOIDCLoginDB(ctx, login.State); ok {
+		t.Errorf("login should only be finished once")
+	}
+
+	expired := model.OIDCLogin{State: "expired", Expires: time.Now().Add(-time.Minute).Unix()}
+	_ = app.Context.DB.Upsert(ctx, db.OIDCLoginsTable, expired)
+	if _, ok, _ := FinishOIDCLoginDB(ctx, "expired"); ok {
+		t.Errorf("expired login should not be finished")
+	}
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+)
+
+// GetUsageDB retrieves how many notes and bytes the user has stored
+func GetUsageDB(ctx context.Context, userID int) (_ model.UserUsage, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetUsageDB")
+	defer tracing.End(span, &err)
+
+	return getUsage(ctx, &app.Context.DB, userID)
+}
+
+func getUsage(ctx context.Context, s db.Store, userID int) (model.UserUsage, error) {
+	res, err := s.Query(ctx, db.UserUsageTable, db.IDIdx, userID)
+	if err != nil {
+		return model.UserUsage{}, err
+	}
+
+	if len(res) == 0 {
+		return model.UserUsage{UserID: userID}, nil
+	}
+
+	return res[0].(model.UserUsage), nil
+}
+
+// chargeUsage adds to the user's usage, which must be done in the same transaction as the write it accounts for. Growth
+// is checked against the configured quotas first, so nothing is written if it doesn't fit. noteBytes is the size of the
+// note being written, or 0 if none is
+func chargeUsage(ctx context.Context, s db.Store, userID int, notes int, bytes int64, noteBytes int64) error {
+	quotas := app.Context.Config.Quotas
+	if quotas.MaxNoteBytes > 0 && noteBytes > quotas.MaxNoteBytes {
+		return apperr.New(apperr.ErrNoteTooLarge, fmt.Sprintf("note is %d bytes, the maximum is %d", noteBytes, quotas.MaxNoteBytes))
+	}
+
+	usage, err := getUsage(ctx, s, userID)
+	if err != nil {
+		return err
+	}
+
+	if notes > 0 && quotas.MaxNotes > 0 && usage.Notes+notes > quotas.MaxNotes {
+		return apperr.New(apperr.ErrQuotaExceeded, fmt.Sprintf("note limit of %d reached", quotas.MaxNotes))
+	}
+	if bytes > 0 && quotas.MaxTotalBytes > 0 && usage.Bytes+bytes > quotas.MaxTotalBytes {
+		return apperr.New(apperr.ErrQuotaExceeded, fmt.Sprintf("storage limit of %d bytes would be exceeded, %d bytes in use", quotas.MaxTotalBytes, usage.Bytes))
+	}
+
+	if notes == 0 && bytes == 0 {
+		return nil
+	}
+
+	// Notes written before usage was tracked aren't counted, so removing them mustn't leave a negative total
+	usage.Notes = max(usage.Notes+notes, 0)
+	usage.Bytes = max(usage.Bytes+bytes, 0)
+
+	return s.Upsert(ctx, db.UserUsageTable, usage)
+}
+
+// RebuildUsageDB recalculates every user's usage from the notes they own, replacing the running totals
+func RebuildUsageDB(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.RebuildUsageDB")
+	defer tracing.End(span, &err)
+
+	return app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		_, err := txn.Delete(ctx, db.UserUsageTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+
+		userNotes, err := txn.Query(ctx, db.UserNotesTable, db.IDIdx)
+		if err != nil {
+			return err
+		}
+
+		usage := map[int]*model.UserUsage{}
+		for _, row := range userNotes {
+			userNote := row.(model.UserNote)
+			note, err := getNote(ctx, txn, userNote.NoteID)
+			if err != nil {
+				return err
+			}
+
+			u, ok := usage[userNote.UserID]
+			if !ok {
+				u = &model.UserUsage{UserID: userNote.UserID}
+				usage[userNote.UserID] = u
+			}
+			u.Notes++
+			u.Bytes += int64(len(note.Content))
+		}
+
+		for _, u := range usage {
+			err = txn.Upsert(ctx, db.UserUsageTable, *u)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
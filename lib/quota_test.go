@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/model"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	app.Init()
+	app.Context.Config.Quotas.MaxNotes = 2
+	app.Context.Config.Quotas.MaxTotalBytes = 20
+	app.Context.Config.Quotas.MaxNoteBytes = 10
+	ctx := context.Background()
+	userID := 1
+
+	usageIs := func(notes int, bytes int64) {
+		t.Helper()
+		usage, err := GetUsageDB(ctx, userID)
+		if err != nil || usage.Notes != notes || usage.Bytes != bytes {
+			t.Errorf("usage should be %d notes and %d bytes, have: %+v", notes, bytes, usage)
+		}
+	}
+
+	first, err := CreateNoteForUserDB(ctx, userID, "hello")
+	if err != nil {
+		t.Fatalf("create should have succeeded: %v", err)
+	}
+	usageIs(1, 5)
+
+	// Notes over the maximum size are refused before anything is written
+	_, err = CreateNoteForUserDB(ctx, userID, "hello world")
+	if !errors.Is(err, apperr.ErrNoteTooLarge) {
+		t.Errorf("oversized note should have been refused, have: %v", err)
+	}
+	usageIs(1, 5)
+
+	second, err := CreateNoteForUserDB(ctx, userID, "0123456789")
+	if err != nil {
+		t.Fatalf("create should have succeeded: %v", err)
+	}
+	usageIs(2, 15)
+
+	_, err = CreateNoteForUserDB(ctx, userID, "x")
+	if !errors.Is(err, apperr.ErrQuotaExceeded) {
+		t.Errorf("note count quota should have been enforced, have: %v", err)
+	}
+
+	// Updates are charged the difference in size
+	err = UpdateNoteForUserDB(ctx, userID, first, "hello, you")
+	if err != nil {
+		t.Errorf("update within quota should have succeeded: %v", err)
+	}
+	usageIs(2, 20)
+
+	err = DeleteNoteForUserDB(ctx, userID, second)
+	if err != nil {
+		t.Errorf("delete should have succeeded: %v", err)
+	}
+	usageIs(1, 10)
+
+	// Quota failures in a batch fail the operation rather than the request
+	results, committed, err := ApplyNoteBatchDB(ctx, userID, BatchBestEffort, []model.BatchOperation{
+		{Op: BatchCreate, Content: "fits"},
+		{Op: BatchCreate, Content: "too many"},
+	})
+	if err != nil || !committed || results[0].Status != BatchApplied || results[1].Error != apperr.ErrQuotaExceeded.Code {
+		t.Errorf("second create should have exceeded the quota, have: %+v %v", results, err)
+	}
+	usageIs(2, 14)
+
+	// Rebuilding from the stored notes gives the same totals
+	err = RebuildUsageDB(ctx)
+	if err != nil {
+		t.Errorf("rebuild failed: %v", err)
+	}
+	usageIs(2, 14)
+}
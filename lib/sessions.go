@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+	"time"
+)
+
+// CreateSessionDB starts a browser session for the user that lasts for the configured session lifetime. The user's
+// sessions that have already expired are removed at the same time
+func CreateSessionDB(ctx context.Context, userID int) (_ model.Session, err error) {
+	ctx, span := tracing.Start(ctx, "lib.CreateSessionDB")
+	defer tracing.End(span, &err)
+
+	now := time.Now()
+	session := model.Session{
+		SessionID: newSessionID(),
+		UserID:    userID,
+		Created:   now.Unix(),
+		Expires:   now.Add(app.Context.Config.Auth.Sessions.Lifetime).Unix(),
+	}
+
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.SessionsTable, db.UserIdx, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range res {
+			existing := row.(model.Session)
+			if existing.Expires > now.Unix() {
+				continue
+			}
+			_, err = txn.Delete(ctx, db.SessionsTable, db.IDIdx, existing.SessionID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return txn.Upsert(ctx, db.SessionsTable, session)
+	})
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	return session, nil
+}
+
+// DeleteSessionDB ends a browser session, revoking the token held in its cookie
+func DeleteSessionDB(ctx context.Context, sessionID string) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.DeleteSessionDB")
+	defer tracing.End(span, &err)
+
+	_, err = app.Context.DB.Delete(ctx, db.SessionsTable, db.IDIdx, sessionID)
+	return err
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,252 @@
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+	"sort"
+	"strconv"
+)
+
+const (
+	SyncApplied  = "applied"
+	SyncConflict = "conflict"
+	SyncRejected = "rejected"
+)
+
+// EncodeSyncToken converts a change sequence number into the opaque token handed to clients
+func EncodeSyncToken(seq int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(seq)))
+}
+
+// DecodeSyncToken converts a client supplied token back into a change sequence number. An empty token requests a full sync
+func DecodeSyncToken(token string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, apperr.ErrInvalidSyncToken
+	}
+
+	seq, err := strconv.Atoi(string(b))
+	if err != nil || seq < 0 {
+		return 0, apperr.ErrInvalidSyncToken
+	}
+
+	// A token from the future was issued before the data store was reset, so the client must start again
+	if seq > db.GetCurrentChangeSeq() {
+		return 0, apperr.New(apperr.ErrInvalidSyncToken, "sync token is newer than the data store, perform a full sync")
+	}
+
+	return seq, nil
+}
+
+// RecordNoteChangeDB records that a note was created, updated or deleted, so that it's picked up by the next sync
+func RecordNoteChangeDB(ctx context.Context, userID int, noteID int, deleted bool) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.RecordNoteChangeDB")
+	defer tracing.End(span, &err)
+
+	var seq int
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		var err error
+		seq, err = recordNoteChange(ctx, txn, userID, noteID, deleted)
+		return err
+	})
+
+	return seq, err
+}
+
+// recordNoteChange must be called with a write transaction, which keeps the change sequence ordered
+func recordNoteChange(ctx context.Context, txn *db.Txn, userID int, noteID int, deleted bool) (int, error) {
+	change := model.NoteChange{
+		NoteID:  noteID,
+		UserID:  userID,
+		Seq:     db.IncrementChangeSeq(),
+		Deleted: deleted,
+	}
+
+	err := txn.Upsert(ctx, db.NoteChangesTable, change)
+	if err != nil {
+		return 0, err
+	}
+
+	return change.Seq, nil
+}
+
+func getNoteChange(ctx context.Context, s db.Store, noteID int) (model.NoteChange, error) {
+	var change model.NoteChange
+
+	res, err := s.Query(ctx, db.NoteChangesTable, db.IDIdx, noteID)
+	if err != nil {
+		return change, err
+	}
+
+	if len(res) > 0 {
+		change = res[0].(model.NoteChange)
+	}
+
+	return change, nil
+}
+
+// GetSyncChangesDB retrieves every change made to the user's notes after the specified sequence, along with the
+// sequence to resume from
+func GetSyncChangesDB(ctx context.Context, userID int, since int) (_ []model.SyncChange, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetSyncChangesDB")
+	defer tracing.End(span, &err)
+
+	changes := make([]model.SyncChange, 0)
+	latest := since
+
+	// Read from a single snapshot so the returned sequence can't skip a change committed mid-request
+	err = app.Context.DB.View(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.NoteChangesTable, db.UserIdx, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range res {
+			change := row.(model.NoteChange)
+			if change.Seq <= since {
+				continue
+			}
+
+			syncChange, err := toSyncChange(ctx, txn, change)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, syncChange)
+
+			if change.Seq > latest {
+				latest = change.Seq
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Revision < changes[j].Revision
+	})
+
+	return changes, latest, nil
+}
+
+func toSyncChange(ctx context.Context, s db.Store, change model.NoteChange) (model.SyncChange, error) {
+	syncChange := model.SyncChange{
+		NoteID:   change.NoteID,
+		Revision: change.Seq,
+		Deleted:  change.Deleted,
+	}
+
+	if change.Deleted {
+		return syncChange, nil
+	}
+
+	note, err := getNote(ctx, s, change.NoteID)
+	if err != nil {
+		return syncChange, err
+	}
+	syncChange.Content = note.Content
+	syncChange.Modified = note.Modified
+
+	return syncChange, nil
+}
+
+// ApplySyncChangeDB applies a single change uploaded by an offline client. The change is only applied if the note hasn't
+// been modified since the revision the client based its change on, otherwise the server's version is returned as a conflict
+func ApplySyncChangeDB(ctx context.Context, userID int, item model.SyncUploadItem) (_ model.SyncUploadResult, err error) {
+	ctx, span := tracing.Start(ctx, "lib.ApplySyncChangeDB")
+	defer tracing.End(span, &err)
+
+	result := model.SyncUploadResult{ClientID: item.ClientID, NoteID: item.NoteID}
+
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		if item.NoteID == 0 {
+			if item.Deleted {
+				result.Status = SyncRejected
+				result.Error = apperr.ErrInvalidRequest.Code
+				return nil
+			}
+
+			noteID, seq, err := createUserNote(ctx, txn, userID, item.Content)
+			if apperr.IsClientError(err) {
+				result.Status = SyncRejected
+				result.Error = apperr.Lookup(err).Code
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			result.NoteID = noteID
+			result.Status = SyncApplied
+			result.Revision = seq
+			return nil
+		}
+
+		change, err := getNoteChange(ctx, txn, item.NoteID)
+		if err != nil {
+			return err
+		}
+
+		// Tombstones still belong to the user, everything else must pass the usual ownership check
+		if !(change.Deleted && change.UserID == userID) {
+			err = validateNoteOwnership(ctx, txn, userID, item.NoteID)
+			if err != nil {
+				result.Status = SyncRejected
+				result.Error = apperr.Lookup(err).Code
+				return nil
+			}
+		}
+
+		if change.Deleted && item.Deleted {
+			result.Status = SyncApplied
+			result.Revision = change.Seq
+			return nil
+		}
+
+		// A deleted note can't be edited, so the client has to decide whether to recreate it
+		if change.Seq != item.BaseRevision || change.Deleted {
+			current, err := toSyncChange(ctx, txn, change)
+			if err != nil {
+				return err
+			}
+			current.NoteID = item.NoteID
+
+			result.Status = SyncConflict
+			result.Revision = change.Seq
+			result.Current = &current
+			return nil
+		}
+
+		var seq int
+		if item.Deleted {
+			seq, err = removeUserNote(ctx, txn, userID, item.NoteID)
+		} else {
+			seq, err = updateUserNote(ctx, txn, userID, item.NoteID, item.Content)
+		}
+		if apperr.IsClientError(err) {
+			result.Status = SyncRejected
+			result.Error = apperr.Lookup(err).Code
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		result.Status = SyncApplied
+		result.Revision = seq
+		return nil
+	})
+
+	return result, err
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"context"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/model"
+	"testing"
+)
+
+func TestSyncToken(t *testing.T) {
+	app.Init()
+
+	// An empty token requests a full sync
+	have, err := DecodeSyncToken("")
+	if err != nil || have != 0 {
+		t.Errorf("empty token should decode to zero, have: %v", have)
+	}
+
+	// Round trip a valid token
+	want, err := RecordNoteChangeDB(context.Background(), 1, 1, false)
+	if err != nil {
+		t.Errorf("failed to record change: %s", err.Error())
+	}
+	have, err = DecodeSyncToken(EncodeSyncToken(want))
+	if err != nil {
+		t.Errorf("failed to decode token: %s", err.Error())
+	}
+	if have != want {
+		t.Errorf("unexpected sequence, have: %v, want: %v", have, want)
+	}
+
+	// Reject garbage and tokens issued beyond the current sequence
+	_, err = DecodeSyncToken("not a token")
+	if err == nil {
+		t.Errorf("invalid token should have been rejected")
+	}
+	_, err = DecodeSyncToken(EncodeSyncToken(want + 100))
+	if err == nil {
+		t.Errorf("token from the future should have been rejected")
+	}
+}
+
+func TestGetSyncChangesDB(t *testing.T) {
+	app.Init()
+
+	userID := 1
+	upload := []model.SyncUploadItem{
+		{ClientID: "a", Content: "first note"},
+		{ClientID: "b", Content: "second note"},
+	}
+
+	var noteIDs []int
+	for _, item := range upload {
+		result, err := ApplySyncChangeDB(context.Background(), userID, item)
+		if err != nil {
+			t.Errorf("failed to apply change: %s", err.Error())
+		}
+		noteIDs = append(noteIDs, result.NoteID)
+	}
+
+	// A full sync returns both notes
+	changes, token, err := GetSyncChangesDB(context.Background(), userID, 0)
+	if err != nil {
+		t.Errorf("failed to get changes: %s", err.Error())
+	}
+	if len(changes) != len(upload) {
+		t.Errorf("unexpected number of changes, have: %v, want: %v", len(changes), len(upload))
+	}
+
+	// Nothing has changed since the token was issued
+	changes, _, err = GetSyncChangesDB(context.Background(), userID, token)
+	if err != nil {
+		t.Errorf("failed to get changes: %s", err.Error())
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected no changes, have: %v", len(changes))
+	}
+
+	// Deleting a note leaves a tombstone for the next sync
+	_, err = ApplySyncChangeDB(context.Background(), userID, model.SyncUploadItem{NoteID: noteIDs[0], BaseRevision: token - 1, Deleted: true})
+	if err != nil {
+		t.Errorf("failed to apply delete: %s", err.Error())
+	}
+	changes, _, err = GetSyncChangesDB(context.Background(), userID, token)
+	if err != nil {
+		t.Errorf("failed to get changes: %s", err.Error())
+	}
+	if len(changes) != 1 || !changes[0].Deleted || changes[0].NoteID != noteIDs[0] {
+		t.Errorf("expected a single tombstone, have: %+v", changes)
+	}
+
+	// Other users don't see the changes
+	changes, _, err = GetSyncChangesDB(context.Background(), 2, 0)
+	if err != nil {
+		t.Errorf("failed to get changes: %s", err.Error())
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected no changes for another user, have: %v", len(changes))
+	}
+}
+
+func TestApplySyncChangeDB(t *testing.T) {
+	app.Init()
+
+	userID := 1
+	created, err := ApplySyncChangeDB(context.Background(), userID, model.SyncUploadItem{Content: "offline note"})
+	if err != nil || created.Status != SyncApplied {
+		t.Errorf("create should have been applied, have: %+v", created)
+	}
+
+	// Update based on the latest revision
+	updated, err := ApplySyncChangeDB(context.Background(), userID, model.SyncUploadItem{NoteID: created.NoteID, BaseRevision: created.Revision, Content: "edited"})
+	if err != nil || updated.Status != SyncApplied {
+		t.Errorf("update should have been applied, have: %+v", updated)
+	}
+
+	// Update based on a stale revision conflicts and returns the server's copy
+	stale, err := ApplySyncChangeDB(context.Background(), userID, model.SyncUploadItem{NoteID: created.NoteID, BaseRevision: created.Revision, Content: "stale edit"})
+	if err != nil {
+		t.Errorf("failed to apply change: %s", err.Error())
+	}
+	if stale.Status != SyncConflict || stale.Current == nil || stale.Current.Content != "edited" {
+		t.Errorf("stale update should have conflicted, have: %+v", stale)
+	}
+	note, _ := GetNoteDB(context.Background(), created.NoteID)
+	if note.Content != "edited" {
+		t.Errorf("conflicting change should not have been written, have: %v", note.Content)
+	}
+
+	// Another user can't touch the note
+	other, err := ApplySyncChangeDB(context.Background(), 2, model.SyncUploadItem{NoteID: created.NoteID, BaseRevision: updated.Revision, Deleted: true})
+	if err != nil || other.Status != SyncRejected {
+		t.Errorf("change by another user should have been rejected, have: %+v", other)
+	}
+
+	// Deleting twice is harmless
+	for i := 0; i < 2; i++ {
+		deleted, err := ApplySyncChangeDB(context.Background(), userID, model.SyncUploadItem{NoteID: created.NoteID, BaseRevision: updated.Revision, Deleted: true})
+		if err != nil || deleted.Status != SyncApplied {
+			t.Errorf("delete should have been applied, have: %+v", deleted)
+		}
+	}
+}
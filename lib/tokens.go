@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scopes lists every scope a personal access token can be given
+var Scopes = []string{model.ScopeNotesRead, model.ScopeNotesWrite, model.ScopeAccountRead}
+
+// maxAccessTokens limits how many personal access tokens each user may hold
+const maxAccessTokens = 100
+
+// accessTokenTouchInterval limits how often a token's LastUsed time is written, so busy scripts don't write on every
+// request
+const accessTokenTouchInterval = time.Minute
+
+// CreateAccessTokenDB issues the user a personal access token. The token is only returned this once, since only a hash
+// of its secret is stored
+func CreateAccessTokenDB(ctx context.Context, userID int, request model.CreateAccessTokenRequest) (_ model.CreateAccessTokenResponse, err error) {
+	ctx, span := tracing.Start(ctx, "lib.CreateAccessTokenDB")
+	defer tracing.End(span, &err)
+
+	now := time.Now()
+	var fields []model.FieldError
+	var scopes []string
+	for i, scope := range request.Scopes {
+		if !slices.Contains(Scopes, scope) {
+			fields = append(fields, model.FieldError{Field: fmt.Sprintf("scopes[%d]", i), Code: "invalid_choice", Message: "scopes must be one of: " + strings.Join(Scopes, ", ")})
+		} else if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if request.Expires != 0 && request.Expires <= now.Unix() {
+		fields = append(fields, model.FieldError{Field: "expires", Code: "invalid", Message: "expires must be in the future"})
+	}
+	if len(fields) > 0 {
+		return model.CreateAccessTokenResponse{}, apperr.Validation(fields...)
+	}
+
+	secret := randomString(32, base64.RawURLEncoding.EncodeToString)
+	token := model.AccessToken{
+		TokenID:    randomString(8, hex.EncodeToString),
+		UserID:     userID,
+		Name:       request.Name,
+		SecretHash: hashAccessTokenSecret(secret),
+		Scopes:     scopes,
+		Created:    now.Unix(),
+		Expires:    request.Expires,
+	}
+
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.AccessTokensTable, db.UserIdx, userID)
+		if err != nil {
+			return err
+		}
+		if len(res) >= maxAccessTokens {
+			return apperr.New(apperr.ErrInvalidRequest, fmt.Sprintf("a user may hold at most %d access tokens, revoke one first", maxAccessTokens))
+		}
+
+		return txn.Upsert(ctx, db.AccessTokensTable, token)
+	})
+	if err != nil {
+		return model.CreateAccessTokenResponse{}, err
+	}
+
+	return model.CreateAccessTokenResponse{
+		AccessTokenSummary: summariseAccessToken(token),
+		Token:              model.AccessTokenPrefix + token.TokenID + "_" + secret,
+	}, nil
+}
+
+// ListAccessTokensDB lists the user's personal access tokens, oldest first
+func ListAccessTokensDB(ctx context.Context, userID int) (_ []model.AccessTokenSummary, err error) {
+	ctx, span := tracing.Start(ctx, "lib.ListAccessTokensDB")
+	defer tracing.End(span, &err)
+
+	res, err := app.Context.DB.Query(ctx, db.AccessTokensTable, db.UserIdx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]model.AccessTokenSummary, 0, len(res))
+	for _, row := range res {
+		tokens = append(tokens, summariseAccessToken(row.(model.AccessToken)))
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Created != tokens[j].Created {
+			return tokens[i].Created < tokens[j].Created
+		}
+		return tokens[i].TokenID < tokens[j].TokenID
+	})
+
+	return tokens, nil
+}
+
+// DeleteAccessTokenDB revokes one of the user's personal access tokens
+func DeleteAccessTokenDB(ctx context.Context, userID int, tokenID string) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.DeleteAccessTokenDB")
+	defer tracing.End(span, &err)
+
+	return app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.AccessTokensTable, db.IDIdx, tokenID)
+		if err != nil {
+			return err
+		}
+
+		// Other users' tokens are reported as missing, so their IDs can't be probed
+		if len(res) == 0 || res[0].(model.AccessToken).UserID != userID {
+			return apperr.ErrAccessTokenNotFound
+		}
+
+		_, err = txn.Delete(ctx, db.AccessTokensTable, db.IDIdx, tokenID)
+		return err
+	})
+}
+
+// LookupAccessTokenDB finds the personal access token, returning false if it isn't one that was issued. It doesn't check
+// whether the token has expired
+func LookupAccessTokenDB(ctx context.Context, token string) (_ model.AccessToken, _ bool, err error) {
+	ctx, span := tracing.Start(ctx, "lib.LookupAccessTokenDB")
+	defer tracing.End(span, &err)
+
+	tokenID, secret, ok := strings.Cut(strings.TrimPrefix(token, model.AccessTokenPrefix), "_")
+	if !ok || !strings.HasPrefix(token, model.AccessTokenPrefix) {
+		return model.AccessToken{}, false, nil
+	}
+
+	res, err := app.Context.DB.Query(ctx, db.AccessTokensTable, db.IDIdx, tokenID)
+	if err != nil || len(res) == 0 {
+		return model.AccessToken{}, false, err
+	}
+
+	stored := res[0].(model.AccessToken)
+	if !hmac.Equal([]byte(hashAccessTokenSecret(secret)), []byte(stored.SecretHash)) {
+		return model.AccessToken{}, false, nil
+	}
+
+	return stored, true, nil
+}
+
+// TouchAccessTokenDB records that the token has just been used
+func TouchAccessTokenDB(ctx context.Context, token model.AccessToken) (err error) {
+	now := time.Now()
+	if now.Sub(time.Unix(token.LastUsed, 0)) < accessTokenTouchInterval {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "lib.TouchAccessTokenDB")
+	defer tracing.End(span, &err)
+
+	return app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		// The token may have been revoked since it was looked up, and mustn't be brought back
+		res, err := txn.Query(ctx, db.AccessTokensTable, db.IDIdx, token.TokenID)
+		if err != nil || len(res) == 0 {
+			return err
+		}
+
+		stored := res[0].(model.AccessToken)
+		stored.LastUsed = now.Unix()
+		return txn.Upsert(ctx, db.AccessTokensTable, stored)
+	})
+}
+
+// hashAccessTokenSecret hashes the secret for storage. The secret is random and long, so a fast hash can't be brute
+// forced, unlike a password
+func hashAccessTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func summariseAccessToken(token model.AccessToken) model.AccessTokenSummary {
+	return model.AccessTokenSummary{
+		TokenID:  token.TokenID,
+		Name:     token.Name,
+		Scopes:   token.Scopes,
+		Created:  token.Created,
+		Expires:  token.Expires,
+		LastUsed: token.LastUsed,
+	}
+}
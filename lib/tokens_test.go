@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/validate"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessTokens(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	userID, _ := InsertUserDB(ctx, "test.account", "")
+	otherID, _ := InsertUserDB(ctx, "other.account", "")
+
+	created, err := CreateAccessTokenDB(ctx, userID, model.CreateAccessTokenRequest{Name: "Backups", Scopes: []string{model.ScopeNotesRead, model.ScopeNotesRead}})
+	if err != nil {
+		t.Fatalf("failed to create access token: %s", err.Error())
+	}
+	if !strings.HasPrefix(created.Token, model.AccessTokenPrefix) {
+		t.Errorf("token should start with %s, have: %s", model.AccessTokenPrefix, created.Token)
+	}
+	if len(created.Scopes) != 1 {
+		t.Errorf("duplicate scopes should be removed, have: %v", created.Scopes)
+	}
+
+	// Only a hash of the secret is stored
+	res, _ := app.Context.DB.Query(ctx, db.AccessTokensTable, db.IDIdx, created.TokenID)
+	if len(res) != 1 || strings.Contains(created.Token, res[0].(model.AccessToken).SecretHash) {
+		t.Errorf("token secret should be stored hashed")
+	}
+
+	token, ok, err := LookupAccessTokenDB(ctx, created.Token)
+	if err != nil || !ok || token.UserID != userID {
+		t.Errorf("token should be found, have: %v, %v, %v", token, ok, err)
+	}
+	if _, ok, _ = LookupAccessTokenDB(ctx, created.Token+"x"); ok {
+		t.Errorf("token with the wrong secret should not be found")
+	}
+	if _, ok, _ = LookupAccessTokenDB(ctx, "notes_pat_missing"); ok {
+		t.Errorf("malformed token should not be found")
+	}
+
+	err = TouchAccessTokenDB(ctx, token)
+	if err != nil {
+		t.Fatalf("failed to touch access token: %s", err.Error())
+	}
+	tokens, _ := ListAccessTokensDB(ctx, userID)
+	if len(tokens) != 1 || tokens[0].LastUsed == 0 {
+		t.Errorf("token should have been used, have: %v", tokens)
+	}
+
+	err = DeleteAccessTokenDB(ctx, otherID, created.TokenID)
+	if !errors.Is(err, apperr.ErrAccessTokenNotFound) {
+		t.Errorf("another user's token should be reported missing, have: %v", err)
+	}
+	err = DeleteAccessTokenDB(ctx, userID, created.TokenID)
+	if err != nil {
+		t.Fatalf("failed to delete access token: %s", err.Error())
+	}
+	if _, ok, _ = LookupAccessTokenDB(ctx, created.Token); ok {
+		t.Errorf("deleted token should not be found")
+	}
+}
+
+func TestCreateAccessTokenValidation(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	userID, _ := InsertUserDB(ctx, "test.account", "")
+
+	tests := []struct {
+		name    string
+		request model.CreateAccessTokenRequest
+		field   string
+	}{
+		{"unknown scope", model.CreateAccessTokenRequest{Name: "Token", Scopes: []string{model.ScopeNotesRead, "notes:delete"}}, "scopes[1]"},
+		{"expired", model.CreateAccessTokenRequest{Name: "Token", Scopes: []string{model.ScopeNotesRead}, Expires: time.Now().Add(-time.Minute).Unix()}, "expires"},
+	}
+
+	for _, test := range tests {
+		_, err := CreateAccessTokenDB(ctx, userID, test.request)
+		fields := apperr.Fields(err)
+		if len(fields) != 1 || fields[0].Field != test.field {
+			t.Errorf("%s, have: %v, want an error for: %s", test.name, err, test.field)
+		}
+	}
+
+	// Every scope can be asked for, however many there are, and repeating one doesn't count against a limit
+	request := model.CreateAccessTokenRequest{Name: "Everything", Scopes: append(slices.Clone(Scopes), Scopes[0])}
+	err := validate.Struct(&request)
+	if err != nil {
+		t.Errorf("request for every scope failed validation: %s", err.Error())
+	}
+	created, err := CreateAccessTokenDB(ctx, userID, request)
+	if err != nil || len(created.Scopes) != len(Scopes) {
+		t.Errorf("token should have every scope once, have: %v, %v", created.Scopes, err)
+	}
+}
+
+func TestRevokeAccessTokens(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	userID, _ := InsertUserDB(ctx, "test.account", "")
+	created, _ := CreateAccessTokenDB(ctx, userID, model.CreateAccessTokenRequest{Name: "Backups", Scopes: []string{model.ScopeNotesRead}})
+	expired := model.AccessToken{TokenID: "expired", UserID: userID, Expires: time.Now().Add(-time.Minute).Unix()}
+	_ = app.Context.DB.Upsert(ctx, db.AccessTokensTable, expired)
+
+	removed, err := CompactDB(ctx)
+	if err != nil {
+		t.Fatalf("failed to compact: %s", err.Error())
+	}
+	if removed[db.AccessTokensTable] != 1 {
+		t.Errorf("expired token should have been removed, have: %v", removed)
+	}
+
+	err = LogoutUserDB(ctx, userID)
+	if err != nil {
+		t.Fatalf("failed to log user out: %s", err.Error())
+	}
+	if _, ok, _ := LookupAccessTokenDB(ctx, created.Token); ok {
+		t.Errorf("logging the user out should revoke their access tokens")
+	}
+}
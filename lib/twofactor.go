@@ -0,0 +1,379 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/totp"
+	"github.com/kylegk/notes/tracing"
+	"golang.org/x/crypto/bcrypt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// loginChallengeLifetime limits how long the user may take to enter their code once their password was accepted
+	loginChallengeLifetime = 5 * time.Minute
+
+	// maxChallengeFailures is how many wrong codes a login may be given before the password has to be entered again
+	maxChallengeFailures = 5
+
+	// maxAccountFailures is how many wrong codes the account's logins may be given in a row, however many challenges
+	// they're spread over, before its logins are locked for twoFactorLockout
+	maxAccountFailures = 10
+	twoFactorLockout   = 15 * time.Minute
+
+	// recoveryCodeCount is how many recovery codes the user is given at a time
+	recoveryCodeCount = 10
+)
+
+var errTwoFactorDisabled = apperr.New(apperr.ErrInvalidRequest, "two-factor authentication is not enabled")
+
+// GetTwoFactorStatusDB tells the user whether two-factor authentication is enabled for their account
+func GetTwoFactorStatusDB(ctx context.Context, userID int) (_ model.TwoFactorStatus, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetTwoFactorStatusDB")
+	defer tracing.End(span, &err)
+
+	account, err := getUser(ctx, &app.Context.DB, userID)
+	if err != nil {
+		return model.TwoFactorStatus{}, err
+	}
+
+	return model.TwoFactorStatus{Enabled: account.TOTPSecret != "", RecoveryCodes: len(account.RecoveryCodes)}, nil
+}
+
+// StartTwoFactorDB generates a secret for the user's authenticator app. Two-factor authentication isn't enabled until a
+// code generated from it is confirmed, and starting again replaces the secret
+func StartTwoFactorDB(ctx context.Context, userID int) (_ model.StartTwoFactorResponse, err error) {
+	ctx, span := tracing.Start(ctx, "lib.StartTwoFactorDB")
+	defer tracing.End(span, &err)
+
+	secret := totp.NewSecret()
+	var account model.UserAccount
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		account, err = getUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		if account.TOTPSecret != "" {
+			return apperr.ErrTwoFactorEnabled
+		}
+
+		account.TOTPPending = secret
+		return txn.Upsert(ctx, db.UsersTable, account)
+	})
+	if err != nil {
+		return model.StartTwoFactorResponse{}, err
+	}
+
+	return model.StartTwoFactorResponse{
+		Secret: secret,
+		URI:    totp.URI(app.Context.Config.Auth.TwoFactor.Issuer, account.User, secret),
+	}, nil
+}
+
+// ConfirmTwoFactorDB enables two-factor authentication once the user shows their authenticator app generates the right
+// codes, and returns their recovery codes
+func ConfirmTwoFactorDB(ctx context.Context, userID int, code string) (_ model.RecoveryCodesResponse, err error) {
+	ctx, span := tracing.Start(ctx, "lib.ConfirmTwoFactorDB")
+	defer tracing.End(span, &err)
+
+	codes, hashes := newRecoveryCodes()
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		account, err := getUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		if account.TOTPSecret != "" {
+			return apperr.ErrTwoFactorEnabled
+		}
+		if account.TOTPPending == "" {
+			return apperr.New(apperr.ErrInvalidRequest, "two-factor enrolment hasn't been started")
+		}
+
+		step, ok := totp.Validate(account.TOTPPending, normaliseCode(code), time.Now(), 0)
+		if !ok {
+			metrics.AuthFailures.WithLabelValues("invalid_two_factor_code").Inc()
+			return apperr.ErrInvalidTwoFactorCode
+		}
+
+		account.TOTPSecret, account.TOTPPending, account.TOTPLastStep = account.TOTPPending, "", step
+		account.RecoveryCodes = hashes
+		return txn.Upsert(ctx, db.UsersTable, account)
+	})
+	if err != nil {
+		return model.RecoveryCodesResponse{}, err
+	}
+
+	return model.RecoveryCodesResponse{RecoveryCodes: codes}, nil
+}
+
+// DisableTwoFactorDB turns two-factor authentication off once the user has entered their password, if they have one,
+// and a code from their authenticator app or a recovery code
+func DisableTwoFactorDB(ctx context.Context, userID int, request model.DisableTwoFactorRequest) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.DisableTwoFactorDB")
+	defer tracing.End(span, &err)
+
+	return app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		account, err := getUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		if account.TOTPSecret == "" {
+			return errTwoFactorDisabled
+		}
+
+		if account.PasswordHash != "" && bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(request.Password)) != nil {
+			metrics.AuthFailures.WithLabelValues("invalid_credentials").Inc()
+			return apperr.ErrInvalidCredentials
+		}
+
+		if !verifySecondFactor(&account, request.Code, true) {
+			metrics.AuthFailures.WithLabelValues("invalid_two_factor_code").Inc()
+			return apperr.ErrInvalidTwoFactorCode
+		}
+
+		account.TOTPSecret, account.TOTPPending, account.TOTPLastStep, account.RecoveryCodes = "", "", 0, nil
+		account.TwoFactorFailures, account.TwoFactorLockedUntil = 0, 0
+		err = txn.Upsert(ctx, db.UsersTable, account)
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.Delete(ctx, db.LoginChallengesTable, db.UserIdx, userID)
+		return err
+	})
+}
+
+// RegenerateRecoveryCodesDB replaces the user's recovery codes. Only a code from their authenticator app is accepted, so
+// a recovery code that was written down can't be used to get more
+func RegenerateRecoveryCodesDB(ctx context.Context, userID int, code string) (_ model.RecoveryCodesResponse, err error) {
+	ctx, span := tracing.Start(ctx, "lib.RegenerateRecoveryCodesDB")
+	defer tracing.End(span, &err)
+
+	codes, hashes := newRecoveryCodes()
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		account, err := getUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		if account.TOTPSecret == "" {
+			return errTwoFactorDisabled
+		}
+
+		if !verifySecondFactor(&account, code, false) {
+			metrics.AuthFailures.WithLabelValues("invalid_two_factor_code").Inc()
+			return apperr.ErrInvalidTwoFactorCode
+		}
+
+		account.RecoveryCodes = hashes
+		return txn.Upsert(ctx, db.UsersTable, account)
+	})
+	if err != nil {
+		return model.RecoveryCodesResponse{}, err
+	}
+
+	return model.RecoveryCodesResponse{RecoveryCodes: codes}, nil
+}
+
+// ResetTwoFactorDB turns off the user's two-factor authentication without a code, returning their ID, for when they've
+// lost their authenticator app and their recovery codes
+func ResetTwoFactorDB(ctx context.Context, user string) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.ResetTwoFactorDB")
+	defer tracing.End(span, &err)
+
+	var userID int
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.UsersTable, db.UserIdx, user)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return apperr.ErrUserNotFound
+		}
+
+		account := res[0].(model.UserAccount)
+		if account.TOTPSecret == "" {
+			return errTwoFactorDisabled
+		}
+		account.TOTPSecret, account.TOTPPending, account.TOTPLastStep, account.RecoveryCodes = "", "", 0, nil
+		account.TwoFactorFailures, account.TwoFactorLockedUntil = 0, 0
+		userID = account.UserID
+
+		err = txn.Upsert(ctx, db.UsersTable, account)
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.Delete(ctx, db.LoginChallengesTable, db.UserIdx, userID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// FinishTwoFactorLoginDB checks the second factor of a login whose password was accepted, returning the user's ID. The
+// challenge can only be finished once, and is abandoned after too many wrong codes
+func FinishTwoFactorLoginDB(ctx context.Context, request model.TwoFactorLoginRequest) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.FinishTwoFactorLoginDB")
+	defer tracing.End(span, &err)
+
+	// Wrong codes are counted against the challenge, so the error is only returned once that's been stored
+	var account model.UserAccount
+	var failed error
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.LoginChallengesTable, db.IDIdx, request.Challenge)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 || res[0].(model.LoginChallenge).Expires <= time.Now().Unix() {
+			metrics.AuthFailures.WithLabelValues("unknown_challenge").Inc()
+			failed = apperr.New(apperr.ErrInvalidTwoFactorCode, "the login is unknown or has expired, log in with the password again")
+			return nil
+		}
+		challenge := res[0].(model.LoginChallenge)
+
+		account, err = getUser(ctx, txn, challenge.UserID)
+		if err != nil {
+			return err
+		}
+
+		// Wrong codes are counted against the account too, so someone who knows the password can't keep guessing by
+		// starting new logins
+		now := time.Now()
+		if account.TwoFactorLockedUntil > now.Unix() {
+			metrics.AuthFailures.WithLabelValues("two_factor_locked").Inc()
+			failed = twoFactorLocked(account.TwoFactorLockedUntil)
+			return nil
+		}
+
+		if !verifySecondFactor(&account, request.Code, true) {
+			metrics.AuthFailures.WithLabelValues("invalid_two_factor_code").Inc()
+			failed = apperr.ErrInvalidTwoFactorCode
+
+			account.TwoFactorFailures++
+			if account.TwoFactorFailures >= maxAccountFailures {
+				account.TwoFactorFailures = 0
+				account.TwoFactorLockedUntil = now.Add(twoFactorLockout).Unix()
+				failed = twoFactorLocked(account.TwoFactorLockedUntil)
+			}
+			err = txn.Upsert(ctx, db.UsersTable, account)
+			if err != nil {
+				return err
+			}
+
+			challenge.Failures++
+			if challenge.Failures >= maxChallengeFailures {
+				_, err = txn.Delete(ctx, db.LoginChallengesTable, db.IDIdx, challenge.ChallengeID)
+				return err
+			}
+			return txn.Upsert(ctx, db.LoginChallengesTable, challenge)
+		}
+
+		_, err = txn.Delete(ctx, db.LoginChallengesTable, db.IDIdx, challenge.ChallengeID)
+		if err != nil {
+			return err
+		}
+		account.TwoFactorFailures, account.TwoFactorLockedUntil = 0, 0
+		return txn.Upsert(ctx, db.UsersTable, account)
+	})
+	if err == nil {
+		err = failed
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if account.Disabled {
+		metrics.AuthFailures.WithLabelValues("account_disabled").Inc()
+		return 0, apperr.ErrAccountDisabled
+	}
+
+	return account.UserID, nil
+}
+
+// twoFactorLocked returns the error reported while the account's logins are locked after too many wrong codes
+func twoFactorLocked(until int64) error {
+	wait := time.Until(time.Unix(until, 0))
+	err := apperr.New(apperr.ErrTwoFactorLocked, fmt.Sprintf("too many wrong codes, try again in %d minutes", int(math.Ceil(wait.Minutes()))))
+	return apperr.WithRetryAfter(err, wait)
+}
+
+// startLoginChallenge records that the user's password was accepted, returning the challenge the login is finished with
+func startLoginChallenge(ctx context.Context, userID int) (string, error) {
+	challenge := model.LoginChallenge{
+		ChallengeID: randomString(32, base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString),
+		UserID:      userID,
+		Expires:     time.Now().Add(loginChallengeLifetime).Unix(),
+	}
+
+	err := app.Context.DB.Upsert(ctx, db.LoginChallengesTable, challenge)
+	if err != nil {
+		return "", err
+	}
+
+	return challenge.ChallengeID, nil
+}
+
+// verifySecondFactor checks the code against the user's authenticator app, and then their recovery codes if they're
+// allowed. The account is updated so the code can't be used again, and the caller must store it
+func verifySecondFactor(account *model.UserAccount, code string, allowRecovery bool) bool {
+	code = normaliseCode(code)
+	if step, ok := totp.Validate(account.TOTPSecret, code, time.Now(), account.TOTPLastStep); ok {
+		account.TOTPLastStep = step
+		return true
+	}
+
+	if !allowRecovery {
+		return false
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, stored := range account.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			account.RecoveryCodes = slices.Delete(slices.Clone(account.RecoveryCodes), i, i+1)
+			return true
+		}
+	}
+
+	return false
+}
+
+// newRecoveryCodes returns a set of recovery codes, formatted to be written down, along with the hashes that are stored.
+// They're random enough that a fast hash is as good as a slow one, like access token secrets
+func newRecoveryCodes() ([]string, []string) {
+	encode := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code := strings.ToLower(randomString(10, encode))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	return codes, hashes
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// normaliseCode strips the separators users may type or copy along with a code, and lower cases recovery codes
+func normaliseCode(code string) string {
+	code = strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code))
+	return strings.ToLower(code)
+}
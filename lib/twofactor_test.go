@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/totp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enableTwoFactor enrols an authenticator app for the user, returning its secret and the recovery codes
+func enableTwoFactor(t *testing.T, userID int) (string, []string) {
+	t.Helper()
+	ctx := context.Background()
+
+	enrolment, err := StartTwoFactorDB(ctx, userID)
+	if err != nil {
+		t.Fatalf("failed to start enrolment: %s", err.Error())
+	}
+	code, _ := totp.Code(enrolment.Secret, totp.Step(time.Now()))
+	recovery, err := ConfirmTwoFactorDB(ctx, userID, code)
+	if err != nil {
+		t.Fatalf("failed to confirm enrolment: %s", err.Error())
+	}
+
+	return enrolment.Secret, recovery.RecoveryCodes
+}
+
+// challenge logs in with the password, returning the challenge to finish the login with
+func challenge(t *testing.T, user string, password string) string {
+	t.Helper()
+
+	_, err := AuthenticateUserDB(context.Background(), user, password)
+	if !errors.Is(err, apperr.ErrTwoFactorRequired) || apperr.Challenge(err) == "" {
+		t.Fatalf("login should need a second factor, have: %v", err)
+	}
+	return apperr.Challenge(err)
+}
+
+func TestTwoFactorEnrolment(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+	userID, _ := InsertUserDB(ctx, "test.account", "correct horse")
+
+	// Enrolment needs a code from the secret that was handed out
+	if _, err := ConfirmTwoFactorDB(ctx, userID, "123456"); !errors.Is(err, apperr.ErrInvalidRequest) {
+		t.Errorf("confirming before starting should have been refused, have: %v", err)
+	}
+	enrolment, err := StartTwoFactorDB(ctx, userID)
+	if err != nil || !strings.HasPrefix(enrolment.URI, "otpauth://totp/Notes:test.account?") || !strings.Contains(enrolment.URI, enrolment.Secret) {
+		t.Fatalf("unexpected enrolment, have: %v, %v", enrolment, err)
+	}
+	other, _ := totp.Code(totp.NewSecret(), totp.Step(time.Now()))
+	if _, err = ConfirmTwoFactorDB(ctx, userID, other); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("code from another secret should have been refused, have: %v", err)
+	}
+	if status, _ := GetTwoFactorStatusDB(ctx, userID); status.Enabled {
+		t.Errorf("two-factor authentication should not be enabled before it's confirmed")
+	}
+
+	code, _ := totp.Code(enrolment.Secret, totp.Step(time.Now()))
+	recovery, err := ConfirmTwoFactorDB(ctx, userID, code)
+	if err != nil || len(recovery.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("failed to confirm enrolment: %v, %v", recovery, err)
+	}
+	if status, _ := GetTwoFactorStatusDB(ctx, userID); !status.Enabled || status.RecoveryCodes != recoveryCodeCount {
+		t.Errorf("unexpected status, have: %v", status)
+	}
+	if _, err = StartTwoFactorDB(ctx, userID); !errors.Is(err, apperr.ErrTwoFactorEnabled) {
+		t.Errorf("enrolling again should have been refused, have: %v", err)
+	}
+
+	// Only hashes of the recovery codes are kept, and the secret isn't exported
+	account, _ := GetUserDB(ctx, userID)
+	for _, code := range recovery.RecoveryCodes {
+		if strings.Contains(strings.Join(account.RecoveryCodes, " "), normaliseCode(code)) {
+			t.Errorf("recovery codes should be stored hashed")
+		}
+	}
+	export, _ := ExportUserDB(ctx, userID)
+	if !export.Account.TwoFactorEnabled {
+		t.Errorf("export should say two-factor authentication is enabled")
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+	userID, _ := InsertUserDB(ctx, "test.account", "correct horse")
+	secret, recovery := enableTwoFactor(t, userID)
+
+	// The wrong password is still refused before any code is asked for
+	if _, err := AuthenticateUserDB(ctx, "test.account", "wrong horse"); !errors.Is(err, apperr.ErrInvalidCredentials) {
+		t.Errorf("wrong password should have been refused, have: %v", err)
+	}
+
+	// A code from the app finishes the login, but only once, and the code used to enrol can't be used again
+	account, _ := GetUserDB(ctx, userID)
+	used, _ := totp.Code(secret, account.TOTPLastStep)
+	if _, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: used}); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("code used to enrol should have been refused, have: %v", err)
+	}
+	login := challenge(t, "test.account", "correct horse")
+	code, _ := totp.Code(secret, totp.Step(time.Now())+1)
+	if have, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: login, Code: code}); err != nil || have != userID {
+		t.Errorf("login should have been finished, have: %v, %v", have, err)
+	}
+	if _, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: login, Code: recovery[0]}); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("login should only be finished once, have: %v", err)
+	}
+	if _, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: code}); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("code should only be accepted once, have: %v", err)
+	}
+
+	// Recovery codes work once each, however they're typed
+	typed := strings.ToUpper(strings.ReplaceAll(recovery[0], "-", " "))
+	if _, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: typed}); err != nil {
+		t.Errorf("recovery code should have been accepted, have: %v", err)
+	}
+	if _, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: recovery[0]}); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("recovery code should only be accepted once, have: %v", err)
+	}
+	if status, _ := GetTwoFactorStatusDB(ctx, userID); status.RecoveryCodes != recoveryCodeCount-1 {
+		t.Errorf("used recovery code should have been removed, have: %v", status)
+	}
+
+	// Too many wrong codes abandon the login
+	login = challenge(t, "test.account", "correct horse")
+	for i := 0; i < maxChallengeFailures; i++ {
+		_, _ = FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: login, Code: "not-a-code"})
+	}
+	if _, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: login, Code: recovery[1]}); err == nil || apperr.Detail(err) == "" {
+		t.Errorf("login should have been abandoned, have: %v", err)
+	}
+
+	// Expired challenges are refused and compacted
+	expired := model.LoginChallenge{ChallengeID: "expired", UserID: userID, Expires: time.Now().Add(-time.Minute).Unix()}
+	_ = app.Context.DB.Upsert(ctx, db.LoginChallengesTable, expired)
+	if _, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: "expired", Code: recovery[1]}); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("expired login should have been refused, have: %v", err)
+	}
+	_ = app.Context.DB.Upsert(ctx, db.LoginChallengesTable, expired)
+	if removed, _ := CompactDB(ctx); removed[db.LoginChallengesTable] != 1 {
+		t.Errorf("expired login should have been compacted, have: %v", removed)
+	}
+
+	// Logging the user out abandons their logins too
+	login = challenge(t, "test.account", "correct horse")
+	_ = LogoutUserDB(ctx, userID)
+	if _, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: login, Code: recovery[1]}); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("login should have been abandoned when the user was logged out, have: %v", err)
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+	userID, _ := InsertUserDB(ctx, "test.account", "correct horse")
+	secret, recovery := enableTwoFactor(t, userID)
+
+	// Wrong codes count against the account across challenges, so starting new logins doesn't allow more guesses
+	var err error
+	for i := 0; i < maxAccountFailures; i++ {
+		_, err = FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: "not-a-code"})
+	}
+	if !errors.Is(err, apperr.ErrTwoFactorLocked) {
+		t.Errorf("too many wrong codes should have locked the account, have: %v", err)
+	}
+	code, _ := totp.Code(secret, totp.Step(time.Now())+1)
+	if _, err = FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: code}); !errors.Is(err, apperr.ErrTwoFactorLocked) {
+		t.Errorf("right code should have been refused while locked, have: %v", err)
+	}
+
+	// Once the lockout has passed, the right code logs in and the count starts again
+	account, _ := GetUserDB(ctx, userID)
+	account.TwoFactorLockedUntil = time.Now().Add(-time.Second).Unix()
+	_ = app.Context.DB.Upsert(ctx, db.UsersTable, account)
+	if have, err := FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: code}); err != nil || have != userID {
+		t.Errorf("login should have been finished once the lockout passed, have: %v, %v", have, err)
+	}
+	if account, _ = GetUserDB(ctx, userID); account.TwoFactorFailures != 0 || account.TwoFactorLockedUntil != 0 {
+		t.Errorf("login should have reset the failures, have: %v, %v", account.TwoFactorFailures, account.TwoFactorLockedUntil)
+	}
+
+	// Failures stop counting once a login succeeds
+	for i := 0; i < maxAccountFailures-1; i++ {
+		_, _ = FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: "not-a-code"})
+	}
+	_, _ = FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: recovery[0]})
+	if _, err = FinishTwoFactorLoginDB(ctx, model.TwoFactorLoginRequest{Challenge: challenge(t, "test.account", "correct horse"), Code: "not-a-code"}); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("failures should have been reset by the login, have: %v", err)
+	}
+}
+
+func TestDisableTwoFactor(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+	userID, _ := InsertUserDB(ctx, "test.account", "correct horse")
+	secret, recovery := enableTwoFactor(t, userID)
+
+	// New recovery codes need a code from the app, not a recovery code
+	if _, err := RegenerateRecoveryCodesDB(ctx, userID, recovery[0]); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("recovery code should not regenerate recovery codes, have: %v", err)
+	}
+	code, _ := totp.Code(secret, totp.Step(time.Now())+1)
+	regenerated, err := RegenerateRecoveryCodesDB(ctx, userID, code)
+	if err != nil || len(regenerated.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("failed to regenerate recovery codes: %v, %v", regenerated, err)
+	}
+
+	// Disabling needs the password as well as a code, and old recovery codes no longer work
+	if err = DisableTwoFactorDB(ctx, userID, model.DisableTwoFactorRequest{Password: "wrong horse", Code: regenerated.RecoveryCodes[0]}); !errors.Is(err, apperr.ErrInvalidCredentials) {
+		t.Errorf("wrong password should have been refused, have: %v", err)
+	}
+	if err = DisableTwoFactorDB(ctx, userID, model.DisableTwoFactorRequest{Password: "correct horse", Code: recovery[0]}); !errors.Is(err, apperr.ErrInvalidTwoFactorCode) {
+		t.Errorf("replaced recovery code should have been refused, have: %v", err)
+	}
+	if err = DisableTwoFactorDB(ctx, userID, model.DisableTwoFactorRequest{Password: "correct horse", Code: regenerated.RecoveryCodes[0]}); err != nil {
+		t.Fatalf("failed to disable two-factor authentication: %s", err.Error())
+	}
+
+	if have, err := AuthenticateUserDB(ctx, "test.account", "correct horse"); err != nil || have != userID {
+		t.Errorf("password alone should log in again, have: %v, %v", have, err)
+	}
+	if err = DisableTwoFactorDB(ctx, userID, model.DisableTwoFactorRequest{Password: "correct horse", Code: regenerated.RecoveryCodes[1]}); !errors.Is(err, apperr.ErrInvalidRequest) {
+		t.Errorf("disabling twice should have been refused, have: %v", err)
+	}
+
+	// Administrators can turn it off for users who are locked out
+	enableTwoFactor(t, userID)
+	if have, err := ResetTwoFactorDB(ctx, "test.account"); err != nil || have != userID {
+		t.Errorf("failed to reset two-factor authentication: %v, %v", have, err)
+	}
+	if status, _ := GetTwoFactorStatusDB(ctx, userID); status.Enabled || status.RecoveryCodes != 0 {
+		t.Errorf("two-factor authentication should have been turned off, have: %v", status)
+	}
+}
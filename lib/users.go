@@ -1,37 +1,457 @@
 package lib
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
 	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/metrics"
 	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/tracing"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"sync"
 )
 
-// InsertUserDB inserts a user into the data store
-func InsertUserDB(user string) (int, error) {
+// InsertUserDB inserts a user into the data store. The password is optional, but users without one can't log in
+func InsertUserDB(ctx context.Context, user string, password string) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.InsertUserDB")
+	defer tracing.End(span, &err)
+
 	userID := db.IncrementUserID()
 
 	account := model.UserAccount{
 		UserID: userID,
 		User: user,
+		Role: model.RoleUser,
 	}
 
 	if user == "" {
-		return 0, fmt.Errorf(app.InvalidUserError)
+		return 0, apperr.Validation(model.FieldError{Field: "user", Code: "required", Message: "user is required"})
+	}
+
+	if password != "" {
+		account.PasswordHash, err = hashPassword(password)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// The name is checked in the same transaction the user is written in, so concurrent requests can't both claim it
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.UsersTable, db.UserIdx, user)
+		if err != nil {
+			return err
+		}
+		if len(res) > 0 {
+			return apperr.ErrUserExists
+		}
+
+		return txn.Upsert(ctx, db.UsersTable, account)
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	res, err := app.Context.DB.Query(db.UsersTable, db.UserIdx, user)
+	return userID, nil
+}
+
+// AuthenticateUserDB checks the user's password, returning their ID. When the user has two-factor authentication enabled,
+// a login challenge is started instead and returned in an ErrTwoFactorRequired error, to be finished with
+// FinishTwoFactorLoginDB
+func AuthenticateUserDB(ctx context.Context, user string, password string) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.AuthenticateUserDB")
+	defer tracing.End(span, &err)
+
+	res, err := app.Context.DB.Query(ctx, db.UsersTable, db.UserIdx, user)
+	if err != nil {
+		return 0, err
+	}
+
+	var account model.UserAccount
 	if len(res) > 0 {
-		err = fmt.Errorf(app.UserExistsError)
+		account = res[0].(model.UserAccount)
+	}
+
+	// Unknown users and users without a password are still checked against a hash, so the time taken doesn't reveal
+	// which accounts exist
+	hash := account.PasswordHash
+	if hash == "" {
+		hash = dummyPasswordHash()
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || account.PasswordHash == "" {
+		metrics.AuthFailures.WithLabelValues("invalid_credentials").Inc()
+		return 0, apperr.ErrInvalidCredentials
+	}
+
+	// Only someone who knows the password learns the account is disabled
+	if account.Disabled {
+		metrics.AuthFailures.WithLabelValues("account_disabled").Inc()
+		return 0, apperr.ErrAccountDisabled
+	}
+
+	if account.TOTPSecret != "" {
+		challenge, err := startLoginChallenge(ctx, account.UserID)
+		if err != nil {
+			return 0, err
+		}
+		return 0, apperr.TwoFactorRequired(challenge)
+	}
+
+	return account.UserID, nil
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", apperr.Validation(model.FieldError{Field: "password", Code: "too_long", Message: "password must be at most 72 bytes"})
+	}
+	if err != nil {
+		return "", err
 	}
+
+	return string(hash), nil
+}
+
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return string(hash)
+})
+
+// SetUserPasswordDB replaces the user's password, returning their ID. Their tokens are revoked and their browser sessions
+// ended, so anyone who logged in with the old password has to log in again
+func SetUserPasswordDB(ctx context.Context, user string, password string) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "lib.SetUserPasswordDB")
+	defer tracing.End(span, &err)
+
+	hash, err := hashPassword(password)
 	if err != nil {
 		return 0, err
 	}
 
-	err = app.Context.DB.Upsert(db.UsersTable, account)
+	var userID int
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		res, err := txn.Query(ctx, db.UsersTable, db.UserIdx, user)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return apperr.ErrUserNotFound
+		}
+
+		account := res[0].(model.UserAccount)
+		account.PasswordHash = hash
+		userID = account.UserID
+
+		return revokeTokens(ctx, txn, account)
+	})
 	if err != nil {
 		return 0, err
 	}
 
 	return userID, nil
-}
\ No newline at end of file
+}
+
+// GetUserDB retrieves a user's account
+func GetUserDB(ctx context.Context, userID int) (_ model.UserAccount, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetUserDB")
+	defer tracing.End(span, &err)
+
+	return getUser(ctx, &app.Context.DB, userID)
+}
+
+func getUser(ctx context.Context, s db.Store, userID int) (model.UserAccount, error) {
+	res, err := s.Query(ctx, db.UsersTable, db.IDIdx, userID)
+	if err != nil {
+		return model.UserAccount{}, err
+	}
+
+	if len(res) == 0 {
+		return model.UserAccount{}, apperr.ErrUserNotFound
+	}
+
+	return res[0].(model.UserAccount), nil
+}
+
+// revokeTokens saves the account with every token issued until now revoked, ends the user's browser sessions and
+// unfinished two-factor logins, and deletes their personal access tokens
+func revokeTokens(ctx context.Context, txn *db.Txn, account model.UserAccount) error {
+	account.TokenVersion++
+
+	err := txn.Upsert(ctx, db.UsersTable, account)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{db.SessionsTable, db.AccessTokensTable, db.LoginChallengesTable} {
+		_, err = txn.Delete(ctx, table, db.UserIdx, account.UserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteUserDB deletes the user along with everything they own: their notes, the record of changes to them, their usage,
+// their sessions, their personal access tokens, their linked identities, their unfinished logins and their idempotency
+// records. The last administrator can't be deleted
+func DeleteUserDB(ctx context.Context, userID int) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.DeleteUserDB")
+	defer tracing.End(span, &err)
+
+	return app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		account, err := getUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+
+		err = ensureAnotherAdmin(ctx, txn, account)
+		if err != nil {
+			return err
+		}
+
+		return deleteUser(ctx, txn, userID)
+	})
+}
+
+func deleteUser(ctx context.Context, txn *db.Txn, userID int) error {
+	userNotes, err := txn.Query(ctx, db.UserNotesTable, db.UserIdx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range userNotes {
+		_, err = deleteNote(ctx, txn, row.(model.UserNote).NoteID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Nobody is left to sync the deletions, so the record of changes goes too, as do responses kept for replay, which may
+	// hold the user's notes
+	for _, table := range []string{db.UserNotesTable, db.NoteChangesTable, db.SessionsTable, db.AccessTokensTable, db.IdentitiesTable, db.LoginChallengesTable, db.IdempotencyKeysTable} {
+		_, err = txn.Delete(ctx, table, db.UserIdx, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, table := range []string{db.UserUsageTable, db.UsersTable} {
+		_, err = txn.Delete(ctx, table, db.IDIdx, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportUserDB gathers everything held about the user: their account, usage, browser sessions, personal access tokens,
+// linked identities and notes, in ascending order of ID
+func ExportUserDB(ctx context.Context, userID int) (_ model.UserExport, err error) {
+	ctx, span := tracing.Start(ctx, "lib.ExportUserDB")
+	defer tracing.End(span, &err)
+
+	export := model.UserExport{Notes: make([]model.Note, 0)}
+	err = app.Context.DB.View(ctx, func(ctx context.Context, txn *db.Txn) error {
+		account, err := getUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+
+		summary, err := summarise(ctx, txn, account)
+		if err != nil {
+			return err
+		}
+		export.Account = model.ExportedAccount{
+			UserID:           summary.UserID,
+			User:             summary.User,
+			DisplayName:      account.DisplayName,
+			Role:             summary.Role,
+			HasPassword:      account.PasswordHash != "",
+			TwoFactorEnabled: account.TOTPSecret != "",
+			Settings:         account.Settings,
+			Notes:            summary.Notes,
+			Bytes:            summary.Bytes,
+			Sessions:         make([]model.ExportedSession, 0),
+			AccessTokens:     make([]model.AccessTokenSummary, 0),
+			Identities:       make([]model.ExportedIdentity, 0),
+		}
+
+		identities, err := txn.Query(ctx, db.IdentitiesTable, db.UserIdx, userID)
+		if err != nil {
+			return err
+		}
+		for _, row := range identities {
+			identity := row.(model.Identity)
+			export.Account.Identities = append(export.Account.Identities, model.ExportedIdentity{Issuer: identity.Issuer, Subject: identity.Subject, Created: identity.Created})
+		}
+
+		tokens, err := txn.Query(ctx, db.AccessTokensTable, db.UserIdx, userID)
+		if err != nil {
+			return err
+		}
+		for _, row := range tokens {
+			export.Account.AccessTokens = append(export.Account.AccessTokens, summariseAccessToken(row.(model.AccessToken)))
+		}
+
+		sessions, err := txn.Query(ctx, db.SessionsTable, db.UserIdx, userID)
+		if err != nil {
+			return err
+		}
+		for _, row := range sessions {
+			session := row.(model.Session)
+			export.Account.Sessions = append(export.Account.Sessions, model.ExportedSession{Created: session.Created, Expires: session.Expires})
+		}
+
+		userNotes, err := txn.Query(ctx, db.UserNotesTable, db.UserIdx, userID)
+		if err != nil {
+			return err
+		}
+		for _, row := range userNotes {
+			note, err := getNote(ctx, txn, row.(model.UserNote).NoteID)
+			if err != nil {
+				return err
+			}
+			export.Notes = append(export.Notes, note)
+		}
+		sort.Slice(export.Notes, func(i, j int) bool { return export.Notes[i].NoteID < export.Notes[j].NoteID })
+
+		return nil
+	})
+	if err != nil {
+		return model.UserExport{}, err
+	}
+
+	return export, nil
+}
+
+// GetProfileDB returns the user's profile, with their settings' defaults filled in
+func GetProfileDB(ctx context.Context, userID int) (_ model.UserProfile, err error) {
+	ctx, span := tracing.Start(ctx, "lib.GetProfileDB")
+	defer tracing.End(span, &err)
+
+	account, err := getUser(ctx, &app.Context.DB, userID)
+	if err != nil {
+		return model.UserProfile{}, err
+	}
+
+	return profile(account), nil
+}
+
+// UpdateProfileDB renames the user, or changes their display name or settings. The new name must not be taken by another
+// user
+func UpdateProfileDB(ctx context.Context, userID int, update model.UpdateProfileRequest) (_ model.UserProfile, err error) {
+	ctx, span := tracing.Start(ctx, "lib.UpdateProfileDB")
+	defer tracing.End(span, &err)
+
+	var account model.UserAccount
+	err = app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		account, err = getUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+
+		if update.User != nil && *update.User != account.User {
+			res, err := txn.Query(ctx, db.UsersTable, db.UserIdx, *update.User)
+			if err != nil {
+				return err
+			}
+			if len(res) > 0 {
+				return apperr.ErrUserExists
+			}
+			account.User = *update.User
+		}
+
+		if update.DisplayName != nil {
+			account.DisplayName = *update.DisplayName
+		}
+
+		if settings := update.Settings; settings != nil {
+			if settings.NoteFormat != nil {
+				account.Settings.NoteFormat = *settings.NoteFormat
+			}
+			if settings.Timezone != nil {
+				account.Settings.Timezone = *settings.Timezone
+			}
+			if settings.DefaultNotebook != nil {
+				account.Settings.DefaultNotebook = *settings.DefaultNotebook
+			}
+		}
+
+		return txn.Upsert(ctx, db.UsersTable, account)
+	})
+	if err != nil {
+		return model.UserProfile{}, err
+	}
+
+	return profile(account), nil
+}
+
+func profile(account model.UserAccount) model.UserProfile {
+	settings := account.Settings
+	if settings.NoteFormat == "" {
+		settings.NoteFormat = model.NoteFormatPlain
+	}
+	if settings.Timezone == "" {
+		settings.Timezone = "UTC"
+	}
+
+	return model.UserProfile{
+		UserID:      account.UserID,
+		User:        account.User,
+		DisplayName: account.DisplayName,
+		Role:        roleOf(account),
+		Settings:    settings,
+	}
+}
+
+// roleOf returns the user's role. Users created before roles were introduced have none, which makes them ordinary users
+func roleOf(account model.UserAccount) string {
+	if account.Role == "" {
+		return model.RoleUser
+	}
+	return account.Role
+}
+
+// LogoutUserDB revokes every token issued to the user and ends their browser sessions
+func LogoutUserDB(ctx context.Context, userID int) (err error) {
+	ctx, span := tracing.Start(ctx, "lib.LogoutUserDB")
+	defer tracing.End(span, &err)
+
+	return app.Context.DB.Update(ctx, func(ctx context.Context, txn *db.Txn) error {
+		account, err := getUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+
+		return revokeTokens(ctx, txn, account)
+	})
+}
+
+// ensureAnotherAdmin fails if the account is the only enabled administrator, who mustn't be removed, disabled or demoted
+func ensureAnotherAdmin(ctx context.Context, txn *db.Txn, account model.UserAccount) error {
+	if account.Role != model.RoleAdmin || account.Disabled {
+		return nil
+	}
+
+	res, err := txn.Query(ctx, db.UsersTable, db.IDIdx)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range res {
+		other := row.(model.UserAccount)
+		if other.UserID != account.UserID && other.Role == model.RoleAdmin && !other.Disabled {
+			return nil
+		}
+	}
+
+	return apperr.ErrLastAdmin
+}
@@ -1,8 +1,12 @@
 package lib
 
 import (
+	"context"
+	"errors"
 	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
 	"github.com/kylegk/notes/db"
+	"sync"
 	"testing"
 )
 
@@ -11,7 +15,7 @@ func TestInsertUser(t *testing.T) {
 
 	userName := "test.account1"
 	want := 1
-	have, err := InsertUserDB(userName)
+	have, err := InsertUserDB(context.Background(), userName, "")
 	if err != nil {
 		t.Errorf("failed to insert user: %s", err.Error())
 	}
@@ -23,7 +27,7 @@ func TestInsertUser(t *testing.T) {
 	// Insert a couple more test users and verify the latest ID is the value expected
 	moreUsers := []string{"test.account2","test.account3"}
 	for _, user := range moreUsers {
-		have, err = InsertUserDB(user)
+		have, err = InsertUserDB(context.Background(), user, "")
 		if err != nil {
 			t.Errorf("failed to insert user: %s", err.Error())
 		}
@@ -32,4 +36,121 @@ func TestInsertUser(t *testing.T) {
 			t.Errorf("unexpected user id, have %v, want: %v", have, want)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestInsertUserConcurrently(t *testing.T) {
+	app.Init()
+
+	// Only one of several concurrent inserts of the same name succeeds, the rest find the user already exists
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, 50)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = InsertUserDB(context.Background(), "concurrent.account", "")
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		if err == nil {
+			created++
+		} else if !errors.Is(err, apperr.ErrUserExists) {
+			t.Errorf("unexpected error, have: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("user should have been created once, have: %v", created)
+	}
+}
+
+func TestAuthenticateUser(t *testing.T) {
+	app.Init()
+
+	userID, err := InsertUserDB(context.Background(), "test.account", "correct horse")
+	if err != nil {
+		t.Fatalf("failed to insert user: %s", err.Error())
+	}
+	_, err = InsertUserDB(context.Background(), "no.password", "")
+	if err != nil {
+		t.Fatalf("failed to insert user: %s", err.Error())
+	}
+
+	have, err := AuthenticateUserDB(context.Background(), "test.account", "correct horse")
+	if err != nil || have != userID {
+		t.Errorf("valid password should have been accepted, have: %v, %v", have, err)
+	}
+
+	// Wrong passwords, unknown users and users without a password are all refused the same way
+	for _, c := range [][2]string{{"test.account", "wrong horse"}, {"unknown.account", "correct horse"}, {"no.password", ""}} {
+		_, err = AuthenticateUserDB(context.Background(), c[0], c[1])
+		if !errors.Is(err, apperr.ErrInvalidCredentials) {
+			t.Errorf("login as %s should have been refused, have: %v", c[0], err)
+		}
+	}
+}
+
+func TestSetUserPassword(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	userID, _ := InsertUserDB(ctx, "test.account", "correct horse")
+	session, _ := CreateSessionDB(ctx, userID)
+
+	have, err := SetUserPasswordDB(ctx, "test.account", "battery staple")
+	if err != nil || have != userID {
+		t.Fatalf("failed to set password, have: %v, %v", have, err)
+	}
+
+	if _, err = AuthenticateUserDB(ctx, "test.account", "correct horse"); err == nil {
+		t.Errorf("old password should have been rejected")
+	}
+	if _, err = AuthenticateUserDB(ctx, "test.account", "battery staple"); err != nil {
+		t.Errorf("new password should have been accepted, have: %s", err.Error())
+	}
+
+	res, _ := app.Context.DB.Query(ctx, db.SessionsTable, db.IDIdx, session.SessionID)
+	if len(res) != 0 {
+		t.Errorf("user's sessions should have ended")
+	}
+
+	_, err = SetUserPasswordDB(ctx, "no.such.user", "battery staple")
+	if !errors.Is(err, apperr.ErrUserNotFound) {
+		t.Errorf("unknown user should have been reported, have: %v", err)
+	}
+}
+
+func TestExportUser(t *testing.T) {
+	app.Init()
+	ctx := context.Background()
+
+	userID, _ := InsertUserDB(ctx, "test.account", "correct horse")
+	otherID, _ := InsertUserDB(ctx, "other.account", "")
+	olderID, _ := CreateNoteForUserDB(ctx, userID, "older note")
+	_, _ = CreateNoteForUserDB(ctx, otherID, "other note")
+	newerID, _ := CreateNoteForUserDB(ctx, userID, "newer note")
+	_, _ = CreateSessionDB(ctx, userID)
+
+	export, err := ExportUserDB(ctx, userID)
+	if err != nil {
+		t.Fatalf("failed to export user: %s", err.Error())
+	}
+
+	account := export.Account
+	if account.UserID != userID || !account.HasPassword || account.Notes != 2 || len(account.Sessions) != 1 {
+		t.Errorf("export should describe the account, have: %+v", account)
+	}
+	if len(export.Notes) != 2 || export.Notes[0].NoteID != olderID || export.Notes[1].NoteID != newerID {
+		t.Errorf("export should hold the user's notes in order, have: %+v", export.Notes)
+	}
+
+	_, err = ExportUserDB(ctx, 9999)
+	if !errors.Is(err, apperr.ErrUserNotFound) {
+		t.Errorf("unknown user should have been reported, have: %v", err)
+	}
+}
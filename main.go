@@ -1,11 +1,181 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/config"
+	"github.com/kylegk/notes/lib"
 	"github.com/kylegk/notes/router"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 )
 
-func main ()  {
-	app.Init()
-	router.AddRouting()
-}
\ No newline at end of file
+// command is a subcommand of the server binary. setup registers the command's own flags and returns the function that
+// runs it with the arguments left after the flags
+type command struct {
+	usage   string
+	summary string
+	setup   func(fs *flag.FlagSet) func(ctx context.Context, args []string) error
+
+	// admin commands work on the data store directly, so they need the file backend and the server must be stopped
+	admin bool
+}
+
+var commands = map[string]command{
+	"serve":          {"serve [flags]", "run the server, the default when no command is given", setupServe, false},
+	"create-user":    {"create-user [flags] [-role ROLE] NAME", "create a user, reading the password from the terminal or stdin", setupCreateUser, true},
+	"reset-password": {"reset-password [flags] NAME", "replace a user's password and end their sessions", setupResetPassword, true},
+	"reset-2fa":      {"reset-2fa [flags] NAME", "turn off a user's two-factor authentication, for when they've lost their authenticator app", setupResetTwoFactor, true},
+	"export":         {"export [flags] [-o FILE]", "write a snapshot of the data store to stdout or a file", setupExport, true},
+	"import":         {"import [flags] [-replace] FILE", "load a snapshot into an empty data store, or replace its contents", setupImport, true},
+	"compact":        {"compact [flags]", "remove expired sessions, idempotency records, access tokens, identity provider logins, login challenges and signing keys", setupCompact, true},
+	"verify":         {"verify [flags]", "check notes, owners, the change log, usage and id sequences agree", setupVerify, true},
+	"rotate-keys":    {"rotate-keys [flags] [-revoke]", "sign new tokens with a new key, retiring or revoking the old ones", setupRotateKeys, true},
+}
+
+// usageError is reported along with the usage of the command, and exits with status 2
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Getenv))
+}
+
+// run runs the command named by the first argument, or the server if there isn't one, returning the exit status
+func run(args []string, getenv func(string) string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s\n\n%s\n\nflags:\n", os.Args[0], cmd.usage, cmd.summary)
+		fs.PrintDefaults()
+	}
+	runCmd := cmd.setup(fs)
+
+	cfg, err := config.Parse(fs, args, getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if cmd.admin && cfg.Storage.Backend != config.FileBackend {
+		fmt.Fprintf(os.Stderr, "%s needs the %s storage backend, nothing is kept by the %s backend\n", name, config.FileBackend, cfg.Storage.Backend)
+		return 2
+	}
+
+	err = app.Setup(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = runCmd(ctx, fs.Args())
+
+	// Admin commands write their changes out when the application shuts down, the server shuts down by itself
+	if cmd.admin {
+		if shutdownErr := app.Context.Shutdown(context.Background()); err == nil {
+			err = shutdownErr
+		}
+	}
+
+	var usageErr *usageError
+	switch {
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(os.Stderr, "%s\nusage: %s %s\n", usageErr.msg, os.Args[0], cmd.usage)
+		return 2
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s [command] [flags] [arguments]\n\ncommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-16s %s\n", name, commands[name].summary)
+	}
+
+	fmt.Fprintf(w, "\nRun %s <command> -h for a command's flags. Every command accepts the server's configuration flags.\n", os.Args[0])
+}
+
+func setupServe(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return &usageError{msg: fmt.Sprintf("unexpected argument %q", args[0])}
+		}
+
+		// Usage totals are kept up to date as notes are written, but data saved before they were tracked needs counting
+		err := lib.RebuildUsageDB(ctx)
+		if err != nil {
+			return err
+		}
+
+		// Responses kept for idempotent replay are removed once their window passes, not only when retried
+		stopSweeper := lib.StartIdempotencySweeper()
+		app.Context.OnShutdown(func(ctx context.Context) error {
+			stopSweeper()
+			return nil
+		})
+
+		err = router.Serve(ctx)
+		if err != nil {
+			slog.Error("server stopped unexpectedly", "error", err)
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), app.Context.Config.Server.ShutdownTimeout)
+		defer cancel()
+
+		if shutdownErr := app.Context.Shutdown(shutdownCtx); err == nil {
+			err = shutdownErr
+		}
+
+		status := 0
+		if err != nil {
+			status = 1
+		}
+		slog.Info("shutdown complete", "status", status)
+
+		return err
+	}
+}
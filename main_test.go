@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/kylegk/notes/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withStdin runs fn with stdin reading the input, the way passwords are piped to the admin commands
+func withStdin(t *testing.T, input string, fn func()) {
+	t.Helper()
+
+	f, err := os.CreateTemp("", "stdin")
+	if err != nil {
+		t.Fatalf("failed to create stdin: %s", err.Error())
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, _ = f.WriteString(input)
+	_, _ = f.Seek(0, 0)
+
+	stdin := os.Stdin
+	os.Stdin = f
+	defer func() { os.Stdin = stdin }()
+
+	fn()
+}
+
+// withStderr runs fn and returns what it wrote to stderr, where the commands report their errors
+func withStderr(t *testing.T, fn func()) string {
+	t.Helper()
+
+	f, err := os.CreateTemp("", "stderr")
+	if err != nil {
+		t.Fatalf("failed to create stderr: %s", err.Error())
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stderr := os.Stderr
+	os.Stderr = f
+	defer func() { os.Stderr = stderr }()
+
+	fn()
+
+	b, _ := os.ReadFile(f.Name())
+	return string(b)
+}
+
+func TestUnknownCommand(t *testing.T) {
+	if status := run([]string{"frobnicate"}, func(string) string { return "" }); status != 2 {
+		t.Errorf("unknown command should exit with status 2, have: %v", status)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "notes")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notes.json")
+
+	env := map[string]string{"NOTES_STORAGE_BACKEND": "file", "NOTES_STORAGE_PATH": path}
+	getenv := func(key string) string {
+		return env[key]
+	}
+
+	// Admin commands need the file backend
+	if status := run([]string{"compact", "-storage-backend", "memory"}, getenv); status != 2 {
+		t.Errorf("admin command should need the file backend, have: %v", status)
+	}
+
+	if status := run([]string{"compact"}, getenv); status != 0 {
+		t.Errorf("compact should have succeeded, have: %v", status)
+	}
+	if status := run([]string{"compact", "extra"}, getenv); status != 2 {
+		t.Errorf("unexpected argument should exit with status 2, have: %v", status)
+	}
+
+	// Users created by one command are saved to the file, where the next one finds them
+	withStdin(t, "correct horse\n", func() {
+		if status := run([]string{"create-user", "test.account"}, getenv); status != 0 {
+			t.Errorf("create-user should have succeeded, have: %v", status)
+		}
+	})
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("create-user should have written the snapshot: %s", err.Error())
+	}
+	withStdin(t, "correct horse\n", func() {
+		if status := run([]string{"create-user", "test.account"}, getenv); status != 1 {
+			t.Errorf("existing user should not have been created again, have: %v", status)
+		}
+	})
+	withStdin(t, "battery staple\n", func() {
+		if status := run([]string{"reset-password", "test.account"}, getenv); status != 0 {
+			t.Errorf("reset-password should have succeeded, have: %v", status)
+		}
+	})
+	withStdin(t, "battery staple\n", func() {
+		var status int
+		stderr := withStderr(t, func() {
+			status = run([]string{"reset-password", "missing.account"}, getenv)
+		})
+		if status != 1 || !strings.Contains(stderr, "User not found") {
+			t.Errorf("unknown user should have been reported, have: %v, %q", status, stderr)
+		}
+	})
+
+	// Passwords are checked, but the names of existing users aren't held to the rules for new ones
+	withStdin(t, "\n", func() {
+		var status int
+		stderr := withStderr(t, func() {
+			status = run([]string{"reset-password", "test.account"}, getenv)
+		})
+		if status != 1 || !strings.Contains(stderr, "password is required") {
+			t.Errorf("empty password should have been refused, have: %v, %q", status, stderr)
+		}
+	})
+	withStdin(t, "battery staple\n", func() {
+		var status int
+		stderr := withStderr(t, func() {
+			status = run([]string{"reset-password", "x"}, getenv)
+		})
+		if status != 1 || !strings.Contains(stderr, "User not found") {
+			t.Errorf("short name should have been looked up, have: %v, %q", status, stderr)
+		}
+	})
+
+	// Nothing runs while another process, such as the server, holds the lock
+	unlock, err := db.LockFile(path)
+	if err != nil {
+		t.Fatalf("failed to lock: %s", err.Error())
+	}
+	before, _ := os.ReadFile(path)
+	withStdin(t, "correct horse\n", func() {
+		if status := run([]string{"create-user", "locked.account"}, getenv); status != 1 {
+			t.Errorf("locked store should have been refused, have: %v", status)
+		}
+	})
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Errorf("locked store should not have changed")
+	}
+	_ = unlock()
+
+	if status := run([]string{"compact"}, getenv); status != 0 {
+		t.Errorf("compact should have succeeded once the lock was released, have: %v", status)
+	}
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+)
+
+const namespace = "notes"
+
+// Registry holds every metric exposed by the application
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, by route template, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	HTTPRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests currently being handled.",
+	})
+
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Requests rejected during authentication, by reason.",
+	}, []string{"reason"})
+
+	PanicsRecovered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "panics_recovered_total",
+		Help:      "Panics recovered while handling requests.",
+	})
+
+	DBOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "Time taken by data store operations, by operation and table.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1},
+	}, []string{"operation", "table"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		HTTPRequestsInFlight,
+		AuthFailures,
+		PanicsRecovered,
+		DBOperationDuration,
+		tableRows,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+var tableRowsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "db", "table_rows"), "Rows currently stored, by table.", []string{"table"}, nil)
+
+// tableRowsCollector counts the rows in each table when the metrics are scraped
+type tableRowsCollector struct {
+	mu    sync.RWMutex
+	count func() (map[string]int, error)
+}
+
+var tableRows = &tableRowsCollector{}
+
+// SetTableRowCounter sets the function used to count the rows in each table
+func SetTableRowCounter(count func() (map[string]int, error)) {
+	tableRows.mu.Lock()
+	defer tableRows.mu.Unlock()
+	tableRows.count = count
+}
+
+func (c *tableRowsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tableRowsDesc
+}
+
+func (c *tableRowsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	count := c.count
+	c.mu.RUnlock()
+	if count == nil {
+		return
+	}
+
+	counts, err := count()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(tableRowsDesc, err)
+		return
+	}
+
+	for table, rows := range counts {
+		ch <- prometheus.MustNewConstMetric(tableRowsDesc, prometheus.GaugeValue, float64(rows), table)
+	}
+}
@@ -0,0 +1,28 @@
+package model
+
+// BatchOperation is a single create, update or delete within a batch request
+type BatchOperation struct {
+	Op      string `json:"op" validate:"required,oneof=create|update|delete"`
+	NoteID  int    `json:"noteid,omitempty"`
+	Content string `json:"content,omitempty" validate:"required_unless=op:delete,max=100000"`
+}
+
+// BatchRequest defines the shape of the request used for applying many note operations at once
+type BatchRequest struct {
+	Mode       string           `json:"mode,omitempty" validate:"oneof=atomic|best_effort"`
+	Operations []BatchOperation `json:"operations" validate:"required"`
+}
+
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	NoteID int    `json:"noteid,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Mode      string        `json:"mode"`
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
@@ -0,0 +1,20 @@
+package model
+
+// HealthResponse is returned by the liveness probe
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// ReadinessResponse reports the outcome of every readiness check, keyed by the check's name
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// VersionResponse describes the running build
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"builddate,omitempty"`
+	GoVersion string `json:"goversion"`
+}
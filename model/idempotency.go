@@ -0,0 +1,14 @@
+package model
+
+// IdempotencyRecord holds the response to a request made with an Idempotency-Key header, so that retries can be answered
+// without repeating the request. UserID is the user who made the request, or the one it created, and is 0 for anonymous
+// requests that didn't create one
+type IdempotencyRecord struct {
+	Key         string
+	UserID      int
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+	Expires     int64
+}
@@ -0,0 +1,11 @@
+package model
+
+// SigningKey signs and verifies tokens, which name the key in their kid header. New tokens are signed with the key that
+// hasn't been retired, and retired keys keep verifying the tokens they signed until those expire, unless they're revoked
+type SigningKey struct {
+	KeyID   string
+	Secret  string
+	Created int64
+	Retired int64
+	Revoked bool
+}
@@ -13,7 +13,7 @@ type UserNote struct {
 
 // CreateNoteRequest defines the shape of the request used for creating notes
 type CreateNoteRequest struct {
-	Content string `json:"content"`
+	Content string `json:"content" validate:"required,max=100000"`
 }
 
 type CreateNoteResponse struct {
@@ -21,9 +21,12 @@ type CreateNoteResponse struct {
 }
 
 type UpdateNoteRequest struct {
-	Content string
+	Content string `json:"content" validate:"required,max=100000"`
 }
 
+// GetAllNotesForUserResponse lists the IDs of the user's notes in ascending order. When the list is paginated, Next is the
+// cursor for the following page, and it's omitted on the last page
 type GetAllNotesForUserResponse struct {
 	Notes []int `json:"notes"`
+	Next int `json:"next,omitempty"`
 }
\ No newline at end of file
@@ -0,0 +1,54 @@
+package model
+
+// Identity links a user to their account at an OpenID Connect identity provider. IdentityID joins the issuer and the
+// subject, which together name the account at the provider
+type Identity struct {
+	IdentityID string
+	UserID     int
+	Issuer     string
+	Subject    string
+	Created    int64
+}
+
+// OIDCLogin is a login that has been sent to the identity provider and hasn't come back yet. The verifier and nonce
+// never leave the server, so only the login that was started can be finished. When UserID is set, the identity is
+// linked to that user rather than used to log in
+type OIDCLogin struct {
+	State    string
+	Verifier string
+	Nonce    string
+	UserID   int
+	Expires  int64
+}
+
+// IdentityClaims are what the server uses from a verified ID token
+type IdentityClaims struct {
+	Issuer      string
+	Subject     string
+	Username    string
+	DisplayName string
+}
+
+// OIDCLoginResponse is returned when the identity provider sends the user back. Provisioned is set when an account was
+// created for them, and Linked when the identity was linked to the account that started the login. When browser
+// sessions are enabled a session is started as well, and its CSRF token is returned
+type OIDCLoginResponse struct {
+	UserID      int    `json:"userid"`
+	Token       string `json:"token"`
+	Provisioned bool   `json:"provisioned"`
+	Linked      bool   `json:"linked"`
+	CSRFToken   string `json:"csrftoken,omitempty"`
+}
+
+// OIDCLinkResponse is returned when a user starts linking an identity with a POST. Front ends send the browser to URL to
+// log in at the identity provider
+type OIDCLinkResponse struct {
+	URL string `json:"url"`
+}
+
+// ExportedIdentity is one of the identities linked to the user, in their export
+type ExportedIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	Created int64  `json:"created"`
+}
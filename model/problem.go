@@ -0,0 +1,22 @@
+package model
+
+// Problem is the RFC 7807 problem details body returned for every error. Challenge is only set when a login needs a
+// second factor, and names the login to finish with it
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"requestid,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	Challenge string       `json:"challenge,omitempty"`
+}
+
+// FieldError describes why a single field of a request failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
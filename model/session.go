@@ -0,0 +1,16 @@
+package model
+
+// Session is a browser session, which lasts until it expires or the user logs out. The session cookie holds a token
+// naming the session, so ending it revokes the token
+type Session struct {
+	SessionID string
+	UserID    int
+	Created   int64
+	Expires   int64
+}
+
+type CreateSessionResponse struct {
+	UserID    int    `json:"userid"`
+	CSRFToken string `json:"csrftoken"`
+	Expires   int64  `json:"expires"`
+}
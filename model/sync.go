@@ -0,0 +1,52 @@
+package model
+
+// NoteChange records the most recent change made to a note. Deleted notes are kept as tombstones so offline clients
+// learn about them
+type NoteChange struct {
+	NoteID  int
+	UserID  int
+	Seq     int
+	Deleted bool
+}
+
+// SyncChange describes the current state of a note that has changed since the client's last sync
+type SyncChange struct {
+	NoteID   int    `json:"noteid"`
+	Revision int    `json:"revision"`
+	Deleted  bool   `json:"deleted"`
+	Content  string `json:"content,omitempty"`
+	Modified string `json:"modified,omitempty"`
+}
+
+type GetSyncChangesResponse struct {
+	Changes []SyncChange `json:"changes"`
+	Token   string       `json:"token"`
+}
+
+// SyncUploadItem is a single change made by the client while offline. A zero NoteID creates a new note
+type SyncUploadItem struct {
+	ClientID     string `json:"clientid" validate:"max=128"`
+	NoteID       int    `json:"noteid"`
+	BaseRevision int    `json:"baserevision"`
+	Content      string `json:"content" validate:"required_unless=deleted:true,max=100000"`
+	Deleted      bool   `json:"deleted"`
+}
+
+type SyncUploadRequest struct {
+	Changes []SyncUploadItem `json:"changes" validate:"required"`
+}
+
+// SyncUploadResult reports the outcome of a single uploaded change. On conflict, Current holds the server's version of
+// the note
+type SyncUploadResult struct {
+	ClientID string      `json:"clientid,omitempty"`
+	NoteID   int         `json:"noteid"`
+	Status   string      `json:"status"`
+	Revision int         `json:"revision,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Current  *SyncChange `json:"current,omitempty"`
+}
+
+type SyncUploadResponse struct {
+	Results []SyncUploadResult `json:"results"`
+}
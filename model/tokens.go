@@ -0,0 +1,52 @@
+package model
+
+// Scopes limit what a personal access token can be used for
+const (
+	ScopeNotesRead   = "notes:read"
+	ScopeNotesWrite  = "notes:write"
+	ScopeAccountRead = "account:read"
+)
+
+// AccessTokenPrefix starts every personal access token, so they can be told apart from the JWTs issued when logging in
+const AccessTokenPrefix = "notes_pat_"
+
+// AccessToken is a personal access token, a long-lived token for scripts that can only be used for its scopes. Only a
+// hash of its secret is kept. Expires is 0 for tokens that don't expire, and times are in seconds since the Unix epoch
+type AccessToken struct {
+	TokenID    string
+	UserID     int
+	Name       string
+	SecretHash string
+	Scopes     []string
+	Created    int64
+	Expires    int64
+	LastUsed   int64
+}
+
+// CreateAccessTokenRequest asks for a token with the given scopes, which expires at the given time, in seconds since the
+// Unix epoch, or never when it's omitted
+type CreateAccessTokenRequest struct {
+	Name    string   `json:"name" validate:"required,max=100"`
+	Scopes  []string `json:"scopes" validate:"required"`
+	Expires int64    `json:"expires,omitempty"`
+}
+
+// AccessTokenSummary describes a token without its secret
+type AccessTokenSummary struct {
+	TokenID  string   `json:"tokenid"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Created  int64    `json:"created"`
+	Expires  int64    `json:"expires,omitempty"`
+	LastUsed int64    `json:"lastused,omitempty"`
+}
+
+// CreateAccessTokenResponse is the only time the token itself is returned
+type CreateAccessTokenResponse struct {
+	AccessTokenSummary
+	Token string `json:"token"`
+}
+
+type ListAccessTokensResponse struct {
+	Tokens []AccessTokenSummary `json:"tokens"`
+}
@@ -0,0 +1,48 @@
+package model
+
+// LoginChallenge is a login whose password has been checked, waiting for the user's second factor. It's removed once
+// it's finished, or after too many wrong codes
+type LoginChallenge struct {
+	ChallengeID string
+	UserID      int
+	Expires     int64
+	Failures    int
+}
+
+// TwoFactorStatus tells the user whether two-factor authentication is enabled, and how many recovery codes they have
+// left
+type TwoFactorStatus struct {
+	Enabled       bool `json:"enabled"`
+	RecoveryCodes int  `json:"recoverycodes"`
+}
+
+// StartTwoFactorResponse holds the secret for the user's authenticator app, both on its own and as the otpauth:// URI
+// a QR code is made from
+type StartTwoFactorResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TwoFactorCodeRequest carries a code from the user's authenticator app
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" validate:"required,max=64"`
+}
+
+// RecoveryCodesResponse lists the user's new recovery codes, which are only returned this once
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoverycodes"`
+}
+
+// DisableTwoFactorRequest re-authenticates the user before two-factor authentication is turned off. Code may be a code
+// from their authenticator app or a recovery code, and the password is only needed when the account has one
+type DisableTwoFactorRequest struct {
+	Password string `json:"password,omitempty" validate:"max=72"`
+	Code     string `json:"code" validate:"required,max=64"`
+}
+
+// TwoFactorLoginRequest finishes a login with the challenge returned by the first step, and a code from the user's
+// authenticator app or one of their recovery codes
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge" validate:"required,max=64"`
+	Code      string `json:"code" validate:"required,max=64"`
+}
@@ -0,0 +1,21 @@
+package model
+
+// UserUsage is the running total of what a user has stored, kept up to date as notes are written
+type UserUsage struct {
+	UserID int
+	Notes  int
+	Bytes  int64
+}
+
+type GetUsageResponse struct {
+	Notes  int         `json:"notes"`
+	Bytes  int64       `json:"bytes"`
+	Limits UsageLimits `json:"limits"`
+}
+
+// UsageLimits are the user's quotas, where 0 means unlimited
+type UsageLimits struct {
+	MaxNotes     int   `json:"maxnotes"`
+	MaxBytes     int64 `json:"maxbytes"`
+	MaxNoteBytes int64 `json:"maxnotebytes"`
+}
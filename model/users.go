@@ -1,12 +1,72 @@
 package model
 
+const (
+	RoleUser = "user"
+	RoleAdmin = "admin"
+)
+
+// UserAccount is a user's row in the data store. Disabled users can't log in or use their tokens. Tokens carry the
+// TokenVersion they were issued at, so incrementing it revokes every token issued until then. Two-factor authentication
+// is enabled when TOTPSecret is set, while TOTPPending holds the secret of an enrolment that hasn't been confirmed yet.
+// TOTPLastStep is the last step a code was accepted for, and RecoveryCodes are hashes of the unused recovery codes.
+// TwoFactorFailures counts wrong codes given since the last login, and logins can't be finished until
+// TwoFactorLockedUntil once there have been too many
 type UserAccount struct {
 	UserID int
 	User string
+	PasswordHash string
+	Role string
+	Disabled bool
+	TokenVersion int
+	DisplayName string
+	Settings UserSettings
+	TOTPSecret string
+	TOTPPending string
+	TOTPLastStep int64
+	RecoveryCodes []string
+	TwoFactorFailures int
+	TwoFactorLockedUntil int64
 }
 
-type CreateUserRequest struct {
+// UserSettings are the user's preferences, kept on the server so each of their clients can apply them. Empty settings
+// take their defaults: plain notes, UTC and no default notebook
+type UserSettings struct {
+	NoteFormat string `json:"noteformat"`
+	Timezone string `json:"timezone"`
+	DefaultNotebook string `json:"defaultnotebook"`
+}
+
+const (
+	NoteFormatPlain = "plain"
+	NoteFormatMarkdown = "markdown"
+)
+
+// UserProfile is what the user can see and change about their own account
+type UserProfile struct {
+	UserID int `json:"userid"`
 	User string `json:"user"`
+	DisplayName string `json:"displayname"`
+	Role string `json:"role"`
+	Settings UserSettings `json:"settings"`
+}
+
+// UpdateProfileRequest changes the fields that are given, leaving the others as they are. An empty display name or
+// setting clears it
+type UpdateProfileRequest struct {
+	User *string `json:"user,omitempty" validate:"min=3,max=64,username"`
+	DisplayName *string `json:"displayname,omitempty" validate:"max=100"`
+	Settings *UpdateSettingsRequest `json:"settings,omitempty"`
+}
+
+type UpdateSettingsRequest struct {
+	NoteFormat *string `json:"noteformat,omitempty" validate:"oneof=plain|markdown"`
+	Timezone *string `json:"timezone,omitempty" validate:"timezone"`
+	DefaultNotebook *string `json:"defaultnotebook,omitempty" validate:"max=100"`
+}
+
+type CreateUserRequest struct {
+	User string `json:"user" validate:"required,min=3,max=64,username"`
+	Password string `json:"password,omitempty" validate:"omitempty,min=8,max=72"`
 }
 
 type CreateUserResponse struct {
@@ -14,3 +74,80 @@ type CreateUserResponse struct {
 	Token string `json:"token"`
 }
 
+// ResetPasswordRequest is the new password an administrator sets for an existing user
+type ResetPasswordRequest struct {
+	Password string `json:"password" validate:"required,min=8,max=72"`
+}
+
+type LoginRequest struct {
+	User string `json:"user" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type LoginResponse struct {
+	UserID int `json:"userid"`
+	Token string `json:"token"`
+}
+
+
+// UserSummary describes a user to administrators
+type UserSummary struct {
+	UserID int `json:"userid"`
+	User string `json:"user"`
+	Role string `json:"role"`
+	Disabled bool `json:"disabled"`
+	Notes int `json:"notes"`
+	Bytes int64 `json:"bytes"`
+}
+
+// ListUsersResponse lists users in ascending order of ID. When the list is paginated, Next is the cursor for the
+// following page, and it's omitted on the last page
+type ListUsersResponse struct {
+	Users []UserSummary `json:"users"`
+	Next int `json:"next,omitempty"`
+}
+
+// UpdateUserRequest changes the fields that are given, leaving the others as they are
+type UpdateUserRequest struct {
+	Role *string `json:"role,omitempty" validate:"oneof=user|admin"`
+	Disabled *bool `json:"disabled,omitempty"`
+}
+
+// SystemStats summarises what the server holds. Admins only counts administrators who aren't disabled
+type SystemStats struct {
+	Users int `json:"users"`
+	Admins int `json:"admins"`
+	DisabledUsers int `json:"disabledusers"`
+	Notes int `json:"notes"`
+	Bytes int64 `json:"bytes"`
+	ActiveSessions int `json:"activesessions"`
+}
+
+// UserExport is everything held about a user, as written to the archive they can download. Password hashes, session IDs,
+// access token hashes and two-factor secrets are left out, since they're only useful for getting into the account
+type UserExport struct {
+	Account ExportedAccount `json:"account"`
+	Notes []Note `json:"notes"`
+}
+
+// ExportedAccount describes the user in their export
+type ExportedAccount struct {
+	UserID int `json:"userid"`
+	User string `json:"user"`
+	DisplayName string `json:"displayname"`
+	Role string `json:"role"`
+	HasPassword bool `json:"haspassword"`
+	TwoFactorEnabled bool `json:"twofactorenabled"`
+	Settings UserSettings `json:"settings"`
+	Notes int `json:"notes"`
+	Bytes int64 `json:"bytes"`
+	Sessions []ExportedSession `json:"sessions"`
+	AccessTokens []AccessTokenSummary `json:"accesstokens"`
+	Identities []ExportedIdentity `json:"identities"`
+}
+
+// ExportedSession is one of the user's browser sessions, with its times in seconds since the Unix epoch
+type ExportedSession struct {
+	Created int64 `json:"created"`
+	Expires int64 `json:"expires"`
+}
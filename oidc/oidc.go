@@ -0,0 +1,394 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config names the identity provider and how the server is registered with it
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Provider logs users in with an OpenID Connect identity provider, using the authorization code flow with PKCE. The
+// provider's endpoints are discovered the first time they're needed, so the server can start while it's unreachable
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      map[string]interface{}
+}
+
+// IDToken holds the claims of an ID token that has been verified
+type IDToken struct {
+	Subject string
+	Claims  map[string]interface{}
+}
+
+// discovery is the part of the provider's metadata the server uses
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// clockSkew is how far the provider's clock may be ahead of the server's
+const clockSkew = time.Minute
+
+// New returns a provider that makes its requests with client, or a client with a short timeout when it's nil
+func New(cfg Config, client *http.Client) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &Provider{cfg: cfg, client: client}
+}
+
+// NewVerifier returns a random PKCE code verifier
+func NewVerifier() string {
+	return randomString(32)
+}
+
+// NewState returns a random value for the state or nonce of a login
+func NewState() string {
+	return randomString(32)
+}
+
+// AuthCodeURL returns the URL the user is sent to for logging in. The provider sends them back to the redirect URL with
+// the state, and the code can only be exchanged with the verifier, which never leaves the server
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return d.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange swaps the code the provider sent the user back with for an ID token, which is verified before it's returned.
+// The token must have been issued to this client for the login with the nonce
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string, nonce string) (IDToken, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return IDToken{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return IDToken{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.fetchJSON(request, &body)
+	if err != nil {
+		return IDToken{}, err
+	}
+	if body.Error != "" {
+		return IDToken{}, fmt.Errorf("token request failed: %s %s", body.Error, body.ErrorDescription)
+	}
+	if status != http.StatusOK || body.IDToken == "" {
+		return IDToken{}, fmt.Errorf("token request failed with status %d and no ID token", status)
+	}
+
+	return p.verify(ctx, d, body.IDToken, nonce)
+}
+
+// verify checks the ID token was signed by the provider, for this client, and hasn't expired
+func (p *Provider) verify(ctx context.Context, d *discovery, rawToken string, nonce string) (IDToken, error) {
+	token, err := jwt.Parse(rawToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, d, kid)
+	})
+	if err != nil {
+		// The provider's clock may be slightly ahead, so tokens that aren't valid yet are checked below instead
+		var validationErr *jwt.ValidationError
+		if !errors.As(err, &validationErr) || validationErr.Errors != jwt.ValidationErrorIssuedAt {
+			return IDToken{}, fmt.Errorf("invalid ID token: %v", err)
+		}
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return IDToken{}, errors.New("invalid ID token claims")
+	}
+
+	now := time.Now()
+	if iss, _ := claims["iss"].(string); iss != d.Issuer {
+		return IDToken{}, fmt.Errorf("ID token was issued by %q", iss)
+	}
+	if !audienceContains(claims["aud"], p.cfg.ClientID) {
+		return IDToken{}, errors.New("ID token was issued to another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.cfg.ClientID {
+		return IDToken{}, errors.New("ID token was issued to another client")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || now.Unix() >= int64(exp) {
+		return IDToken{}, errors.New("ID token has expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && int64(iat) > now.Add(clockSkew).Unix() {
+		return IDToken{}, errors.New("ID token was issued in the future")
+	}
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return IDToken{}, errors.New("ID token was issued for another login")
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return IDToken{}, errors.New("ID token has no subject")
+	}
+
+	return IDToken{Subject: subject, Claims: claims}, nil
+}
+
+// key returns the provider's public key with the ID. When it isn't known, the provider's keys are fetched again, since
+// it may have rotated them
+func (p *Provider) key(ctx context.Context, d *discovery, kid string) (interface{}, error) {
+	p.mu.Lock()
+	key, ok := p.lookupKey(kid)
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, d.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	status, err := p.fetchJSON(request, &set)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("fetching the provider's keys failed with status %d", status)
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if publicKey, err := k.publicKey(); err == nil {
+			keys[k.KeyID] = publicKey
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	key, ok = p.lookupKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	return key, nil
+}
+
+// lookupKey finds the key with the ID, or the only key when the token doesn't name one
+func (p *Provider) lookupKey(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// discover fetches the provider's metadata, which must be for the configured issuer
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	d = &discovery{}
+	status, err := p.fetchJSON(request, d)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("discovery failed with status %d", status)
+	}
+	if d.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("provider reports issuer %q, expected %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("provider metadata is missing an endpoint")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.discovery = d
+
+	return d, nil
+}
+
+// fetchJSON sends the request and decodes the response body, returning the response's status
+func (p *Provider) fetchJSON(request *http.Request, v interface{}) (int, error) {
+	response, err := p.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(v)
+	if err != nil {
+		return response.StatusCode, fmt.Errorf("cannot decode response from %s: %v", request.URL.Redacted(), err)
+	}
+
+	return response.StatusCode, nil
+}
+
+// jsonWebKey is one of the provider's public keys. RSA keys and P-256 elliptic curve keys are supported
+type jsonWebKey struct {
+	KeyID string `json:"kid"`
+	Type  string `json:"kty"`
+	Use   string `json:"use"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Type {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid elliptic curve key")
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Type)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// audienceContains reports whether the aud claim, which may be a string or a list, names the client
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
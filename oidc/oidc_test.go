@@ -0,0 +1,109 @@
+package oidc
+
+import (
+	"context"
+	"github.com/golang-jwt/jwt"
+	"github.com/kylegk/notes/oidc/oidctest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// login runs the flow against the provider, returning the ID token or the error from the exchange
+func login(t *testing.T, p *Provider, idp *oidctest.Provider) (IDToken, error) {
+	t.Helper()
+
+	verifier, state, nonce := NewVerifier(), NewState(), NewState()
+	authURL, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatalf("failed to build the authorization URL: %s", err.Error())
+	}
+
+	callback, err := idp.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("failed to authorize: %s", err.Error())
+	}
+	u, _ := url.Parse(callback)
+	if have := u.Query().Get("state"); have != state {
+		t.Fatalf("state should be returned, have: %s, want: %s", have, state)
+	}
+
+	return p.Exchange(context.Background(), u.Query().Get("code"), verifier, nonce)
+}
+
+func TestExchange(t *testing.T) {
+	idp := oidctest.NewProvider("notes", "secret")
+	defer idp.Close()
+	idp.Login("user-1", map[string]interface{}{"preferred_username": "test.account"})
+
+	p := New(Config{Issuer: idp.Issuer(), ClientID: "notes", ClientSecret: "secret", RedirectURL: "http://notes.test/oidc/callback", Scopes: []string{"openid"}}, nil)
+	token, err := login(t, p, idp)
+	if err != nil {
+		t.Fatalf("failed to log in: %s", err.Error())
+	}
+	if token.Subject != "user-1" || token.Claims["preferred_username"] != "test.account" {
+		t.Errorf("unexpected ID token, have: %v", token)
+	}
+}
+
+func TestExchangeRefusesBadTokens(t *testing.T) {
+	idp := oidctest.NewProvider("notes", "")
+	defer idp.Close()
+	idp.Login("user-1", nil)
+
+	p := New(Config{Issuer: idp.Issuer(), ClientID: "notes", RedirectURL: "http://notes.test/oidc/callback", Scopes: []string{"openid"}}, nil)
+
+	tests := []struct {
+		name   string
+		tamper func(claims jwt.MapClaims)
+	}{
+		{"another issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://elsewhere.test" }},
+		{"another audience", func(claims jwt.MapClaims) { claims["aud"] = "other" }},
+		{"another authorized party", func(claims jwt.MapClaims) { claims["aud"] = []string{"notes", "other"}; claims["azp"] = "other" }},
+		{"expired", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{"another nonce", func(claims jwt.MapClaims) { claims["nonce"] = "replayed" }},
+		{"no subject", func(claims jwt.MapClaims) { delete(claims, "sub") }},
+	}
+
+	for _, test := range tests {
+		idp.Tamper = test.tamper
+		_, err := login(t, p, idp)
+		if err == nil {
+			t.Errorf("%s, token should have been refused", test.name)
+		}
+	}
+
+	// Several audiences are fine as long as the client is the authorized party
+	idp.Tamper = func(claims jwt.MapClaims) { claims["aud"] = []string{"other", "notes"}; claims["azp"] = "notes" }
+	if _, err := login(t, p, idp); err != nil {
+		t.Errorf("token for several audiences should have been accepted, have: %s", err.Error())
+	}
+}
+
+func TestExchangeRefusesWrongVerifier(t *testing.T) {
+	idp := oidctest.NewProvider("notes", "")
+	defer idp.Close()
+	idp.Login("user-1", nil)
+
+	p := New(Config{Issuer: idp.Issuer(), ClientID: "notes", RedirectURL: "http://notes.test/oidc/callback", Scopes: []string{"openid"}}, nil)
+	authURL, _ := p.AuthCodeURL(context.Background(), NewState(), "nonce", NewVerifier())
+	callback, _ := idp.Authorize(authURL)
+	u, _ := url.Parse(callback)
+
+	_, err := p.Exchange(context.Background(), u.Query().Get("code"), NewVerifier(), "nonce")
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("code should only be exchanged with its verifier, have: %v", err)
+	}
+}
+
+func TestDiscoveryChecksIssuer(t *testing.T) {
+	idp := oidctest.NewProvider("notes", "")
+	defer idp.Close()
+
+	p := New(Config{Issuer: idp.Issuer() + "/", ClientID: "notes", RedirectURL: "http://notes.test/oidc/callback"}, nil)
+	_, err := p.AuthCodeURL(context.Background(), "state", "nonce", NewVerifier())
+	if err == nil || !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("provider for another issuer should have been refused, have: %v", err)
+	}
+}
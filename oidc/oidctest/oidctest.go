@@ -0,0 +1,234 @@
+// Package oidctest runs an OpenID Connect identity provider for tests. It implements just enough of the authorization
+// code flow with PKCE to log a chosen user in, and checks the requests made to it the way a real provider would
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const keyID = "test-key"
+
+// Provider is an identity provider listening on a local address. Users log in as whoever was last passed to Login
+type Provider struct {
+	ClientID     string
+	ClientSecret string
+
+	// Tamper, when set, changes the claims of the ID tokens issued, so tests can check bad tokens are refused
+	Tamper func(claims jwt.MapClaims)
+
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims jwt.MapClaims
+	codes  map[string]grant
+}
+
+// grant is an authorization code that hasn't been exchanged yet
+type grant struct {
+	claims      jwt.MapClaims
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+// NewProvider starts a provider for the client, which should be closed when the test is done
+func NewProvider(clientID string, clientSecret string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	p := &Provider{ClientID: clientID, ClientSecret: clientSecret, key: key, codes: map[string]grant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+	p.server = httptest.NewServer(mux)
+
+	return p
+}
+
+// Issuer returns the provider's issuer URL
+func (p *Provider) Issuer() string {
+	return p.server.URL
+}
+
+// Close stops the provider
+func (p *Provider) Close() {
+	p.server.Close()
+}
+
+// Login sets the user who logs in next, named by the subject, with any other claims their ID token should carry
+func (p *Provider) Login(subject string, claims map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.claims = jwt.MapClaims{"sub": subject}
+	for k, v := range claims {
+		p.claims[k] = v
+	}
+}
+
+// Authorize follows the URL the server sent the user to, and returns the URL the provider sends them back to
+func (p *Provider) Authorize(authURL string) (string, error) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	response, err := client.Get(authURL)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusFound {
+		return "", fmt.Errorf("authorization failed with status %d", response.StatusCode)
+	}
+
+	return response.Header.Get("Location"), nil
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 p.Issuer(),
+		"authorization_endpoint": p.Issuer() + "/authorize",
+		"token_endpoint":         p.Issuer() + "/token",
+		"jwks_uri":               p.Issuer() + "/jwks",
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("client_id") != p.ClientID || redirectURI.Host == "" {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+
+	back := redirectURI.Query()
+	back.Set("state", query.Get("state"))
+
+	p.mu.Lock()
+	claims := p.claims
+	p.mu.Unlock()
+
+	switch {
+	case query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "":
+		back.Set("error", "invalid_request")
+	case claims == nil:
+		back.Set("error", "access_denied")
+	default:
+		code := randomString()
+		p.mu.Lock()
+		p.codes[code] = grant{claims: claims, redirectURI: query.Get("redirect_uri"), challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+		p.mu.Unlock()
+		back.Set("code", code)
+	}
+
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	// Public clients don't authenticate, and only name themselves in the form
+	clientID, clientSecret, ok := r.BasicAuth()
+	clientID, _ = url.QueryUnescape(clientID)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+	if clientID != p.ClientID || clientSecret != p.ClientSecret || r.PostForm.Get("client_id") != p.ClientID {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	// Codes can only be used once
+	p.mu.Lock()
+	g, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("redirect_uri") != g.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": p.Issuer(),
+		"aud": p.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	for k, v := range g.claims {
+		claims[k] = v
+	}
+	if p.Tamper != nil {
+		p.Tamper(claims)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": keyID,
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,68 @@
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"github.com/kylegk/notes/version"
+	swaggerFiles "github.com/swaggo/files/v2"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"sync"
+)
+
+// source is the document as written, it's kept in YAML to be easier to read and review
+//
+//go:embed openapi.yaml
+var source []byte
+
+// swaggerInitializer replaces the one shipped with Swagger UI, which loads the petstore example. The document is found
+// relative to the UI, so it still works behind a proxy that serves the API under a prefix
+const swaggerInitializer = `window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: "../openapi.json",
+    dom_id: "#swagger-ui",
+    deepLinking: true,
+    presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+    plugins: [SwaggerUIBundle.plugins.DownloadUrl],
+    layout: "StandaloneLayout"
+  });
+};
+`
+
+// Document returns the OpenAPI document as JSON, reporting the version of the running build
+var Document = sync.OnceValue(func() []byte {
+	var doc map[string]interface{}
+	err := yaml.Unmarshal(source, &doc)
+	if err != nil {
+		panic("openapi: cannot parse document: " + err.Error())
+	}
+	doc["info"].(map[string]interface{})["version"] = version.Get().Version
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		panic("openapi: cannot encode document: " + err.Error())
+	}
+	return b
+})
+
+// Handler serves the OpenAPI document
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Write(Document())
+	})
+}
+
+// DocsHandler serves Swagger UI, which must be mounted at prefix
+func DocsHandler(prefix string) http.Handler {
+	files := http.FileServer(http.FS(swaggerFiles.FS))
+
+	return http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "swagger-initializer.js" {
+			w.Header().Set("Content-Type", "text/javascript; charset=UTF-8")
+			w.Write([]byte(swaggerInitializer))
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+}
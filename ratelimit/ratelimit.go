@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rule allows bursts of up to Burst requests, refilling at Requests per Period. Burst defaults to Requests, and a rule
+// without any requests doesn't limit anything
+type Rule struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// Unlimited reports whether the rule lets every request through
+func (r Rule) Unlimited() bool {
+	return r.Requests <= 0 || r.Period <= 0
+}
+
+func (r Rule) capacity() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return float64(r.Requests)
+}
+
+// perToken is how long it takes to refill a single request
+func (r Rule) perToken() time.Duration {
+	return r.Period / time.Duration(r.Requests)
+}
+
+// Result describes the state of a key's bucket after a request was counted against it
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+
+	// RetryAfter is how long until the next request would be allowed, zero if this one was
+	RetryAfter time.Duration
+}
+
+// Limiter counts requests against a rule. Implementations backed by a shared store let several server instances enforce
+// a limit together
+type Limiter interface {
+	Allow(ctx context.Context, key string, rule Rule) (Result, error)
+}
+
+// sweepInterval is how often idle buckets are removed from a Memory limiter
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	rule    Rule
+}
+
+// Memory is a token bucket Limiter held in process memory, suitable when there's a single server instance
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemory returns an empty in-memory limiter
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+// Allow takes a token from the key's bucket if one is available
+func (m *Memory) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	if rule.Unlimited() {
+		return Result{Allowed: true}, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		m.sweep(now)
+	}
+
+	capacity := rule.capacity()
+	b, ok := m.buckets[key]
+	if !ok || b.rule != rule {
+		b = &bucket{tokens: capacity, updated: now, rule: rule}
+		m.buckets[key] = b
+	}
+	b.refill(now)
+
+	result := Result{Limit: int(capacity)}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) * float64(rule.perToken()))
+	}
+	result.Remaining = int(math.Floor(b.tokens))
+	result.Reset = time.Duration((capacity - b.tokens) * float64(rule.perToken()))
+
+	return result, nil
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated)
+	b.updated = now
+	b.tokens = math.Min(b.rule.capacity(), b.tokens+float64(elapsed)/float64(b.rule.perToken()))
+}
+
+// sweep forgets buckets that have refilled completely, since a new bucket would be in the same state
+func (m *Memory) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		b.refill(now)
+		if b.tokens >= b.rule.capacity() {
+			delete(m.buckets, key)
+		}
+	}
+	m.lastSweep = now
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+	rule := Rule{Requests: 60, Period: time.Minute, Burst: 2}
+
+	// The burst is allowed straight away, after which requests are refused until a token is refilled
+	for i := 0; i < 2; i++ {
+		result, _ := m.Allow(context.Background(), "user:1", rule)
+		if !result.Allowed || result.Remaining != 1-i {
+			t.Errorf("request %d should have been allowed, have: %+v", i, result)
+		}
+	}
+	result, _ := m.Allow(context.Background(), "user:1", rule)
+	if result.Allowed || result.RetryAfter != time.Second || result.Reset != 2*time.Second {
+		t.Errorf("request should have been refused for a second, have: %+v", result)
+	}
+
+	// Other keys have their own bucket
+	result, _ = m.Allow(context.Background(), "user:2", rule)
+	if !result.Allowed {
+		t.Errorf("another key should have its own bucket")
+	}
+
+	now = now.Add(time.Second)
+	result, _ = m.Allow(context.Background(), "user:1", rule)
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("a refilled token should have been used, have: %+v", result)
+	}
+
+	// Full buckets are forgotten
+	now = now.Add(time.Hour)
+	m.Allow(context.Background(), "user:3", rule)
+	if len(m.buckets) != 1 {
+		t.Errorf("idle buckets should have been removed, have: %v", len(m.buckets))
+	}
+
+	// Unlimited rules don't create buckets
+	result, _ = m.Allow(context.Background(), "user:4", Rule{})
+	if !result.Allowed || len(m.buckets) != 1 {
+		t.Errorf("unlimited rule should allow every request without tracking it")
+	}
+}
@@ -1,20 +1,372 @@
 package router
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"github.com/gorilla/mux"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/auth"
+	"github.com/kylegk/notes/handler"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/ratelimit"
+	"github.com/kylegk/notes/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Logs some basic information about every request
+// quietRoutes are polled by orchestrators and monitoring, so successful requests to them are only logged at debug level
+var quietRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/version": true,
+	"/metrics": true,
+}
+
+// Log every request once it has finished, along with how it was handled
 func logRequest(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
-		handler.ServeHTTP(w, r)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(rec, r)
+
+		info := app.CurrentRequest(r.Context())
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", info.Route),
+			slog.Int("status", rec.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", rec.bytes),
+			slog.String("remote_addr", r.RemoteAddr),
+		}
+		if info.UserID != 0 {
+			attrs = append(attrs, slog.Int("user_id", info.UserID))
+		}
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if quietRoutes[info.Route] && rec.status < http.StatusBadRequest {
+			level = slog.LevelDebug
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// RequestIDHeader carries the ID used to correlate a request with its logs and error responses
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the size of request IDs accepted from clients
+const maxRequestIDLength = 128
+
+// Assign every request an ID, reusing the one supplied by the client or a proxy when it looks sensible, and somewhere
+// to collect the details reported once it has finished
+func requestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		ctx, _ := app.WithRequestInfo(app.WithRequestID(r.Context(), id))
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status code and size of the response written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Record request counts, latencies and the number of requests in flight. The route template is only known once the
+// router has matched the request, so recordRoute passes it back out through the request's RequestInfo
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		metrics.HTTPRequestsInFlight.Inc()
+		defer metrics.HTTPRequestsInFlight.Dec()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		route := app.CurrentRequest(r.Context()).Route
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(rec.status)
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, status).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Pass the template of the matched route back to the middleware wrapping the router, and name the request's span after it
+func recordRoute(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tmpl, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+			app.CurrentRequest(r.Context()).Route = tmpl
+
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + tmpl)
+			span.SetAttributes(attribute.String("http.route", tmpl))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Trace every request, continuing the caller's trace when it sent a W3C traceparent header
+func traceRequest(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.StartRequest(r)
+		defer span.End()
+		span.SetAttributes(attribute.String("http.request.id", app.RequestID(ctx)))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// Limit how often each caller may use the API. Callers are told apart by the user their token was issued to or, without a
+// valid token, by their IP address. Routes with their own rule have a separate allowance, the rest share the default one
+func rateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.Context.Config.RateLimit
+		route := app.CurrentRequest(r.Context()).Route
+		if !cfg.Enabled || app.Context.Limiter == nil || quietRoutes[route] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key := "default|" + rateLimitCaller(r, cfg.TrustedProxies)
+		rule, ok := cfg.Routes[r.Method+" "+route]
+		if ok {
+			key = r.Method + " " + route + "|" + rateLimitCaller(r, cfg.TrustedProxies)
+		} else {
+			rule = cfg.Default
+		}
+
+		limit := ratelimit.Rule(rule)
+		if limit.Unlimited() {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// A limiter that can't be reached shouldn't take the API down with it
+		result, err := app.Context.Limiter.Allow(r.Context(), key, limit)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "rate limiter failed, allowing request", "error", err)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, int(limit.Period.Seconds())))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+		if !result.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			handler.SendErrorResponse(w, r, apperr.New(apperr.ErrRateLimited, fmt.Sprintf("rate limit exceeded, retry in %d seconds", ceilSeconds(result.RetryAfter))))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitCaller names the caller a request is counted against. Clients can send any X-Forwarded-For they like, and
+// each proxy only appends the address it received the request from, so the client's address is the one added by the
+// outermost of the trusted proxies, counting from the right. Anything to the left of it is ignored
+func rateLimitCaller(r *http.Request, trustedProxies int) string {
+	if userID, ok := auth.TokenUserID(r); ok {
+		return "user:" + strconv.Itoa(userID)
+	}
+
+	if trustedProxies > 0 {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		if len(hops) > 0 {
+			return "ip:" + hops[max(len(hops)-trustedProxies, 0)]
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// Let browser front ends on the allowed origins call the API. Preflight requests are answered here, since they don't
+// match any route, and requests from other origins are served without CORS headers so the browser withholds the response
+func cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.Context.Config.CORS
+		origin := r.Header.Get("Origin")
+		if len(cfg.AllowedOrigins) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed, ok := allowedOrigin(cfg.AllowedOrigins, origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !ok {
+			if preflight {
+				handler.SendErrorResponse(w, r, apperr.New(apperr.ErrForbidden, "origin is not allowed"))
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		if cfg.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+			if cfg.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if len(cfg.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposedHeaders, ", "))
+		}
+
+		h.ServeHTTP(w, r)
 	})
 }
 
+// allowedOrigin returns the value of the Access-Control-Allow-Origin header for the origin, if it's allowed. Origins
+// are compared case-insensitively
+func allowedOrigin(allowed []string, origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+
+	for _, o := range allowed {
+		if o == "*" {
+			return "*", true
+		}
+		if strings.EqualFold(o, origin) {
+			return origin, true
+		}
+	}
+
+	return "", false
+}
+
+// Refuse state-changing requests made with a session cookie unless they carry the session's CSRF token
+func csrf(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := auth.CheckCSRF(r)
+		if err != nil {
+			handler.SendErrorResponse(w, r, err)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Let personal access tokens holding every one of the scopes use the route
+func scoped(h http.HandlerFunc, scopes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, auth.WithScopes(r, scopes...))
+	})
+}
+
+// Only let users with the role use the routes, refusing everyone else before the handler runs
+func requireRole(role string) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := auth.RequireRole(r, role)
+			if err != nil {
+				handler.SendErrorResponse(w, r, err)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
 // Inform the client an error has occurred and gracefully recover from a panic
 func panicRecovery(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -24,12 +376,130 @@ func panicRecovery(h http.Handler) http.Handler {
 				n := runtime.Stack(buf, false)
 				buf = buf[:n]
 
-				fmt.Printf("recovering from error: %v\n %s", err, buf)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(`{"error":"Internal Server Error"}`))
+				slog.ErrorContext(r.Context(), "recovered from panic", "panic", fmt.Sprint(err), "stack", string(buf))
+				metrics.PanicsRecovered.Inc()
+				handler.SendErrorResponse(w, r, apperr.ErrInternal)
 			}
 		}()
 
 		h.ServeHTTP(w, r)
 	})
-}
\ No newline at end of file
+}
+
+// IdempotencyKeyHeader is the header clients use to make retries of a POST request safe
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength limits the size of the keys we're willing to store
+const maxIdempotencyKeyLength = 255
+
+// responseRecorder captures the response written by a handler so it can be stored for replay
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Replay the original response when a request is retried with the same Idempotency-Key. The body is read with the
+// handler's limit, and keys are scoped to the authenticated user, or to the client's address on anonymous routes, since
+// the response can hold the credentials of the user the request created
+func idempotency(h http.HandlerFunc, limit int64, anonymous bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			handler.SendErrorResponse(w, r, apperr.New(apperr.ErrInvalidRequest, "idempotency key is too long"))
+			return
+		}
+
+		caller := rateLimitCaller(r, app.Context.Config.RateLimit.TrustedProxies)
+		var userID int
+		if !anonymous {
+			var err error
+			userID, err = auth.ValidateUserToken(r)
+			if err != nil {
+				handler.SendErrorResponse(w, r, err)
+				return
+			}
+			caller = strconv.Itoa(userID)
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		if err != nil {
+			handler.SendErrorResponse(w, r, apperr.New(apperr.ErrRequestTooLarge, fmt.Sprintf("request body must not exceed %d bytes", limit)))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are scoped to the caller and the route, and the body is fingerprinted to catch keys reused for a different request
+		scope := sha256.Sum256([]byte(r.Method + "\n" + r.URL.Path + "\n" + caller + "\n" + key))
+		scopedKey := hex.EncodeToString(scope[:])
+		fingerprint := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(fingerprint[:])
+
+		unlock := lib.LockIdempotencyKey(scopedKey)
+		defer unlock()
+
+		record, found, err := lib.GetIdempotencyRecordDB(r.Context(), scopedKey)
+		if err != nil {
+			handler.SendErrorResponse(w, r, err)
+			return
+		}
+
+		if found {
+			if record.RequestHash != requestHash {
+				handler.SendErrorResponse(w, r, apperr.ErrIdempotencyKeyReused)
+				return
+			}
+
+			w.Header().Set("Content-Type", record.ContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.Status)
+			w.Write(record.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		// Server errors aren't stored, so the client can retry them
+		if rec.status >= http.StatusInternalServerError {
+			return
+		}
+
+		contentType := w.Header().Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/json; charset=UTF-8"
+		}
+
+		// Records are removed along with their user, which on anonymous routes is the user the request created, if any
+		if anonymous {
+			userID = app.CurrentRequest(r.Context()).UserID
+		}
+
+		err = lib.SaveIdempotencyRecordDB(r.Context(), model.IdempotencyRecord{
+			Key:         scopedKey,
+			UserID:      userID,
+			RequestHash: requestHash,
+			Status:      rec.status,
+			ContentType: contentType,
+			Body:        rec.body.Bytes(),
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "cannot store response for idempotent replay", "error", err)
+		}
+	}
+}
@@ -0,0 +1,831 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/auth"
+	"github.com/kylegk/notes/config"
+	"github.com/kylegk/notes/db"
+	"github.com/kylegk/notes/handler"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/oidc/oidctest"
+	"github.com/kylegk/notes/totp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func postWithKey(h http.Handler, path string, key string, payload interface{}) *httptest.ResponseRecorder {
+	j, _ := json.Marshal(payload)
+	request, _ := http.NewRequest("POST", path, bytes.NewBuffer(j))
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if key != "" {
+		request.Header.Set(IdempotencyKeyHeader, key)
+	}
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, request)
+	return response
+}
+
+func TestIdempotency(t *testing.T) {
+	app.Init()
+	h := idempotency(handler.CreateUser, app.Context.Config.Limits.MaxBodySize, true)
+
+	// The first request creates the user
+	first := postWithKey(h, "/users", "key-1", model.CreateUserRequest{User: "test.account"})
+	if first.Code != 200 {
+		t.Errorf("create user should have succeeded, have: %v", first.Code)
+	}
+
+	// A retry with the same key replays the original response instead of failing as a duplicate
+	retry := postWithKey(h, "/users", "key-1", model.CreateUserRequest{User: "test.account"})
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry should have replayed the original response, have: %v %s", retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replayed response should be marked")
+	}
+
+	// Reusing the key for a different request is rejected
+	reused := postWithKey(h, "/users", "key-1", model.CreateUserRequest{User: "another.account"})
+	if reused.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key should have been rejected, have: %v", reused.Code)
+	}
+
+	// The response holds the new user's token, so it isn't replayed to another client that sends the same key
+	j, _ := json.Marshal(model.CreateUserRequest{User: "test.account"})
+	request := httptest.NewRequest("POST", "/users", bytes.NewBuffer(j))
+	request.RemoteAddr = "192.0.2.1:1000"
+	request.Header.Set(IdempotencyKeyHeader, "key-1")
+	other := httptest.NewRecorder()
+	h.ServeHTTP(other, request)
+	if other.Code != http.StatusConflict || other.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another client should not have been replayed the response, have: %v %s", other.Code, other.Body.String())
+	}
+
+	// Requests without a key behave as before
+	duplicate := postWithKey(h, "/users", "", model.CreateUserRequest{User: "test.account"})
+	if duplicate.Code == 200 {
+		t.Errorf("duplicate user should have been rejected")
+	}
+}
+
+func TestIdempotencyConcurrentReplays(t *testing.T) {
+	app.Init()
+	h := idempotency(handler.CreateUser, app.Context.Config.Limits.MaxBodySize, true)
+
+	// Concurrent requests with the same key are serialised, so only one user is created
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = postWithKey(h, "/users", "key-2", model.CreateUserRequest{User: "concurrent.account"}).Code
+		}(i)
+	}
+	wg.Wait()
+
+	for _, code := range codes {
+		if code != 200 {
+			t.Errorf("every replay should have succeeded, have: %v", code)
+		}
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	app.Init()
+	h := idempotency(handler.CreateNote, app.Context.Config.Limits.MaxBodySize, false)
+	ctx := context.Background()
+
+	post := func(token string, key string, payload interface{}) *httptest.ResponseRecorder {
+		j, _ := json.Marshal(payload)
+		request := httptest.NewRequest("POST", "/notes", bytes.NewReader(j))
+		request.Header.Set(IdempotencyKeyHeader, key)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		return response
+	}
+
+	// Keys belong to the user rather than the token, so a retry after logging in again still replays
+	userID, _ := lib.InsertUserDB(ctx, "test.account", "correct horse")
+	first, _ := auth.GenerateUserToken(ctx, userID)
+	original := post(first, "key-1", model.CreateNoteRequest{Content: "First note"})
+	_ = lib.LogoutUserDB(ctx, userID)
+	second, _ := auth.GenerateUserToken(ctx, userID)
+	if retry := post(second, "key-1", model.CreateNoteRequest{Content: "First note"}); retry.Header().Get("Idempotent-Replayed") != "true" || retry.Body.String() != original.Body.String() {
+		t.Errorf("retry with a new token should have been replayed, have: %v %s", retry.Code, retry.Body.String())
+	}
+
+	if res, _ := app.Context.DB.Query(ctx, db.IdempotencyKeysTable, db.UserIdx, userID); len(res) != 1 {
+		t.Errorf("response should have been stored against the user, have: %v", res)
+	}
+
+	// Other users, and callers without a valid token, don't share the key
+	otherID, _ := lib.InsertUserDB(ctx, "another.account", "correct horse")
+	other, _ := auth.GenerateUserToken(ctx, otherID)
+	if response := post(other, "key-1", model.CreateNoteRequest{Content: "First note"}); response.Code != 200 || response.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another user's request should not have been replayed, have: %v", response.Code)
+	}
+	if response := post(first, "key-2", model.CreateNoteRequest{Content: "First note"}); response.Code != 401 {
+		t.Errorf("revoked token should have been refused, have: %v", response.Code)
+	}
+
+	// Bodies over the handler's limit are refused before they're read in full
+	large := model.CreateNoteRequest{Content: strings.Repeat("a", int(app.Context.Config.Limits.MaxBodySize))}
+	if response := post(second, "key-3", large); response.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body should have been refused, have: %v", response.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	app.Init()
+	h := NewHandler()
+
+	// An authentication failure on a templated route
+	request, _ := http.NewRequest("GET", "/notes/42", nil)
+	h.ServeHTTP(httptest.NewRecorder(), request)
+
+	// A request that doesn't match any route
+	request, _ = http.NewRequest("GET", "/nowhere", nil)
+	h.ServeHTTP(httptest.NewRecorder(), request)
+
+	request, _ = http.NewRequest("GET", "/metrics", nil)
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, request)
+	if response.Code != 200 {
+		t.Fatalf("metrics should have been served, have: %v", response.Code)
+	}
+
+	body := response.Body.String()
+	for _, want := range []string{
+		`notes_http_requests_total{method="GET",route="/notes/{id}",status="401"}`,
+		`notes_http_requests_total{method="GET",route="unmatched",status="404"}`,
+		`notes_auth_failures_total{reason="missing"}`,
+		`notes_db_table_rows{table="notes"}`,
+		`notes_http_requests_in_flight 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics should include %s", want)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	app.Init()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	// The caller's trace is continued
+	request, _ := http.NewRequest("GET", "/notes/42", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	NewHandler().ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	server, ok := spans["GET /notes/{id}"]
+	if !ok {
+		t.Fatalf("request span should be named after the route, have: %v", spans)
+	}
+	if have := server.SpanContext().TraceID().String(); have != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("request span should continue the caller's trace, have: %v", have)
+	}
+
+	authSpan, ok := spans["auth.ValidateUserToken"]
+	if !ok {
+		t.Fatalf("token validation should have been traced")
+	}
+	if authSpan.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("token validation should be a child of the request span")
+	}
+	if authSpan.Status().Code != codes.Error {
+		t.Errorf("failed token validation should be marked as an error")
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	app.Init()
+	var buf bytes.Buffer
+	logger, _ := app.NewLogger(&buf, "info")
+	slog.SetDefault(logger)
+	h := NewHandler()
+
+	var user model.CreateUserResponse
+	created := postWithKey(h, "/users", "", model.CreateUserRequest{User: "test.account"})
+	_ = json.NewDecoder(created.Body).Decode(&user)
+	buf.Reset()
+
+	request, _ := http.NewRequest("GET", "/notes", nil)
+	request.Header.Set("Authorization", "Bearer "+user.Token)
+	request.Header.Set(RequestIDHeader, "log-test")
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, request)
+
+	var entry struct {
+		Msg       string `json:"msg"`
+		RequestID string `json:"request_id"`
+		Route     string `json:"route"`
+		Status    int    `json:"status"`
+		Bytes     int    `json:"bytes"`
+		UserID    int    `json:"user_id"`
+	}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("request should have been logged as a single JSON record, have: %s", buf.String())
+	}
+
+	if entry.Msg != "request" || entry.RequestID != "log-test" || entry.Route != "/notes" || entry.Status != 200 {
+		t.Errorf("log record should describe the request, have: %s", buf.String())
+	}
+	if entry.UserID != user.UserID {
+		t.Errorf("log record should include the authenticated user, have: %v, want: %v", entry.UserID, user.UserID)
+	}
+	if entry.Bytes != response.Body.Len() {
+		t.Errorf("log record should include the response size, have: %v, want: %v", entry.Bytes, response.Body.Len())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.Default = config.RateLimitRule{Requests: 1, Period: time.Minute}
+	cfg.RateLimit.Routes["POST /users"] = config.RateLimitRule{Requests: 1, Period: time.Minute}
+	_ = app.Setup(cfg)
+	h := NewHandler()
+
+	send := func(method string, path string, remoteAddr string, token string, body interface{}) *httptest.ResponseRecorder {
+		j, _ := json.Marshal(body)
+		request := httptest.NewRequest(method, path, bytes.NewBuffer(j))
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("X-Forwarded-For", "203.0.113.9")
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		return response
+	}
+
+	// Each IP has its own allowance, and X-Forwarded-For is ignored unless proxies are trusted
+	first := send("POST", "/users", "192.0.2.1:1000", "", model.CreateUserRequest{User: "test.account"})
+	if first.Code != 200 || first.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("first request should have been allowed, have: %v %v", first.Code, first.Header())
+	}
+	limited := send("POST", "/users", "192.0.2.1:1001", "", model.CreateUserRequest{User: "other.account"})
+	if limited.Code != 429 || limited.Header().Get("Retry-After") != "60" {
+		t.Errorf("second request should have been limited, have: %v %v", limited.Code, limited.Header())
+	}
+	if !strings.Contains(limited.Body.String(), "RATE_LIMITED") {
+		t.Errorf("limited request should report RATE_LIMITED, have: %s", limited.Body.String())
+	}
+	other := send("POST", "/users", "192.0.2.2:1000", "", model.CreateUserRequest{User: "other.account"})
+	if other.Code != 200 {
+		t.Errorf("another IP should have its own allowance, have: %v", other.Code)
+	}
+
+	// Authenticated requests are limited by user, wherever they come from, and routes without a rule share the default
+	var user model.CreateUserResponse
+	_ = json.NewDecoder(first.Body).Decode(&user)
+	if code := send("GET", "/notes", "192.0.2.3:1000", user.Token, nil).Code; code != 200 {
+		t.Errorf("first request should have been allowed, have: %v", code)
+	}
+	if code := send("GET", "/sync", "192.0.2.4:1000", user.Token, nil).Code; code != 429 {
+		t.Errorf("user should have used up the default allowance, have: %v", code)
+	}
+
+	// Probes are never limited
+	for i := 0; i < 3; i++ {
+		if code := send("GET", "/healthz", "192.0.2.1:1000", "", nil).Code; code != 200 {
+			t.Errorf("health check should not be limited, have: %v", code)
+		}
+	}
+}
+
+func TestRateLimitTrustedProxies(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.TrustedProxies = 1
+	cfg.RateLimit.Routes["POST /users"] = config.RateLimitRule{Requests: 1, Period: time.Minute}
+	_ = app.Setup(cfg)
+	h := NewHandler()
+
+	// The proxy appends the address it received the request from, after whatever the client sent
+	send := func(forwardedFor string, user string) int {
+		j, _ := json.Marshal(model.CreateUserRequest{User: user})
+		request := httptest.NewRequest("POST", "/users", bytes.NewBuffer(j))
+		request.RemoteAddr = "10.0.0.1:1000"
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	if code := send("198.51.100.7", "test.account"); code != 200 {
+		t.Errorf("first request should have been allowed, have: %v", code)
+	}
+
+	// Addresses the client adds in front of its own don't give it a new allowance
+	if code := send("203.0.113.1, 198.51.100.7", "spoofed.account"); code != 429 {
+		t.Errorf("spoofed header should not have reset the limit, have: %v", code)
+	}
+	if code := send("198.51.100.8", "other.account"); code != 200 {
+		t.Errorf("another client should have its own allowance, have: %v", code)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	cfg := config.Default()
+	cfg.Auth.Sessions.Enabled = true
+	cfg.RateLimit.Enabled = false
+	_ = app.Setup(cfg)
+	h := NewHandler()
+
+	send := func(method string, path string, cookies []*http.Cookie, csrfToken string, body interface{}) *httptest.ResponseRecorder {
+		j, _ := json.Marshal(body)
+		request := httptest.NewRequest(method, path, bytes.NewBuffer(j))
+		for _, c := range cookies {
+			request.AddCookie(c)
+		}
+		if csrfToken != "" {
+			request.Header.Set(auth.CSRFHeader, csrfToken)
+		}
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		return response
+	}
+
+	if code := send("POST", "/users", nil, "", model.CreateUserRequest{User: "test.account", Password: "correct horse"}).Code; code != 200 {
+		t.Fatalf("failed to create user, status code: %v", code)
+	}
+
+	// Logging in sets an HttpOnly session cookie and a CSRF cookie, without returning the token itself
+	login := send("POST", "/session", nil, "", model.LoginRequest{User: "test.account", Password: "correct horse"})
+	var session model.CreateSessionResponse
+	_ = json.NewDecoder(bytes.NewReader(login.Body.Bytes())).Decode(&session)
+	cookies := login.Result().Cookies()
+	if login.Code != 200 || len(cookies) != 2 || session.CSRFToken == "" || strings.Contains(login.Body.String(), `"token"`) {
+		t.Fatalf("login should have started a session, have: %v %s", login.Code, login.Body.String())
+	}
+	for _, c := range cookies {
+		if c.Name == auth.SessionCookie && (!c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode) {
+			t.Errorf("session cookie should be HttpOnly, Secure and SameSite=Lax, have: %+v", c)
+		}
+		if c.Name == auth.CSRFCookie && (c.HttpOnly || c.Value != session.CSRFToken) {
+			t.Errorf("CSRF cookie should be readable and match the response, have: %+v", c)
+		}
+	}
+
+	// The cookie authenticates reads on its own
+	if code := send("GET", "/notes", cookies, "", nil).Code; code != 200 {
+		t.Errorf("session cookie should have authenticated the request, have: %v", code)
+	}
+
+	// State-changing requests also need the CSRF token
+	note := model.CreateNoteRequest{Content: "This is a test note"}
+	missing := send("POST", "/notes", cookies, "", note)
+	if missing.Code != 403 || !strings.Contains(missing.Body.String(), "INVALID_CSRF_TOKEN") {
+		t.Errorf("request without a CSRF token should have been refused, have: %v %s", missing.Code, missing.Body.String())
+	}
+	if code := send("POST", "/notes", cookies, "forged", note).Code; code != 403 {
+		t.Errorf("request with the wrong CSRF token should have been refused, have: %v", code)
+	}
+	if code := send("POST", "/notes", cookies, session.CSRFToken, note).Code; code != 200 {
+		t.Errorf("request with the CSRF token should have been allowed, have: %v", code)
+	}
+
+	// Logging out revokes the session's token, even if the browser holds on to the cookie
+	logout := send("DELETE", "/session", cookies, session.CSRFToken, nil)
+	if logout.Code != 200 || len(logout.Result().Cookies()) != 2 || logout.Result().Cookies()[0].MaxAge >= 0 {
+		t.Errorf("logout should have cleared the cookies, have: %v %v", logout.Code, logout.Result().Cookies())
+	}
+	if code := send("GET", "/notes", cookies, "", nil).Code; code != 401 {
+		t.Errorf("ended session should no longer authenticate, have: %v", code)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.Enabled = false
+	_ = app.Setup(cfg)
+	h := NewHandler()
+
+	listNotes := func(token string) int {
+		request := httptest.NewRequest("GET", "/notes", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		return response.Code
+	}
+	login := func() string {
+		j, _ := json.Marshal(model.LoginRequest{User: "test.account", Password: "correct horse"})
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, httptest.NewRequest("POST", "/login", bytes.NewBuffer(j)))
+		var body model.LoginResponse
+		_ = json.NewDecoder(response.Body).Decode(&body)
+		return body.Token
+	}
+
+	_, _ = lib.InsertUserDB(context.Background(), "test.account", "correct horse")
+	configured := login()
+
+	// Tokens signed before a rotation stay valid, and new ones are signed with the new key
+	_, _ = lib.RotateSigningKeyDB(context.Background(), false)
+	rotated := login()
+	if rotated == configured {
+		t.Fatalf("token should have been signed with the new key")
+	}
+	for _, token := range []string{configured, rotated} {
+		if code := listNotes(token); code != 200 {
+			t.Errorf("token should still be valid after rotating keys, have: %v", code)
+		}
+	}
+
+	// Revoking the old keys rejects their tokens straight away
+	_, _ = lib.RotateSigningKeyDB(context.Background(), true)
+	for _, token := range []string{configured, rotated} {
+		if code := listNotes(token); code != 401 {
+			t.Errorf("token signed with a revoked key should have been rejected, have: %v", code)
+		}
+	}
+	if code := listNotes(login()); code != 200 {
+		t.Errorf("token signed with the current key should be valid, have: %v", code)
+	}
+}
+
+func TestAdminRole(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.Enabled = false
+	_ = app.Setup(cfg)
+	h := NewHandler()
+
+	do := func(method string, path string, token string, body string) int {
+		request := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		return response.Code
+	}
+	login := func(user string) string {
+		j, _ := json.Marshal(model.LoginRequest{User: user, Password: "correct horse"})
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, httptest.NewRequest("POST", "/login", bytes.NewBuffer(j)))
+		var body model.LoginResponse
+		_ = json.NewDecoder(response.Body).Decode(&body)
+		return body.Token
+	}
+
+	adminID, _ := lib.InsertUserDB(context.Background(), "admin.account", "correct horse")
+	userID, _ := lib.InsertUserDB(context.Background(), "test.account", "correct horse")
+	adminToken, userToken := login("admin.account"), login("test.account")
+
+	// The role is only picked up by tokens issued after it's granted
+	role := model.RoleAdmin
+	_, _ = lib.UpdateUserDB(context.Background(), adminID, model.UpdateUserRequest{Role: &role})
+	if code := do("GET", "/admin/stats", adminToken, ""); code != 403 {
+		t.Errorf("token issued before the role was granted should have been refused, have: %v", code)
+	}
+	adminToken = login("admin.account")
+	if code := do("GET", "/admin/stats", adminToken, ""); code != 200 {
+		t.Errorf("administrator should have been allowed, have: %v", code)
+	}
+	if code := do("GET", "/admin/stats", userToken, ""); code != 403 {
+		t.Errorf("user without the role should have been refused, have: %v", code)
+	}
+
+	// Logging a user out revokes the tokens they hold, but not new ones
+	userPath := fmt.Sprintf("/admin/users/%d", userID)
+	if code := do("POST", userPath+"/logout", adminToken, ""); code != 200 {
+		t.Fatalf("failed to log user out, have: %v", code)
+	}
+	if code := do("GET", "/notes", userToken, ""); code != 401 {
+		t.Errorf("revoked token should have been refused, have: %v", code)
+	}
+	userToken = login("test.account")
+	if code := do("GET", "/notes", userToken, ""); code != 200 {
+		t.Errorf("token issued after logging out should be valid, have: %v", code)
+	}
+
+	// Disabled users can neither use their tokens nor log in, until they're enabled again
+	if code := do("PATCH", userPath, adminToken, `{"disabled": true}`); code != 200 {
+		t.Fatalf("failed to disable user, have: %v", code)
+	}
+	if code := do("GET", "/notes", userToken, ""); code != 401 {
+		t.Errorf("disabled user's token should have been refused, have: %v", code)
+	}
+	if token := login("test.account"); token != "" {
+		t.Errorf("disabled user should not have been able to log in")
+	}
+	if code := do("PATCH", userPath, adminToken, `{"disabled": false}`); code != 200 {
+		t.Fatalf("failed to enable user, have: %v", code)
+	}
+	if code := do("GET", "/notes", login("test.account"), ""); code != 200 {
+		t.Errorf("enabled user should have been able to log in again, have: %v", code)
+	}
+}
+
+func TestAccessTokenScopes(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.Enabled = false
+	_ = app.Setup(cfg)
+	h := NewHandler()
+
+	do := func(method string, path string, token string, body string) int {
+		request := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	ctx := context.Background()
+	userID, _ := lib.InsertUserDB(ctx, "test.account", "correct horse")
+	readOnly, _ := lib.CreateAccessTokenDB(ctx, userID, model.CreateAccessTokenRequest{Name: "Backups", Scopes: []string{model.ScopeNotesRead}})
+	readWrite, _ := lib.CreateAccessTokenDB(ctx, userID, model.CreateAccessTokenRequest{Name: "Sync", Scopes: []string{model.ScopeNotesRead, model.ScopeNotesWrite}})
+
+	// Tokens can only be used for the routes their scopes allow, and never for routes without scopes
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+	}{
+		{"GET", "/notes", readOnly.Token, "", 200},
+		{"POST", "/notes", readOnly.Token, `{"content": "Scoped"}`, 403},
+		{"POST", "/notes", readWrite.Token, `{"content": "Scoped"}`, 200},
+		{"GET", "/users/me", readWrite.Token, "", 403},
+		{"GET", "/users/me/export", readOnly.Token, "", 403},
+		{"GET", "/users/me/tokens", readWrite.Token, "", 403},
+		{"PATCH", "/users/me", readWrite.Token, `{"displayname": "Scoped"}`, 403},
+		{"POST", "/users/me/2fa", readWrite.Token, "", 403},
+		{"POST", "/users/me/2fa/disable", readWrite.Token, `{"code": "123456"}`, 403},
+		{"GET", "/notes", model.AccessTokenPrefix + readOnly.TokenID + "_wrong", "", 401},
+	}
+	for _, test := range tests {
+		if code := do(test.method, test.path, test.token, test.body); code != test.want {
+			t.Errorf("%s %s, have: %v, want: %v", test.method, test.path, code, test.want)
+		}
+	}
+
+	// Expired tokens are refused
+	res, _ := app.Context.DB.Query(ctx, db.AccessTokensTable, db.IDIdx, readWrite.TokenID)
+	expired := res[0].(model.AccessToken)
+	expired.Expires = time.Now().Add(-time.Minute).Unix()
+	_ = app.Context.DB.Upsert(ctx, db.AccessTokensTable, expired)
+	if code := do("GET", "/notes", readWrite.Token, ""); code != 401 {
+		t.Errorf("expired token should have been refused, have: %v", code)
+	}
+
+	// Logging the user out revokes their access tokens
+	if err := lib.LogoutUserDB(ctx, userID); err != nil {
+		t.Fatalf("failed to log user out: %s", err.Error())
+	}
+	if code := do("GET", "/notes", readOnly.Token, ""); code != 401 {
+		t.Errorf("access token should have been revoked, have: %v", code)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := oidctest.NewProvider("notes", "client secret")
+	defer idp.Close()
+
+	cfg := config.Default()
+	cfg.Auth.Sessions.Enabled = true
+	cfg.Auth.OIDC.Enabled = true
+	cfg.Auth.OIDC.Issuer = idp.Issuer()
+	cfg.Auth.OIDC.ClientID = idp.ClientID
+	cfg.Auth.OIDC.ClientSecret = idp.ClientSecret
+	cfg.Auth.OIDC.RedirectURL = "https://notes.example.com/oidc/callback"
+	cfg.RateLimit.Enabled = false
+	_ = app.Setup(cfg)
+	h := NewHandler()
+
+	// finish logs in at the identity provider as the subject, following the login the request starts back to the callback
+	// with the browser's cookies, and returns the response from the callback
+	finish := func(subject string, username string, request *http.Request) *httptest.ResponseRecorder {
+		idp.Login(subject, map[string]interface{}{"preferred_username": username})
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		location := response.Header().Get("Location")
+		if response.Code == 200 {
+			var link model.OIDCLinkResponse
+			_ = json.NewDecoder(response.Body).Decode(&link)
+			location = link.URL
+		} else if response.Code != 302 {
+			return response
+		}
+
+		callback, err := idp.Authorize(location)
+		if err != nil {
+			t.Fatalf("failed to log in at the identity provider: %s", err.Error())
+		}
+		if !strings.HasPrefix(callback, cfg.Auth.OIDC.RedirectURL+"?") {
+			t.Fatalf("identity provider should send the user back to the callback, have: %s", callback)
+		}
+		next := httptest.NewRequest("GET", strings.TrimPrefix(callback, "https://notes.example.com"), nil)
+		for _, cookie := range response.Result().Cookies() {
+			next.AddCookie(cookie)
+		}
+		response = httptest.NewRecorder()
+		h.ServeHTTP(response, next)
+		return response
+	}
+	// login logs in at the identity provider as the subject, with the token when it's given
+	login := func(subject string, username string, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/oidc/login", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		return finish(subject, username, request)
+	}
+	decode := func(response *httptest.ResponseRecorder) model.OIDCLoginResponse {
+		var body model.OIDCLoginResponse
+		_ = json.NewDecoder(response.Body).Decode(&body)
+		return body
+	}
+
+	// The first login provisions an account and starts a session, and later ones log in to it
+	response := login("user-1", "sso.account", "")
+	first := decode(response)
+	if response.Code != 200 || !first.Provisioned || first.CSRFToken == "" || len(response.Result().Cookies()) != 3 {
+		t.Fatalf("identity should have been provisioned with a session, have: %v, %s", response.Code, response.Body.String())
+	}
+	request := httptest.NewRequest("GET", "/notes", nil)
+	request.Header.Set("Authorization", "Bearer "+first.Token)
+	check := httptest.NewRecorder()
+	h.ServeHTTP(check, request)
+	if check.Code != 200 {
+		t.Errorf("token from the identity provider login should be valid, have: %v", check.Code)
+	}
+	if again := decode(login("user-1", "sso.account", "")); again.Provisioned || again.UserID != first.UserID {
+		t.Errorf("identity should have logged in to the same account, have: %v", again)
+	}
+
+	// Users with two-factor authentication enabled still need a code, and the login is finished like a password login
+	enrolment, _ := lib.StartTwoFactorDB(context.Background(), first.UserID)
+	code, _ := totp.Code(enrolment.Secret, totp.Step(time.Now()))
+	recovery, _ := lib.ConfirmTwoFactorDB(context.Background(), first.UserID, code)
+	response = login("user-1", "sso.account", "")
+	var problem model.Problem
+	_ = json.NewDecoder(response.Body).Decode(&problem)
+	if response.Code != 401 || problem.Code != apperr.ErrTwoFactorRequired.Code || problem.Challenge == "" {
+		t.Fatalf("login should have needed a second factor, have: %v, %v", response.Code, problem)
+	}
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == auth.SessionCookie && cookie.Value != "" {
+			t.Errorf("session should not have been started before the second factor")
+		}
+	}
+	j, _ := json.Marshal(model.TwoFactorLoginRequest{Challenge: problem.Challenge, Code: recovery.RecoveryCodes[0]})
+	request = httptest.NewRequest("POST", "/session/2fa", bytes.NewBuffer(j))
+	check = httptest.NewRecorder()
+	h.ServeHTTP(check, request)
+	var finished model.CreateSessionResponse
+	_ = json.NewDecoder(check.Body).Decode(&finished)
+	if check.Code != 200 || finished.UserID != first.UserID {
+		t.Errorf("login should have been finished with the code, have: %v, %v", check.Code, finished)
+	}
+
+	// Users with a password can link an identity whose name would clash, but not one linked to someone else
+	userID, _ := lib.InsertUserDB(context.Background(), "test.account", "correct horse")
+	token, _ := auth.GenerateUserToken(context.Background(), userID)
+	if response = login("user-2", "test.account", ""); response.Code != 409 {
+		t.Errorf("identity with a taken name should have been refused, have: %v", response.Code)
+	}
+	if linked := decode(login("user-2", "test.account", token)); !linked.Linked || linked.UserID != userID {
+		t.Errorf("identity should have been linked, have: %v", linked)
+	}
+	if response = login("user-1", "sso.account", token); response.Code != 409 {
+		t.Errorf("identity linked to another user should have been refused, have: %v", response.Code)
+	}
+
+	// Personal access tokens can't link identities
+	pat, _ := lib.CreateAccessTokenDB(context.Background(), userID, model.CreateAccessTokenRequest{Name: "Script", Scopes: []string{model.ScopeAccountRead}})
+	if response = login("user-3", "script.account", pat.Token); response.Code != 403 {
+		t.Errorf("access token should not have been able to link an identity, have: %v", response.Code)
+	}
+
+	// Session cookies only link identities with a POST that passes the CSRF check, since browsers send them with
+	// navigations other sites start too
+	session, _ := lib.CreateSessionDB(context.Background(), userID)
+	sessionToken, _ := auth.GenerateSessionToken(context.Background(), session)
+	withSession := func(method string, csrfToken string) *http.Request {
+		request := httptest.NewRequest(method, "/oidc/login", nil)
+		request.AddCookie(&http.Cookie{Name: auth.SessionCookie, Value: sessionToken})
+		request.AddCookie(&http.Cookie{Name: auth.CSRFCookie, Value: auth.CSRFToken(session.SessionID)})
+		if csrfToken != "" {
+			request.Header.Set(auth.CSRFHeader, csrfToken)
+		}
+		return request
+	}
+	if linked := decode(finish("user-3", "cookie.account", withSession("GET", ""))); linked.Linked || linked.UserID == userID {
+		t.Errorf("session cookie should not have linked an identity on a GET, have: %v", linked)
+	}
+	if response = finish("user-4", "cookie.account", withSession("POST", "")); response.Code != 403 {
+		t.Errorf("link without the CSRF token should have been refused, have: %v", response.Code)
+	}
+	if linked := decode(finish("user-4", "cookie.account", withSession("POST", auth.CSRFToken(session.SessionID)))); !linked.Linked || linked.UserID != userID {
+		t.Errorf("identity should have been linked with the session, have: %v", linked)
+	}
+	if response = finish("user-5", "anonymous.account", httptest.NewRequest("POST", "/oidc/login", nil)); response.Code != 401 {
+		t.Errorf("link without a token should have been refused, have: %v", response.Code)
+	}
+
+	// Callbacks are only finished by the browser that started the login, so another user's callback URL can't log the
+	// browser in to their account
+	idp.Login("user-1", map[string]interface{}{"preferred_username": "sso.account"})
+	response = httptest.NewRecorder()
+	h.ServeHTTP(response, httptest.NewRequest("GET", "/oidc/login", nil))
+	callback, _ := idp.Authorize(response.Header().Get("Location"))
+	stolen := strings.TrimPrefix(callback, "https://notes.example.com")
+	for _, cookie := range []*http.Cookie{nil, {Name: auth.OIDCStateCookie, Value: "other"}} {
+		request := httptest.NewRequest("GET", stolen, nil)
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		check = httptest.NewRecorder()
+		h.ServeHTTP(check, request)
+		if check.Code != 401 {
+			t.Errorf("callback without the browser's state cookie should have failed, have: %v", check.Code)
+		}
+	}
+
+	// Unknown logins, and logins the provider refused, fail
+	response = httptest.NewRecorder()
+	h.ServeHTTP(response, httptest.NewRequest("GET", "/oidc/login", nil))
+	authURL, _ := url.Parse(response.Header().Get("Location"))
+	state := authURL.Query().Get("state")
+	for _, path := range []string{"/oidc/callback?state=unknown&code=code", "/oidc/callback?state=" + state + "&error=access_denied"} {
+		request := httptest.NewRequest("GET", path, nil)
+		request.AddCookie(&http.Cookie{Name: auth.OIDCStateCookie, Value: state})
+		response = httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		if response.Code != 401 {
+			t.Errorf("%s should have failed, have: %v", path, response.Code)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	cfg := config.Default()
+	cfg.CORS.AllowedOrigins = []string{"https://app.example.com"}
+	cfg.CORS.AllowCredentials = true
+	_ = app.Setup(cfg)
+	h := NewHandler()
+
+	send := func(method string, origin string, requestMethod string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/notes", nil)
+		request.Header.Set("Origin", origin)
+		if requestMethod != "" {
+			request.Header.Set("Access-Control-Request-Method", requestMethod)
+		}
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		return response
+	}
+
+	// Preflight requests from allowed origins are answered without reaching the routes
+	preflight := send("OPTIONS", "https://app.example.com", "POST")
+	if preflight.Code != 204 || preflight.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		preflight.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		!strings.Contains(preflight.Header().Get("Access-Control-Allow-Headers"), "X-CSRF-Token") ||
+		preflight.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("preflight should have been allowed, have: %v %v", preflight.Code, preflight.Header())
+	}
+
+	// Actual requests carry the CORS headers, even when they fail
+	actual := send("GET", "https://app.example.com", "")
+	if actual.Code != 401 || actual.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		!strings.Contains(actual.Header().Get("Access-Control-Expose-Headers"), "X-Request-ID") {
+		t.Errorf("response should have allowed the origin, have: %v %v", actual.Code, actual.Header())
+	}
+
+	// Other origins get no CORS headers
+	if code := send("OPTIONS", "https://evil.example.com", "POST").Code; code != 403 {
+		t.Errorf("preflight from another origin should have been refused, have: %v", code)
+	}
+	other := send("GET", "https://evil.example.com", "")
+	if other.Header().Get("Access-Control-Allow-Origin") != "" || other.Header().Get("Vary") != "Origin" {
+		t.Errorf("response to another origin should not allow it, have: %v", other.Header())
+	}
+}
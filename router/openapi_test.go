@@ -0,0 +1,415 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gorilla/mux"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/auth"
+	"github.com/kylegk/notes/config"
+	"github.com/kylegk/notes/lib"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/oidc/oidctest"
+	"github.com/kylegk/notes/openapi"
+	"github.com/kylegk/notes/totp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	decodeString := func(body io.Reader, _ http.Header, _ *openapi3.SchemaRef, _ openapi3filter.EncodingFn) (interface{}, error) {
+		b, err := io.ReadAll(body)
+		return string(b), err
+	}
+	openapi3filter.RegisterBodyDecoder("text/html", decodeString)
+	openapi3filter.RegisterBodyDecoder("application/zip", decodeString)
+}
+
+func loadOpenAPI(t *testing.T) *openapi3.T {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openapi.Document())
+	if err != nil {
+		t.Fatalf("cannot load the OpenAPI document: %s", err.Error())
+	}
+
+	err = doc.Validate(loader.Context)
+	if err != nil {
+		t.Fatalf("the OpenAPI document is not valid: %s", err.Error())
+	}
+
+	return doc
+}
+
+// setupOpenAPITest enables every optional route, and lifts the rate limits so the tests can make as many requests as
+// they need. Users log in with the identity provider that's returned, which must be closed when the test is done
+func setupOpenAPITest() *oidctest.Provider {
+	idp := oidctest.NewProvider("notes", "")
+	cfg := config.Default()
+	cfg.Auth.Sessions.Enabled = true
+	cfg.Auth.OIDC.Enabled = true
+	cfg.Auth.OIDC.Issuer = idp.Issuer()
+	cfg.Auth.OIDC.ClientID = idp.ClientID
+	cfg.Auth.OIDC.RedirectURL = "http://example.com/oidc/callback"
+	cfg.Metrics.Enabled = true
+	cfg.RateLimit.Enabled = false
+	_ = app.Setup(cfg)
+	return idp
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	idp := setupOpenAPITest()
+	defer idp.Close()
+	doc := loadOpenAPI(t)
+
+	documented := map[string]bool{}
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			documented[method+" "+path] = true
+		}
+	}
+
+	routed := map[string]bool{}
+	_ = newRouter().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routed[method+" "+tmpl] = true
+			if !documented[method+" "+tmpl] {
+				t.Errorf("route %s %s is not in the OpenAPI document", method, tmpl)
+			}
+		}
+		return nil
+	})
+
+	for operation := range documented {
+		if !routed[operation] {
+			t.Errorf("documented operation %s is not routed", operation)
+		}
+	}
+}
+
+// conformanceClient makes requests to the server, checking each request and response against the OpenAPI document and
+// remembering which operations have been exercised
+type conformanceClient struct {
+	t         *testing.T
+	handler   http.Handler
+	router    routers.Router
+	exercised map[string]bool
+}
+
+// do sends the request, which is only checked against the document when it's meant to be valid, and checks the response
+func (c *conformanceClient) do(method string, path string, body interface{}, valid bool, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+	c.t.Helper()
+
+	var b []byte
+	switch v := body.(type) {
+	case nil:
+	case string:
+		b = []byte(v)
+	default:
+		b, _ = json.Marshal(v)
+	}
+
+	newRequest := func() *http.Request {
+		var r *http.Request
+		if b == nil {
+			r = httptest.NewRequest(method, path, nil)
+		} else {
+			r = httptest.NewRequest(method, path, bytes.NewReader(b))
+			r.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		}
+		if prepare != nil {
+			prepare(r)
+		}
+		return r
+	}
+
+	response := httptest.NewRecorder()
+	c.handler.ServeHTTP(response, newRequest())
+
+	request := newRequest()
+	route, pathParams, err := c.router.FindRoute(request)
+	if err != nil {
+		c.t.Errorf("%s %s is not in the OpenAPI document: %s", method, path, err.Error())
+		return response
+	}
+	c.exercised[route.Method+" "+route.Path] = true
+
+	input := &openapi3filter.RequestValidationInput{
+		Request:    request,
+		PathParams: pathParams,
+		Route:      route,
+		Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+	}
+	if valid {
+		err = openapi3filter.ValidateRequest(context.Background(), input)
+		if err != nil {
+			c.t.Errorf("%s %s request does not conform: %s", method, path, err.Error())
+		}
+	}
+
+	err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 response.Code,
+		Header:                 response.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(response.Body.Bytes())),
+		Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+	})
+	if err != nil {
+		c.t.Errorf("%s %s response %d does not conform: %s", method, path, response.Code, err.Error())
+	}
+
+	return response
+}
+
+func (c *conformanceClient) expect(response *httptest.ResponseRecorder, want int, what string) {
+	c.t.Helper()
+	if response.Code != want {
+		c.t.Errorf("%s, have: %v, want: %v, body: %s", what, response.Code, want, response.Body.String())
+	}
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func TestOpenAPIConformance(t *testing.T) {
+	idp := setupOpenAPITest()
+	defer idp.Close()
+	doc := loadOpenAPI(t)
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		t.Fatalf("cannot route the OpenAPI document: %s", err.Error())
+	}
+	c := &conformanceClient{t: t, handler: NewHandler(), router: router, exercised: map[string]bool{}}
+
+	// Users and logging in
+	response := c.do("POST", "/users", model.CreateUserRequest{User: "test.account", Password: "correct horse"}, true, nil)
+	c.expect(response, 200, "create user")
+	var user model.CreateUserResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &user)
+	c.expect(c.do("POST", "/users", model.CreateUserRequest{User: "test.account"}, true, nil), 409, "create duplicate user")
+	c.expect(c.do("POST", "/users", `{"user": "-", "extra": 1}`, false, nil), 400, "create invalid user")
+
+	response = c.do("POST", "/users", model.CreateUserRequest{User: "other.account"}, true, nil)
+	var other model.CreateUserResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &other)
+
+	c.expect(c.do("POST", "/login", model.LoginRequest{User: "test.account", Password: "correct horse"}, true, nil), 200, "login")
+	c.expect(c.do("POST", "/login", model.LoginRequest{User: "test.account", Password: "wrong horse"}, true, nil), 401, "login with the wrong password")
+
+	// Notes
+	c.expect(c.do("GET", "/notes", nil, true, bearer(user.Token)), 200, "list notes before creating any")
+	c.expect(c.do("GET", "/notes", nil, true, nil), 401, "list notes without a token")
+
+	response = c.do("POST", "/notes", model.CreateNoteRequest{Content: "This is a test note"}, true, bearer(user.Token))
+	c.expect(response, 200, "create note")
+	var note model.CreateNoteResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &note)
+	notePath := fmt.Sprintf("/notes/%d", note.NoteID)
+	c.expect(c.do("POST", "/notes", model.CreateNoteRequest{}, false, bearer(user.Token)), 400, "create empty note")
+
+	c.expect(c.do("GET", "/notes", nil, true, bearer(user.Token)), 200, "list notes")
+	c.expect(c.do("GET", "/notes?limit=1", nil, true, bearer(user.Token)), 200, "list a page of notes")
+	c.expect(c.do("GET", "/notes?limit=0", nil, false, bearer(user.Token)), 400, "list notes with an invalid limit")
+	c.expect(c.do("GET", notePath, nil, true, bearer(user.Token)), 200, "get note")
+	c.expect(c.do("GET", notePath, nil, true, bearer(other.Token)), 403, "get another user's note")
+	c.expect(c.do("GET", "/notes/9999", nil, true, bearer(user.Token)), 404, "get missing note")
+	c.expect(c.do("PUT", notePath, model.UpdateNoteRequest{Content: "Updated"}, true, bearer(user.Token)), 200, "update note")
+
+	c.expect(c.do("POST", "/notes/batch", model.BatchRequest{Operations: []model.BatchOperation{{Op: "create", Content: "Batched"}}}, true, bearer(user.Token)), 200, "apply batch")
+	c.expect(c.do("POST", "/notes/batch", model.BatchRequest{Operations: []model.BatchOperation{{Op: "delete", NoteID: 9999}}}, true, bearer(user.Token)), 422, "apply failing atomic batch")
+
+	// Sync
+	response = c.do("GET", "/sync", nil, true, bearer(user.Token))
+	c.expect(response, 200, "full sync")
+	var changes model.GetSyncChangesResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &changes)
+	c.expect(c.do("GET", "/sync?since="+changes.Token, nil, true, bearer(user.Token)), 200, "incremental sync")
+	c.expect(c.do("GET", "/sync?since=bad", nil, true, bearer(user.Token)), 400, "sync with an invalid token")
+	c.expect(c.do("POST", "/sync", model.SyncUploadRequest{Changes: []model.SyncUploadItem{
+		{ClientID: "new", Content: "Written offline"},
+		{ClientID: "stale", NoteID: note.NoteID, BaseRevision: 1, Content: "Conflicting"},
+	}}, true, bearer(user.Token)), 200, "upload changes")
+
+	c.expect(c.do("GET", "/users/me/usage", nil, true, bearer(user.Token)), 200, "get usage")
+	c.expect(c.do("GET", "/users/me/export", nil, true, bearer(user.Token)), 200, "export user")
+	c.expect(c.do("GET", "/users/me", nil, true, bearer(user.Token)), 200, "get profile")
+	c.expect(c.do("PATCH", "/users/me", `{"displayname": "Test Account", "settings": {"noteformat": "markdown", "timezone": "Europe/London"}}`, true, bearer(user.Token)), 200, "update profile")
+	c.expect(c.do("PATCH", "/users/me", `{"user": "other.account"}`, true, bearer(user.Token)), 409, "rename to a name that's taken")
+	c.expect(c.do("PATCH", "/users/me", `{"settings": {"timezone": "Mars/Olympus_Mons"}}`, true, bearer(user.Token)), 400, "update profile with an unknown time zone")
+	c.expect(c.do("DELETE", notePath, nil, true, bearer(user.Token)), 200, "delete note")
+
+	// Personal access tokens
+	response = c.do("POST", "/users/me/tokens", model.CreateAccessTokenRequest{Name: "Backups", Scopes: []string{model.ScopeNotesRead}}, true, bearer(user.Token))
+	c.expect(response, 200, "create access token")
+	var accessToken model.CreateAccessTokenResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &accessToken)
+	c.expect(c.do("POST", "/users/me/tokens", `{"name": "Everything", "scopes": ["notes:delete"]}`, false, bearer(user.Token)), 400, "create access token with an unknown scope")
+	c.expect(c.do("GET", "/notes", nil, true, bearer(accessToken.Token)), 200, "list notes with an access token")
+	c.expect(c.do("POST", "/notes", model.CreateNoteRequest{Content: "Scoped"}, true, bearer(accessToken.Token)), 403, "create note with a read-only access token")
+	c.expect(c.do("GET", "/users/me/tokens", nil, true, bearer(accessToken.Token)), 403, "list access tokens with an access token")
+	c.expect(c.do("GET", "/users/me/tokens", nil, true, bearer(user.Token)), 200, "list access tokens")
+	c.expect(c.do("DELETE", "/users/me/tokens/"+accessToken.TokenID, nil, true, bearer(user.Token)), 200, "delete access token")
+	c.expect(c.do("DELETE", "/users/me/tokens/"+accessToken.TokenID, nil, true, bearer(user.Token)), 404, "delete missing access token")
+
+	// Administration, once the user has been made an administrator and logged in again to pick up the role
+	c.expect(c.do("GET", "/admin/stats", nil, true, bearer(user.Token)), 403, "get stats without the admin role")
+	role, disabled := model.RoleAdmin, true
+	_, err = lib.UpdateUserDB(context.Background(), user.UserID, model.UpdateUserRequest{Role: &role})
+	if err != nil {
+		t.Fatalf("failed to make the user an administrator: %s", err.Error())
+	}
+	response = c.do("POST", "/login", model.LoginRequest{User: "test.account", Password: "correct horse"}, true, nil)
+	var login model.LoginResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &login)
+	admin := bearer(login.Token)
+
+	otherPath := fmt.Sprintf("/admin/users/%d", other.UserID)
+	c.expect(c.do("GET", "/admin/users?q=ACCOUNT&limit=1", nil, true, admin), 200, "list users")
+	c.expect(c.do("GET", "/admin/users?limit=0", nil, false, admin), 400, "list users with an invalid limit")
+	c.expect(c.do("GET", otherPath, nil, true, admin), 200, "get user")
+	c.expect(c.do("GET", "/admin/users/9999", nil, true, admin), 404, "get missing user")
+	c.expect(c.do("PATCH", otherPath, model.UpdateUserRequest{Disabled: &disabled}, true, admin), 200, "disable user")
+	c.expect(c.do("PATCH", fmt.Sprintf("/admin/users/%d", user.UserID), `{"role": "user"}`, true, admin), 409, "demote the last administrator")
+	c.expect(c.do("POST", otherPath+"/logout", nil, true, admin), 200, "log user out")
+	c.expect(c.do("GET", "/admin/stats", nil, true, admin), 200, "get stats")
+	c.expect(c.do("DELETE", otherPath, nil, true, admin), 200, "delete user")
+	c.expect(c.do("DELETE", "/users/me", nil, true, admin), 409, "delete the last administrator's account")
+	response = c.do("POST", "/users", model.CreateUserRequest{User: "leaving.account"}, true, nil)
+	var leaving model.CreateUserResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &leaving)
+	c.expect(c.do("DELETE", "/users/me", nil, true, bearer(leaving.Token)), 200, "delete account")
+
+	// Browser sessions
+	response = c.do("POST", "/session", model.LoginRequest{User: "test.account", Password: "correct horse"}, true, nil)
+	c.expect(response, 200, "start session")
+	var session model.CreateSessionResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &session)
+	cookies := response.Result().Cookies()
+	withSession := func(csrfToken string) func(r *http.Request) {
+		return func(r *http.Request) {
+			for _, cookie := range cookies {
+				r.AddCookie(cookie)
+			}
+			if csrfToken != "" {
+				r.Header.Set(auth.CSRFHeader, csrfToken)
+			}
+		}
+	}
+	c.expect(c.do("POST", "/notes", model.CreateNoteRequest{Content: "Forged"}, true, withSession("")), 403, "create note without the CSRF token")
+	c.expect(c.do("DELETE", "/session", nil, true, withSession(session.CSRFToken)), 200, "end session")
+
+	// Two-factor authentication, enrolled with codes worked out from the secret the way an authenticator app would
+	response = c.do("POST", "/users", model.CreateUserRequest{User: "careful.account", Password: "correct horse"}, true, nil)
+	var careful model.CreateUserResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &careful)
+	c.expect(c.do("GET", "/users/me/2fa", nil, true, bearer(careful.Token)), 200, "get two-factor status")
+	response = c.do("POST", "/users/me/2fa", nil, true, bearer(careful.Token))
+	c.expect(response, 200, "start two-factor enrolment")
+	var enrolment model.StartTwoFactorResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &enrolment)
+	step := totp.Step(time.Now())
+	code, _ := totp.Code(enrolment.Secret, step)
+	c.expect(c.do("POST", "/users/me/2fa/confirm", model.TwoFactorCodeRequest{Code: "not-a-code"}, true, bearer(careful.Token)), 401, "confirm two-factor enrolment with the wrong code")
+	response = c.do("POST", "/users/me/2fa/confirm", model.TwoFactorCodeRequest{Code: code}, true, bearer(careful.Token))
+	c.expect(response, 200, "confirm two-factor enrolment")
+	var recovery model.RecoveryCodesResponse
+	_ = json.Unmarshal(response.Body.Bytes(), &recovery)
+	c.expect(c.do("POST", "/users/me/2fa", nil, true, bearer(careful.Token)), 409, "start two-factor enrolment when it's enabled")
+
+	response = c.do("POST", "/login", model.LoginRequest{User: "careful.account", Password: "correct horse"}, true, nil)
+	c.expect(response, 401, "login that needs a second factor")
+	var problem model.Problem
+	_ = json.Unmarshal(response.Body.Bytes(), &problem)
+	c.expect(c.do("POST", "/login/2fa", model.TwoFactorLoginRequest{Challenge: problem.Challenge, Code: recovery.RecoveryCodes[0]}, true, nil), 200, "finish login with a recovery code")
+	c.expect(c.do("POST", "/login/2fa", model.TwoFactorLoginRequest{Challenge: problem.Challenge, Code: recovery.RecoveryCodes[1]}, true, nil), 401, "finish login twice")
+	response = c.do("POST", "/session", model.LoginRequest{User: "careful.account", Password: "correct horse"}, true, nil)
+	_ = json.Unmarshal(response.Body.Bytes(), &problem)
+	c.expect(c.do("POST", "/session/2fa", model.TwoFactorLoginRequest{Challenge: problem.Challenge, Code: recovery.RecoveryCodes[1]}, true, nil), 200, "finish session login with a recovery code")
+
+	code, _ = totp.Code(enrolment.Secret, step+1)
+	response = c.do("POST", "/users/me/2fa/recovery-codes", model.TwoFactorCodeRequest{Code: code}, true, bearer(careful.Token))
+	c.expect(response, 200, "regenerate recovery codes")
+	_ = json.Unmarshal(response.Body.Bytes(), &recovery)
+	c.expect(c.do("POST", "/users/me/2fa/disable", model.DisableTwoFactorRequest{Password: "wrong horse", Code: recovery.RecoveryCodes[0]}, true, bearer(careful.Token)), 401, "disable two-factor authentication with the wrong password")
+	c.expect(c.do("POST", "/users/me/2fa/disable", model.DisableTwoFactorRequest{Password: "correct horse", Code: recovery.RecoveryCodes[0]}, true, bearer(careful.Token)), 200, "disable two-factor authentication")
+
+	// Single sign-on, where the identity provider sends the user back to the callback with a code
+	idp.Login("sso-user", map[string]interface{}{"preferred_username": "sso.account", "name": "Single Sign-On"})
+	response = c.do("GET", "/oidc/login", nil, true, nil)
+	c.expect(response, 302, "start identity provider login")
+	callback, err := idp.Authorize(response.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("failed to log in at the identity provider: %s", err.Error())
+	}
+	u, _ := url.Parse(callback)
+	withState := func(response *httptest.ResponseRecorder) func(r *http.Request) {
+		return func(r *http.Request) {
+			for _, cookie := range response.Result().Cookies() {
+				r.AddCookie(cookie)
+			}
+		}
+	}
+	c.expect(c.do("GET", u.RequestURI(), nil, true, nil), 401, "finish identity provider login in another browser")
+	c.expect(c.do("GET", u.RequestURI(), nil, true, withState(response)), 200, "finish identity provider login")
+	c.expect(c.do("GET", u.RequestURI(), nil, true, withState(response)), 401, "finish identity provider login twice")
+	c.expect(c.do("POST", "/oidc/login", nil, true, nil), 401, "link identity without a token")
+	c.expect(c.do("POST", "/oidc/login", nil, true, bearer(careful.Token)), 200, "start linking an identity")
+
+	// Operations
+	c.expect(c.do("GET", "/healthz", nil, true, nil), 200, "liveness probe")
+	c.expect(c.do("GET", "/readyz", nil, true, nil), 200, "readiness probe")
+	c.expect(c.do("GET", "/version", nil, true, nil), 200, "version")
+	c.expect(c.do("GET", "/metrics", nil, true, nil), 200, "metrics")
+	c.expect(c.do("GET", "/openapi.json", nil, true, nil), 200, "OpenAPI document")
+	response = c.do("GET", "/docs/", nil, true, nil)
+	c.expect(response, 200, "Swagger UI")
+	if !strings.Contains(response.Body.String(), "swagger-ui") {
+		t.Errorf("docs should serve Swagger UI, have: %s", response.Body.String())
+	}
+
+	// Every documented operation should have been tried
+	var missed []string
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !c.exercised[method+" "+path] {
+				missed = append(missed, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(missed)
+	if len(missed) > 0 {
+		t.Errorf("operations not exercised by the conformance test: %s", strings.Join(missed, ", "))
+	}
+}
+
+func TestSwaggerUIInitializer(t *testing.T) {
+	idp := setupOpenAPITest()
+	defer idp.Close()
+	h := NewHandler()
+
+	request := httptest.NewRequest("GET", "/docs/swagger-initializer.js", nil)
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, request)
+	if response.Code != 200 || !strings.Contains(response.Body.String(), "../openapi.json") {
+		t.Errorf("Swagger UI should load our document, have: %v %s", response.Code, response.Body.String())
+	}
+}
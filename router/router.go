@@ -1,35 +1,202 @@
 package router
 
 import (
+	"context"
+	"errors"
 	"github.com/gorilla/mux"
+	"github.com/kylegk/notes/app"
 	"github.com/kylegk/notes/handler"
-	"log"
+	"github.com/kylegk/notes/metrics"
+	"github.com/kylegk/notes/model"
+	"github.com/kylegk/notes/openapi"
+	"log/slog"
+	"net"
 	"net/http"
 )
 
-// PORT specifies the port the application will listen for HTTP requests
-// NOTE: If this were a production application, this would be configured through an environment variable or .env file
-const PORT = ":8080"
+// NewHandler builds the handler serving every route, wrapped in the application's middleware
+func NewHandler() http.Handler {
+	return requestID(traceRequest(instrument(logRequest(cors(newRouter())))))
+}
 
-func AddRouting() {
+// newRouter registers every route, along with the middleware that needs to know which route matched
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
+	limits := app.Context.Config.Limits
 
 	// Generic handlers for bad requests
 	router.NotFoundHandler = http.HandlerFunc(handler.SendGenericNotFoundResponse)
 	router.MethodNotAllowedHandler = http.HandlerFunc(handler.SendGenericNotAllowedResponse)
 
-	// Notes
-	router.HandleFunc("/notes", handler.GetAllNotesForUser).Methods("GET")
-	router.HandleFunc("/notes", handler.CreateNote).Methods("POST")
-	router.HandleFunc("/notes/{id}", handler.GetNote).Methods("GET")
-	router.HandleFunc("/notes/{id}", handler.UpdateNote).Methods("PUT")
-	router.HandleFunc("/notes/{id}", handler.DeleteNote).Methods("DELETE")
+	// Notes. Personal access tokens may only use the routes marked with the scopes they need
+	router.Handle("/notes", scoped(handler.GetAllNotesForUser, model.ScopeNotesRead)).Methods("GET")
+	router.Handle("/notes", scoped(idempotency(handler.CreateNote, limits.MaxBodySize, false), model.ScopeNotesWrite)).Methods("POST")
+	router.Handle("/notes/batch", scoped(idempotency(handler.BatchNotes, limits.MaxBulkBodySize, false), model.ScopeNotesWrite)).Methods("POST")
+	router.Handle("/notes/{id}", scoped(handler.GetNote, model.ScopeNotesRead)).Methods("GET")
+	router.Handle("/notes/{id}", scoped(handler.UpdateNote, model.ScopeNotesWrite)).Methods("PUT")
+	router.Handle("/notes/{id}", scoped(handler.DeleteNote, model.ScopeNotesWrite)).Methods("DELETE")
+
+	// Sync
+	router.Handle("/sync", scoped(handler.GetSyncChanges, model.ScopeNotesRead)).Methods("GET")
+	router.Handle("/sync", scoped(idempotency(handler.UploadSyncChanges, limits.MaxBulkBodySize, false), model.ScopeNotesWrite)).Methods("POST")
 
 	// User
-	router.HandleFunc("/users", handler.CreateUser).Methods("POST")
+	router.Handle("/users", idempotency(handler.CreateUser, limits.MaxBodySize, true)).Methods("POST")
+	router.Handle("/users/me", scoped(handler.GetCurrentUser, model.ScopeAccountRead)).Methods("GET")
+	router.HandleFunc("/users/me", handler.UpdateCurrentUser).Methods("PATCH")
+	router.HandleFunc("/users/me", handler.DeleteCurrentUser).Methods("DELETE")
+	router.Handle("/users/me/usage", scoped(handler.GetUsage, model.ScopeAccountRead)).Methods("GET")
+	router.Handle("/users/me/export", scoped(handler.ExportCurrentUser, model.ScopeAccountRead, model.ScopeNotesRead)).Methods("GET")
+	router.HandleFunc("/users/me/tokens", handler.ListAccessTokens).Methods("GET")
+	router.HandleFunc("/users/me/tokens", handler.CreateAccessToken).Methods("POST")
+	router.HandleFunc("/users/me/tokens/{id}", handler.DeleteAccessToken).Methods("DELETE")
+	router.HandleFunc("/login", handler.Login).Methods("POST")
+
+	// Two-factor authentication
+	router.HandleFunc("/users/me/2fa", handler.GetTwoFactorStatus).Methods("GET")
+	router.HandleFunc("/users/me/2fa", handler.StartTwoFactor).Methods("POST")
+	router.HandleFunc("/users/me/2fa/confirm", handler.ConfirmTwoFactor).Methods("POST")
+	router.HandleFunc("/users/me/2fa/disable", handler.DisableTwoFactor).Methods("POST")
+	router.HandleFunc("/users/me/2fa/recovery-codes", handler.RegenerateRecoveryCodes).Methods("POST")
+	router.HandleFunc("/login/2fa", handler.FinishTwoFactorLogin).Methods("POST")
+
+	// Administration, only for users with the admin role
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/users", handler.ListUsers).Methods("GET")
+	admin.HandleFunc("/users/{id}", handler.GetUser).Methods("GET")
+	admin.HandleFunc("/users/{id}", handler.UpdateUser).Methods("PATCH")
+	admin.HandleFunc("/users/{id}", handler.DeleteUser).Methods("DELETE")
+	admin.HandleFunc("/users/{id}/logout", handler.LogoutUser).Methods("POST")
+	admin.HandleFunc("/stats", handler.GetStats).Methods("GET")
+	admin.Use(requireRole(model.RoleAdmin))
+
+	// Browser sessions
+	if app.Context.Config.Auth.Sessions.Enabled {
+		router.HandleFunc("/session", handler.CreateSession).Methods("POST")
+		router.HandleFunc("/session", handler.DeleteSession).Methods("DELETE")
+		router.HandleFunc("/session/2fa", handler.FinishTwoFactorSession).Methods("POST")
+	}
+
+	// Single sign-on with an OpenID Connect identity provider
+	if app.Context.Config.Auth.OIDC.Enabled {
+		router.HandleFunc("/oidc/login", handler.OIDCLogin).Methods("GET")
+		router.HandleFunc("/oidc/login", handler.OIDCLink).Methods("POST")
+		router.HandleFunc("/oidc/callback", handler.OIDCCallback).Methods("GET")
+	}
+
+	// Probes and build information, none of which require a token
+	router.HandleFunc("/healthz", handler.Healthz).Methods("GET")
+	router.HandleFunc("/readyz", handler.Readyz).Methods("GET")
+	router.HandleFunc("/version", handler.Version).Methods("GET")
+
+	// Metrics
+	if app.Context.Config.Metrics.Enabled {
+		router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	}
+
+	// API documentation
+	router.Handle("/openapi.json", openapi.Handler()).Methods("GET")
+	router.PathPrefix("/docs/").Handler(openapi.DocsHandler("/docs/")).Methods("GET")
+
+	// Add panic, metrics, rate limiting and CSRF middleware
+	router.Use(panicRecovery, recordRoute, rateLimit, csrf)
+
+	return router
+}
+
+// Serve handles requests on the configured address until ctx is cancelled, then stops accepting connections and waits
+// for in-flight requests to finish, up to the configured shutdown timeout. HTTPS (with HTTP/2) is served when a
+// certificate is configured, optionally alongside a plain HTTP listener that redirects to it
+func Serve(ctx context.Context) error {
+	cfg := app.Context.Config
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	srv := newServer(NewHandler())
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := newTLSConfig(ctx, cfg.TLS)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	if cfg.TLS.RedirectAddr == "" {
+		return serve(ctx, srv, ln)
+	}
+
+	redirectLn, err := net.Listen("tcp", cfg.TLS.RedirectAddr)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	// If either listener fails, the other is shut down too
+	redirectErr := make(chan error, 1)
+	go func() {
+		defer cancel()
+		redirectErr <- serve(ctx, newServer(redirectToHTTPS(cfg.ListenAddr)), redirectLn)
+	}()
+
+	err = serve(ctx, srv, ln)
+	cancel()
+	if rErr := <-redirectErr; err == nil {
+		err = rErr
+	}
+
+	return err
+}
+
+func newServer(h http.Handler) *http.Server {
+	cfg := app.Context.Config.Server
+
+	return &http.Server{
+		Handler:           h,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+func serve(ctx context.Context, srv *http.Server, ln net.Listener) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			slog.Info("listening for HTTPS", "addr", ln.Addr().String())
+			errCh <- srv.ServeTLS(ln, "", "")
+			return
+		}
+
+		slog.Info("listening", "addr", ln.Addr().String())
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, waiting for in-flight requests to finish")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.Context.Config.Server.ShutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		return err
+	}
 
-	// Add panic middleware
-	router.Use(panicRecovery)
+	err = <-errCh
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
 
-	log.Fatal(http.ListenAndServe(PORT, logRequest(router)))
-}
\ No newline at end of file
+	return nil
+}
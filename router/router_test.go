@@ -0,0 +1,61 @@
+package router
+
+import (
+	"context"
+	"github.com/kylegk/notes/app"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	app.Init()
+
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newServer(h), ln)
+	}()
+
+	// Start a slow request, then ask the server to stop while it's in flight
+	body := make(chan string, 1)
+	go func() {
+		response, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+		b, _ := io.ReadAll(response.Body)
+		body <- string(b)
+	}()
+	<-started
+	cancel()
+
+	if have := <-body; have != "done" {
+		t.Errorf("in-flight request should have completed, have: %v", have)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve should have stopped cleanly, have: %v", err)
+	}
+
+	// New connections are refused once the server has stopped
+	_, err = http.Get("http://" + ln.Addr().String())
+	if err == nil {
+		t.Errorf("server should no longer accept requests")
+	}
+}
@@ -0,0 +1,170 @@
+package router
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/kylegk/notes/app"
+	"github.com/kylegk/notes/config"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost to dir, returning the certificate and key paths
+func writeTestCert(t *testing.T, dir string, name string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err.Error())
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "tls")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, first := writeTestCert(t, dir, "server")
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err.Error())
+	}
+
+	// Nothing is reloaded until the files change
+	reloaded, err := reloader.reload()
+	if err != nil || reloaded {
+		t.Errorf("unchanged certificate should not have been reloaded")
+	}
+
+	// A renewed certificate is picked up
+	_, _, second := writeTestCert(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+	reloaded, err = reloader.reload()
+	if err != nil || !reloaded {
+		t.Errorf("renewed certificate should have been reloaded, have: %v", err)
+	}
+	current, _ := reloader.getCertificate(nil)
+	if string(current.Certificate[0]) == string(first.Raw) || string(current.Certificate[0]) != string(second.Raw) {
+		t.Errorf("renewed certificate is not being served")
+	}
+
+	// A broken certificate is reported and the previous one stays in use
+	_ = os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	future = future.Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+	_, err = reloader.reload()
+	if err == nil {
+		t.Errorf("broken certificate should have been reported")
+	}
+	current, _ = reloader.getCertificate(nil)
+	if string(current.Certificate[0]) != string(second.Raw) {
+		t.Errorf("previous certificate should still be served")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	app.Init()
+	dir, _ := os.MkdirTemp("", "tls")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, serverCert := writeTestCert(t, dir, "server")
+	clientCertFile, clientKeyFile, _ := writeTestCert(t, dir, "client")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tlsConfig, err := newTLSConfig(ctx, config.TLSConfig{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Hour, ClientCAFile: clientCertFile, ClientAuth: config.ClientAuthRequire})
+	if err != nil {
+		t.Fatalf("failed to build TLS config: %s", err.Error())
+	}
+
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.TLSConfig = tlsConfig
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go serve(ctx, srv, ln)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	clientCert, _ := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+
+	// Clients presenting a trusted certificate are served over HTTP/2
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}},
+		ForceAttemptHTTP2: true,
+	}}
+	response, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("request failed: %s", err.Error())
+	}
+	b, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(b) != "HTTP/2.0" {
+		t.Errorf("expected HTTP/2, have: %s", b)
+	}
+
+	// Clients without a certificate are turned away
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = client.Get("https://" + ln.Addr().String())
+	if err == nil {
+		t.Errorf("client without a certificate should have been rejected")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		addr string
+		url  string
+		want string
+	}{
+		{":443", "http://example.com/notes?since=abc", "https://example.com/notes?since=abc"},
+		{":8443", "http://example.com:8080/notes", "https://example.com:8443/notes"},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("GET", test.url, nil)
+		response := httptest.NewRecorder()
+		redirectToHTTPS(test.addr).ServeHTTP(response, request)
+
+		if response.Code != http.StatusPermanentRedirect || response.Header().Get("Location") != test.want {
+			t.Errorf("unexpected redirect, have: %v %v, want: %v", response.Code, response.Header().Get("Location"), test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCode(t *testing.T) {
+	// Test vectors from RFC 6238, appendix B, for SHA1
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, test := range tests {
+		have := code(key, Step(time.Unix(test.time, 0)), 8)
+		if have != test.want {
+			t.Errorf("unexpected code at %d, have: %s, want: %s", test.time, have, test.want)
+		}
+	}
+
+	// Six digit codes are the last six digits
+	have, err := Code(encoding.EncodeToString(key), Step(time.Unix(59, 0)))
+	if err != nil || have != "287082" {
+		t.Errorf("unexpected code, have: %s, %v", have, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := NewSecret()
+	now := time.Now()
+	step := Step(now)
+
+	// Codes from the steps either side are accepted, but not from further away
+	for _, offset := range []int64{-1, 0, 1} {
+		c, _ := Code(secret, step+offset)
+		if matched, ok := Validate(secret, c, now, 0); !ok || matched != step+offset {
+			t.Errorf("code %d steps away should have been accepted, have: %d, %v", offset, matched, ok)
+		}
+	}
+	c, _ := Code(secret, step-2)
+	if _, ok := Validate(secret, c, now, 0); ok {
+		t.Errorf("code 2 steps away should have been refused")
+	}
+
+	// Codes can't be used again
+	c, _ = Code(secret, step)
+	if _, ok := Validate(secret, c, now, step); ok {
+		t.Errorf("code should not be accepted again")
+	}
+
+	// Lower case secrets are fine, unlike malformed codes
+	if _, ok := Validate(strings.ToLower(secret), c, now, 0); !ok {
+		t.Errorf("lower case secret should have been accepted")
+	}
+	if _, ok := Validate(secret, c+"0", now, 0); ok {
+		t.Errorf("code with too many digits should have been refused")
+	}
+}
+
+func TestURI(t *testing.T) {
+	have := URI("Notes", "test.account", "JBSWY3DPEHPK3PXP")
+	want := "otpauth://totp/Notes:test.account?algorithm=SHA1&digits=6&issuer=Notes&period=30&secret=JBSWY3DPEHPK3PXP"
+	if have != want {
+		t.Errorf("unexpected URI, have: %s, want: %s", have, want)
+	}
+}
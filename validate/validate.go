@@ -0,0 +1,227 @@
+package validate
+
+import (
+	"fmt"
+	"github.com/kylegk/notes/apperr"
+	"github.com/kylegk/notes/model"
+	"golang.org/x/text/unicode/norm"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
+)
+
+// Struct normalises every string in the request to Unicode NFC and then checks it against the rules declared in its
+// `validate` struct tags, returning a single validation error listing every violation. Supported rules are:
+//
+//	required     the value must not be empty
+//	required_unless=field:value
+//	             the value must not be empty unless the sibling field with that JSON name holds the value
+//	omitempty    the rules that follow are skipped when the value is empty
+//	min=N        strings must have at least N characters, slices at least N items
+//	max=N        strings must have at most N characters, slices at most N items
+//	oneof=a|b    non-empty strings must be one of the listed values
+//	username     strings may only contain letters, digits, '.', '_' and '-', starting with a letter or digit
+//	timezone     non-empty strings must name an IANA time zone, such as Europe/London
+//
+// Structs and slices of structs are validated recursively, with failures reported against the JSON path of the field.
+// Nil pointers are skipped, and the rules of other pointers apply to the value they point to
+func Struct(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		panic("validate: Struct requires a pointer to a struct")
+	}
+
+	var fields []model.FieldError
+	validateStruct(rv.Elem(), "", &fields)
+
+	if len(fields) > 0 {
+		return apperr.Validation(fields...)
+	}
+
+	return nil
+}
+
+func validateStruct(rv reflect.Value, path string, fields *[]model.FieldError) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		name := jsonName(sf)
+		if name == "-" {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+
+		// Pointers mark optional fields in partial updates, so the rules apply to the value only when it's given
+		fv := rv.Field(i)
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.String {
+			fv.SetString(norm.NFC.String(fv.String()))
+		}
+
+		for _, rule := range strings.Split(sf.Tag.Get("validate"), ",") {
+			if rule == "" {
+				continue
+			}
+
+			// Optional fields are only checked when they're given
+			if rule == "omitempty" {
+				if fv.IsZero() {
+					break
+				}
+				continue
+			}
+
+			if fe, ok := check(rv, fv, rule, name); !ok {
+				*fields = append(*fields, fe)
+			}
+		}
+
+		switch fv.Kind() {
+		case reflect.Struct:
+			validateStruct(fv, name, fields)
+		case reflect.Slice:
+			if fv.Type().Elem().Kind() != reflect.Struct {
+				continue
+			}
+			for j := 0; j < fv.Len(); j++ {
+				validateStruct(fv.Index(j), fmt.Sprintf("%s[%d]", name, j), fields)
+			}
+		}
+	}
+}
+
+func check(rv reflect.Value, fv reflect.Value, rule string, name string) (model.FieldError, bool) {
+	key, arg := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		key, arg = rule[:i], rule[i+1:]
+	}
+
+	switch key {
+	case "required":
+		if fv.IsZero() {
+			return model.FieldError{Field: name, Code: "required", Message: name + " is required"}, false
+		}
+	case "required_unless":
+		field, value, ok := strings.Cut(arg, ":")
+		if !ok {
+			panic("validate: invalid rule " + rule)
+		}
+		if fv.IsZero() && fmt.Sprint(sibling(rv, field, rule).Interface()) != value {
+			return model.FieldError{Field: name, Code: "required", Message: fmt.Sprintf("%s is required unless %s is %s", name, field, value)}, false
+		}
+	case "min":
+		n := mustAtoi(rule, arg)
+		if length(fv) < n {
+			return model.FieldError{Field: name, Code: "too_short", Message: fmt.Sprintf("%s must have at least %d %s", name, n, unit(fv))}, false
+		}
+	case "max":
+		n := mustAtoi(rule, arg)
+		if length(fv) > n {
+			return model.FieldError{Field: name, Code: "too_long", Message: fmt.Sprintf("%s must have at most %d %s", name, n, unit(fv))}, false
+		}
+	case "oneof":
+		if fv.String() == "" {
+			break
+		}
+		for _, allowed := range strings.Split(arg, "|") {
+			if fv.String() == allowed {
+				return model.FieldError{}, true
+			}
+		}
+		return model.FieldError{Field: name, Code: "invalid_choice", Message: fmt.Sprintf("%s must be one of: %s", name, strings.ReplaceAll(arg, "|", ", "))}, false
+	case "username":
+		if fv.String() != "" && !isUsername(fv.String()) {
+			return model.FieldError{Field: name, Code: "invalid_characters", Message: name + " may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit"}, false
+		}
+	case "timezone":
+		if fv.String() != "" && !isTimezone(fv.String()) {
+			return model.FieldError{Field: name, Code: "invalid_timezone", Message: name + " must be an IANA time zone, such as Europe/London"}, false
+		}
+	default:
+		panic("validate: unknown rule " + rule)
+	}
+
+	return model.FieldError{}, true
+}
+
+func isUsername(s string) bool {
+	for i, c := range s {
+		alnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if i == 0 && !alnum {
+			return false
+		}
+		if !alnum && c != '.' && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isTimezone reports whether the name is in the time zone database, which is embedded so the answer doesn't depend on
+// the host. Local is refused, since it means whatever zone the server happens to be in
+func isTimezone(name string) bool {
+	if name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+func length(fv reflect.Value) int {
+	switch fv.Kind() {
+	case reflect.String:
+		return utf8.RuneCountInString(fv.String())
+	case reflect.Slice, reflect.Map:
+		return fv.Len()
+	default:
+		panic("validate: length rules only apply to strings, slices and maps")
+	}
+}
+
+func unit(fv reflect.Value) string {
+	if fv.Kind() == reflect.String {
+		return "characters"
+	}
+	return "items"
+}
+
+func mustAtoi(rule string, arg string) int {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		panic("validate: invalid rule " + rule)
+	}
+	return n
+}
+
+// sibling finds the field of the struct with the JSON name, which rules that depend on another field refer to it by
+func sibling(rv reflect.Value, name string, rule string) reflect.Value {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		if sf := rt.Field(i); sf.PkgPath == "" && jsonName(sf) == name {
+			return rv.Field(i)
+		}
+	}
+	panic("validate: unknown field in rule " + rule)
+}
+
+func jsonName(sf reflect.StructField) string {
+	name := strings.Split(sf.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return sf.Name
+	}
+	return name
+}
@@ -0,0 +1,121 @@
+package validate
+
+import (
+	"github.com/kylegk/notes/apperr"
+	"testing"
+)
+
+type testItem struct {
+	Name string `json:"name" validate:"required,max=5"`
+}
+
+type testRequest struct {
+	User  string     `json:"user" validate:"required,min=3,username"`
+	Mode  string     `json:"mode" validate:"oneof=a|b"`
+	Items []testItem `json:"items" validate:"max=2"`
+	Code  string     `json:"code" validate:"omitempty,min=4"`
+}
+
+func TestStruct(t *testing.T) {
+	// A valid request passes
+	valid := testRequest{User: "test.account", Mode: "a", Items: []testItem{{Name: "one"}}}
+	err := Struct(&valid)
+	if err != nil {
+		t.Errorf("valid request failed validation: %s", err.Error())
+	}
+
+	// Every violation is reported at once, including those in nested items
+	invalid := testRequest{User: "-x", Mode: "c", Items: []testItem{{Name: ""}, {Name: "toolong"}, {Name: "ok"}}, Code: "abc"}
+	err = Struct(&invalid)
+	if err == nil {
+		t.Errorf("invalid request passed validation")
+	}
+
+	want := []string{
+		"user:too_short",
+		"user:invalid_characters",
+		"mode:invalid_choice",
+		"items:too_long",
+		"items[0].name:required",
+		"items[1].name:too_long",
+		"code:too_short",
+	}
+	fields := apperr.Fields(err)
+	if len(fields) != len(want) {
+		t.Fatalf("unexpected number of violations, have: %+v", fields)
+	}
+	for i, f := range fields {
+		if f.Field+":"+f.Code != want[i] {
+			t.Errorf("unexpected violation, have: %v, want: %v", f.Field+":"+f.Code, want[i])
+		}
+	}
+}
+
+func TestStructNormalisesUnicode(t *testing.T) {
+	// "é" written as "e" followed by a combining acute accent is normalised to the single precomposed character
+	item := testItem{Name: "cafe\u0301"}
+	err := Struct(&item)
+	if err != nil {
+		t.Errorf("valid request failed validation: %s", err.Error())
+	}
+	if item.Name != "caf\u00e9" {
+		t.Errorf("string was not normalised, have: %q", item.Name)
+	}
+}
+
+type testPatch struct {
+	Role *string `json:"role" validate:"oneof=user|admin"`
+	Name *string `json:"name" validate:"required,max=5"`
+}
+
+func TestStructPointers(t *testing.T) {
+	// Fields that aren't given aren't checked, even when they're required
+	err := Struct(&testPatch{})
+	if err != nil {
+		t.Errorf("empty patch failed validation: %s", err.Error())
+	}
+
+	role, name := "owner", "toolong"
+	err = Struct(&testPatch{Role: &role, Name: &name})
+	fields := apperr.Fields(err)
+	if len(fields) != 2 || fields[0].Code != "invalid_choice" || fields[1].Code != "too_long" {
+		t.Errorf("given fields should have been checked, have: %+v", fields)
+	}
+}
+
+func TestStructTimezone(t *testing.T) {
+	type settings struct {
+		Timezone string `json:"timezone" validate:"timezone"`
+	}
+
+	for _, zone := range []string{"", "UTC", "Europe/London", "America/Argentina/Buenos_Aires"} {
+		if err := Struct(&settings{Timezone: zone}); err != nil {
+			t.Errorf("time zone %q should have been accepted, have: %s", zone, err.Error())
+		}
+	}
+
+	for _, zone := range []string{"Local", "Mars/Olympus_Mons", "../etc/passwd"} {
+		fields := apperr.Fields(Struct(&settings{Timezone: zone}))
+		if len(fields) != 1 || fields[0].Code != "invalid_timezone" {
+			t.Errorf("time zone %q should have been refused, have: %+v", zone, fields)
+		}
+	}
+}
+
+func TestStructRequiredUnless(t *testing.T) {
+	type operation struct {
+		Op      string `json:"op"`
+		Content string `json:"content" validate:"required_unless=op:delete"`
+	}
+
+	for _, op := range []operation{{Op: "create", Content: "one"}, {Op: "delete"}} {
+		if err := Struct(&op); err != nil {
+			t.Errorf("operation %+v should have been accepted, have: %s", op, err.Error())
+		}
+	}
+
+	fields := apperr.Fields(Struct(&operation{Op: "create"}))
+	if len(fields) != 1 || fields[0].Field != "content" || fields[0].Code != "required" {
+		t.Errorf("content should have been required, have: %+v", fields)
+	}
+}